@@ -0,0 +1,366 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BackupMagic is the magic at the start of an incremental backup.
+const BackupMagic = "\xFFRBI"
+
+const (
+	backupVersion    = 2
+	backupHeaderSize = 4 + 4 + 8 + 8 + 4 + 4 + 4 // magic, version, base WAL ID, WAL ID, page count, record count, flags
+
+	backupFlagEncrypted = 1 << 0
+)
+
+var (
+	// ErrInvalidBackup is returned when a backup cannot be parsed.
+	ErrInvalidBackup = errors.New("rbf: invalid backup")
+
+	// ErrBackupMismatch is returned by RestoreChain when an incremental
+	// backup does not start at the WAL ID of the previous backup.
+	ErrBackupMismatch = errors.New("rbf: incremental backup does not follow previous backup")
+)
+
+// BackupManifest describes the contents of an incremental backup. It is
+// written at the start of every backup created by BackupSince.
+type BackupManifest struct {
+	BaseWALID int64    // changes after this WAL ID are included
+	WALID     int64    // WAL ID of the backup snapshot
+	PageN     uint32   // total number of pages in the database
+	Pgnos     []uint32 // pages included in the backup, in order
+
+	// Encrypted is true if the pages are encrypted. An encrypted backup
+	// holds the header page of the encrypted data file after the manifest
+	// and each page is followed by its encryption record.
+	Encrypted bool
+}
+
+// ReadBackupManifest reads the manifest from the start of an incremental
+// backup. The page data for each page in Pgnos follows the manifest.
+// Version 1 manifests, which have no flags, are also accepted.
+func ReadBackupManifest(r io.Reader) (*BackupManifest, error) {
+	hdr := make([]byte, backupHeaderSize)
+	if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+		return nil, fmt.Errorf("read manifest header: %w", err)
+	} else if string(hdr[0:4]) != BackupMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidBackup)
+	}
+
+	switch v := binary.BigEndian.Uint32(hdr[4:]); v {
+	case 1:
+		hdr = hdr[:backupHeaderSize-4]
+	case backupVersion:
+	default:
+		return nil, fmt.Errorf("%w: unsupported version: %d", ErrInvalidBackup, v)
+	}
+	if _, err := io.ReadFull(r, hdr[8:]); err != nil {
+		return nil, fmt.Errorf("read manifest header: %w", err)
+	}
+
+	m := &BackupManifest{
+		BaseWALID: int64(binary.BigEndian.Uint64(hdr[8:])),
+		WALID:     int64(binary.BigEndian.Uint64(hdr[16:])),
+		PageN:     binary.BigEndian.Uint32(hdr[24:]),
+	}
+	if len(hdr) == backupHeaderSize {
+		m.Encrypted = binary.BigEndian.Uint32(hdr[32:])&backupFlagEncrypted != 0
+	}
+
+	buf := make([]byte, 4*int(binary.BigEndian.Uint32(hdr[28:])))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read manifest pages: %w", err)
+	}
+	for i := 0; i < len(buf); i += 4 {
+		pgno := binary.BigEndian.Uint32(buf[i:])
+		if pgno >= m.PageN {
+			return nil, fmt.Errorf("%w: page out of bounds: pgno=%d max=%d", ErrInvalidBackup, pgno, m.PageN-1)
+		}
+		m.Pgnos = append(m.Pgnos, pgno)
+	}
+	return m, nil
+}
+
+// write encodes the manifest to w.
+func (m *BackupManifest) write(w io.Writer) error {
+	buf := make([]byte, backupHeaderSize+(4*len(m.Pgnos)))
+	copy(buf, BackupMagic)
+	binary.BigEndian.PutUint32(buf[4:], backupVersion)
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.BaseWALID))
+	binary.BigEndian.PutUint64(buf[16:], uint64(m.WALID))
+	binary.BigEndian.PutUint32(buf[24:], m.PageN)
+	binary.BigEndian.PutUint32(buf[28:], uint32(len(m.Pgnos)))
+	if m.Encrypted {
+		binary.BigEndian.PutUint32(buf[32:], backupFlagEncrypted)
+	}
+	for i, pgno := range m.Pgnos {
+		binary.BigEndian.PutUint32(buf[backupHeaderSize+(i*4):], pgno)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// BackupSince writes an incremental backup of all pages changed after walID
+// to w and returns the WAL ID of the backup. Passing the returned WAL ID to
+// the next call creates a chain of backups which can be restored with
+// RestoreChain. A walID of zero creates a full backup.
+//
+// Pages of a database created without Config.PageVersions, and pages past the
+// end of the version table, are always included. The pages of an encrypted database
+// stay encrypted in the backup.
+func (db *DB) BackupSince(w io.Writer, walID int64) (int64, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return tx.backupSince(w, walID)
+}
+
+func (tx *Tx) backupSince(w io.Writer, walID int64) (int64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	}
+
+	m := &BackupManifest{
+		BaseWALID: walID,
+		WALID:     readMetaWALID(tx.meta[:]),
+		PageN:     readMetaPageN(tx.meta[:]),
+		Encrypted: tx.db.aead != nil,
+	}
+	if walID > m.WALID {
+		return 0, fmt.Errorf("rbf: backup wal id after current wal id: %d > %d", walID, m.WALID)
+	}
+
+	// Page table pages are not versioned so they are always included.
+	tablePgnos, err := tx.allTablePgnos()
+	if err != nil {
+		return 0, err
+	}
+	tableSet := make(map[uint32]struct{}, len(tablePgnos))
+	for _, pgno := range tablePgnos {
+		tableSet[pgno] = struct{}{}
+	}
+
+	m.Pgnos = append(m.Pgnos, 0)
+	for pgno := uint32(1); pgno < m.PageN; pgno++ {
+		if _, ok := tableSet[pgno]; ok {
+			m.Pgnos = append(m.Pgnos, pgno)
+			continue
+		}
+
+		version, err := tx.pageVersion(pgno)
+		if err != nil {
+			return 0, err
+		} else if walID == 0 || version == 0 || version > walID {
+			m.Pgnos = append(m.Pgnos, pgno)
+		}
+	}
+
+	if err := m.write(w); err != nil {
+		return 0, err
+	} else if m.Encrypted {
+		return m.WALID, tx.writeEncryptedPages(w, m.Pgnos)
+	}
+	for _, pgno := range m.Pgnos {
+		buf, err := tx.readStoredPage(pgno)
+		if err != nil {
+			return 0, err
+		} else if _, err := w.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return m.WALID, nil
+}
+
+// RestoreChain restores a full backup followed by a chain of incremental
+// backups into the database at path. The full backup can either be a snapshot
+// from Backup or a backup from BackupSince with a zero WAL ID. Each
+// incremental backup must start at the WAL ID of the backup before it.
+// Encrypted backups are restored without the key so a chain must be created
+// from a single encrypted data file and must start with a backup from
+// BackupSince. Make sure the database is closed before calling RestoreChain.
+func RestoreChain(path string, full io.Reader, incrementals ...io.Reader) error {
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return err
+	}
+
+	dataPath := filepath.Join(path, "data")
+	tempPath := dataPath + ".tmp"
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	walID, err := restoreFull(f, full)
+	if err != nil {
+		return fmt.Errorf("full backup: %w", err)
+	}
+	for i, r := range incrementals {
+		if walID, err = restoreIncremental(f, r, walID); err != nil {
+			return fmt.Errorf("incremental backup %d: %w", i, err)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	f = nil
+
+	// Remove any WAL left from a previous database so it is not replayed.
+	if err := removeWALSegments(OSVFS{}, filepath.Join(path, "wal")); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, dataPath)
+}
+
+// restoreFull writes a full backup to f and returns its WAL ID.
+func restoreFull(f *os.File, r io.Reader) (int64, error) {
+	// Determine the backup format from the magic of the first page.
+	page := make([]byte, PageSize)
+	n, err := io.ReadFull(r, page[:4])
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	if string(page[:4]) == BackupMagic {
+		return restoreIncremental(f, io.MultiReader(bytes.NewReader(page[:n]), r), 0)
+	} else if isEncryptedFile(page) {
+		return 0, fmt.Errorf("%w: encrypted snapshot cannot start a chain", ErrInvalidBackup)
+	}
+
+	if _, err := io.ReadFull(r, page[4:]); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	} else if !IsMetaPage(page) {
+		return 0, fmt.Errorf("%w: missing meta page", ErrInvalidBackup)
+	} else if _, err := f.Write(page); err != nil {
+		return 0, err
+	} else if _, err := io.Copy(f, r); err != nil {
+		return 0, err
+	}
+	return readMetaWALID(page), nil
+}
+
+// restoreIncremental applies an incremental backup to f. The backup must
+// start at walID. Returns the WAL ID of the backup.
+func restoreIncremental(f *os.File, r io.Reader, walID int64) (int64, error) {
+	m, err := ReadBackupManifest(r)
+	if err != nil {
+		return 0, err
+	} else if m.BaseWALID != walID {
+		return 0, fmt.Errorf("%w: base=%d want=%d", ErrBackupMismatch, m.BaseWALID, walID)
+	} else if m.Encrypted {
+		return m.WALID, restoreEncryptedPages(f, m, r)
+	}
+
+	if header, err := readRestoreHeader(f); err != nil {
+		return 0, err
+	} else if header != nil && isEncryptedFile(header) {
+		return 0, fmt.Errorf("%w: unencrypted backup of encrypted database", ErrBackupMismatch)
+	}
+
+	page := make([]byte, PageSize)
+	for _, pgno := range m.Pgnos {
+		if _, err := io.ReadFull(r, page); err != nil {
+			return 0, fmt.Errorf("read page %d: %w", pgno, err)
+		}
+
+		if pgno == 0 {
+			if !IsMetaPage(page) {
+				return 0, fmt.Errorf("%w: invalid meta page", ErrInvalidBackup)
+			} else if id := readMetaWALID(page); id != m.WALID {
+				return 0, fmt.Errorf("%w: meta wal id mismatch: %d != %d", ErrInvalidBackup, id, m.WALID)
+			}
+		}
+
+		if _, err := f.WriteAt(page, int64(pgno)*PageSize); err != nil {
+			return 0, err
+		}
+	}
+
+	// Remove any pages truncated from the end of the database.
+	if err := f.Truncate(int64(m.PageN) * PageSize); err != nil {
+		return 0, err
+	}
+	return m.WALID, nil
+}
+
+func readVersionEntry(entry []byte) int64     { return int64(binary.BigEndian.Uint64(entry)) }
+func writeVersionEntry(entry []byte, v int64) { binary.BigEndian.PutUint64(entry, uint64(v)) }
+
+// pageVersion returns the WAL ID of the last commit that wrote pgno or zero
+// if the version is unknown.
+func (tx *Tx) pageVersion(pgno uint32) (int64, error) {
+	entry, err := tx.tableEntry(&versionTable, pgno)
+	if err != nil || entry == nil {
+		return 0, err
+	}
+	return readVersionEntry(entry), nil
+}
+
+// versionsEnabled returns true if the file stores page versions.
+func (tx *Tx) versionsEnabled() bool {
+	return readMetaFeatures(tx.meta[:])&MetaFeaturePageVersions != 0
+}
+
+// writeVersions records the version of all dirty pages and of the branch
+// pages above them, if versions are enabled. The version is the first WAL ID
+// written by the transaction so it is always greater than the WAL ID of any
+// previous commit.
+func (tx *Tx) writeVersions() error {
+	if !tx.versionsEnabled() {
+		return nil
+	}
+	version := readMetaWALID(tx.meta[:]) + 1
+
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyPages) {
+		if !isTablePage(tx.dirtyPages[pgno]) {
+			if err := tx.setPageVersion(pgno, version); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyBitmapPages) {
+		if err := tx.setPageVersion(pgno, version); err != nil {
+			return err
+		}
+	}
+	for pgno := range tx.changedBranches {
+		if err := tx.setPageVersion(pgno, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPageVersion records the version for pgno. Versions of pages past the end
+// of the table are not recorded.
+func (tx *Tx) setPageVersion(pgno uint32, version int64) error {
+	if dirIndex, _, _ := versionTable.index(pgno); dirIndex >= versionTable.dirN {
+		return nil
+	}
+
+	entry, err := tx.writableTableEntry(&versionTable, pgno)
+	if err != nil {
+		return err
+	}
+	writeVersionEntry(entry, version)
+	return nil
+}
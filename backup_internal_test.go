@@ -0,0 +1,29 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import "testing"
+
+// Ensure versions of pages past the end of the version table are not recorded
+// so commits do not fail on large databases.
+func TestTx_PageVersionPastTable(t *testing.T) {
+	db := testHelperMustOpenNewDB(t)
+	defer MustCloseDB(t, db)
+
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	end := uint32(versionTable.dirN * dirEntriesPerPage * versionTable.entriesPerPage())
+	for _, tt := range []struct {
+		pgno uint32
+		want int64
+	}{{end - 1, 10}, {end, 0}, {^uint32(0), 0}} {
+		if err := tx.setPageVersion(tt.pgno, 10); err != nil {
+			t.Fatal(err)
+		} else if v, err := tx.pageVersion(tt.pgno); err != nil {
+			t.Fatal(err)
+		} else if v != tt.want {
+			t.Fatalf("pageVersion(%d)=%d, want %d", tt.pgno, v, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gernest/roaring"
+)
+
+// ErrBitmapNotEmpty is returned by BulkLoad if the bitmap already has bits.
+var ErrBitmapNotEmpty = errors.New("rbf: bitmap not empty")
+
+// BulkLoad writes the containers returned by itr to an empty or new bitmap.
+// Containers must be returned in ascending key order. Rather than inserting
+// each container through the cursor, which splits pages as they fill, leaf
+// pages are packed in a single pass and the branch pages are built above them
+// so each page is written once. The iterator is not closed.
+func (tx *Tx) BulkLoad(name string, itr roaring.ContainerIterator) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.bulkLoad(name, itr)
+}
+
+func (tx *Tx) bulkLoad(name string, itr roaring.ContainerIterator) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if name == "" {
+		return ErrBitmapNameRequired
+	}
+
+	if err := tx.createBitmapIfNotExists(name); err != nil {
+		return err
+	}
+	c, err := tx.cursor(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	root := c.stack.elems[0].pgno
+	if page, _, err := tx.readPage(root); err != nil {
+		return err
+	} else if readFlags(page) != PageTypeLeaf || readCellN(page) != 0 {
+		return ErrBitmapNotEmpty
+	}
+
+	// Fill each leaf page before writing it. A leaf is only given a new page
+	// once the next one is started; if there is only one it replaces the root.
+	var cells []leafCell
+	var parents []branchCell
+	var dataSize int
+	for itr.Next() {
+		key, ct := itr.Value()
+		if ct == nil || ct.N() == 0 {
+			continue
+		} else if len(cells) > 0 && key <= cells[len(cells)-1].Key {
+			return fmt.Errorf("bulk load: key %d does not follow key %d", key, cells[len(cells)-1].Key)
+		}
+
+		cell, err := tx.bulkLoadCell(ConvertToLeafArgs(key, ct))
+		if err != nil {
+			return err
+		}
+		tx.recordChange(c, key)
+		tx.adjustCount(c, cell.BitN)
+
+		sz := align8(cell.Size())
+		if len(cells) > 0 && dataOffset(len(cells)+1)+dataSize+sz > PageSize {
+			parent, err := tx.writeBulkLoadLeaf(0, cells)
+			if err != nil {
+				return err
+			}
+			parents, cells, dataSize = append(parents, parent), cells[:1], 0
+			cells[0] = cell
+		} else {
+			cells = append(cells, cell)
+		}
+		dataSize += sz
+	}
+
+	if len(cells) == 0 {
+		return nil
+	} else if len(parents) == 0 {
+		_, err := tx.writeBulkLoadLeaf(root, cells)
+		return err
+	} else if parent, err := tx.writeBulkLoadLeaf(0, cells); err != nil {
+		return err
+	} else {
+		parents = append(parents, parent)
+	}
+
+	// Build each level of branch pages from the one below until the cells
+	// fit on the root page.
+	maxN := 1
+	for branchCellsPageSize(make([]branchCell, maxN+1)) <= PageSize {
+		maxN++
+	}
+	for len(parents) > maxN {
+		var next []branchCell
+		for len(parents) > 0 {
+			n := min(len(parents), maxN)
+			parent, err := tx.writeBulkLoadBranch(0, parents[:n])
+			if err != nil {
+				return err
+			}
+			next, parents = append(next, parent), parents[n:]
+		}
+		parents = next
+	}
+	_, err = tx.writeBulkLoadBranch(root, parents)
+	return err
+}
+
+// bulkLoadCell returns a copy of cell which can be held until its leaf page is
+// written. Bitmap containers are written to their own page immediately.
+func (tx *Tx) bulkLoadCell(cell leafCell) (leafCell, error) {
+	if cell.Type != ContainerTypeBitmap {
+		cell.Data = append([]byte(nil), cell.Data...)
+		return cell, nil
+	}
+
+	pgno, err := tx.allocatePgno()
+	if err != nil {
+		return cell, err
+	}
+	page := make([]byte, PageSize)
+	copy(page, cell.Data)
+	if err := tx.writeBitmapPage(pgno, page); err != nil {
+		return cell, err
+	}
+	cell.Type, cell.Data = ContainerTypeBitmapPtr, fromPgno(pgno)
+	return cell, nil
+}
+
+// writeBulkLoadLeaf writes cells to a leaf page at pgno, allocating a page if
+// pgno is zero, and returns the parent cell for the page.
+func (tx *Tx) writeBulkLoadLeaf(pgno uint32, cells []leafCell) (parent branchCell, err error) {
+	if pgno == 0 {
+		if pgno, err = tx.allocatePgno(); err != nil {
+			return parent, fmt.Errorf("cannot allocate leaf: %w", err)
+		}
+	}
+
+	buf := allocPage()
+	writePageNo(buf, pgno)
+	writeFlags(buf, PageTypeLeaf)
+	writeCellN(buf, len(cells))
+
+	offset := dataOffset(len(cells))
+	for i, cell := range cells {
+		writeLeafCell(buf, i, offset, cell)
+		offset += align8(cell.Size())
+	}
+
+	parent.ChildPgno = pgno
+	if len(cells) > 0 {
+		parent.LeftKey = cells[0].Key
+	}
+	return parent, tx.writePage(buf)
+}
+
+// writeBulkLoadBranch writes cells to a branch page at pgno, allocating a
+// page if pgno is zero, and returns the parent cell for the page.
+func (tx *Tx) writeBulkLoadBranch(pgno uint32, cells []branchCell) (parent branchCell, err error) {
+	if pgno == 0 {
+		if pgno, err = tx.allocatePgno(); err != nil {
+			return parent, fmt.Errorf("cannot allocate branch: %w", err)
+		}
+	}
+
+	buf := allocPage()
+	writePageNo(buf, pgno)
+	writeFlags(buf, PageTypeBranch)
+	writeCellN(buf, len(cells))
+
+	offset := dataOffset(len(cells))
+	for i, cell := range cells {
+		writeBranchCell(buf, i, offset, cell)
+		offset += align8(branchCellSize)
+	}
+	return branchCell{LeftKey: cells[0].LeftKey, ChildPgno: pgno}, tx.writePage(buf)
+}
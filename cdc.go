@@ -0,0 +1,260 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/benbjohnson/immutable"
+)
+
+// ErrSubscriptionOverflow is returned by Subscription.Err when events were
+// dropped because the subscriber did not keep up.
+var ErrSubscriptionOverflow = errors.New("rbf: subscription buffer overflow")
+
+// CommitEvent describes the changes made by a committed write transaction.
+type CommitEvent struct {
+	WALID   int64               // WAL ID of the commit
+	Created []string            // bitmaps created, sorted
+	Deleted []string            // bitmaps deleted, sorted
+	Renamed []BitmapRename      // bitmaps renamed, sorted by new name
+	Changed map[string][]uint64 // sorted container keys changed, by bitmap
+}
+
+// BitmapRename describes a renamed bitmap.
+type BitmapRename struct {
+	OldName string
+	NewName string
+}
+
+// Subscription receives a CommitEvent for every write transaction committed
+// after it was created. Events are delivered in commit order through a
+// bounded buffer. Commits never wait for a subscriber: if the buffer is full
+// the subscription is ended, C is closed once the buffered events have been
+// received and Err returns ErrSubscriptionOverflow. The subscriber should then
+// resynchronize and subscribe again.
+type Subscription struct {
+	db  *DB
+	ch  chan *CommitEvent
+	err error
+
+	// C delivers commit events. It is closed when the subscription ends.
+	C <-chan *CommitEvent
+}
+
+// Subscribe returns a new subscription which buffers up to bufferSize events.
+// Only transactions which begin after Subscribe returns are delivered.
+func (db *DB) Subscribe(bufferSize int) *Subscription {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan *CommitEvent, bufferSize)
+	sub := &Subscription{db: db, ch: ch, C: ch}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.subscriptions = append(db.subscriptions, sub)
+	return sub
+}
+
+// Close ends the subscription. Buffered events can still be received from C.
+func (sub *Subscription) Close() {
+	sub.db.mu.Lock()
+	defer sub.db.mu.Unlock()
+	sub.db.unsubscribe(sub, nil)
+}
+
+// Err returns the reason the subscription ended, if any. It returns
+// ErrSubscriptionOverflow if events were dropped and ErrClosed if the
+// database was closed.
+func (sub *Subscription) Err() error {
+	sub.db.mu.RLock()
+	defer sub.db.mu.RUnlock()
+	return sub.err
+}
+
+// unsubscribe removes sub & closes its channel. Must be called while holding
+// db.mu.
+func (db *DB) unsubscribe(sub *Subscription, err error) {
+	for i, other := range db.subscriptions {
+		if other == sub {
+			db.subscriptions = append(db.subscriptions[:i], db.subscriptions[i+1:]...)
+			sub.err = err
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// publish delivers event to all subscriptions without blocking. Must be
+// called while holding db.mu.
+func (db *DB) publish(event *CommitEvent) {
+	for _, sub := range append([]*Subscription(nil), db.subscriptions...) {
+		select {
+		case sub.ch <- event:
+		default:
+			db.unsubscribe(sub, ErrSubscriptionOverflow)
+		}
+	}
+}
+
+// closeSubscriptions ends all subscriptions. Must be called while holding
+// db.mu.
+func (db *DB) closeSubscriptions() {
+	for len(db.subscriptions) > 0 {
+		db.unsubscribe(db.subscriptions[0], ErrClosed)
+	}
+}
+
+// recordChange marks a container as changed by the transaction. Changes to
+// the freelist are internal and are not recorded.
+func (tx *Tx) recordChange(c *Cursor, key uint64) {
+	if tx.changes == nil || c == &tx.db.freelistCursor {
+		return
+	}
+
+	keys := tx.changes[c.name]
+	if keys == nil {
+		keys = make(map[uint64]struct{})
+		tx.changes[c.name] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// trackRoot records the root of a bitmap before the transaction first changes
+// its root record so the commit event can be built without reading every
+// record. A zero pgno means the bitmap did not exist.
+func (tx *Tx) trackRoot(name string) error {
+	if tx.changes == nil {
+		return nil
+	} else if _, ok := tx.prevRoots[name]; ok {
+		return nil
+	}
+
+	pgno, err := tx.root(name)
+	if err != nil && err != ErrBitmapNotFound {
+		return err
+	}
+	if tx.prevRoots == nil {
+		tx.prevRoots = make(map[string]uint32)
+	}
+	tx.prevRoots[name] = pgno
+	return nil
+}
+
+// changedRootRecords returns the starting & current root records of bitmaps
+// which were created, deleted, renamed or changed by the transaction.
+func (tx *Tx) changedRootRecords() (prev, records *immutable.SortedMap[string, uint32], err error) {
+	prev = immutable.NewSortedMap[string, uint32](nil)
+	records = immutable.NewSortedMap[string, uint32](nil)
+	for name, pgno := range tx.prevRoots {
+		if pgno != 0 {
+			prev = prev.Set(name, pgno)
+		}
+		if pgno, err := tx.root(name); err == nil {
+			records = records.Set(name, pgno)
+		} else if err != ErrBitmapNotFound {
+			return nil, nil, err
+		}
+	}
+
+	// Bitmaps with changed containers but untouched records are unchanged.
+	for name := range tx.changes {
+		if _, ok := tx.prevRoots[name]; ok {
+			continue
+		}
+		if pgno, err := tx.root(name); err == nil {
+			prev, records = prev.Set(name, pgno), records.Set(name, pgno)
+		} else if err != ErrBitmapNotFound {
+			return nil, nil, err
+		}
+	}
+	return prev, records, nil
+}
+
+// commitEvent builds the event for the transaction by comparing its root
+// records with those it started with.
+func (tx *Tx) commitEvent(prev, records *immutable.SortedMap[string, uint32]) *CommitEvent {
+	if prev == nil {
+		prev = immutable.NewSortedMap[string, uint32](nil)
+	}
+
+	event := &CommitEvent{
+		WALID:   readMetaWALID(tx.meta[:]),
+		Changed: make(map[string][]uint64),
+	}
+
+	// Find bitmaps which were added or removed. A bitmap that was deleted and
+	// recreated has a new root page.
+	created := make(map[uint32]string)
+	for itr := records.Iterator(); !itr.Done(); {
+		name, pgno, _ := itr.Next()
+		if prevPgno, ok := prev.Get(name); !ok || prevPgno != pgno {
+			created[pgno] = name
+		}
+	}
+
+	var deleted []string
+	for itr := prev.Iterator(); !itr.Done(); {
+		name, pgno, _ := itr.Next()
+		if newPgno, ok := records.Get(name); ok && newPgno == pgno {
+			continue
+		}
+
+		// A renamed bitmap keeps its root page.
+		if newName, ok := created[pgno]; ok {
+			if _, existed := prev.Get(newName); !existed {
+				delete(created, pgno)
+				event.Renamed = append(event.Renamed, BitmapRename{OldName: name, NewName: newName})
+				continue
+			}
+		}
+		deleted = append(deleted, name)
+	}
+	for _, name := range created {
+		event.Created = append(event.Created, name)
+	}
+	event.Deleted = deleted
+	sort.Strings(event.Created)
+	sort.Slice(event.Renamed, func(i, j int) bool { return event.Renamed[i].NewName < event.Renamed[j].NewName })
+
+	// Container changes are recorded under the name used when they were made.
+	names := make(map[string]string)
+	for _, r := range event.Renamed {
+		names[r.OldName] = r.NewName
+	}
+	for name, keys := range tx.changes {
+		if newName, ok := names[name]; ok {
+			name = newName
+		}
+		if _, ok := records.Get(name); !ok {
+			continue // deleted
+		}
+
+		a := event.Changed[name]
+		for key := range keys {
+			a = append(a, key)
+		}
+		event.Changed[name] = a
+	}
+	for _, a := range event.Changed {
+		sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	}
+	return event
+}
+
+func cloneChanges(m map[string]map[uint64]struct{}) map[string]map[uint64]struct{} {
+	if m == nil {
+		return nil
+	}
+	other := make(map[string]map[uint64]struct{}, len(m))
+	for name, keys := range m {
+		o := make(map[uint64]struct{}, len(keys))
+		for k := range keys {
+			o[k] = struct{}{}
+		}
+		other[name] = o
+	}
+	return other
+}
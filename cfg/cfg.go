@@ -7,18 +7,25 @@ import "log/slog"
 const (
 	DefaultMinWALCheckpointSize = 1 * (1 << 20) // 1MB
 	DefaultMaxWALCheckpointSize = DefaultMaxWALSize / 2
+	DefaultWALSegmentSize       = 64 * (1 << 20) // 64MB
 )
 
 // Config defines externally configurable rbf options.
 // The separate package avoids circular import.
 type Config struct {
 
-	// The maximum allowed database size. Required by mmap.
+	// The maximum allowed database size. Zero means no limit. Files are
+	// memory mapped in steps as they grow so this is only a hard cap.
 	MaxSize int64 `toml:"max-db-size"`
 
-	// The maximum allowed WAL size. Required by mmap.
+	// The maximum allowed WAL size. Zero means no limit. Transactions which
+	// would grow the WAL past this size return ErrTxTooLarge.
 	MaxWALSize int64 `toml:"max-wal-size"`
 
+	// The size at which a new WAL segment file is started. Commits are never
+	// split across segments. Zero keeps the WAL in a single file.
+	WALSegmentSize int64 `toml:"wal-segment-size"`
+
 	// The minimum WAL size before the WAL is copied to the DB.
 	MinWALCheckpointSize int64 `toml:"min-wal-checkpoint-size"`
 
@@ -29,6 +36,38 @@ type Config struct {
 	FsyncEnabled    bool `toml:"fsync"`
 	FsyncWALEnabled bool `toml:"fsync-wal"`
 
+	// ReadOnly opens the database without write access to the data or WAL
+	// files. It may be opened while a writer is open and each read
+	// transaction sees the writer's last commit before it began. A shared
+	// lock is held while transactions are open, which holds back the
+	// writer's checkpoints. Writable transactions return ErrReadOnly.
+	ReadOnly bool `toml:"read-only"`
+
+	// Follower opens the database as a replication follower. Changes are
+	// only applied from a primary's WAL stream with DB.ApplyWAL. Writable
+	// transactions return ErrReadOnly.
+	Follower bool `toml:"follower"`
+
+	// PageChecksums stores a checksum for every page which is verified when
+	// the page is read. Only applies when a new database file is created.
+	// Checksums change the file format, so versions which predate them
+	// cannot open such a database.
+	PageChecksums bool `toml:"page-checksums"`
+
+	// PageVersions stores the WAL ID of the last commit which wrote each page
+	// so incremental backups only include the pages changed since the
+	// previous backup. Otherwise every page is included. Only applies when a
+	// new database file is created. Versions change the file format, so
+	// versions which predate them cannot open such a database.
+	PageVersions bool `toml:"page-versions"`
+
+	// PageCompression compresses pages when they are written to the WAL &
+	// data file. Compressed pages are packed into slots of frame pages and
+	// their own page in the data file is deallocated, where the file system
+	// supports it. Only applies when a new database file is created and
+	// cannot be used with a KeyProvider.
+	PageCompression bool `toml:"page-compression"`
+
 	// for mmap correctness testing.
 	DoAllocZero bool `toml:"do-alloc-zero"`
 
@@ -36,19 +75,34 @@ type Config struct {
 	// readyCursorCh arena to avoid GC pressure.
 	CursorCacheSize int64 `toml:"cursor-cache-size"`
 
+	// KeyProvider enables encryption at rest when set. Every page of the
+	// data & WAL files is encrypted with the key it returns. An encrypted
+	// database can only be opened with the same key and an unencrypted
+	// database cannot be opened with a KeyProvider. It cannot be set from
+	// toml.
+	KeyProvider KeyProvider `toml:"-"`
+
 	// Logger specifies a logger for asynchronous errors, such as
 	// background checkpoints. It cannot be set from toml. The default is
 	// to use stderr.
 	Logger *slog.Logger `toml:"-"`
 
-	// The maximum number of bits to be deleted in a single transaction default(65536)
+	// MaxDelete is the maximum number of bits DB.RemoveRange deletes per
+	// transaction (default 65536). Zero removes a range in one transaction.
 	MaxDelete int `toml:"max-delete"`
 }
 
+// KeyProvider supplies the encryption key for a database.
+type KeyProvider interface {
+	// Key returns the AES key for the database at path. The key must be 16,
+	// 24, or 32 bytes long.
+	Key(path string) ([]byte, error)
+}
+
 func NewDefaultConfig() *Config {
 	return &Config{
-		MaxSize:              DefaultMaxSize,
 		MaxWALSize:           DefaultMaxWALSize,
+		WALSegmentSize:       DefaultWALSegmentSize,
 		MinWALCheckpointSize: DefaultMinWALCheckpointSize,
 		MaxWALCheckpointSize: DefaultMaxWALCheckpointSize,
 		FsyncEnabled:         true,
@@ -5,14 +5,13 @@
 
 package cfg
 
-// DefaultMaxSize is the default mmap size and therefore the maximum allowed
-// size of the database. The size can be increased by updating the DB.MaxSize
-// and reopening the database. This setting mainly affects virtual space usage.
+// DefaultMaxSize is a suggested cap on the size of the database. The database
+// is not capped by default since memory maps grow with the data file.
 const DefaultMaxSize = 4 * (1 << 30)
 
-// DefaultMaxWALSize is the default mmap size and therefore the maximum allowed
-// size of the WAL. The size can be increased by updating the DB.MaxWALSize
-// and reopening the database. This setting mainly affects virtual space usage.
+// DefaultMaxWALSize is the default maximum size of the WAL. The WAL memory map
+// grows with the file so this only limits how large the WAL can become
+// between checkpoints.
 const DefaultMaxWALSize = 4 * (1 << 30)
 
 // DefaultMaxDelete is the maximum number of bits that will be deleted in a single batch
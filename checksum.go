@@ -0,0 +1,234 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Databases created with MetaFeaturePageChecksums store a CRC-32C checksum for
+// every page except the meta page in checksumTable. A stored checksum of zero
+// means that no checksum has been recorded.
+
+// ErrChecksumMismatch is wrapped by ChecksumError and can be matched with errors.Is.
+var ErrChecksumMismatch = errors.New("rbf: page checksum mismatch")
+
+// ChecksumError is returned when a page does not match its stored checksum.
+type ChecksumError struct {
+	Pgno uint32
+	Name string // bitmap name, if known
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%s: pgno=%d", ErrChecksumMismatch, e.Pgno)
+	}
+	return fmt.Sprintf("%s: pgno=%d bitmap=%q", ErrChecksumMismatch, e.Pgno, e.Name)
+}
+
+func (e *ChecksumError) Unwrap() error { return ErrChecksumMismatch }
+
+// withBitmapName attaches name to err if it is a checksum error without one.
+func withBitmapName(err error, name string) error {
+	var cerr *ChecksumError
+	if errors.As(err, &cerr) && cerr.Name == "" {
+		cerr.Name = name
+	}
+	return err
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// pageChecksum returns the checksum for a page. Zero is reserved to mean that
+// no checksum is recorded so it is never returned.
+func pageChecksum(page []byte) uint32 {
+	if sum := crc32.Checksum(page, castagnoli); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+func readChecksumEntry(entry []byte) uint32     { return binary.BigEndian.Uint32(entry) }
+func writeChecksumEntry(entry []byte, v uint32) { binary.BigEndian.PutUint32(entry, v) }
+
+// checksumsEnabled returns true if the file stores page checksums.
+func (tx *Tx) checksumsEnabled() bool {
+	return readMetaFeatures(tx.meta[:])&MetaFeaturePageChecksums != 0
+}
+
+// verifyPage compares page against its stored checksum. Each page is only
+// verified once per transaction.
+func (tx *Tx) verifyPage(pgno uint32, page []byte) error {
+	if !tx.checksumsEnabled() {
+		return nil
+	} else if _, ok := tx.verified.Load(pgno); ok {
+		return nil
+	}
+
+	if want, err := tx.storedChecksum(pgno); err != nil {
+		return err
+	} else if want != 0 && want != pageChecksum(page) {
+		return &ChecksumError{Pgno: pgno}
+	}
+	tx.verified.Store(pgno, struct{}{})
+	return nil
+}
+
+// storedChecksum returns the checksum recorded for pgno or zero if none exists.
+func (tx *Tx) storedChecksum(pgno uint32) (uint32, error) {
+	entry, err := tx.tableEntry(&checksumTable, pgno)
+	if err != nil || entry == nil {
+		return 0, err
+	}
+	return readChecksumEntry(entry), nil
+}
+
+// writeChecksums records the checksums of all dirty pages. It must be called
+// after all other pages have been updated and before the dirty pages are
+// written to the WAL.
+func (tx *Tx) writeChecksums() error {
+	if !tx.checksumsEnabled() {
+		return nil
+	}
+
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyPages) {
+		if page := tx.dirtyPages[pgno]; !isTablePage(page) {
+			if err := tx.setStoredChecksum(pgno, pageChecksum(page)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyBitmapPages) {
+		if err := tx.setStoredChecksum(pgno, pageChecksum(tx.dirtyBitmapPages[pgno])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setStoredChecksum records the checksum for pgno.
+func (tx *Tx) setStoredChecksum(pgno, sum uint32) error {
+	entry, err := tx.writableTableEntry(&checksumTable, pgno)
+	if err != nil {
+		return err
+	}
+	writeChecksumEntry(entry, sum)
+	return nil
+}
+
+// checkChecksums verifies the checksum of every reachable page. Unlike the
+// structural checks, it continues past corrupt pages so that all of them are
+// reported.
+func (tx *Tx) checkChecksums() error {
+	if !tx.checksumsEnabled() {
+		return nil
+	}
+
+	var errorList ErrorList
+	for _, t := range pageTables {
+		tx.checkTablePages(t, &errorList)
+	}
+
+	if err := tx.walkRootRecordPages(func(uint32, []byte) error { return nil }); err != nil {
+		errorList.Append(err)
+	}
+
+	framePgnos, err := tx.framePgnos()
+	if err != nil {
+		errorList.Append(err)
+	}
+	for _, pgno := range framePgnos {
+		if _, _, err := tx.readPage(pgno); err != nil {
+			errorList.Append(err)
+		}
+	}
+
+	tx.checkTreeChecksums(readMetaFreelistPageNo(tx.meta[:]), "freelist", &errorList)
+
+	records, err := tx.RootRecords()
+	if err != nil {
+		errorList.Append(err)
+		return errorList.Err()
+	}
+	for itr := records.Iterator(); !itr.Done(); {
+		name, pgno, _ := itr.Next()
+		tx.checkTreeChecksums(pgno, name, &errorList)
+	}
+	return errorList.Err()
+}
+
+// checkTreeChecksums verifies the pages of a b-tree. Children of a corrupt
+// branch page cannot be found so they are skipped.
+func (tx *Tx) checkTreeChecksums(pgno uint32, name string, errorList *ErrorList) {
+	page, _, err := tx.readPage(pgno)
+	if err != nil {
+		errorList.Append(withBitmapName(err, name))
+		return
+	}
+
+	switch readFlags(page) {
+	case PageTypeBranch:
+		for i, n := 0, readCellN(page); i < n; i++ {
+			tx.checkTreeChecksums(readBranchCell(page, i).ChildPgno, name, errorList)
+		}
+	case PageTypeLeaf:
+		for i, n := 0, readCellN(page); i < n; i++ {
+			if cell := readLeafCell(page, i); cell.Type == ContainerTypeBitmapPtr {
+				if _, _, err := tx.readPage(toPgno(cell.Data)); err != nil {
+					errorList.Append(withBitmapName(err, name))
+				}
+			}
+		}
+	}
+}
+
+// checkTablePages verifies the header checksum of every page in a table.
+func (tx *Tx) checkTablePages(t *pageTable, errorList *ErrorList) {
+	for i := 0; i < t.dirN; i++ {
+		dirPgno := t.readDirPgno(tx.meta[:], i)
+		if dirPgno == 0 {
+			continue
+		}
+
+		dir, err := tx.readTablePage(dirPgno, t.dirType)
+		if err != nil {
+			errorList.Append(err)
+			continue
+		}
+		for j := 0; j < dirEntriesPerPage; j++ {
+			if pgno := readDirEntry(dir, j); pgno != 0 {
+				if _, err := tx.readTablePage(pgno, t.typ); err != nil {
+					errorList.Append(err)
+				}
+			}
+		}
+	}
+}
+
+// initChecksumPages returns a directory & checksum page which record the
+// checksums for pages. The meta page is updated to reference them.
+func initChecksumPages(meta []byte, pages [][]byte) (dir, page []byte) {
+	dirPgno, pgno := uint32(len(pages)), uint32(len(pages)+1)
+
+	page = allocPage()
+	writePageNo(page, pgno)
+	writeFlags(page, PageTypeChecksum)
+	for i := 1; i < len(pages); i++ {
+		writeChecksumEntry(checksumTable.entry(page, i), pageChecksum(pages[i]))
+	}
+	writeTablePageSum(page, tablePageSum(page))
+
+	dir = allocPage()
+	writePageNo(dir, dirPgno)
+	writeFlags(dir, PageTypeChecksumDir)
+	writeDirEntry(dir, 0, pgno)
+	writeTablePageSum(dir, tablePageSum(dir))
+
+	writeMetaFeatures(meta, readMetaFeatures(meta)|MetaFeaturePageChecksums)
+	checksumTable.writeDirPgno(meta, 0, dirPgno)
+	writeMetaPageN(meta, pgno+1)
+	return dir, page
+}
@@ -0,0 +1,536 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+
+// Command rbf inspects and maintains RBF databases.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gernest/rbf"
+	rbfcfg "github.com/gernest/rbf/cfg"
+)
+
+// ErrUsage is returned when a command is invoked with invalid arguments.
+var ErrUsage = errors.New("usage")
+
+const usage = `rbf is a tool for inspecting and maintaining RBF databases.
+
+Usage:
+
+	rbf <command> [arguments] <path>
+
+The commands are:
+
+	info      print the meta page, page count & WAL ID
+	check     run an integrity check
+	pages     list every page with its type & owning bitmap
+	dump      print the contents of a page
+	dot       write a bitmap's b-tree in Graphviz format
+	bitmaps   list bitmaps, optionally by prefix, with their sizes
+	export    write a bitmap in roaring format
+	backup    write a backup of the database
+	restore   restore a database from backups
+
+Commands other than restore open the database read-only, so they may run
+while a writer has it open. Each command reads a snapshot of the writer's last
+commit before it started, including commits which are still in the WAL, and
+holds back the writer's checkpoints until it finishes. Restore writes a new
+database. The path is the database directory. Encrypted databases are opened
+with the key in the file given by -key-file or the RBF_KEY_FILE environment
+variable, as raw bytes or hex.
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err == ErrUsage {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command in args.
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return ErrUsage
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "info":
+		return runInfo(args, stdout)
+	case "check":
+		return runCheck(args, stdout)
+	case "pages":
+		return runPages(args, stdout)
+	case "dump":
+		return runDump(args, stdout)
+	case "dot":
+		return runDot(args, stdout)
+	case "bitmaps":
+		return runBitmaps(args, stdout)
+	case "export":
+		return runExport(args, stdout)
+	case "backup":
+		return runBackup(args, stdout)
+	case "restore":
+		return runRestore(args, stdin)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		return fmt.Errorf("rbf %s: unknown command", cmd)
+	}
+}
+
+// database is the database a command operates on.
+type database struct {
+	path    string
+	keyFile string // file holding the encryption key, if any
+}
+
+// parseFlags parses args and returns the database followed by any remaining
+// positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string, argN int, argUsage string) (db database, rest []string, err error) {
+	keyFile := fs.String("key-file", os.Getenv("RBF_KEY_FILE"), "file holding the encryption key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: rbf %s [flags] <path> %s\n", fs.Name(), argUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return db, nil, ErrUsage
+	} else if fs.NArg() < 1 || fs.NArg() > 1+argN {
+		fs.Usage()
+		return db, nil, ErrUsage
+	}
+	return database{path: fs.Arg(0), keyFile: *keyFile}, fs.Args()[1:], nil
+}
+
+// keyFile is a KeyProvider which reads the key from a file. The file holds
+// either the key in hex, which takes precedence, or the raw key.
+type keyFile string
+
+func (path keyFile) Key(string) ([]byte, error) {
+	buf, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, err
+	} else if key, err := hex.DecodeString(strings.TrimSpace(string(buf))); err == nil {
+		return key, nil
+	}
+	return buf, nil
+}
+
+// openDB opens the database read-only.
+func openDB(t database) (*rbf.DB, error) {
+	if _, err := os.Stat(t.path); err != nil {
+		return nil, err
+	}
+
+	config := rbfcfg.NewDefaultConfig()
+	config.ReadOnly = true
+	if t.keyFile != "" {
+		config.KeyProvider = keyFile(t.keyFile)
+	}
+	db := rbf.NewDB(t.path, config)
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// view opens the database and calls fn with a read transaction.
+func view(t database, fn func(db *rbf.DB, tx *rbf.Tx) error) error {
+	db, err := openDB(t)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(db, tx)
+}
+
+func runInfo(args []string, w io.Writer) error {
+	target, _, err := parseFlags(flag.NewFlagSet("info", flag.ContinueOnError), args, 0, "")
+	if err != nil {
+		return err
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		pages, err := tx.Pages([]uint32{0})
+		if err != nil {
+			return err
+		}
+		meta := pages[0].(*rbf.MetaPage)
+
+		records, err := tx.RootRecords()
+		if err != nil {
+			return err
+		}
+		size, err := db.Size()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(tw, "Path:\t%s\n", target.path)
+		fmt.Fprintf(tw, "Page count:\t%d\n", meta.PageN)
+		fmt.Fprintf(tw, "WAL ID:\t%d\n", meta.WALID)
+		fmt.Fprintf(tw, "Root record pgno:\t%d\n", meta.RootRecordPageNo)
+		fmt.Fprintf(tw, "Freelist pgno:\t%d\n", meta.FreelistPageNo)
+		fmt.Fprintf(tw, "Features:\t%s\n", featureString(meta.Features))
+		fmt.Fprintf(tw, "Bitmaps:\t%d\n", records.Len())
+		fmt.Fprintf(tw, "Size:\t%d\n", size)
+		fmt.Fprintf(tw, "WAL size:\t%d\n", db.WALSize())
+		return tw.Flush()
+	})
+}
+
+// featureString returns a readable list of meta page feature flags.
+func featureString(features uint32) string {
+	var a []string
+	if features&rbf.MetaFeaturePageChecksums != 0 {
+		a = append(a, "checksums")
+		features &^= rbf.MetaFeaturePageChecksums
+	}
+	if features&rbf.MetaFeaturePageCompression != 0 {
+		a = append(a, "compression")
+		features &^= rbf.MetaFeaturePageCompression
+	}
+	if features&rbf.MetaFeaturePageVersions != 0 {
+		a = append(a, "versions")
+		features &^= rbf.MetaFeaturePageVersions
+	}
+	if features != 0 {
+		a = append(a, fmt.Sprintf("0x%x", features))
+	}
+	if len(a) == 0 {
+		return "none"
+	}
+	return strings.Join(a, ",")
+}
+
+func runCheck(args []string, w io.Writer) error {
+	target, _, err := parseFlags(flag.NewFlagSet("check", flag.ContinueOnError), args, 0, "")
+	if err != nil {
+		return err
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		err := tx.Check()
+		var errorList rbf.ErrorList
+		if errors.As(err, &errorList) {
+			for _, err := range errorList {
+				fmt.Fprintln(w, err)
+			}
+			return fmt.Errorf("check failed: %d errors", len(errorList))
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ok")
+		return nil
+	})
+}
+
+func runPages(args []string, w io.Writer) error {
+	target, _, err := parseFlags(flag.NewFlagSet("pages", flag.ContinueOnError), args, 0, "")
+	if err != nil {
+		return err
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		infos, err := tx.PageInfos()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PGNO\tTYPE\tBITMAP\tEXTRA")
+		for pgno, info := range infos {
+			typ, tree, extra := describePage(info)
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", pgno, typ, tree, extra)
+		}
+		return tw.Flush()
+	})
+}
+
+// describePage returns the type, owning bitmap & details for a page.
+func describePage(info rbf.PageInfo) (typ, tree, extra string) {
+	switch info := info.(type) {
+	case *rbf.MetaPageInfo:
+		return "meta", "", fmt.Sprintf("pageN=%d walid=%d rootrec=%d freelist=%d", info.PageN, info.WALID, info.RootRecordPageNo, info.FreelistPageNo)
+	case *rbf.RootRecordPageInfo:
+		switch info.Flags {
+		case rbf.PageTypeRootRecordLeaf:
+			return "rootrec", "", "leaf"
+		case rbf.PageTypeRootRecordBranch:
+			return "rootrec", "", "branch"
+		}
+		return "rootrec", "", fmt.Sprintf("next=%d", info.Next)
+	case *rbf.LeafPageInfo:
+		return "leaf", info.Tree, fmt.Sprintf("parent=%d celln=%d", info.Parent, info.CellN)
+	case *rbf.BranchPageInfo:
+		return "branch", info.Tree, fmt.Sprintf("parent=%d celln=%d", info.Parent, info.CellN)
+	case *rbf.BitmapPageInfo:
+		return "bitmap", info.Tree, fmt.Sprintf("parent=%d", info.Parent)
+	case *rbf.FreePageInfo:
+		return "free", "", ""
+	case *rbf.ChecksumPageInfo:
+		if info.Flags == rbf.PageTypeChecksumDir {
+			return "checksumdir", "", ""
+		}
+		return "checksum", "", ""
+	case *rbf.VersionPageInfo:
+		if info.Flags == rbf.PageTypeVersionDir {
+			return "versiondir", "", ""
+		}
+		return "version", "", ""
+	case *rbf.CompressionPageInfo:
+		if info.Flags == rbf.PageTypeCompressionDir {
+			return "compressiondir", "", ""
+		}
+		return "compression", "", ""
+	case *rbf.CountPageInfo:
+		if info.Flags == rbf.PageTypeCountDir {
+			return "countdir", "", ""
+		}
+		return "count", "", ""
+	case *rbf.FramePageInfo:
+		return "frame", "", fmt.Sprintf("slots=%d used=%d", info.SlotN, info.UsedN)
+	case nil:
+		return "unknown", "", "page is not reachable"
+	default:
+		return fmt.Sprintf("%T", info), "", ""
+	}
+}
+
+func runDump(args []string, w io.Writer) error {
+	target, rest, err := parseFlags(flag.NewFlagSet("dump", flag.ContinueOnError), args, 1, "<pgno>")
+	if err != nil {
+		return err
+	} else if len(rest) != 1 {
+		return fmt.Errorf("page number required")
+	}
+
+	pgno, err := strconv.ParseUint(rest[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid page number: %q", rest[0])
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		page, err := tx.PageData(uint32(pgno))
+		if err != nil {
+			return err
+		}
+		rbf.Pagedump(page, "", w)
+		return nil
+	})
+}
+
+func runDot(args []string, w io.Writer) error {
+	target, rest, err := parseFlags(flag.NewFlagSet("dot", flag.ContinueOnError), args, 1, "<bitmap>")
+	if err != nil {
+		return err
+	} else if len(rest) != 1 {
+		return fmt.Errorf("bitmap name required")
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		pgno, err := tx.Root(rest[0])
+		if err != nil {
+			return err
+		} else if pgno == 0 {
+			return rbf.ErrBitmapNotFound
+		}
+
+		fmt.Fprintf(w, "digraph RBF{\n")
+		fmt.Fprintf(w, "rankdir=\"LR\"\n")
+		fmt.Fprintf(w, "node [shape=record height=.1]\n")
+		fmt.Fprintf(w, "root[label=%q]\n", rest[0])
+		rbf.Dumpdot(tx, pgno, "root", w)
+		fmt.Fprintf(w, "}\n")
+		return nil
+	})
+}
+
+func runBitmaps(args []string, w io.Writer) error {
+	target, rest, err := parseFlags(flag.NewFlagSet("bitmaps", flag.ContinueOnError), args, 1, "[prefix]")
+	if err != nil {
+		return err
+	}
+	var prefix string
+	if len(rest) > 0 {
+		prefix = rest[0]
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		names, err := tx.BitmapNamesWithPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+
+		// The size of a name includes every bitmap it is a prefix of. Those
+		// follow it in sorted order so walk backwards & subtract their sizes.
+		sizes := make([]uint64, len(names))
+		for i := len(names) - 1; i >= 0; i-- {
+			if sizes[i], err = tx.GetSizeBytesWithPrefix(names[i]); err != nil {
+				return err
+			}
+			for j := i + 1; j < len(names) && strings.HasPrefix(names[j], names[i]); j++ {
+				sizes[i] -= sizes[j]
+			}
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tPAGES\tBYTES\tCOUNT")
+		for i, name := range names {
+			n, err := tx.Count(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%q\t%d\t%d\t%d\n", name, sizes[i]/rbf.PageSize, sizes[i], n)
+		}
+		return tw.Flush()
+	})
+}
+
+func runExport(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "output file, defaults to stdout")
+	format := fs.String("format", "roaring", "output format: roaring or text")
+	target, rest, err := parseFlags(fs, args, 1, "<bitmap>")
+	if err != nil {
+		return err
+	} else if len(rest) != 1 {
+		return fmt.Errorf("bitmap name required")
+	} else if *format != "roaring" && *format != "text" {
+		return fmt.Errorf("invalid format: %q", *format)
+	}
+
+	return view(target, func(db *rbf.DB, tx *rbf.Tx) error {
+		if ok, err := tx.BitmapExists(rest[0]); err != nil {
+			return err
+		} else if !ok {
+			return rbf.ErrBitmapNotFound
+		}
+		bm, err := tx.RoaringBitmap(rest[0])
+		if err != nil {
+			return err
+		}
+
+		return writeOutput(*output, w, func(w io.Writer) error {
+			if *format == "text" {
+				for _, v := range bm.Slice() {
+					if _, err := fmt.Fprintln(w, v); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			_, err := bm.WriteTo(w)
+			return err
+		})
+	})
+}
+
+func runBackup(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "output file, defaults to stdout")
+	since := fs.Int64("since", -1, "write an incremental backup of changes after this WAL ID")
+	target, _, err := parseFlags(fs, args, 0, "")
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return writeOutput(*output, w, func(w io.Writer) error {
+		if *since < 0 {
+			return db.Backup(w)
+		}
+		walID, err := db.BackupSince(w, *since)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "wal id: %d\n", walID)
+		return nil
+	})
+}
+
+func runRestore(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := fs.String("i", "", "full backup file, defaults to stdin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: rbf restore [flags] <path> [incremental...]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ErrUsage
+	} else if fs.NArg() < 1 {
+		fs.Usage()
+		return ErrUsage
+	}
+	path := fs.Arg(0)
+
+	full := stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		full = f
+	}
+
+	var incrementals []io.Reader
+	for _, filename := range fs.Args()[1:] {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		incrementals = append(incrementals, f)
+	}
+	return rbf.RestoreChain(path, full, incrementals...)
+}
+
+// writeOutput calls fn with the named file or w if filename is blank.
+func writeOutput(filename string, w io.Writer, fn func(w io.Writer) error) error {
+	if filename == "" {
+		return fn(w)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := fn(f); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gernest/rbf"
+	rbfcfg "github.com/gernest/rbf/cfg"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	config := rbfcfg.NewDefaultConfig()
+	config.PageChecksums = true
+	db := rbf.NewDB(path, config)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("x", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("xy", 4); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("y", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	root, err := tx.Root("x")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exec := func(t *testing.T, args ...string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := run(args, nil, &buf); err != nil {
+			t.Fatalf("rbf %s: %v", strings.Join(args, " "), err)
+		}
+		return buf.String()
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"info", path}, []string{"WAL ID:", "Bitmaps:", "checksums"}},
+		{[]string{"check", path}, []string{"ok"}},
+		{[]string{"pages", path}, []string{"meta", "rootrec", "leaf"}},
+		{[]string{"dump", path, strconv.Itoa(int(root))}, []string{"LEAF"}},
+		{[]string{"dot", path, "x"}, []string{"digraph", "LEAF"}},
+		{[]string{"bitmaps", path, "x"}, []string{`"x"`, "8192"}},
+		{[]string{"export", "-format", "text", path, "x"}, []string{"1\n2\n3\n"}},
+	} {
+		out := exec(t, tt.args...)
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Fatalf("rbf %s: expected %q in output:\n%s", strings.Join(tt.args, " "), want, out)
+			}
+		}
+	}
+
+	if out := exec(t, "bitmaps", path, "x"); strings.Contains(out, `"y"`) {
+		t.Fatalf("unexpected bitmap in output:\n%s", out)
+	} else if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+		t.Fatalf("unexpected output:\n%s", out)
+	} else {
+		// Sizes of bitmaps which share a prefix are not counted twice.
+		for i, want := range []string{`"x" 1 8192 3`, `"xy" 1 8192 1`} {
+			if got := strings.Join(strings.Fields(lines[i+1]), " "); got != want {
+				t.Fatalf("unexpected line: %q, want %q", got, want)
+			}
+		}
+	}
+
+	// Back up & restore into a new database.
+	backupPath := filepath.Join(t.TempDir(), "backup")
+	restorePath := filepath.Join(t.TempDir(), "restored")
+	exec(t, "backup", "-o", backupPath, path)
+	exec(t, "restore", "-i", backupPath, restorePath)
+	if out := exec(t, "export", "-format", "text", restorePath, "y"); out != "1048576\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	if err := run([]string{"dot", path, "z"}, nil, &bytes.Buffer{}); err != rbf.ErrBitmapNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := run([]string{"bogus"}, nil, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRun_Encrypted(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyPath, []byte(strings.Repeat("ab", 32)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "db")
+	config := rbfcfg.NewDefaultConfig()
+	config.KeyProvider = keyFile(keyPath)
+	db := rbf.NewDB(path, config)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("x", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"check", path}, nil, &bytes.Buffer{}); !errors.Is(err, rbf.ErrEncrypted) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := run([]string{"export", "-key-file", keyPath, "-format", "text", path, "x"}, nil, &buf); err != nil {
+		t.Fatal(err)
+	} else if got := buf.String(); got != "1\n2\n3\n" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+
+	t.Setenv("RBF_KEY_FILE", keyPath)
+	buf.Reset()
+	if err := run([]string{"check", path}, nil, &buf); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(buf.String(), "ok") {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// ErrTxOpen is returned by Vacuum when transactions are still open.
+var ErrTxOpen = errors.New("rbf: transactions are open")
+
+// compactBatchPageN is the number of pages written per transaction by Compact
+// when the WAL size is not limited.
+const compactBatchPageN = 16384
+
+// CompactStats reports the result of a compaction.
+type CompactStats struct {
+	SrcPageN       uint32 // page count of the source database
+	DstPageN       uint32 // page count of the compacted database
+	LivePageN      int    // number of live pages copied, excluding the meta page
+	PagesMoved     int    // b-tree pages with a different page number in the copy
+	BytesReclaimed int64  // reduction in data file size, in bytes
+}
+
+// Compact writes a compacted copy of the database to dstPath. Every bitmap is
+// rewritten into contiguous pages and the copy starts with an empty freelist.
+// The copy is made from a snapshot so writes may continue during compaction.
+// The destination must not already contain a database and is written using
+// the same VFS as the source.
+func (db *DB) Compact(dstPath string) (*CompactStats, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return tx.compact(dstPath)
+}
+
+// Vacuum compacts the database in place and atomically swaps the data file.
+// The WAL is checkpointed & removed before the swap so it is never applied to
+// the compacted file. Writers are blocked while the database is compacted and
+// ErrTxOpen is returned if any transactions are open when the file is
+// swapped. ErrDatabaseLocked is returned if read-only databases are attached.
+func (db *DB) Vacuum() (*CompactStats, error) {
+	if db.cfg.ReadOnly || db.cfg.Follower {
+		return nil, ErrReadOnly
+	}
+
+	db.rwmu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			db.rwmu.Unlock()
+		}
+	}()
+
+	// Compact into a temporary directory next to the database.
+	tmpPath := db.Path + ".vacuum"
+	if err := db.VFS.RemoveAll(tmpPath); err != nil {
+		return nil, err
+	}
+	defer db.VFS.RemoveAll(tmpPath)
+
+	stats, err := func() (*CompactStats, error) {
+		tx, err := db.Begin(false)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		return tx.compact(tmpPath)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Readers cannot follow the files being replaced.
+	if ok, err := db.lockReaders(); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrDatabaseLocked
+	}
+	defer func() {
+		if err := db.releaseReaders(); err != nil {
+			db.logger.Error("unlock readers", "err", err)
+		}
+	}()
+
+	// Copy the WAL into the current data file so it can be removed before
+	// the compacted file replaces it. A crash at any point then leaves a data
+	// file with either its own WAL or none. The checkpoint would wait for
+	// open transactions so they are checked first.
+	for db.walSize() > 0 {
+		if !db.opened {
+			return nil, ErrClosed
+		} else if len(db.txs) > 0 {
+			return nil, ErrTxOpen
+		} else if _, err := db.checkpoint(); err != nil {
+			return nil, err
+		} else if err := db.waitCheckpoint(); err != nil {
+			return nil, err
+		}
+	}
+	if !db.opened {
+		return nil, ErrClosed
+	} else if len(db.txs) > 0 {
+		return nil, ErrTxOpen
+	}
+
+	// Close the current files, remove the WAL and swap in the compacted data
+	// file. The database is reopened with whichever data file is in place,
+	// even if a step fails.
+	db.opened = false
+	if err = db.closeHandles(); err != nil {
+		err = fmt.Errorf("close: %w", err)
+	} else if err = removeWALSegments(db.VFS, db.WALPath()); err != nil {
+		err = fmt.Errorf("remove wal: %w", err)
+	} else if err = db.VFS.Rename(filepath.Join(tmpPath, "data"), db.DataPath()); err != nil {
+		err = fmt.Errorf("swap data file: %w", err)
+	}
+	db.pageMap = NewPageMap()
+	db.walPageN, db.walStart = 0, 0
+
+	// Reopening acquires the write lock for its startup checkpoint.
+	db.rwmu.Unlock()
+	locked = false
+	if e := db.open(); e != nil {
+		return nil, errors.Join(err, fmt.Errorf("reopen: %w", e))
+	} else if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// compact copies every bitmap in the transaction's snapshot to a new database
+// at dstPath.
+func (tx *Tx) compact(dstPath string) (_ *CompactStats, err error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	if f, err := tx.db.VFS.OpenFile(filepath.Join(dstPath, "data"), true, tx.db.cfg.MaxSize); err == nil {
+		sz, _ := f.Size()
+		f.Close()
+		if sz > 0 {
+			return nil, fmt.Errorf("rbf: compact destination already exists: %s", dstPath)
+		}
+	}
+
+	stats := &CompactStats{SrcPageN: readMetaPageN(tx.meta[:])}
+	inuse, err := tx.inusePageSet()
+	if err != nil {
+		return nil, err
+	}
+	stats.LivePageN = len(inuse) - 1 // exclude meta page
+	srcPgnos, err := tx.treePgnos()
+	if err != nil {
+		return nil, err
+	}
+
+	// The destination uses the same settings as the source, other than the
+	// checksum, version & compression settings which are carried over from
+	// the source file.
+	cfg := tx.db.cfg
+	cfg.ReadOnly = false
+	cfg.PageChecksums = tx.checksumsEnabled()
+	cfg.PageVersions = tx.versionsEnabled()
+	cfg.PageCompression = tx.compressionEnabled()
+	dst := NewDB(dstPath, &cfg)
+	dst.VFS = tx.db.VFS
+
+	// Continue from the source WAL ID so every page in the copy has a newer
+	// version than the source and incremental backups remain correct.
+	dst.initWALID = readMetaWALID(tx.meta[:])
+	if err := dst.Open(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := dst.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	records, err := tx.RootRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the copy into multiple transactions so it fits in the WAL.
+	maxDirtyN := int(cfg.MaxWALSize / PageSize / 4)
+	if cfg.MaxWALSize <= 0 {
+		maxDirtyN = compactBatchPageN
+	}
+	dtx, err := dst.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { dtx.Rollback() }()
+
+	for itr := records.Iterator(); !itr.Done(); {
+		name, _, _ := itr.Next()
+		if err := dtx.CreateBitmap(name); err != nil {
+			return nil, err
+		}
+
+		if err := tx.forEachContainer(name, func(key uint64, cell leafCell) error {
+			if err := dtx.PutContainer(name, key, toContainer(cell, tx)); err != nil {
+				return err
+			}
+
+			if dtx.dirtyN() < maxDirtyN {
+				return nil
+			} else if err := dtx.Commit(); err != nil {
+				return err
+			}
+
+			next, err := dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			dtx = next
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("copy bitmap %q: %w", name, err)
+		}
+	}
+	if err := dtx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Move all pages into the data file so it reflects the final size.
+	if err := dst.Checkpoint(); err != nil {
+		return nil, err
+	}
+	rtx, err := dst.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer rtx.Rollback()
+
+	stats.DstPageN = readMetaPageN(rtx.meta[:])
+	stats.BytesReclaimed = (int64(stats.SrcPageN) - int64(stats.DstPageN)) * PageSize
+
+	// Pages are matched by their position in each bitmap's b-tree.
+	dstPgnos, err := rtx.treePgnos()
+	if err != nil {
+		return nil, err
+	}
+	for name, pgnos := range srcPgnos {
+		for i, pgno := range pgnos {
+			if i >= len(dstPgnos[name]) || dstPgnos[name][i] != pgno {
+				stats.PagesMoved++
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// treePgnos returns the page numbers of every bitmap's b-tree, by bitmap name,
+// in the order they are walked.
+func (tx *Tx) treePgnos() (map[string][]uint32, error) {
+	m := make(map[string][]uint32)
+	if err := tx.walkRootRecords("", func(name string, root uint32) error {
+		return tx.walkTree(root, 0, func(pgno, parent, typ uint32, err error) error {
+			m[name] = append(m[name], pgno)
+			return err
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// forEachContainer calls fn for every container in a bitmap, in key order.
+func (tx *Tx) forEachContainer(name string, fn func(key uint64, cell leafCell) error) error {
+	c, err := tx.cursor(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.First(); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for {
+		if err := c.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		elem := &c.stack.elems[c.stack.top]
+		leafPage, _, err := c.readPage(elem.pgno)
+		if err != nil {
+			return err
+		}
+		cell := readLeafCell(leafPage, elem.index)
+		if err := fn(cell.Key, cell); err != nil {
+			return err
+		}
+	}
+}
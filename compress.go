@@ -0,0 +1,644 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Databases created with MetaFeaturePageCompression store pages as compressed
+// frames. A frame holds the 8-byte page header, followed by the rest of the
+// page compressed with DEFLATE. Frames are packed into the slots of frame
+// pages, which are written to the WAL & data file like any other page. Each
+// frame page is divided into a fixed number of equal slots, from 2 to 32, and
+// a frame is stored in a page with the smallest slots it fits in so frames of
+// any size waste little space.
+//
+// compressionTable maps the page number of each compressed page to its frame
+// page, slot & frame length. Compressed pages are never written themselves so
+// their own page in the data file holds no data. It is deallocated by the
+// checkpoint which copies the compression entry to the data file. Page table,
+// meta & frame pages are never compressed.
+//
+// A frame page starts with its page number, flags & slot count followed by the
+// page number stored in each slot, or zero if the slot is free. The slot of a
+// page is released when the page is rewritten or freed and a frame page is
+// freed once it has no stored pages.
+
+const (
+	frameHeaderSize     = 8  // pgno, flags
+	framePageHeaderSize = 12 // pgno, flags, slot count
+
+	// minFrameSlotN & maxFrameSlotN bound the number of slots in a frame page.
+	// Frames which do not fit in half a page are stored uncompressed.
+	minFrameSlotN = 2
+	maxFrameSlotN = 32
+
+	// maxFrameHintN is the number of frame pages with free slots that are
+	// remembered for each slot count.
+	maxFrameHintN = 64
+
+	// pageCacheSize is the number of decompressed pages cached by a
+	// transaction.
+	pageCacheSize = 256
+)
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaderPool = sync.Pool{
+	New: func() any { return flate.NewReader(nil) },
+}
+
+// readCompressionEntry returns the frame page, slot & frame length of a
+// compressed page. The frame page is zero if the page is stored uncompressed.
+func readCompressionEntry(entry []byte) (framePgno uint32, slot, n int) {
+	return binary.BigEndian.Uint32(entry), int(binary.BigEndian.Uint16(entry[4:])), int(binary.BigEndian.Uint16(entry[6:]))
+}
+
+func writeCompressionEntry(entry []byte, framePgno uint32, slot, n int) {
+	binary.BigEndian.PutUint32(entry, framePgno)
+	binary.BigEndian.PutUint16(entry[4:], uint16(slot))
+	binary.BigEndian.PutUint16(entry[6:], uint16(n))
+}
+
+func readFrameSlotN(page []byte) int     { return int(binary.BigEndian.Uint16(page[8:])) }
+func writeFrameSlotN(page []byte, n int) { binary.BigEndian.PutUint16(page[8:], uint16(n)) }
+
+// readFrameOwner returns the page number stored in slot i of a frame page.
+func readFrameOwner(page []byte, i int) uint32 {
+	return binary.BigEndian.Uint32(page[framePageHeaderSize+(i*4):])
+}
+
+func writeFrameOwner(page []byte, i int, pgno uint32) {
+	binary.BigEndian.PutUint32(page[framePageHeaderSize+(i*4):], pgno)
+}
+
+// frameSlotSize returns the size of each slot of a frame page with slotN slots.
+func frameSlotSize(slotN int) int {
+	return (PageSize - align8(framePageHeaderSize+(slotN*4))) / slotN
+}
+
+// frameSlot returns the bytes of slot i of a frame page.
+func frameSlot(page []byte, i int) []byte {
+	slotN := readFrameSlotN(page)
+	sz := frameSlotSize(slotN)
+	offset := align8(framePageHeaderSize+(slotN*4)) + (i * sz)
+	return page[offset : offset+sz]
+}
+
+// frameSlotN returns the number of slots of the frame pages used to store a
+// frame of size n, or zero if the frame is too large to store.
+func frameSlotN(n int) int {
+	for slotN := maxFrameSlotN; slotN >= minFrameSlotN; slotN-- {
+		if frameSlotSize(slotN) >= n {
+			return slotN
+		}
+	}
+	return 0
+}
+
+// frameUsedN returns the number of slots of a frame page which store a page.
+func frameUsedN(page []byte) (n int) {
+	for i := 0; i < readFrameSlotN(page); i++ {
+		if readFrameOwner(page, i) != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// freeFrameSlot returns the first free slot of a frame page or -1 if it is
+// full.
+func freeFrameSlot(page []byte) int {
+	for i := 0; i < readFrameSlotN(page); i++ {
+		if readFrameOwner(page, i) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// isFramePage returns true if page is a frame page.
+func isFramePage(page []byte) bool {
+	return readFlags(page) == PageTypeFrame
+}
+
+// compressionEnabled returns true if the file stores compressed pages.
+func (tx *Tx) compressionEnabled() bool {
+	return readMetaFeatures(tx.meta[:])&MetaFeaturePageCompression != 0
+}
+
+// compressPage returns the frame for a page or nil if it does not compress
+// enough to be stored in a frame page.
+func compressPage(page []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(PageSize)
+	buf.Write(page[:frameHeaderSize])
+
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(page[frameHeaderSize:]); err != nil {
+		return nil
+	} else if err := w.Close(); err != nil {
+		return nil
+	} else if frameSlotN(buf.Len()) == 0 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decompressPage returns a new page with the contents of a frame.
+func decompressPage(frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	page := make([]byte, PageSize)
+	copy(page, frame[:frameHeaderSize])
+
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(frame[frameHeaderSize:]), nil); err != nil {
+		return nil, err
+	} else if _, err := io.ReadFull(r, page[frameHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// readCompressedPage returns the contents of a page stored in a frame page.
+// Returns nil if the page is stored uncompressed or is dirty.
+func (tx *Tx) readCompressedPage(pgno uint32) ([]byte, error) {
+	if tx.isDirty(pgno) {
+		return nil, nil
+	} else if buf := tx.pageCache.get(pgno); buf != nil {
+		return buf, nil
+	}
+
+	framePgno, slot, n, err := tx.compressedFrame(pgno)
+	if err != nil || framePgno == 0 {
+		return nil, err
+	}
+	frame, err := tx.readFrame(pgno, framePgno, slot, n)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := decompressPage(frame)
+	if err != nil {
+		return nil, fmt.Errorf("rbf: decompress page: pgno=%d: %w", pgno, err)
+	}
+	tx.pageCache.put(pgno, buf)
+	return buf, nil
+}
+
+// compressedFrame returns the frame page, slot & frame length of a page. The
+// frame page is zero if the page is stored uncompressed or is dirty, in which
+// case its entry is not yet final.
+func (tx *Tx) compressedFrame(pgno uint32) (framePgno uint32, slot, n int, err error) {
+	if pgno == 0 || pgno >= readMetaPageN(tx.meta[:]) || !tx.compressionEnabled() {
+		return 0, 0, 0, nil
+	} else if tx.isDirty(pgno) {
+		return 0, 0, 0, nil
+	}
+
+	entry, err := tx.tableEntry(&compressionTable, pgno)
+	if err != nil || entry == nil {
+		return 0, 0, 0, err
+	}
+	framePgno, slot, n = readCompressionEntry(entry)
+	return framePgno, slot, n, nil
+}
+
+// isDirty returns true if pgno has been written by the transaction.
+func (tx *Tx) isDirty(pgno uint32) bool {
+	return tx.writable && (tx.dirtyPages[pgno] != nil || tx.dirtyBitmapPages[pgno] != nil)
+}
+
+// readStoredPage returns a page as it is copied to a backup. Pages stored in
+// frame pages have no data of their own so they are copied as zeros.
+func (tx *Tx) readStoredPage(pgno uint32) ([]byte, error) {
+	if framePgno, _, _, err := tx.compressedFrame(pgno); err != nil {
+		return nil, err
+	} else if framePgno != 0 {
+		return make([]byte, PageSize), nil
+	}
+	page, _, err := tx.readRawPage(pgno)
+	return page, err
+}
+
+// readFrame returns the frame of pgno stored in a slot of a frame page.
+func (tx *Tx) readFrame(pgno, framePgno uint32, slot, n int) ([]byte, error) {
+	page, _, err := tx.readRawPage(framePgno)
+	if err != nil {
+		return nil, err
+	} else if !isFramePage(page) || slot >= readFrameSlotN(page) || readFrameOwner(page, slot) != pgno {
+		return nil, fmt.Errorf("rbf: invalid frame slot: pgno=%d frame=%d slot=%d", pgno, framePgno, slot)
+	} else if n < frameHeaderSize || n > frameSlotSize(readFrameSlotN(page)) {
+		return nil, fmt.Errorf("rbf: invalid compressed page length: pgno=%d len=%d", pgno, n)
+	}
+	return frameSlot(page, slot)[:n], nil
+}
+
+// pageCache holds recently decompressed pages. Pages are only ever read from
+// the transaction's snapshot so entries never need to be invalidated.
+type pageCache struct {
+	mu    sync.Mutex
+	pages map[uint32][]byte
+}
+
+func (c *pageCache) get(pgno uint32) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pages[pgno]
+}
+
+// put adds a page to the cache, evicting an arbitrary page if it is full.
+func (c *pageCache) put(pgno uint32, page []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pages == nil {
+		c.pages = make(map[uint32][]byte)
+	} else if len(c.pages) >= pageCacheSize {
+		for k := range c.pages {
+			delete(c.pages, k)
+			break
+		}
+	}
+	c.pages[pgno] = page
+}
+
+// compressPages stores the dirty pages which compress well in frame pages. It
+// must be called once the contents of all other pages are final and before
+// page versions & checksums are recorded so that the frame pages are
+// included.
+//
+// The slots of rewritten pages are released first. Freeing an empty frame page
+// changes the freelist, which may dirty more compressed pages, so this repeats
+// until no more slots are released. Frames are then stored in frame pages with
+// free slots or in new pages allocated from the end of the file so that the
+// freelist does not change once pages have been compressed.
+func (tx *Tx) compressPages() error {
+	if !tx.compressionEnabled() {
+		return nil
+	}
+
+	for {
+		var n int
+		for _, pgno := range append(dirtyPageMapKeys(tx.dirtyPages), dirtyPageMapKeys(tx.dirtyBitmapPages)...) {
+			if released, err := tx.releaseFrame(pgno); err != nil {
+				return err
+			} else if released {
+				n++
+			}
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	tx.compressed = make(map[uint32]struct{})
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyPages) {
+		if page := tx.dirtyPages[pgno]; !isTablePage(page) && !isFramePage(page) {
+			if err := tx.storeFrame(pgno, compressPage(page)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pgno := range dirtyPageMapKeys(tx.dirtyBitmapPages) {
+		if err := tx.storeFrame(pgno, compressPage(tx.dirtyBitmapPages[pgno])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeFrame stores the frame of pgno in a free slot of a frame page. A nil
+// frame leaves the page uncompressed. Pages past the end of the table are
+// always stored uncompressed.
+func (tx *Tx) storeFrame(pgno uint32, frame []byte) error {
+	if frame == nil {
+		return nil
+	} else if dirIndex, _, _ := compressionTable.index(pgno); dirIndex >= compressionTable.dirN {
+		return nil
+	}
+
+	framePgno, page, err := tx.frameWithFreeSlot(frameSlotN(len(frame)))
+	if err != nil {
+		return err
+	}
+	slot := freeFrameSlot(page)
+	writeFrameOwner(page, slot, pgno)
+	copy(frameSlot(page, slot), frame)
+
+	entry, err := tx.writableTableEntry(&compressionTable, pgno)
+	if err != nil {
+		return err
+	}
+	writeCompressionEntry(entry, framePgno, slot, len(frame))
+	tx.compressed[pgno] = struct{}{}
+	return nil
+}
+
+// releaseFrame frees the slot of a compressed page and clears its entry. The
+// frame page is freed if no other pages are stored in it. Returns true if the
+// page was compressed.
+func (tx *Tx) releaseFrame(pgno uint32) (bool, error) {
+	if !tx.compressionEnabled() {
+		return false, nil
+	}
+
+	entry, err := tx.tableEntry(&compressionTable, pgno)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	framePgno, slot, _ := readCompressionEntry(entry)
+	if framePgno == 0 {
+		return false, nil
+	}
+
+	if entry, err = tx.writableTableEntry(&compressionTable, pgno); err != nil {
+		return false, err
+	}
+	writeCompressionEntry(entry, 0, 0, 0)
+
+	page, err := tx.writableFramePage(framePgno)
+	if err != nil {
+		return false, err
+	} else if slot >= readFrameSlotN(page) || readFrameOwner(page, slot) != pgno {
+		return false, fmt.Errorf("rbf: invalid frame slot: pgno=%d frame=%d slot=%d", pgno, framePgno, slot)
+	}
+	writeFrameOwner(page, slot, 0)
+	clear(frameSlot(page, slot))
+
+	if frameUsedN(page) > 0 {
+		tx.addFrameHint(framePgno, readFrameSlotN(page))
+		return true, nil
+	}
+	tx.removeFrameHint(framePgno, readFrameSlotN(page))
+	return true, tx.freePgno(framePgno)
+}
+
+// frameWithFreeSlot returns a dirty frame page with slotN slots and at least
+// one free slot. Frame pages which had slots released are used first,
+// otherwise a new page is allocated from the end of the file.
+func (tx *Tx) frameWithFreeSlot(slotN int) (uint32, []byte, error) {
+	for hints := tx.frameHints[slotN]; len(hints) > 0; hints = tx.frameHints[slotN] {
+		pgno := hints[len(hints)-1]
+		if ok, err := tx.isFrameCandidate(pgno, slotN); err != nil {
+			return 0, nil, err
+		} else if ok {
+			page, err := tx.writableFramePage(pgno)
+			if err != nil {
+				return 0, nil, err
+			} else if frameUsedN(page) == slotN-1 {
+				tx.frameHints[slotN] = hints[:len(hints)-1] // full once used
+			}
+			return pgno, page, nil
+		}
+		tx.frameHints[slotN] = hints[:len(hints)-1]
+	}
+
+	pgno := tx.allocateNewPgno()
+	page := allocPage()
+	writePageNo(page, pgno)
+	writeFlags(page, PageTypeFrame)
+	writeFrameSlotN(page, slotN)
+	tx.dirtyPages[pgno] = page
+	tx.addFrameHint(pgno, slotN)
+	return pgno, page, nil
+}
+
+// isFrameCandidate returns true if pgno is an allocated frame page with slotN
+// slots and a free slot. Hints are not updated when savepoints are rolled back
+// so they must be verified before use.
+func (tx *Tx) isFrameCandidate(pgno uint32, slotN int) (bool, error) {
+	if pgno >= readMetaPageN(tx.meta[:]) {
+		return false, nil
+	}
+
+	page, isHeap, err := tx.readRawPage(pgno)
+	if err != nil {
+		return false, err
+	} else if !isFramePage(page) || readFrameSlotN(page) != slotN || freeFrameSlot(page) < 0 {
+		return false, nil
+	} else if isHeap {
+		return true, nil
+	}
+
+	c := tx.db.getFreelistCursor(tx)
+	defer c.unpooledClose()
+	free, err := c.Contains(uint64(pgno))
+	return !free, err
+}
+
+// addFrameHint records that a frame page has a free slot.
+func (tx *Tx) addFrameHint(pgno uint32, slotN int) {
+	if tx.frameHints == nil {
+		tx.frameHints = make(map[int][]uint32)
+	}
+	hints := tx.frameHints[slotN]
+	for _, other := range hints {
+		if other == pgno {
+			return
+		}
+	}
+	if len(hints) >= maxFrameHintN {
+		hints = hints[1:]
+	}
+	tx.frameHints[slotN] = append(hints, pgno)
+}
+
+// removeFrameHint removes a frame page which has been freed from the hints.
+func (tx *Tx) removeFrameHint(pgno uint32, slotN int) {
+	hints := tx.frameHints[slotN]
+	for i, other := range hints {
+		if other == pgno {
+			tx.frameHints[slotN] = append(hints[:i:i], hints[i+1:]...)
+			return
+		}
+	}
+}
+
+// cloneFrameHints returns a copy of the frame page hints.
+func cloneFrameHints(m map[int][]uint32) map[int][]uint32 {
+	other := make(map[int][]uint32, len(m))
+	for slotN, hints := range m {
+		other[slotN] = append([]uint32(nil), hints...)
+	}
+	return other
+}
+
+// writableFramePage returns a dirty copy of a frame page.
+func (tx *Tx) writableFramePage(pgno uint32) ([]byte, error) {
+	if page := tx.dirtyPages[pgno]; page != nil && !tx.isSavepointPage(pgno) {
+		return page, nil
+	}
+	src, _, err := tx.readRawPage(pgno)
+	if err != nil {
+		return nil, err
+	} else if !isFramePage(src) {
+		return nil, fmt.Errorf("rbf: not a frame page: pgno=%d type=%d", pgno, readFlags(src))
+	}
+	page := allocPage()
+	copy(page, src)
+	tx.dirtyPages[pgno] = page
+	return page, nil
+}
+
+// walkCompressionEntries calls fn for every compressed page with the location
+// of its frame.
+func (tx *Tx) walkCompressionEntries(fn func(pgno, framePgno uint32, slot int) error) error {
+	t := &compressionTable
+	for i := 0; i < t.dirN; i++ {
+		dirPgno := t.readDirPgno(tx.meta[:], i)
+		if dirPgno == 0 {
+			continue
+		}
+		dir, err := tx.readTablePage(dirPgno, t.dirType)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < dirEntriesPerPage; j++ {
+			tpgno := readDirEntry(dir, j)
+			if tpgno == 0 {
+				continue
+			}
+			page, err := tx.readTablePage(tpgno, t.typ)
+			if err != nil {
+				return err
+			}
+
+			start := uint64((i*dirEntriesPerPage)+j) * uint64(t.entriesPerPage())
+			for k := 0; k < t.entriesPerPage(); k++ {
+				if framePgno, slot, _ := readCompressionEntry(t.entry(page, k)); framePgno != 0 {
+					if err := fn(uint32(start+uint64(k)), framePgno, slot); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// framePgnos returns the page numbers of all frame pages. Every slot of a
+// frame page must be referenced by the entry of the page stored in it.
+func (tx *Tx) framePgnos() ([]uint32, error) {
+	var errorList ErrorList
+	slots := make(map[uint32]map[int]struct{})
+	if err := tx.walkCompressionEntries(func(pgno, framePgno uint32, slot int) error {
+		if slots[framePgno] == nil {
+			slots[framePgno] = make(map[int]struct{})
+		}
+		slots[framePgno][slot] = struct{}{}
+		return nil
+	}); err != nil {
+		errorList.Append(err)
+	}
+
+	a := make([]uint32, 0, len(slots))
+	for pgno := range slots {
+		a = append(a, pgno)
+	}
+	sort.Sort(uint32Slice(a))
+
+	for _, pgno := range a {
+		page, _, err := tx.readRawPage(pgno)
+		if err != nil {
+			errorList.Append(err)
+			continue
+		} else if !isFramePage(page) {
+			errorList.Append(fmt.Errorf("not a frame page: pgno=%d type=%d", pgno, readFlags(page)))
+			continue
+		}
+		for i := 0; i < readFrameSlotN(page); i++ {
+			if _, ok := slots[pgno][i]; ok != (readFrameOwner(page, i) != 0) {
+				errorList.Append(fmt.Errorf("frame slot not referenced by its page: pgno=%d slot=%d owner=%d", pgno, i, readFrameOwner(page, i)))
+			}
+		}
+	}
+	return a, errorList.Err()
+}
+
+// sparseFile is implemented by files which can deallocate a range so that it
+// reads as zeros without occupying space on disk.
+type sparseFile interface {
+	punchHole(off, size int64) error
+}
+
+// deallocateCompressedPages deallocates the pages of the data file which are
+// stored in frame pages, according to the compression pages copied by a
+// checkpoint. Reads the pages of the checkpoint with readPage. Pages are left
+// allocated if the file cannot deallocate them.
+func (db *DB) deallocateCompressedPages(pageN uint32, pgnos map[uint32]struct{}, readPage func(pgno uint32) ([]byte, error)) error {
+	f, ok := db.data.(sparseFile)
+	if !ok {
+		return nil
+	}
+	meta, err := readPage(0)
+	if err != nil {
+		return err
+	}
+
+	// Merge contiguous pages into a single range. Stop deallocating after the
+	// first failure as the file system likely does not support it.
+	var start, end uint32
+	var failed bool
+	punch := func() {
+		if start != end && !failed {
+			failed = f.punchHole(int64(start)*PageSize, int64(end-start)*PageSize) != nil
+		}
+		start, end = 0, 0
+	}
+
+	t := &compressionTable
+	for i := 0; i < t.dirN; i++ {
+		dirPgno := t.readDirPgno(meta, i)
+		if dirPgno == 0 {
+			continue
+		}
+		dir, err := readPage(dirPgno)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < dirEntriesPerPage; j++ {
+			tpgno := readDirEntry(dir, j)
+			if _, ok := pgnos[tpgno]; !ok || tpgno == 0 {
+				continue
+			}
+			page, err := readPage(tpgno)
+			if err != nil {
+				return err
+			}
+
+			first := uint64((i*dirEntriesPerPage)+j) * uint64(t.entriesPerPage())
+			for k := 0; k < t.entriesPerPage(); k++ {
+				pgno := first + uint64(k)
+				if framePgno, _, _ := readCompressionEntry(t.entry(page, k)); framePgno == 0 || pgno >= uint64(pageN) {
+					continue
+				} else if uint32(pgno) != end || start == end {
+					punch()
+					start = uint32(pgno)
+				}
+				end = uint32(pgno) + 1
+			}
+		}
+	}
+	punch()
+	return nil
+}
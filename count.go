@@ -0,0 +1,186 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// The bit count of every bitmap is stored in countTable, keyed by the page
+// number of its root, so Count does not need to scan the b-tree. Changes to
+// leaf cells are accumulated in the transaction and written when it is
+// flushed. Bitmaps written before counts were tracked have no entry and are
+// counted by a scan, and the result is stored the next time they change.
+
+// countChange is the pending change to the bit count of a bitmap.
+type countChange struct {
+	delta   int64 // change in bit count
+	reset   bool  // bitmap was created in this tx so its count starts at zero
+	deleted bool  // bitmap was deleted in this tx so its entry is cleared
+}
+
+// Entries hold the count plus one so an empty bitmap can be told apart from
+// one which has no recorded count.
+func readCountEntry(entry []byte) (uint64, bool) {
+	v := binary.BigEndian.Uint64(entry)
+	return v - 1, v != 0
+}
+
+func writeCountEntry(entry []byte, n uint64) { binary.BigEndian.PutUint64(entry, n+1) }
+
+// adjustCount records a change in the bit count of the cursor's bitmap.
+// Changes to the freelist are not counted.
+func (tx *Tx) adjustCount(c *Cursor, delta int) {
+	if delta == 0 || c == &tx.db.freelistCursor {
+		return
+	}
+	if tx.counts == nil {
+		tx.counts = make(map[uint32]countChange)
+	}
+	root := c.stack.elems[0].pgno
+	ch := tx.counts[root]
+	ch.delta += int64(delta)
+	tx.counts[root] = ch
+}
+
+// createCount records that a new, empty bitmap has its root at pgno.
+func (tx *Tx) createCount(root uint32) {
+	if tx.counts == nil {
+		tx.counts = make(map[uint32]countChange)
+	}
+	tx.counts[root] = countChange{reset: true}
+}
+
+// deleteCount records that the bitmap with its root at pgno was deleted.
+func (tx *Tx) deleteCount(root uint32) {
+	if tx.counts == nil {
+		tx.counts = make(map[uint32]countChange)
+	}
+	tx.counts[root] = countChange{deleted: true}
+}
+
+// storedCount returns the count recorded for the bitmap with its root at pgno.
+// Returns false if no count is recorded.
+func (tx *Tx) storedCount(root uint32) (uint64, bool, error) {
+	entry, err := tx.tableEntry(&countTable, root)
+	if err != nil || entry == nil {
+		return 0, false, err
+	}
+	n, ok := readCountEntry(entry)
+	return n, ok, nil
+}
+
+// bitCount returns the bit count of the bitmap with its root at pgno,
+// including changes made by the transaction. Returns false if the count is
+// not known without a scan.
+func (tx *Tx) bitCount(root uint32) (uint64, bool, error) {
+	ch := tx.counts[root]
+	if ch.reset {
+		return uint64(ch.delta), true, nil
+	}
+
+	n, ok, err := tx.storedCount(root)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return uint64(int64(n) + ch.delta), true, nil
+}
+
+// writeCounts stores the counts of all bitmaps changed by the transaction.
+// Bitmaps with no recorded count are scanned. It must be called before the
+// table pages are sealed.
+func (tx *Tx) writeCounts() error {
+	roots := make([]uint32, 0, len(tx.counts))
+	for root := range tx.counts {
+		roots = append(roots, root)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+
+	for _, root := range roots {
+		// Pages past the end of the table are always counted by a scan.
+		if dirIndex, _, _ := countTable.index(root); dirIndex >= countTable.dirN {
+			continue
+		}
+
+		if tx.counts[root].deleted {
+			// Avoid dirtying table pages if there is nothing to clear.
+			if entry, err := tx.tableEntry(&countTable, root); err != nil {
+				return err
+			} else if entry == nil || binary.BigEndian.Uint64(entry) == 0 {
+				continue
+			}
+			entry, err := tx.writableTableEntry(&countTable, root)
+			if err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint64(entry, 0)
+			continue
+		}
+
+		n, ok, err := tx.bitCount(root)
+		if err != nil {
+			return err
+		} else if !ok {
+			if n, err = tx.scanCount(root); err != nil {
+				return err
+			}
+		}
+
+		entry, err := tx.writableTableEntry(&countTable, root)
+		if err != nil {
+			return err
+		}
+		writeCountEntry(entry, n)
+	}
+	return nil
+}
+
+// scanCount counts the bits of the bitmap with its root at pgno by reading
+// every leaf cell.
+func (tx *Tx) scanCount(root uint32) (uint64, error) {
+	c := tx.db.getCursor(tx)
+	defer c.Close()
+	c.stack.top = 0
+	c.stack.elems[0] = stackElem{pgno: root}
+	return c.scanCount()
+}
+
+// checkCounts verifies the recorded count of every bitmap against a scan.
+func (tx *Tx) checkCounts() error {
+	records, err := tx.RootRecords()
+	if err != nil {
+		return err
+	}
+
+	var errorList ErrorList
+	for itr := records.Iterator(); !itr.Done(); {
+		name, root, _ := itr.Next()
+		n, ok, err := tx.bitCount(root)
+		if err != nil {
+			errorList.Append(err)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		if want, err := tx.scanCount(root); err != nil {
+			errorList.Append(err)
+		} else if n != want {
+			errorList.Append(fmt.Errorf("bitmap %q: stored count %d does not match count %d", name, n, want))
+		}
+	}
+	return errorList.Err()
+}
+
+func cloneCounts(m map[uint32]countChange) map[uint32]countChange {
+	if m == nil {
+		return nil
+	}
+	other := make(map[uint32]countChange, len(m))
+	for k, v := range m {
+		other[k] = v
+	}
+	return other
+}
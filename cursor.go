@@ -28,7 +28,8 @@ const (
 // be sure to nil out the tx, or it will hold a reference to it.
 type Cursor struct {
 	tx       *Tx
-	buffered bool // if true, Next() and Prev() do not move the cursor position
+	name     string // bitmap name, used for error reporting
+	buffered bool   // if true, Next() and Prev() do not move the cursor position
 
 	// buffers
 	array     [ArrayMaxSize + 1]uint16
@@ -141,7 +142,7 @@ func (c *Cursor) Add(v uint64) (changed bool, err error) {
 
 	// If the container exists and bit is not set then update the page.
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -174,7 +175,7 @@ func (c *Cursor) Add(v uint64) (changed bool, err error) {
 		return false, nil
 	case ContainerTypeBitmapPtr:
 		// Exit if bit set in bitmap container.
-		pgno, bm, err := c.tx.leafCellBitmap(toPgno(cell.Data))
+		pgno, bm, err := c.leafCellBitmap(toPgno(cell.Data))
 
 		if err != nil {
 			return false, errors.Wrap(err, "cursor.Add")
@@ -213,7 +214,7 @@ func (c *Cursor) Remove(v uint64) (changed bool, err error) {
 
 	// If the container exists and bit is not set then update the page.
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -270,7 +271,7 @@ func (c *Cursor) Remove(v uint64) (changed bool, err error) {
 		return true, c.putLeafCell(leafCell{Key: cell.Key, Type: ContainerTypeRLE, ElemN: len(runs), BitN: cell.BitN - 1, Data: fromInterval16(runs)})
 
 	case ContainerTypeBitmapPtr:
-		pgno, bm, err := c.tx.leafCellBitmap(toPgno(cell.Data))
+		pgno, bm, err := c.leafCellBitmap(toPgno(cell.Data))
 		if err != nil {
 			return false, errors.Wrap(err, "cursor.add")
 		}
@@ -326,7 +327,7 @@ func (c *Cursor) Contains(v uint64) (exists bool, err error) {
 
 	// If the container exists then check for low bits existence.
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -347,7 +348,7 @@ func (c *Cursor) Contains(v uint64) (exists bool, err error) {
 		}
 		return false, nil
 	case ContainerTypeBitmapPtr:
-		_, a, err := c.tx.leafCellBitmap(toPgno(cell.Data))
+		_, a, err := c.leafCellBitmap(toPgno(cell.Data))
 		if err != nil {
 			return false, errors.Wrap(err, "cursor.Contains")
 		}
@@ -382,8 +383,11 @@ func toPgno(val []byte) uint32 {
 // root page splits, a new branch page is created but retains the original root
 // page number so that the root records do not need to be updated.
 func (c *Cursor) putLeafCell(in leafCell) (err error) {
+	c.tx.recordChange(c, in.Key)
+	c.markBranches()
+
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, isHeap, err := c.tx.readPage(elem.pgno) // the last read leaf page
+	leafPage, isHeap, err := c.readPage(elem.pgno) // the last read leaf page
 	if err != nil {
 		return err
 	}
@@ -392,6 +396,11 @@ func (c *Cursor) putLeafCell(in leafCell) (err error) {
 	// Determine if the insert/update will overflow the page.
 	// If it doesn't then we can do an optimized write where we don't deserialize.
 	isInsert := elem.index >= cellN || pageKeyAt(leafPage, elem.index) != in.Key
+	if isInsert {
+		c.tx.adjustCount(c, in.BitN)
+	} else {
+		c.tx.adjustCount(c, in.BitN-readLeafCell(leafPage, elem.index).BitN)
+	}
 	newEstPageSize := leafPageSize(leafPage)
 	if isInsert {
 		newEstPageSize += in.Size() + leafCellIndexElemSize
@@ -539,7 +548,7 @@ func (c *Cursor) putLeafCell(in leafCell) (err error) {
 
 	// Free the source page once we've finished with it if it is on heap.
 	if isHeap {
-		freePage(leafPage)
+		c.tx.freeHeapPage(leafPage)
 	}
 
 	// TODO(BBJ): Update page in buffer & cursor stack.
@@ -564,7 +573,7 @@ func (c *Cursor) putLeafCell(in leafCell) (err error) {
 // It works by shifting bytes around instead of deserializing. This must not overflow.
 func (c *Cursor) putLeafCellFast(in leafCell, isInsert bool) (err error) {
 	elem := &c.stack.elems[c.stack.top]
-	src, isHeap, err := c.tx.readPage(elem.pgno)
+	src, isHeap, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
@@ -631,24 +640,42 @@ func (c *Cursor) putLeafCellFast(in leafCell, isInsert bool) (err error) {
 
 	// Free page if on heap.
 	if isHeap {
-		freePage(src)
+		c.tx.freeHeapPage(src)
 	}
 	return nil
 }
 
+// markBranches records the branch pages above the current leaf so their
+// versions are updated with it. A branch page is only rewritten when its cells
+// change but its version covers every page below it.
+func (c *Cursor) markBranches() {
+	if !c.tx.versionsEnabled() {
+		return
+	} else if c.tx.changedBranches == nil {
+		c.tx.changedBranches = make(map[uint32]struct{})
+	}
+	for i := 0; i < c.stack.top; i++ {
+		c.tx.changedBranches[c.stack.elems[i].pgno] = struct{}{}
+	}
+}
+
 // deleteLeafCell removes a cell from the currently positioned page & index.
 // If the removal causes the leaf page to have no more elements then its entry
 // is removed from the parent. If the removal changes the first entry in the
 // leaf page then the entry will be updated in the parent branch page.
-func (c *Cursor) deleteLeafCell(_ uint64) (err error) {
+func (c *Cursor) deleteLeafCell(key uint64) (err error) {
+	c.tx.recordChange(c, key)
+	c.markBranches()
+
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
 	cells := readLeafCells(leafPage, c.leafCells[:])
 	oldPageKey := cells[0].Key
 	cell := readLeafCell(leafPage, elem.index)
+	c.tx.adjustCount(c, -cell.BitN)
 
 	if cell.Type == ContainerTypeBitmapPtr {
 		if err := c.tx.freePgno(toPgno(cell.Data)); err != nil {
@@ -698,7 +725,7 @@ func (c *Cursor) putBranchCells(stackIndex int, newCells []branchCell) (err erro
 	elem := &c.stack.elems[stackIndex]
 
 	// Read branch page from disk. The current buffer is the leaf page.
-	page, _, err := c.tx.readPage(elem.pgno)
+	page, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
@@ -781,7 +808,7 @@ func (c *Cursor) updateBranchCell(stackIndex int, newKey uint64) (err error) {
 	elem := &c.stack.elems[stackIndex]
 
 	// Read branch page from disk. The current buffer is the leaf page.
-	page, _, err := c.tx.readPage(elem.pgno)
+	page, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
@@ -820,7 +847,7 @@ func (c *Cursor) deleteBranchCell(stackIndex int, _ uint64) (err error) {
 	elem := &c.stack.elems[stackIndex]
 
 	// Read branch page from disk. The current buffer is the leaf page.
-	page, _, err := c.tx.readPage(elem.pgno)
+	page, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
@@ -853,7 +880,7 @@ func (c *Cursor) deleteBranchCell(stackIndex int, _ uint64) (err error) {
 
 	// If the root only has one node, replace it with its child.
 	if stackIndex == 0 && len(cells) == 1 {
-		target, _, err := c.tx.readPage(cells[0].ChildPgno)
+		target, _, err := c.readPage(cells[0].ChildPgno)
 		if err != nil {
 			return err
 		}
@@ -985,7 +1012,7 @@ func (c *Cursor) First() error {
 	for c.stack.top = 0; ; c.stack.top++ {
 		elem := &c.stack.elems[c.stack.top]
 
-		buf, _, err := c.tx.readPage(elem.pgno)
+		buf, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return err
 		}
@@ -1026,7 +1053,7 @@ func (c *Cursor) Last() error {
 	for c.stack.top = 0; ; c.stack.top++ {
 		elem := &c.stack.elems[c.stack.top]
 
-		buf, _, err := c.tx.readPage(elem.pgno)
+		buf, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return err
 		}
@@ -1064,7 +1091,7 @@ func (c *Cursor) Seek(key uint64) (exact bool, err error) {
 		elem := &c.stack.elems[c.stack.top]
 		assert(elem.pgno != 0) // cursor should never point to page zero (meta)
 
-		buf, _, err := c.tx.readPage(elem.pgno)
+		buf, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return false, err
 		}
@@ -1117,7 +1144,7 @@ func (c *Cursor) Seek(key uint64) (exact bool, err error) {
 // Next moves to the next element of the btree. Returns EOF if no more elements exist.
 func (c *Cursor) Next() error {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return err
 	}
@@ -1169,17 +1196,20 @@ func (c *Cursor) Prev() error {
 		return io.EOF
 	}
 
-	// Traverse back down the stack to find the first element in each page.
-	for ; ; c.stack.top++ {
+	// Traverse back down the stack to find the last element in each page.
+	for top := c.stack.top; ; c.stack.top++ {
 		elem := &c.stack.elems[c.stack.top]
 
-		buf, _, err := c.tx.readPage(elem.pgno)
+		buf, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return err
 		}
 
 		switch typ := readFlags(buf); typ {
 		case PageTypeBranch:
+			if c.stack.top > top {
+				elem.index = readCellN(buf) - 1
+			}
 			cell := readBranchCell(buf, elem.index)
 
 			c.stack.elems[c.stack.top+1] = stackElem{
@@ -1199,7 +1229,7 @@ func (c *Cursor) Prev() error {
 // Key returns the key for the container the cursor is currently pointing to.
 func (c *Cursor) Key() uint64 {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, _ := c.tx.readPage(elem.pgno)
+	leafPage, _, _ := c.readPage(elem.pgno)
 	if readCellN(leafPage[:]) == 0 {
 		return 0
 	}
@@ -1209,7 +1239,7 @@ func (c *Cursor) Key() uint64 {
 // Values returns the values for the container the cursor is currently pointing to.
 func (c *Cursor) Values() []uint16 {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, _ := c.tx.readPage(elem.pgno)
+	leafPage, _, _ := c.readPage(elem.pgno)
 	if readCellN(leafPage[:]) == 0 {
 		return nil
 	}
@@ -1258,7 +1288,7 @@ var _ = (&stackElem{}).equal
 func (c *Cursor) goNextPage() error {
 	for c.stack.top--; c.stack.top >= 0; c.stack.top-- {
 		elem := &c.stack.elems[c.stack.top]
-		if buf, _, err := c.tx.readPage(elem.pgno); err != nil {
+		if buf, _, err := c.readPage(elem.pgno); err != nil {
 			return err
 		} else if n := readCellN(buf); elem.index+1 < n {
 			elem.index++
@@ -1275,7 +1305,7 @@ func (c *Cursor) goNextPage() error {
 	// Traverse back down the stack to find the first element in each page.
 	for ; ; c.stack.top++ {
 		elem := &c.stack.elems[c.stack.top]
-		buf, _, err := c.tx.readPage(elem.pgno)
+		buf, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return err
 		}
@@ -1342,7 +1372,7 @@ func ConvertToLeafArgs(key uint64, c *roaring.Container) (result leafCell) {
 
 func (c *Cursor) merge(key uint64, data *roaring.Container) (bool, error) {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -1354,7 +1384,7 @@ func (c *Cursor) merge(key uint64, data *roaring.Container) (bool, error) {
 		d := toArray16(cell.Data)
 		container = roaring.NewContainerArray(d)
 	case ContainerTypeBitmapPtr:
-		_, d, err := c.tx.leafCellBitmap(toPgno(cell.Data))
+		_, d, err := c.leafCellBitmap(toPgno(cell.Data))
 		if err != nil {
 			return false, errors.Wrap(err, "cursor.merge")
 		}
@@ -1431,7 +1461,7 @@ func (c *Cursor) RemoveRoaring(bm *roaring.Bitmap) (changed bool, err error) {
 
 func (c *Cursor) difference(key uint64, data *roaring.Container) (bool, error) {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -1443,7 +1473,7 @@ func (c *Cursor) difference(key uint64, data *roaring.Container) (bool, error) {
 		d := toArray16(cell.Data)
 		container = roaring.NewContainerArray(d)
 	case ContainerTypeBitmapPtr:
-		_, d, err := c.tx.leafCellBitmap(toPgno(cell.Data))
+		_, d, err := c.leafCellBitmap(toPgno(cell.Data))
 		if err != nil {
 			return false, errors.Wrap(err, "cursor.difference")
 		}
@@ -1481,6 +1511,27 @@ func (c *Cursor) Close() {
 // a cursor, such as a Db's freelistCursor.
 func (c *Cursor) unpooledClose() {
 	c.tx = nil
+	c.name = ""
+}
+
+// readPage reads a page from the transaction and attaches the bitmap name
+// to any checksum error.
+func (c *Cursor) readPage(pgno uint32) ([]byte, bool, error) {
+	page, isHeap, err := c.tx.readPage(pgno)
+	if err != nil {
+		return nil, false, withBitmapName(err, c.name)
+	}
+	return page, isHeap, nil
+}
+
+// leafCellBitmap reads a bitmap page and attaches the bitmap name to any
+// checksum error.
+func (c *Cursor) leafCellBitmap(pgno uint32) (uint32, []uint64, error) {
+	pgno, bm, err := c.tx.leafCellBitmap(pgno)
+	if err != nil {
+		return 0, nil, withBitmapName(err, c.name)
+	}
+	return pgno, bm, nil
 }
 
 func keysFromParents(parents []branchCell) (ckeys []int) {
@@ -1231,3 +1231,243 @@ func TestCursor_PutContainer(t *testing.T) {
 		}
 	})
 }
+
+func TestCursor_Reverse(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	// Use enough containers for a tree with two levels of branch pages and
+	// leave a gap in the keys at 1000.
+	const n = 200000
+	bm := roaring.NewBitmap()
+	var keys []uint64
+	for key := uint64(0); key < n; key++ {
+		if key != 1000 {
+			bm.DirectAdd(key<<16 | key%7)
+			keys = append(keys, key)
+		}
+	}
+	itr, _ := bm.Containers.Iterator(0)
+	if err := tx.BulkLoad("x", itr); err != nil {
+		t.Fatal(err)
+	} else if depth, err := tx.Depth("x"); err != nil || depth != 3 {
+		t.Fatalf("Depth()=%d, %v", depth, err)
+	}
+
+	// reverse returns keys in descending order from the largest key <= key.
+	reverse := func(key uint64) []uint64 {
+		var a []uint64
+		for i := len(keys) - 1; i >= 0; i-- {
+			if keys[i] <= key {
+				a = append(a, keys[i])
+			}
+		}
+		return a
+	}
+
+	t.Run("IteratorReverse", func(t *testing.T) {
+		c, err := tx.Cursor("x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		itr := c.IteratorReverse()
+		defer itr.Close()
+
+		var a []uint64
+		for itr.Next() {
+			key, ct := itr.Value()
+			if !ct.Contains(uint16(key % 7)) {
+				t.Fatalf("unexpected container for key %d", key)
+			}
+			a = append(a, key)
+		}
+		if !reflect.DeepEqual(a, reverse(n)) {
+			t.Fatalf("unexpected keys: n=%d", len(a))
+		}
+	})
+
+	t.Run("ContainerIteratorReverse", func(t *testing.T) {
+		for _, tt := range []struct {
+			key   uint64
+			found bool
+		}{
+			{key: 5000, found: true},
+			{key: 1000, found: false},
+			{key: 1 << 40, found: false},
+			{key: 0, found: true},
+		} {
+			itr, found, err := tx.ContainerIteratorReverse("x", tt.key)
+			if err != nil {
+				t.Fatal(err)
+			} else if found != tt.found {
+				t.Fatalf("key %d: found=%v", tt.key, found)
+			}
+
+			var a []uint64
+			for itr.Next() {
+				key, _ := itr.Value()
+				a = append(a, key)
+			}
+			itr.Close()
+			if !reflect.DeepEqual(a, reverse(tt.key)) {
+				t.Fatalf("key %d: unexpected keys: n=%d", tt.key, len(a))
+			}
+		}
+
+		if itr, found, err := tx.ContainerIteratorReverse("no such bitmap", 10); err != nil || found || itr.Next() {
+			t.Fatalf("unexpected iterator: found=%v, err=%v", found, err)
+		}
+	})
+
+	t.Run("ApplyFilterReverse", func(t *testing.T) {
+		filter := &latestFilter{limit: 5}
+		if err := tx.ApplyFilterReverse("x", 1003, filter); err != nil {
+			t.Fatal(err)
+		} else if want := []uint64{1003, 1002, 1001, 999, 998}; !reflect.DeepEqual(filter.keys, want) {
+			t.Fatalf("keys=%v, want %v", filter.keys, want)
+		}
+	})
+
+	t.Run("RowsReverse", func(t *testing.T) {
+		c, err := tx.Cursor("x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		all, err := c.Rows()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows, err := c.RowsReverse(0); err != nil {
+			t.Fatal(err)
+		} else if len(rows) != len(all) || rows[0] != all[len(all)-1] || rows[len(rows)-1] != 0 {
+			t.Fatalf("unexpected rows: n=%d", len(rows))
+		}
+		if rows, err := c.RowsReverse(3); err != nil {
+			t.Fatal(err)
+		} else if want := []uint64{(n - 1) >> 4, (n-1)>>4 - 1, (n-1)>>4 - 2}; !reflect.DeepEqual(rows, want) {
+			t.Fatalf("rows=%v, want %v", rows, want)
+		}
+	})
+}
+
+// latestFilter records the keys of the first limit containers it considers
+// and then ends the scan.
+type latestFilter struct {
+	limit int
+	keys  []uint64
+}
+
+func (f *latestFilter) ConsiderKey(key roaring.FilterKey, n int32) roaring.FilterResult {
+	return key.NeedData()
+}
+
+func (f *latestFilter) ConsiderData(key roaring.FilterKey, data *roaring.Container) roaring.FilterResult {
+	if f.keys = append(f.keys, uint64(key)); len(f.keys) == f.limit {
+		return key.RejectUntil(^roaring.FilterKey(0))
+	}
+	return key.MatchOne()
+}
+
+func TestIntersectUnionCursors(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	// A selective bitmap, a dense one spanning several branch pages and one
+	// in between.
+	selective, dense, medium := roaring.NewBitmap(), roaring.NewBitmap(), roaring.NewBitmap()
+	for i := 0; i < 50; i++ {
+		selective.DirectAdd(uint64(rand.Intn(300000)) << 16)
+	}
+	for key := uint64(0); key < 200000; key++ {
+		dense.DirectAdd(key<<16 | uint64(rand.Intn(2)))
+		if key%3 == 0 {
+			medium.DirectAdd(key<<16 | uint64(rand.Intn(2)))
+		}
+	}
+	for name, bm := range map[string]*roaring.Bitmap{"selective": selective, "dense": dense, "medium": medium} {
+		itr, _ := bm.Containers.Iterator(0)
+		if err := tx.BulkLoad(name, itr); err != nil {
+			t.Fatal(err)
+		}
+		itr.Close()
+	}
+
+	cursors := func(t *testing.T, names ...string) []*rbf.Cursor {
+		t.Helper()
+		var a []*rbf.Cursor
+		for _, name := range names {
+			c, err := tx.Cursor(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(c.Close)
+			a = append(a, c)
+		}
+		return a
+	}
+
+	collect := func(t *testing.T, itr roaring.ContainerIterator) *roaring.Bitmap {
+		t.Helper()
+		defer itr.Close()
+		bm := roaring.NewBitmap()
+		for itr.Next() {
+			key, ct := itr.Value()
+			if ct.N() == 0 {
+				t.Fatalf("empty container for key %d", key)
+			}
+			bm.Containers.Put(key, ct.Clone())
+		}
+		return bm
+	}
+
+	t.Run("Intersect", func(t *testing.T) {
+		cs := cursors(t, "dense", "selective", "medium")
+		itr, err := rbf.IntersectCursors(cs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := dense.Intersect(selective).Intersect(medium)
+		if got := collect(t, itr); !reflect.DeepEqual(got.Slice(), want.Slice()) {
+			t.Fatalf("count=%d, want %d", got.Count(), want.Count())
+		} else if want.Count() == 0 {
+			t.Fatal("expected a non-empty intersection")
+		}
+
+		// Cursors are left open for reuse.
+		if err := cs[0].First(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Union", func(t *testing.T) {
+		itr, err := rbf.UnionCursors(cursors(t, "selective", "medium")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := selective.Union(medium)
+		if got := collect(t, itr); !reflect.DeepEqual(got.Slice(), want.Slice()) {
+			t.Fatalf("count=%d, want %d", got.Count(), want.Count())
+		}
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		cs := append(cursors(t, "selective"), nil)
+		if itr, err := rbf.IntersectCursors(cs...); err != nil {
+			t.Fatal(err)
+		} else if got := collect(t, itr); got.Count() != 0 {
+			t.Fatalf("count=%d, want 0", got.Count())
+		}
+		if itr, err := rbf.UnionCursors(cs...); err != nil {
+			t.Fatal(err)
+		} else if got := collect(t, itr); !reflect.DeepEqual(got.Slice(), selective.Slice()) {
+			t.Fatalf("count=%d, want %d", got.Count(), selective.Count())
+		}
+	})
+}
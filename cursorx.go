@@ -35,6 +35,16 @@ func (c *Cursor) ApplyFilter(key uint64, filter roaring.BitmapFilter) (err error
 }
 
 func (c *Cursor) Count() (uint64, error) {
+	if c != &c.tx.db.freelistCursor {
+		if n, ok, err := c.tx.bitCount(c.stack.elems[0].pgno); err != nil || ok {
+			return n, err
+		}
+	}
+	return c.scanCount()
+}
+
+// scanCount counts the bits in every container.
+func (c *Cursor) scanCount() (uint64, error) {
 	if err := c.First(); err == io.EOF {
 		return 0, nil
 	} else if err != nil {
@@ -50,7 +60,7 @@ func (c *Cursor) Count() (uint64, error) {
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return 0, err
 		}
@@ -68,7 +78,7 @@ func (c *Cursor) Max() (uint64, error) {
 		return 0, err
 	}
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return 0, err
 	}
@@ -84,7 +94,7 @@ func (c *Cursor) Min() (uint64, bool, error) {
 	}
 
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return 0, false, err
 	}
@@ -119,7 +129,7 @@ func (c *Cursor) CountRange(start, end uint64) (uint64, error) {
 		}
 
 		elem := &csr.stack.elems[csr.stack.top]
-		leafPage, _, err := csr.tx.readPage(elem.pgno)
+		leafPage, _, err := csr.readPage(elem.pgno)
 		if err != nil {
 			return 0, err
 		}
@@ -184,7 +194,7 @@ func (c *Cursor) OffsetRange(offset, start, endx uint64) (*roaring.Bitmap, error
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return nil, err
 		}
@@ -220,7 +230,7 @@ func (c *Cursor) Rows() ([]uint64, error) {
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return nil, err
 		}
@@ -237,12 +247,7 @@ func (c *Cursor) Rows() ([]uint64, error) {
 }
 
 func (tx *Tx) FieldViews() []string {
-	records, _ := tx.RootRecords()
-	a := make([]string, 0, records.Len())
-	for itr := records.Iterator(); !itr.Done(); {
-		name, _, _ := itr.Next()
-		a = append(a, name)
-	}
+	a, _ := tx.BitmapNames()
 	return a
 }
 
@@ -257,7 +262,7 @@ func (c *Cursor) DumpKeys() {
 			break
 		}
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return
 		}
@@ -300,7 +305,7 @@ func (c *Cursor) Row(shard, rowID uint64) (*roaring.Bitmap, error) {
 	}
 	if !ok {
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return nil, err
 		}
@@ -321,7 +326,7 @@ func (c *Cursor) Row(shard, rowID uint64) (*roaring.Bitmap, error) {
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return nil, err
 		}
@@ -338,7 +343,7 @@ func (c *Cursor) Row(shard, rowID uint64) (*roaring.Bitmap, error) {
 // sometimes the cursor needs to be positions prior to this call with First/Last etc.
 func (c *Cursor) CurrentPageType() ContainerType {
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, _ := c.tx.readPage(elem.pgno)
+	leafPage, _, _ := c.readPage(elem.pgno)
 	cell := readLeafCell(leafPage, elem.index)
 	return cell.Type
 }
@@ -3,6 +3,8 @@
 package rbf
 
 import (
+	"context"
+	"crypto/cipher"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,17 +12,49 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
-	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
 
-	"github.com/benbjohnson/immutable"
 	rbfcfg "github.com/gernest/rbf/cfg"
-	"github.com/gernest/rbf/syswrap"
 )
 
-var ErrClosed = errors.New("rbf: database closed")
+var (
+	ErrClosed = errors.New("rbf: database closed")
+
+	// ErrDatabaseLocked is returned by DB.Open when another writer holds the
+	// database's lock, by DB.Vacuum and DB.Checkpoint when read-only databases
+	// are reading, and to read-only databases when a checkpoint or vacuum does
+	// not finish within the readers lock timeout.
+	ErrDatabaseLocked = errors.New("rbf: database locked by another process")
+
+	// ErrReadOnly is returned when attempting to write to a database opened
+	// with Config.ReadOnly.
+	ErrReadOnly = errors.New("rbf: database opened read-only")
+
+	// ErrWriterBusy is returned by TryBegin when a writable transaction
+	// cannot be started without waiting.
+	ErrWriterBusy = errors.New("rbf: writer busy")
+
+	// ErrMaxSize is returned when a write would grow the data or WAL file past
+	// Config.MaxSize or Config.MaxWALSize.
+	ErrMaxSize = errors.New("rbf: database exceeds max size")
+)
+
+const (
+	// readersLockTimeout is how long read-only databases wait for a
+	// checkpoint or vacuum which holds the readers lock.
+	readersLockTimeout = 30 * time.Second
+
+	// readersLockRetryInterval is how often read-only databases try to
+	// obtain the readers lock while waiting.
+	readersLockRetryInterval = 10 * time.Millisecond
+
+	// checkpointRetryInterval is how often a halted writer retries a
+	// checkpoint which read-only databases are holding back.
+	checkpointRetryInterval = 10 * time.Millisecond
+)
 
 // shared cursor pool across all DB instances.
 // Cursors are returned on Cursor.Close().
@@ -33,43 +67,106 @@ var cursorSyncPool = &sync.Pool{
 // txWaiter is a representation of "i need to wait for txs to complete".
 // it is created with a function, and will run that function, with the db
 // lock held, at some point after every Tx that was open when it was created
-// has closed. WARNING: A txWaiter may hold db.rwmu.
+// has closed.
 type txWaiter struct {
 	ready     chan struct{}
 	waitingOn map[*Tx]struct{}
 	callback  func()
 }
 
+// writerLock is a mutex which can also be acquired without blocking or
+// until a context is done. It must be created with newWriterLock.
+type writerLock chan struct{}
+
+func newWriterLock() writerLock { return make(writerLock, 1) }
+
+func (l writerLock) Lock() { l <- struct{}{} }
+
+func (l writerLock) Unlock() {
+	select {
+	case <-l:
+	default:
+		panic("rbf: unlock of unlocked writer lock")
+	}
+}
+
+// TryLock acquires the lock if it is available and reports whether it did.
+func (l writerLock) TryLock() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// LockContext acquires the lock or returns the context's error if it is
+// done first.
+func (l writerLock) LockContext(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // DB options like 	MaxSize, FsyncEnabled, DoAllocZero
 // can be set before calling DB.Open().
 type DB struct {
 	cfg rbfcfg.Config
 
-	data        []byte                               // database mmap
-	file        *os.File                             // database file descriptor
-	rootRecords *immutable.SortedMap[string, uint32] // cached root records
-	pageMap     *PageMap                             // pgno-to-WALID mapping
-	txs         map[*Tx]struct{}                     // active transactions
-	opened      bool                                 // true if open
-	logger      *slog.Logger                         // for diagnostics from async things
+	data    File             // database file
+	pageMap *PageMap         // pgno-to-WALID mapping
+	txs     map[*Tx]struct{} // active transactions
+	opened  bool             // true if open
+	logger  *slog.Logger     // for diagnostics from async things
+	aead    cipher.AEAD      // page cipher, if encrypted
+
+	frameHints map[int][]uint32 // frame pages with free slots, by slot count
+
+	wal       *segmentedWAL // wal segment files
+	walPageN  int           // wal page count, including checkpointed pages
+	walStart  int           // position of the first page not yet checkpointed
+	baseWALID int64         // WAL ID of first page
+
+	walRetainStart int                        // first position kept after checkpoints
+	walRetentions  map[*WALRetention]struct{} // followers holding back segment removal
 
-	wal       []byte   // wal mmap
-	walFile   *os.File // wal file descriptor
-	walPageN  int      // wal page count
-	baseWALID int64    // WAL ID of first page
+	checkpointWALID int64           // last WAL ID copied to the data file
+	checkpointRun   *checkpointRun  // running checkpoint, if any
+	checkpointStats CheckpointStats // stats of the last checkpoint
+
+	stats Stats // cumulative statistics
+
+	// Metrics receives metrics as they are recorded, if set. It may be set
+	// before calling Open.
+	Metrics MetricsSink
 
 	mu       sync.RWMutex // general mutex
-	rwmu     sync.Mutex   // mutex for restricting single writer
+	rwmu     writerLock   // mutex for restricting single writer
 	haltCond *sync.Cond   // condition for resuming txs after checkpoint
 
 	txWaiters []*txWaiter // things waiting for Txs to close
 
 	isDead error // this database died in an unrecoverable way, error out opens
 
+	unlockFile    func() error // releases the writer or read-only lock
+	unlockReaders func() error // releases the readers lock held by the writer
+	readersLockN  int          // number of holders of unlockReaders
+
+	initWALID int64 // starting WAL ID when a new file is initialized
+
 	// Path represents the path to the database file.
 	Path string
 
+	// VFS is the storage backend for the data & WAL files. Defaults to
+	// OSVFS and may be replaced before calling Open.
+	VFS VFS
+
 	freelistCursor Cursor // cursor to reuse for freelist operations
+
+	subscriptions []*Subscription // commit event subscribers
 }
 
 // NewDB returns a new instance of DB.
@@ -81,8 +178,10 @@ func NewDB(path string, cfg *rbfcfg.Config) *DB {
 	db := &DB{
 		cfg:     *cfg,
 		txs:     make(map[*Tx]struct{}),
+		rwmu:    newWriterLock(),
 		pageMap: NewPageMap(),
 		Path:    path,
+		VFS:     OSVFS{},
 		logger:  cfg.Logger,
 	}
 	if db.logger == nil {
@@ -99,7 +198,25 @@ func (db *DB) DataPath() string {
 	return filepath.Join(db.Path, "data")
 }
 
-// WALPath returns the path to the WAL file.
+// lockPath returns the path of the lock file held exclusively by the writer
+// for as long as the database is open.
+func (db *DB) lockPath() string {
+	return filepath.Join(db.Path, "lock")
+}
+
+// readersLockPath returns the path of the lock file shared by read-only
+// databases while they have transactions open. The writer only holds it,
+// without waiting, while it changes the data file or removes WAL segments so
+// open read transactions keep a consistent snapshot. Separate lock files are
+// used rather than locking the data & WAL files themselves as vacuum replaces
+// the data file and checkpoints remove WAL segments, which would drop locks
+// held on them.
+func (db *DB) readersLockPath() string {
+	return filepath.Join(db.Path, "readers")
+}
+
+// WALPath returns the path prefix of the WAL segment files. Each segment is
+// named by appending the WAL ID before its first page, in hex.
 func (db *DB) WALPath() string {
 	return filepath.Join(db.Path, "wal")
 }
@@ -113,53 +230,270 @@ func (db *DB) TxN() int {
 
 // Open opens a database with the file specified in Path.
 // Creates a new file if one does not already exist.
+//
+// Writers hold an exclusive advisory lock for as long as the database is open
+// and ErrDatabaseLocked is returned if another writer holds it. Databases
+// opened with Config.ReadOnly take a separate shared lock while they have
+// transactions open so any number of readers may attach, including while a
+// writer is open. Each read transaction sees the database as of the last
+// commit before it began. The writer does not checkpoint while read
+// transactions are open so the files they read are only appended to; writers
+// halted on the WAL size wait for them to close. Read-only databases wait up
+// to 30 seconds for a checkpoint to finish before returning ErrDatabaseLocked.
 func (db *DB) Open() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	return db.open()
+}
 
-	if err := os.MkdirAll(db.Path, 0o755); err != nil {
+// open opens the data & WAL files. Must be called while holding db.mu.
+func (db *DB) open() (err error) {
+	// Release file handles & locks if we fail part way through.
+	defer func() {
+		if err != nil {
+			db.opened = false
+			if e := db.closeHandles(); e != nil {
+				db.logger.Error("close after failed open", "err", e)
+			} else if e := db.unlock(); e != nil {
+				db.logger.Error("unlock after failed open", "err", e)
+			}
+		}
+	}()
+
+	if err := db.openKey(); err != nil {
 		return err
-	} else if db.file, err = os.OpenFile(db.DataPath(), os.O_WRONLY|os.O_CREATE, 0o600); err != nil {
-		return fmt.Errorf("open file: %w", err)
 	}
+	db.frameHints = nil
 
-	// Open read-only database mmap.
-	if f, err := os.OpenFile(db.DataPath(), os.O_RDONLY, 0o600); err != nil {
-		return fmt.Errorf("open mmap file: %w", err)
-	} else if db.data, err = syswrap.Mmap(int(f.Fd()), 0, int(db.cfg.MaxSize), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
-		f.Close()
-		return fmt.Errorf("open mmap file: %w", err)
-	} else if err := f.Close(); err != nil {
-		return fmt.Errorf("cannot close mmap file: %w", err)
+	if !db.cfg.ReadOnly {
+		if err := db.VFS.MkdirAll(db.Path); err != nil {
+			return err
+		}
 	}
-
-	// Initialize file if it is too small.
-	if fi, err := db.file.Stat(); err != nil {
-		return fmt.Errorf("stat: %w", err)
-	} else if fi.Size() < PageSize {
-		if err := db.init(); err != nil {
-			return fmt.Errorf("init: %w", err)
+	if db.cfg.ReadOnly {
+		if _, err := db.lockReadOnly(context.Background()); err != nil {
+			return err
 		}
+	} else if err := db.lock(); err != nil {
+		return err
+	}
+	if err := db.openData(); err != nil {
+		return err
 	}
-
-	// TODO(BBJ): Obtain advisory lock on file.
 
 	db.opened = true
 
 	// Open write-ahead log & checkpoint to the end since no transactions are open.
 	if err := db.openWAL(); err != nil {
 		return fmt.Errorf("wal open: %w", err)
+	} else if db.cfg.ReadOnly {
+		// We cannot checkpoint so serve WAL pages through the page map. The
+		// readers lock is only held again while transactions are open.
+		if err := db.loadWALPageMap(); err != nil {
+			return fmt.Errorf("wal page map: %w", err)
+		}
+		return db.unlock()
+	} else if run, err := db.checkpoint(); err != nil {
+		return fmt.Errorf("startup checkpoint: %w", err)
+	} else if err := db.waitCheckpoint(); err != nil {
+		return fmt.Errorf("startup checkpoint: %w", err)
+	} else if run == nil && db.walPageN > db.walStart {
+		// Readers are attached so serve WAL pages until they detach.
+		if err := db.loadWALPageMap(); err != nil {
+			return fmt.Errorf("wal page map: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// openData opens the data file, initializing it if it is new.
+func (db *DB) openData() (err error) {
+	if db.data, err = db.fs().OpenFile(db.DataPath(), db.cfg.ReadOnly, db.cfg.MaxSize); err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+
+	// Initialize file if it is too small.
+	if sz, err := db.data.Size(); err != nil {
+		return fmt.Errorf("stat: %w", err)
+	} else if sz < PageSize {
+		if db.cfg.ReadOnly {
+			return fmt.Errorf("init: %w", ErrReadOnly)
+		} else if err := db.init(); err != nil {
+			return fmt.Errorf("init: %w", err)
+		}
+	} else if db.aead == nil {
+		if page, err := db.readDBPage(0); err != nil {
+			return fmt.Errorf("read meta page: %w", err)
+		} else if isEncryptedFile(page) {
+			return ErrEncrypted
+		}
+	}
+	return nil
+}
+
+// lock obtains the writer lock, or the shared lock of a read-only database,
+// if it is not already held. Returns ErrDatabaseLocked without waiting if
+// the lock is held by another process.
+func (db *DB) lock() (err error) {
+	if db.unlockFile != nil {
+		return nil
+	}
+	if db.cfg.ReadOnly {
+		db.unlockFile, err = db.VFS.Lock(db.readersLockPath(), false, false)
 	} else {
-		// checkpoint wants to hold the rwmu lock.
-		db.rwmu.Lock()
-		if err := db.checkpoint(); err != nil {
-			return fmt.Errorf("startup checkpoint: %w", err)
+		db.unlockFile, err = db.VFS.Lock(db.lockPath(), true, false)
+	}
+	if err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	return nil
+}
+
+// unlock releases the lock obtained by lock.
+func (db *DB) unlock() error {
+	if db.unlockFile == nil {
+		return nil
+	}
+	unlock := db.unlockFile
+	db.unlockFile = nil
+	return unlock()
+}
+
+// lockReadOnly obtains the shared lock of a read-only database, retrying while
+// a checkpoint or vacuum holds it, for up to readersLockTimeout. Returns true
+// if the lock was obtained rather than already held. Must be called while
+// holding db.mu, which is released while waiting.
+func (db *DB) lockReadOnly(ctx context.Context) (bool, error) {
+	deadline := time.Now().Add(readersLockTimeout)
+	for db.unlockFile == nil {
+		if err := db.lock(); err == nil {
+			return true, nil
+		} else if !errors.Is(err, ErrDatabaseLocked) || time.Now().After(deadline) {
+			return false, err
+		}
+
+		db.mu.Unlock()
+		timer := time.NewTimer(readersLockRetryInterval)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		db.mu.Lock()
+
+		if err := ctx.Err(); err != nil {
+			return false, err
 		}
 	}
+	return false, nil
+}
 
+// refresh brings a read-only database up to the writer's last commit before
+// a transaction begins. The shared lock is held while transactions are open
+// so the data file and WAL segments stay in place. When it is newly obtained
+// the files are reopened as they may have been checkpointed or vacuumed since
+// it was last held. Otherwise only the pages appended to the WAL are read.
+// Must be called while holding db.mu.
+func (db *DB) refresh(ctx context.Context) (err error) {
+	locked, err := db.lockReadOnly(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && len(db.txs) == 0 {
+			if e := db.unlock(); e != nil {
+				db.logger.Error("unlock after failed refresh", "err", e)
+			}
+		}
+	}()
+
+	// The database may have closed while waiting for the lock.
+	if !db.opened {
+		return ErrClosed
+	} else if !locked {
+		return db.refreshWAL()
+	}
+
+	if err := db.closeHandles(); err != nil {
+		return err
+	} else if err := db.openData(); err != nil {
+		return err
+	} else if err := db.openWAL(); err != nil {
+		return fmt.Errorf("wal open: %w", err)
+	} else if err := db.loadWALPageMap(); err != nil {
+		return fmt.Errorf("wal page map: %w", err)
+	}
 	return nil
 }
 
+// refreshWAL reads the commits appended to the WAL since a read-only database
+// last read it. Must be called while holding db.mu and the readers lock.
+func (db *DB) refreshWAL() error {
+	releases, err := db.wal.refresh()
+	for _, release := range releases {
+		db.afterCurrentTx(func() {
+			if err := release(); err != nil {
+				db.logger.Error("release mapping", "err", err)
+			}
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("wal refresh: %w", err)
+	}
+
+	fileSize, err := db.wal.Size()
+	if err != nil {
+		return fmt.Errorf("wal stat: %w", err)
+	}
+	pageN, err := db.lastMetaPageN(int(fileSize / PageSize))
+	if err != nil {
+		return err
+	} else if pageN <= db.walPageN {
+		return nil
+	} else if db.walPageN == 0 {
+		db.walPageN = pageN
+		return db.loadWALPageMap()
+	}
+
+	// Open transactions keep the previous page map.
+	if err := db.scanWALPages(db.walPageN, pageN, func(pgno uint32, i int, _ []byte) {
+		db.pageMap = db.pageMap.Set(pgno, db.baseWALID+int64(i)+1)
+	}); err != nil {
+		return err
+	}
+	db.walPageN = pageN
+	return nil
+}
+
+// lockReaders obtains the readers lock exclusively without waiting, or adds a
+// holder if the writer already has it. Returns false if read-only databases
+// are attached. Must be called while holding db.mu.
+func (db *DB) lockReaders() (bool, error) {
+	if db.readersLockN == 0 {
+		unlock, err := db.VFS.Lock(db.readersLockPath(), true, false)
+		if errors.Is(err, ErrDatabaseLocked) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		db.unlockReaders = unlock
+	}
+	db.readersLockN++
+	return true, nil
+}
+
+// releaseReaders removes a holder of the readers lock and releases the lock
+// once there are none. Must be called while holding db.mu.
+func (db *DB) releaseReaders() error {
+	if db.readersLockN--; db.readersLockN > 0 {
+		return nil
+	}
+	unlock := db.unlockReaders
+	db.unlockReaders = nil
+	return unlock()
+}
+
 // Backup creates a snapshot of the database and writes it to w. To restore the
 // snapshot call Restore.
 func (db *DB) Backup(w io.Writer) error {
@@ -194,35 +528,72 @@ func Restore(r io.Reader, path string) error {
 }
 
 func (db *DB) openWAL() (err error) {
-	// Open WAL file writer.
-	if db.walFile, err = os.OpenFile(db.WALPath(), os.O_WRONLY|os.O_CREATE, 0o600); err != nil {
-		return fmt.Errorf("open wal file: %w", err)
+	// A checkpoint of an encrypted data file which was interrupted between
+	// writing a page & its record leaves the page undecryptable. The WAL
+	// still holds every page the checkpoint was copying, including the meta
+	// page, so the base WAL ID is taken from it and the pages are rewritten
+	// by the next checkpoint.
+	baseWALID, metaErr := db.dataWALID()
+	if metaErr != nil && !errors.Is(metaErr, ErrDecrypt) {
+		return metaErr
+	}
+
+	// Open WAL segments. A restored database may not have a WAL yet.
+	if db.wal, err = openSegmentedWAL(db.fs(), db.WALPath(), db.cfg.ReadOnly, db.cfg.WALSegmentSize); err != nil {
+		return fmt.Errorf("open wal: %w", err)
 	}
 
-	// Open read-only mmap.
-	if f, err := os.OpenFile(db.WALPath(), os.O_RDONLY, 0o600); err != nil {
-		return fmt.Errorf("open wal mmap file: %w", err)
-	} else if db.wal, err = syswrap.Mmap(int(f.Fd()), 0, int(db.cfg.MaxWALSize), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
-		f.Close()
-		return fmt.Errorf("map wal mmap file: %w", err)
-	} else if err := f.Close(); err != nil {
-		return fmt.Errorf("cannot close wal mmap file: %w", err)
+	// The first segment may start after the data file's WAL ID if removing
+	// segments after a checkpoint was interrupted.
+	if id, ok := db.wal.base(); ok {
+		baseWALID = id
+	} else if metaErr != nil {
+		return metaErr
 	}
 
 	// Determine the number of whole pages in the WAL.
-	var pageN int
-	var fileSize int64
-	if fi, err := db.walFile.Stat(); err != nil {
+	fileSize, err := db.wal.Size()
+	if err != nil {
 		return fmt.Errorf("wal stat: %w", err)
-	} else {
-		fileSize = fi.Size()
-		pageN = int(fileSize / PageSize)
+	}
+	pageN := int(fileSize / PageSize)
+
+	if pageN, err = db.lastMetaPageN(pageN); err != nil {
+		return err
 	}
 
-	// Read backwards through the WAL to find the last valid meta page.
+	// Nothing in the WAL is assumed to be in the data file as a previous
+	// checkpoint may have been interrupted.
+	db.walStart, db.walRetainStart, db.checkpointWALID = 0, 0, baseWALID
+
+	// Read-only databases leave any partial writes in place for the writer
+	// to clean up when it next opens the WAL.
+	if db.cfg.ReadOnly {
+		db.walPageN = pageN
+		db.baseWALID = baseWALID
+		return nil
+	}
+
+	if fileSize != int64(pageN*PageSize) {
+		if err := db.wal.Truncate(int64(pageN) * PageSize); err != nil {
+			return fmt.Errorf("wal truncate: %w", err)
+		}
+	}
+	db.walPageN = pageN
+	db.baseWALID = baseWALID
+
+	return nil
+}
+
+// lastMetaPageN returns the number of pages in the WAL up to and including the
+// last valid meta page within the first pageN pages. Pages of an encrypted WAL
+// which fail authentication are from a torn write.
+func (db *DB) lastMetaPageN(pageN int) (_ int, err error) {
 	for ; pageN > 0; pageN-- {
-		if page, err := db.readWALPageAt(pageN - 1); err != nil {
-			return err
+		if page, err := db.readWALPageAt(pageN - 1); errors.Is(err, ErrDecrypt) {
+			continue
+		} else if err != nil {
+			return 0, err
 		} else if IsMetaPage(page) {
 			// We now face a challenge. Probably this is a meta page.
 			// But consider a sequence of pages written which gets
@@ -235,7 +606,7 @@ func (db *DB) openWAL() (err error) {
 			// when no pages had changed.
 			if pageN > 1 {
 				if page, err = db.readWALPageAt(pageN - 2); err != nil {
-					return err
+					return 0, err
 				}
 				if IsBitmapHeader(page) {
 					// But wait!
@@ -250,25 +621,64 @@ func (db *DB) openWAL() (err error) {
 					// we might be seeing one.
 					pageN, err = db.methodicalWALPageN(pageN)
 					if err != nil {
-						return err
+						return 0, err
 					}
 				}
 			}
 			break
 		}
 	}
+	return pageN, nil
+}
 
-	if fileSize != int64(pageN*PageSize) {
-		if err := db.walFile.Truncate(int64(pageN) * PageSize); err != nil {
-			return fmt.Errorf("wal truncate: %w", err)
+// loadWALPageMap builds the page map from the pages currently in the WAL.
+// It is used when the WAL cannot be checkpointed on open, such as when the
+// database is read-only.
+func (db *DB) loadWALPageMap() error {
+	m, baseFound := NewPageMap(), false
+	if err := db.scanWALPages(0, db.walPageN, func(pgno uint32, i int, meta []byte) {
+		// The data file may already contain some of these pages if a previous
+		// checkpoint was interrupted, so we derive the base WAL ID from the
+		// first meta page rather than trusting the data file's meta page.
+		if meta != nil && !baseFound {
+			db.baseWALID, baseFound = readMetaWALID(meta)-int64(i)-1, true
 		}
+		m = m.Set(pgno, int64(i))
+	}); err != nil {
+		return err
 	}
-	if _, err := db.walFile.Seek(int64(pageN)*PageSize, io.SeekStart); err != nil {
-		return fmt.Errorf("wal seek: %w", err)
+
+	// Convert WAL positions into WAL IDs now that the base is known.
+	db.checkpointWALID = db.baseWALID
+	db.pageMap = NewPageMap()
+	itr := m.Iterator()
+	itr.First()
+	for k, v, ok := itr.Next(); ok; k, v, ok = itr.Next() {
+		db.pageMap = db.pageMap.Set(k, db.baseWALID+v+1)
 	}
-	db.walPageN = pageN
-	db.baseWALID = readMetaWALID(db.data)
+	return nil
+}
+
+// scanWALPages calls fn with the page number and WAL position of every page
+// from WAL position start up to end. Meta pages are reported as page zero
+// along with their contents.
+func (db *DB) scanWALPages(start, end int, fn func(pgno uint32, i int, meta []byte)) error {
+	for i := start; i < end; i++ {
+		page, err := db.readWALPageAt(i)
+		if err != nil {
+			return fmt.Errorf("reading WAL page %d: %w", i, err)
+		}
 
+		switch {
+		case IsMetaPage(page):
+			fn(0, i, page)
+		case IsBitmapHeader(page):
+			i++ // bitmaps in WAL are two pages
+			fn(readPageNo(page), i, nil)
+		default:
+			fn(readPageNo(page), i, nil)
+		}
+	}
 	return nil
 }
 
@@ -293,159 +703,357 @@ func (db *DB) methodicalWALPageN(pageN int) (lastMeta int, err error) {
 	return lastMeta, nil
 }
 
-// Checkpoint performs a manual checkpoint. This is not necessary except for tests.
+// CheckpointStats reports the result of a checkpoint.
+type CheckpointStats struct {
+	WALID     int64         // last WAL ID copied to the data file
+	PageN     int           // number of pages copied
+	Duration  time.Duration // time from start until the WAL was rebased
+	StallTime time.Duration // time writers waited for the WAL to shrink
+}
+
+// checkpointRun is a checkpoint in progress.
+type checkpointRun struct {
+	done  chan struct{} // closed when the checkpoint finishes
+	ready chan struct{} // closed when older transactions have finished
+	err   error
+
+	end   int              // WAL position to copy up to
+	walID int64            // WAL ID at end
+	pages map[uint32]int64 // pages to copy, by WAL ID
+	start time.Time
+	stall time.Duration // writer stall time when the checkpoint started
+	stats CheckpointStats
+
+	lockedReaders bool // holding the readers lock
+}
+
+// releaseReaders releases the readers lock once the checkpoint no longer
+// changes the data file or WAL segments. Must be called while holding db.mu.
+func (run *checkpointRun) releaseReaders(db *DB) {
+	if !run.lockedReaders {
+		return
+	}
+	run.lockedReaders = false
+	if err := db.releaseReaders(); err != nil {
+		db.logger.Error("unlock readers", "err", err)
+	}
+}
+
+// Checkpoint copies the WAL into the data file and waits for it to complete.
+// Returns ErrDatabaseLocked if read-only databases are reading. This is not
+// necessary except for tests.
 func (db *DB) Checkpoint() error {
+	if db.cfg.ReadOnly {
+		return ErrReadOnly
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.rwmu.Lock()
-	return db.checkpoint()
-}
 
-// checkpoint moves all WAL pages to the main DB file. Must be called
-// while holding both db.mu and db.rwmu. Should release db.rwmu, but not
-// db.mu.
-func (db *DB) checkpoint() (err error) {
-	// if we don't spin off a possible async waiter, we should release the
-	// write lock, if we do, that will release it.
-	releaseLock := true
-	defer func() {
-		if releaseLock {
-			db.rwmu.Unlock()
+	// Wait for background checkpoints so every commit so far is copied.
+	for {
+		if err := db.waitCheckpoint(); err != nil {
+			return err
+		} else if run, err := db.checkpoint(); err != nil {
+			return err
+		} else if run != nil {
+			return db.waitCheckpoint()
+		} else if db.checkpointRun != nil {
+			continue
+		} else if db.opened && db.walPageN > db.walStart {
+			return ErrDatabaseLocked
 		}
-	}()
-	if !db.opened {
 		return nil
 	}
+}
 
+// LastCheckpoint returns the stats of the last completed checkpoint.
+func (db *DB) LastCheckpoint() CheckpointStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.checkpointStats
+}
+
+// checkpoint starts copying the WAL into the data file in the background.
+// Pages are copied up to the current end of the WAL while new commits keep
+// appending past it. Once copied, the WAL is rebased at that position and
+// the segments before it are removed. Returns nil if there is nothing to copy,
+// a checkpoint is already running or read-only databases are reading, which
+// is recorded in Stats.CheckpointBlockedN. Must be called while holding db.mu.
+func (db *DB) checkpoint() (*checkpointRun, error) {
 	// Check if there are any WAL pages, if not do nothing as
 	// checkpointing and calling fsync can be very expensive even if
 	// there are no writes.
-	if db.walPageN == 0 {
-		return nil
+	if !db.opened || db.checkpointRun != nil || db.walPageN == db.walStart {
+		return nil, nil
 	}
-	// wake up things waiting on haltCond when we're done, even if we fail.
-	// Otherwise, we deadlock with them all stuck waiting on that forever.
-	defer func() {
-		if err != nil && db.isDead == nil {
+
+	// Readers expect the data file & WAL segments to stay in place.
+	if ok, err := db.lockReaders(); err != nil {
+		return nil, err
+	} else if !ok {
+		db.recordCheckpointBlocked()
+		return nil, nil
+	}
+
+	run := &checkpointRun{
+		lockedReaders: true,
+		done:          make(chan struct{}),
+		ready:         make(chan struct{}),
+		end:           db.walPageN,
+		walID:         db.baseWALID + int64(db.walPageN),
+		start:         time.Now(),
+		stall:         db.stats.WriterHaltTime,
+	}
+
+	pages, err := db.checkpointPages()
+	if err != nil {
+		run.releaseReaders(db)
+		if db.isDead == nil {
 			db.isDead = err
 		}
 		db.haltCond.Broadcast()
-	}()
+		return nil, err
+	}
+	run.pages = pages
 
-	// Copy the pages from the WAL back to the database outside of the lock.
-	var pageN uint32
-	if err := func() error {
-		db.mu.Unlock() // This is intentionally reversed so run w/o lock
-		defer db.mu.Lock()
+	// Commits after this point go to a new segment so the segments holding
+	// the copied pages can be removed as a whole.
+	db.wal.seal()
 
-		var page []byte
-		// We might have either a *PageMap or just the file. If we have the file,
-		// building the PageMap is fairly expensive because it's fancy and immutable.
-		// If we have the PageMap *or* some other map, that's two different things
-		// to iterate. If we have the PageMap, building a map from it is relatively
-		// cheap, so we'll do it that way.
-		pages := make(map[uint32]int)
-
-		if db.pageMap.size == 0 {
-			// you'd think we're done, but actually this PROBABLY means that
-			// this is initial startup, and we haven't read the file yet. We scan
-			// the file for pages, because it turns out most of them probably
-			// got overwritten.
-			for i := 0; i < db.walPageN; i++ {
-				page, err = db.readWALPageAt(i)
-				if err != nil {
-					return fmt.Errorf("reading WAL page %d: %w", i, err)
-				}
+	// Transactions which are already open may read the pages we are about to
+	// overwrite from the data file, so wait for them before copying. Newer
+	// transactions read these pages from the WAL.
+	db.afterCurrentTx(func() { close(run.ready) })
 
-				// Determine page number. Meta pages are always on zero & bitmap
-				// headers specify the page number of the next page in the WAL.
-				// All other pages have their page number in the page data.
-				var pgno uint32
-				if IsBitmapHeader(page) {
-					pgno = readPageNo(page)
-					if i+1 < db.walPageN {
-						if _, err = db.readWALPageAt(i + 1); err != nil {
-							return err
-						}
-					} else {
-						return fmt.Errorf("last page of WAL file (%d) is bitmap header", i)
-					}
-					i++ // bitmaps in WAL are two pages
-				} else if !IsMetaPage(page) {
-					pgno = readPageNo(page)
-				}
-				// record where in the file we have this page
-				pages[pgno] = i
-			}
-		} else {
-			itr := db.pageMap.Iterator()
-			itr.First()
-			for k, v, ok := itr.Next(); ok; k, v, ok = itr.Next() {
-				pages[k] = int(v - db.baseWALID - 1)
+	db.checkpointRun = run
+	go db.runCheckpoint(run)
+	return run, nil
+}
+
+// checkpointPages returns the WAL ID of the latest version of every page in
+// the WAL which has not been copied to the data file. Must be called while
+// holding db.mu.
+func (db *DB) checkpointPages() (map[uint32]int64, error) {
+	pages := make(map[uint32]int64)
+
+	// We might have either a *PageMap or just the file. If we have the PageMap,
+	// building a map from it is relatively cheap, so we'll do it that way.
+	if db.pageMap.size != 0 {
+		itr := db.pageMap.Iterator()
+		itr.First()
+		for k, v, ok := itr.Next(); ok; k, v, ok = itr.Next() {
+			if v > db.checkpointWALID {
+				pages[k] = v
 			}
 		}
+		return pages, nil
+	}
 
-		for pgno, walID := range pages {
-			page, err = db.readWALPageAt(walID)
-			if err != nil {
-				return fmt.Errorf("reading page %d [page number %d]: %v", walID, pgno, err)
-			}
+	// you'd think we're done, but actually this PROBABLY means that
+	// this is initial startup, and we haven't read the file yet. We scan
+	// the file for pages, because it turns out most of them probably
+	// got overwritten.
+	for i := db.walStart; i < db.walPageN; i++ {
+		page, err := db.readWALPageAt(i)
+		if err != nil {
+			return nil, fmt.Errorf("reading WAL page %d: %w", i, err)
+		}
 
-			// Determine new database size from the page size in meta page.
-			if pgno == 0 {
-				pageN = readMetaPageN(page)
+		// Determine page number. Meta pages are always on zero & bitmap
+		// headers specify the page number of the next page in the WAL.
+		// All other pages have their page number in the page data.
+		var pgno uint32
+		if IsBitmapHeader(page) {
+			pgno = readPageNo(page)
+			if i+1 < db.walPageN {
+				if _, err = db.readWALPageAt(i + 1); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, fmt.Errorf("last page of WAL file (%d) is bitmap header", i)
 			}
+			i++ // bitmaps in WAL are two pages
+		} else if !IsMetaPage(page) {
+			pgno = readPageNo(page)
+		}
+		// record where in the file we have this page
+		pages[pgno] = db.baseWALID + int64(i) + 1
+	}
+	return pages, nil
+}
+
+// runCheckpoint copies the pages of a checkpoint and rebases the WAL.
+func (db *DB) runCheckpoint(run *checkpointRun) {
+	<-run.ready
+	pageN, err := db.copyCheckpoint(run)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-			// Write data to the data file.
-			if err = db.writeDBPage(pgno, page); err != nil {
-				return fmt.Errorf("writing page %d: %v", pgno, err)
+	if err == nil {
+		err = db.rebaseWAL(run, pageN)
+	}
+	if err != nil {
+		run.releaseReaders(db)
+		db.logger.Error("checkpoint", "err", err)
+		if db.isDead == nil {
+			db.isDead = err
+		}
+	} else {
+		run.stats = CheckpointStats{
+			WALID:     run.walID,
+			PageN:     len(run.pages),
+			Duration:  time.Since(run.start),
+			StallTime: db.stats.WriterHaltTime - run.stall,
+		}
+		db.checkpointStats = run.stats
+		db.recordCheckpoint(run.stats)
+		db.logger.Debug("checkpoint", "walid", run.walID, "pages", len(run.pages), "duration", run.stats.Duration, "stall", run.stats.StallTime)
+	}
+	run.err = err
+	db.checkpointRun = nil
+	close(run.done)
+
+	// wake up things waiting on haltCond when we're done, even if we fail.
+	// Otherwise, we deadlock with them all stuck waiting on that forever.
+	db.haltCond.Broadcast()
+
+	// Writers may have filled the WAL while we were copying.
+	if err == nil && db.needCheckpoint() {
+		if _, err := db.checkpoint(); err != nil {
+			db.logger.Error("checkpoint", "err", err)
+		}
+	}
+}
+
+// copyCheckpoint copies the pages of a checkpoint to the data file without
+// holding db.mu. Returns the page count of the database at the checkpoint.
+func (db *DB) copyCheckpoint(run *checkpointRun) (pageN uint32, err error) {
+	for pgno, walID := range run.pages {
+		page, err := db.readWALPageByID(walID)
+		if err != nil {
+			return 0, fmt.Errorf("reading page %d [page number %d]: %v", walID, pgno, err)
+		}
+
+		// Determine new database size from the page size in meta page.
+		if pgno == 0 {
+			pageN = readMetaPageN(page)
+		}
+
+		// Write data to the data file.
+		if err := db.writeDBPage(pgno, page); err != nil {
+			return 0, fmt.Errorf("writing page %d: %v", pgno, err)
+		}
+	}
+
+	// Ensure database file is synced before the WAL is rebased.
+	if err = db.fsync(db.data); err != nil {
+		return 0, fmt.Errorf("db file sync: %w", err)
+	}
+
+	// Pages stored in frame pages no longer need their own page.
+	if walID, ok := run.pages[0]; ok {
+		if meta, err := db.readWALPageByID(walID); err != nil {
+			return 0, fmt.Errorf("reading meta page %d: %v", walID, err)
+		} else if readMetaFeatures(meta)&MetaFeaturePageCompression != 0 {
+			pgnos := make(map[uint32]struct{}, len(run.pages))
+			for pgno := range run.pages {
+				pgnos[pgno] = struct{}{}
+			}
+			if err := db.deallocateCompressedPages(pageN, pgnos, func(pgno uint32) ([]byte, error) {
+				if walID, ok := run.pages[pgno]; ok {
+					return db.readWALPageByID(walID)
+				}
+				return db.readDBPage(pgno)
+			}); err != nil {
+				db.logger.Error("deallocate compressed pages", "err", err)
 			}
 		}
+	}
 
-		// Ensure database file is synced and then truncate the WAL file.
-		if err = db.fsync(db.file); err != nil {
-			return fmt.Errorf("db file sync: %w", err)
+	// Truncate data file if it has shrunk. Newer transactions read any page
+	// allocated past the old size from the WAL. The file is extended if the
+	// last pages were never written.
+	if fileSize, err := db.data.Size(); err != nil {
+		db.logger.Error("stat db file", "err", err)
+	} else if sz := int64(pageN) * PageSize; sz > 0 && fileSize != sz {
+		if err := db.data.Truncate(sz); err != nil {
+			db.logger.Error("truncate db file", "err", err)
 		}
+	}
+	return pageN, nil
+}
 
-		return nil
-	}(); err != nil {
-		return err
+// rebaseWAL moves the start of the WAL to the end of a copied checkpoint.
+// The WAL segments before it are removed once the transactions which may
+// read them have finished. Must be called while holding db.mu.
+func (db *DB) rebaseWAL(run *checkpointRun, pageN uint32) error {
+	if pageN > 0 {
+		if err := db.growMapping(db.data, int64(pageN)*PageSize); err != nil {
+			return fmt.Errorf("grow db mapping: %w", err)
+		}
 	}
 
-	// now we've updated the file. There are existing transactions that are still
-	// using the WAL, though. So we wait for them to terminate before we unlock
-	// the rwmu and update the metadata about the WAL.
-	releaseLock = false
-	db.walPageN = 0
-	db.pageMap = NewPageMap()
+	// Pages up to the checkpoint are now read from the data file. Segments
+	// holding commits which followers have not received are kept.
+	db.checkpointWALID = run.walID
+	db.walStart = run.end
+	end := db.retainedWALPosition()
+	db.walRetainStart = end
+	pageMap := NewPageMap()
+	itr := db.pageMap.Iterator()
+	itr.First()
+	for k, v, ok := itr.Next(); ok; k, v, ok = itr.Next() {
+		if v > run.walID {
+			pageMap = pageMap.Set(k, v)
+		}
+	}
+	db.pageMap = pageMap
 
 	db.afterCurrentTx(func() {
-		defer db.rwmu.Unlock()
-		db.baseWALID = readMetaWALID(db.data)
-		db.mu.Unlock()
-		defer db.mu.Lock()
-
-		if err = db.walFile.Truncate(0); err != nil {
-			db.logger.Error("truncate wal file", "err", err)
-		} else if err = db.fsync(db.walFile); err != nil {
-			db.logger.Error("wal file sync", "err", err)
-		} else if _, err = db.walFile.Seek(0, io.SeekStart); err != nil {
-			db.logger.Error("seek wal file", "err", err)
-		}
-
-		// Truncate data file if it has shrunk.
-		if fi, err := db.file.Stat(); err != nil {
-			db.logger.Error("stat db file", "err", err)
-		} else if sz := int64(pageN) * PageSize; sz > 0 && fi.Size() > sz {
-			if err := db.file.Truncate(sz); err != nil {
-				db.logger.Error("truncate db file", "err", err)
+		defer run.releaseReaders(db)
+		if db.wal == nil {
+			return // closed
+		}
+		if err := db.wal.removeBefore(end); err != nil {
+			db.logger.Error("remove wal segments", "err", err)
+			return
+		}
+
+		// Restart WAL positions once the WAL is empty and no writer can
+		// be holding a position.
+		if db.walPageN == db.walStart && db.rwmu.TryLock() {
+			if db.wal.empty() {
+				db.walPageN, db.walStart, db.walRetainStart = 0, 0, 0
+				db.baseWALID = db.checkpointWALID
 			}
+			db.rwmu.Unlock()
 		}
 	})
-
 	return nil
 }
 
+// waitCheckpoint waits for a running checkpoint to finish and returns its
+// error. Must be called while holding db.mu, which is released while waiting.
+func (db *DB) waitCheckpoint() error {
+	run := db.checkpointRun
+	if run == nil {
+		return nil
+	}
+	db.mu.Unlock()
+	<-run.done
+	db.mu.Lock()
+	return run.err
+}
+
+// needCheckpoint returns true if the WAL should be checkpointed: when it is
+// past the minimum size and either nothing else is open or it is past the
+// maximum size. Must be called while holding db.mu.
+func (db *DB) needCheckpoint() bool {
+	walSize := db.walSize()
+	return walSize > db.cfg.MinWALCheckpointSize && (len(db.txs) == 0 || walSize > db.cfg.MaxWALCheckpointSize)
+}
+
 func (db *DB) IsClosed() bool {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -460,6 +1068,7 @@ func (db *DB) Close() (err error) {
 	// competing with us, we can ensure that it'll exit out quickly.
 	db.mu.Lock()
 	db.opened = false
+	db.closeSubscriptions()
 	// wait for transactions to complete
 	ch := make(chan struct{})
 	db.afterCurrentTx(func() {
@@ -472,46 +1081,41 @@ func (db *DB) Close() (err error) {
 	db.rwmu.Lock()
 	defer db.rwmu.Unlock()
 
-	// and main DB lock.
+	// and main DB lock, once any background checkpoint has finished.
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.waitCheckpoint(); err != nil {
+		db.logger.Error("checkpoint before close", "err", err)
+	}
 
-	// Close mmap handle.
-	if db.data != nil {
-		if e := syswrap.Munmap(db.data); e != nil && err == nil {
-			err = e
+	// Sync the data file before releasing handles.
+	if db.data != nil && !db.cfg.ReadOnly {
+		if err := db.fsync(db.data); err != nil {
+			return err
 		}
-		db.data = nil
 	}
+	if err := db.closeHandles(); err != nil {
+		return err
+	}
+	return db.unlock()
+}
 
-	// Close writer handler.
-	if db.file != nil {
-		err = db.fsync(db.file)
-		if err != nil {
-			return
-		}
-		if e := db.file.Close(); e != nil && err == nil {
+// closeHandles closes the data and WAL files.
+func (db *DB) closeHandles() (err error) {
+	if db.data != nil {
+		if e := db.data.Close(); e != nil && err == nil {
 			err = e
 		}
-		db.file = nil
+		db.data = nil
 	}
 
-	// Close WAL mmap handle.
 	if db.wal != nil {
-		if e := syswrap.Munmap(db.wal); e != nil && err == nil {
+		if e := db.wal.Close(); e != nil && err == nil {
 			err = e
 		}
 		db.wal = nil
 	}
 
-	// Close wal writer handler.
-	if db.walFile != nil {
-		if e := db.walFile.Close(); e != nil && err == nil {
-			err = e
-		}
-		db.walFile = nil
-	}
-
 	return err
 }
 
@@ -546,36 +1150,32 @@ func (db *DB) HasData(requireOneHotBit bool) (hasAnyRecords bool, err error) {
 	}
 	defer tx.Rollback()
 
-	records, err := tx.RootRecords()
-	if err != nil {
-		return false, err
-	}
 	// Loop over each bitmap and attempt to move to the first cell.
 	// If we can move to a cell then we have at least one record.
-
-	for itr := records.Iterator(); !itr.Done(); {
-		name, _, _ := itr.Next()
+	err = tx.walkRootRecords("", func(name string, _ uint32) error {
 		// Fetch cursor for bitmap.
 		cur, err := tx.Cursor(name)
 		if err != nil {
-			return false, err
+			return err
 		}
 		defer cur.Close()
 
 		if !requireOneHotBit {
-			return true, nil
+			hasAnyRecords = true
+			return errStopRootRecords
 		}
 		// INVAR: requireOneHotBit true
 
 		// Check if we can move to the first cell.
 		if err := cur.First(); err == io.EOF {
-			continue // no data in bitmap
+			return nil // no data in bitmap
 		} else if err != nil {
-			return false, err
+			return err
 		}
-		return true, nil
-	}
-	return false, nil
+		hasAnyRecords = true
+		return errStopRootRecords
+	})
+	return hasAnyRecords, err
 }
 
 // Size returns the size of the database & WAL, in bytes.
@@ -583,11 +1183,14 @@ func (db *DB) Size() (int64, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	fi, err := os.Stat(db.Path)
+	if db.data == nil {
+		return 0, ErrClosed
+	}
+	sz, err := db.data.Size()
 	if err != nil {
 		return 0, err
 	}
-	return db.walSize() + fi.Size(), nil
+	return db.walSize() + sz, nil
 }
 
 // WALSize returns the size of the WAL, in bytes.
@@ -598,55 +1201,97 @@ func (db *DB) WALSize() int64 {
 }
 
 func (db *DB) walSize() int64 {
-	return int64(db.walPageN) * PageSize
+	return int64(db.walPageN-db.walStart) * PageSize
 }
 
 // init initializes a new database file.
 func (db *DB) init() error {
-	if err := db.initMetaPage(); err != nil {
-		return fmt.Errorf("meta: %w", err)
-	} else if err := db.initRootRecordPage(); err != nil {
-		return fmt.Errorf("root record page: %w", err)
-	} else if err := db.initFreelistPage(); err != nil {
-		return fmt.Errorf("freelist page: %w", err)
+	pages := [][]byte{newMetaPage(), newRootRecordPage(), newFreelistPage()}
+	writeMetaWALID(pages[0], db.initWALID)
+	if db.cfg.PageChecksums {
+		dir, page := initChecksumPages(pages[0], pages)
+		pages = append(pages, dir, page)
+	}
+	if db.cfg.PageVersions {
+		writeMetaFeatures(pages[0], readMetaFeatures(pages[0])|MetaFeaturePageVersions)
+	}
+	if db.cfg.PageCompression {
+		writeMetaFeatures(pages[0], readMetaFeatures(pages[0])|MetaFeaturePageCompression)
+	}
+
+	for pgno, page := range pages {
+		if _, err := db.data.WriteAt(page, int64(pgno)*PageSize); err != nil {
+			return fmt.Errorf("write page %d: %w", pgno, err)
+		}
 	}
 	return nil
 }
 
-// initMetaPage initializes the meta page.
-func (db *DB) initMetaPage() error {
+// newMetaPage returns an initialized meta page.
+func newMetaPage() []byte {
 	page := allocPage()
 	writeMetaMagic(page)
 	writeMetaPageN(page, 3)
 	writeMetaRootRecordPageNo(page, 1)
 	writeMetaFreelistPageNo(page, 2)
-	_, err := db.file.WriteAt(page, 0*PageSize)
-	return err
+	return page
 }
 
-// initRootRecordPage initializes the initial root record page.
-func (db *DB) initRootRecordPage() error {
+// newRootRecordPage returns the initial root record page, an empty leaf.
+func newRootRecordPage() []byte {
 	page := allocPage()
 	writePageNo(page, 1)
-	writeFlags(page, PageTypeRootRecord)
-	_, err := db.file.WriteAt(page, 1*PageSize)
-	return err
+	writeFlags(page, PageTypeRootRecordLeaf)
+	return page
 }
 
-// initFreelistPage initializes the initial freelist btree page.
-func (db *DB) initFreelistPage() error {
+// newFreelistPage returns the initial freelist btree page.
+func newFreelistPage() []byte {
 	page := allocPage()
 	writePageNo(page, 2)
 	writeFlags(page, PageTypeLeaf)
-	_, err := db.file.WriteAt(page, 2*PageSize)
-	return err
+	return page
 }
 
-// Begin starts a new transaction.
+// Begin starts a new transaction. Writable transactions wait for any other
+// writer to finish and for the WAL to be checkpointed if it is too large.
 func (db *DB) Begin(writable bool) (_ *Tx, err error) {
+	return db.BeginContext(context.Background(), writable)
+}
+
+// BeginContext starts a new transaction like Begin but stops waiting and
+// returns the context's error if ctx is done before the transaction starts.
+func (db *DB) BeginContext(ctx context.Context, writable bool) (_ *Tx, err error) {
+	if writable && (db.cfg.ReadOnly || db.cfg.Follower) {
+		return nil, ErrReadOnly
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.begin(ctx, writable, false)
+}
+
+// TryBegin starts a new transaction without waiting. ErrWriterBusy is
+// returned if a writable transaction is already open or the WAL is waiting
+// to be checkpointed. Read-only transactions never wait.
+func (db *DB) TryBegin(writable bool) (_ *Tx, err error) {
+	if writable && (db.cfg.ReadOnly || db.cfg.Follower) {
+		return nil, ErrReadOnly
+	}
+	return db.begin(context.Background(), writable, true)
+}
+
+// begin starts a new transaction. If try is set then writers return
+// ErrWriterBusy instead of waiting.
+func (db *DB) begin(ctx context.Context, writable, try bool) (_ *Tx, err error) {
 	// Ensure only one writable transaction at a time.
 	if writable {
-		db.rwmu.Lock()
+		if try {
+			if !db.rwmu.TryLock() {
+				return nil, ErrWriterBusy
+			}
+		} else if err := db.rwmu.LockContext(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	// This local function is called at exit points that occur before we can
@@ -670,15 +1315,61 @@ func (db *DB) Begin(writable bool) (_ *Tx, err error) {
 		return nil, err
 	}
 
+	// Read-only databases see the writer's last commit.
+	if db.cfg.ReadOnly {
+		if err := db.refresh(ctx); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
 	// Wait for WAL size to be below threshold, if we're going to write.
 	// Reads don't care.
-	if writable {
-		for int64(db.walPageN)*PageSize > db.cfg.MaxWALCheckpointSize {
+	if writable && db.walSize() > db.cfg.MaxWALCheckpointSize {
+		var stop func() bool
+		defer func(start time.Time) { db.recordWriterHalt(time.Since(start)) }(time.Now())
+		for db.walSize() > db.cfg.MaxWALCheckpointSize {
 			if db.isDead != nil {
 				err := db.isDead
 				cleanup()
 				return nil, err
+			} else if try {
+				cleanup()
+				return nil, ErrWriterBusy
+			} else if err := ctx.Err(); err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			// Retry shortly if read-only databases are holding back the
+			// checkpoint as they do not signal when their transactions close.
+			if !db.opened {
+				cleanup()
+				return nil, ErrClosed
+			} else if db.checkpointRun == nil {
+				if run, err := db.checkpoint(); err != nil {
+					cleanup()
+					return nil, err
+				} else if run == nil {
+					time.AfterFunc(checkpointRetryInterval, func() {
+						db.mu.Lock()
+						defer db.mu.Unlock()
+						db.haltCond.Broadcast()
+					})
+				}
 			}
+
+			// Wake up when the context is done. The broadcast cannot be
+			// missed as it requires db.mu, which Wait releases.
+			if stop == nil && ctx.Done() != nil {
+				stop = context.AfterFunc(ctx, func() {
+					db.mu.Lock()
+					defer db.mu.Unlock()
+					db.haltCond.Broadcast()
+				})
+				defer stop()
+			}
+
 			// This implicitly releases db.mu.Lock and comes back with it
 			// held again.
 			db.haltCond.Wait()
@@ -686,11 +1377,16 @@ func (db *DB) Begin(writable bool) (_ *Tx, err error) {
 	}
 
 	tx := &Tx{
-		db:          db,
-		rootRecords: db.rootRecords,
-		pageMap:     db.pageMap,
-		walPageN:    db.walPageN,
-		writable:    writable,
+		db:       db,
+		pageMap:  db.pageMap,
+		walPageN: db.walPageN,
+		walStart: db.walStart,
+		writable: writable,
+
+		walRetainStart: db.walRetainStart,
+		start:          time.Now(),
+
+		checkpointWALID: db.checkpointWALID,
 
 		DeleteEmptyContainer: true,
 	}
@@ -703,6 +1399,10 @@ func (db *DB) Begin(writable bool) (_ *Tx, err error) {
 	if writable {
 		tx.dirtyPages = make(map[uint32][]byte)
 		tx.dirtyBitmapPages = make(map[uint32][]byte)
+		tx.frameHints = cloneFrameHints(db.frameHints)
+		if len(db.subscriptions) > 0 {
+			tx.changes = make(map[string]map[uint64]struct{})
+		}
 	}
 
 	// Copy meta page into transaction's buffer.
@@ -718,19 +1418,31 @@ func (db *DB) Begin(writable bool) (_ *Tx, err error) {
 
 	// Track transaction with the DB.
 	db.txs[tx] = struct{}{}
-
-	// If no root records are cached, build the cache the first time.
-	// Normally the cache is updated by successful write transactions but
-	// this avoids recomputing the cache if there are no write txs for a while.
-	if db.rootRecords == nil {
-		if db.rootRecords, err = tx.RootRecords(); err != nil {
-			return nil, err
-		}
-	}
+	db.recordTxStart(tx)
 
 	return tx, nil
 }
 
+// growMapping ensures the first size bytes of f can be read by new
+// transactions. A previous memory mapping is released once the transactions
+// which may still reference it have closed. Must be called while holding db.mu.
+func (db *DB) growMapping(f File, size int64) error {
+	m, ok := f.(mappedFile)
+	if !ok {
+		return nil
+	}
+	release, err := m.grow(size)
+	if err != nil || release == nil {
+		return err
+	}
+	db.afterCurrentTx(func() {
+		if err := release(); err != nil {
+			db.logger.Error("release mapping", "err", err)
+		}
+	})
+	return nil
+}
+
 // afterCurrentTx runs the provided callback, with the db lock
 // held, after all current Tx terminate. It should be called with the db
 // lock held.
@@ -760,23 +1472,8 @@ func (db *DB) afterCurrentTx(callback func()) {
 // it retained by an asynchronous op that wants to happen before we start
 // running new tx.
 func (db *DB) removeTx(tx *Tx) error {
-	// We might want to trigger a checkpoint. Only for writable
-	// transactions, and only when either there's nothing else open or we
-	// really need to.
-	checkpoint := false
 	if tx.writable {
-		walSize := db.walSize()
-		if walSize > db.cfg.MinWALCheckpointSize {
-			// Might be a good time for a checkpoint. We'll do a checkpoint
-			// if we're the only transaction, or if we have to.
-			if len(db.txs) == 1 || walSize > db.cfg.MaxWALCheckpointSize {
-				checkpoint = true
-			}
-		}
-		// During checkpointing, we'll be preventing writes, but allowing reads.
-		if !checkpoint {
-			tx.db.rwmu.Unlock()
-		}
+		tx.db.rwmu.Unlock()
 	}
 	// remove ourselves from the list of transactions the db is keeping.
 	delete(tx.db.txs, tx)
@@ -799,21 +1496,25 @@ func (db *DB) removeTx(tx *Tx) error {
 	}
 
 	// Disassociate from db.
+	db.recordTxClose(tx)
 	tx.db = nil
 
-	if checkpoint {
-		// We need to run a checkpoint. This can be semi-asynchronous.
-		// It needs to wait until every existing transaction has finished,
-		// because every existing transaction could want to look up pages
-		// which are in the database before our operations, but which should
-		// now be in the WAL. We want them to use the WAL instead.
-		db.afterCurrentTx(func() {
-			// We still hold db.rwmu here. checkpoint unlocks it when it's
-			// ready.
-			if err := db.checkpoint(); err != nil {
-				db.logger.Error("async checkpoint", "err", err)
-			}
-		})
+	// Read-only databases only hold the readers lock while transactions are
+	// open so the writer can checkpoint between them.
+	if db.cfg.ReadOnly && len(db.txs) == 0 {
+		if err := db.unlock(); err != nil {
+			db.logger.Error("unlock readers", "err", err)
+		}
+	}
+
+	// We might want to trigger a checkpoint. Only for writable
+	// transactions, and only when either there's nothing else open or we
+	// really need to. The checkpoint runs in the background so writers can
+	// continue while it copies pages.
+	if tx.writable && db.needCheckpoint() {
+		if _, err := db.checkpoint(); err != nil {
+			db.logger.Error("async checkpoint", "err", err)
+		}
 	}
 	return nil
 }
@@ -830,21 +1531,21 @@ func (db *DB) Check() error {
 
 // writeDBPage writes a page to the data file.
 func (db *DB) writeDBPage(pgno uint32, page []byte) error {
-	_, err := db.file.WriteAt(page, int64(pgno)*PageSize)
+	_, err := db.data.WriteAt(page, int64(pgno)*PageSize)
 	return err
 }
 
 func (db *DB) readDBPage(pgno uint32) ([]byte, error) {
-	offset := int64(pgno) * PageSize
+	return db.data.ReadPage(pgno)
+}
 
-	// FB-1381
-	// Verify page number requested is within the current size of database.
-	bound := offset + PageSize
-	if sz := int64(len(db.data)); bound >= sz {
-		return nil, fmt.Errorf("rbf: page read out of bounds, pgno=%d upper-bound=%d file-size=%d", pgno, bound, sz)
+// dataWALID returns the WAL ID stored in the meta page of the data file.
+func (db *DB) dataWALID() (int64, error) {
+	page, err := db.readDBPage(0)
+	if err != nil {
+		return 0, fmt.Errorf("read meta page: %w", err)
 	}
-
-	return db.data[offset:bound], nil
+	return readMetaWALID(page), nil
 }
 
 // readWALPageByID reads a WAL page by WAL ID.
@@ -854,12 +1555,11 @@ func (db *DB) readWALPageByID(id int64) ([]byte, error) {
 
 // readWALPageAt reads the i-th page in the WAL file.
 func (db *DB) readWALPageAt(i int) ([]byte, error) {
-	offset := int64(i) * PageSize
-	return db.wal[offset : offset+PageSize], nil
+	return db.wal.ReadPage(uint32(i))
 }
 
 func (db *DB) readMetaPage() ([]byte, error) {
-	if walID, ok := db.pageMap.Get(uint32(0)); ok {
+	if walID, ok := db.pageMap.Get(uint32(0)); ok && walID > db.checkpointWALID {
 		return db.readWALPageByID(walID)
 	}
 	return db.readDBPage(0)
@@ -900,6 +1600,7 @@ type DebugInfo struct {
 func (db *DB) getFreelistCursor(tx *Tx) *Cursor {
 	c := &db.freelistCursor
 	c.tx = tx
+	c.name = "freelist"
 	c.stack.elems[0] = stackElem{pgno: readMetaFreelistPageNo(tx.meta[:])}
 	c.stack.top = 0
 	c.buffered = false
@@ -7,11 +7,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -20,6 +24,7 @@ import (
 	"github.com/felixge/fgprof"
 	"github.com/gernest/rbf"
 	rbfcfg "github.com/gernest/rbf/cfg"
+	"github.com/gernest/roaring"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -43,9 +48,13 @@ func TestDB_WAL(t *testing.T) {
 		tx := MustBegin(t, db, true)
 		defer tx.Rollback()
 
+		// The root record page is updated in place so each bitmap only adds
+		// its root page. The third fills the WAL.
 		if err := tx.CreateBitmap("x"); err != nil {
 			t.Fatal(err)
-		} else if err := tx.CreateBitmap("y"); err != rbf.ErrTxTooLarge {
+		} else if err := tx.CreateBitmap("y"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.CreateBitmap("z"); err != rbf.ErrTxTooLarge {
 			t.Fatalf("unexpected error: %v", err)
 		}
 	})
@@ -60,7 +69,11 @@ func TestDB_WAL(t *testing.T) {
 		tx := MustBegin(t, db, true)
 		defer tx.Rollback()
 
-		if err := tx.CreateBitmap("x"); err != nil {
+		// The root record page is updated in place so a second bitmap is
+		// needed for the bitmap page to fill the WAL.
+		if err := tx.CreateBitmap("y"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.CreateBitmap("x"); err != nil {
 			t.Fatal(err)
 		}
 
@@ -270,11 +283,19 @@ func TestDB_Recovery(t *testing.T) {
 		}
 		tx1.Rollback()
 
-		// Close database & truncate WAL to remove commit page & bitmap data page.
-		walPath, walSize := db.WALPath(), db.WALSize()
+		// Close database & truncate the last WAL segment to remove commit page
+		// & bitmap data page.
 		if err := db.Close(); err != nil {
 			t.Fatal(err)
-		} else if err := os.Truncate(walPath, walSize-(2*rbf.PageSize)); err != nil {
+		}
+		paths, err := filepath.Glob(db.WALPath() + ".*")
+		if err != nil || len(paths) == 0 {
+			t.Fatalf("no wal segments: %v", err)
+		}
+		walPath := paths[len(paths)-1]
+		if fi, err := os.Stat(walPath); err != nil {
+			t.Fatal(err)
+		} else if err := os.Truncate(walPath, fi.Size()-(2*rbf.PageSize)); err != nil {
 			t.Fatal(err)
 		}
 
@@ -652,3 +673,1782 @@ func TestDB_Backup(t *testing.T) {
 		t.Fatalf("want %v got %v", want, got)
 	}
 }
+
+func TestDB_BackupSince(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.PageVersions = true
+	db := MustOpenDB(t, config)
+	defer MustCloseDB(t, db)
+
+	commit := func(fn func(tx *rbf.Tx) error) {
+		t.Helper()
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := func(walID int64) ([]byte, int64) {
+		t.Helper()
+		var buf bytes.Buffer
+		id, err := db.BackupSince(&buf, walID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), id
+	}
+
+	// Write enough data to span many pages before the full backup.
+	commit(func(tx *rbf.Tx) error {
+		for i := uint64(0); i < 1000; i++ {
+			if _, err := tx.Add("y", i<<16); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Add("x", 1, 2, 3)
+		return err
+	})
+	full, id0 := backup(0)
+
+	commit(func(tx *rbf.Tx) error {
+		_, err := tx.Add("x", 4)
+		return err
+	})
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	inc1, id1 := backup(id0)
+
+	commit(func(tx *rbf.Tx) error {
+		_, err := tx.Remove("x", 1)
+		return err
+	})
+	inc2, id2 := backup(id1)
+	if id0 >= id1 || id1 >= id2 {
+		t.Fatalf("unexpected wal ids: %d, %d, %d", id0, id1, id2)
+	}
+
+	// Incremental backups should only contain changed pages.
+	m0, err := rbf.ReadBackupManifest(bytes.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, err := rbf.ReadBackupManifest(bytes.NewReader(inc1))
+	if err != nil {
+		t.Fatal(err)
+	} else if m1.BaseWALID != id0 || m1.WALID != id1 {
+		t.Fatalf("unexpected manifest: base=%d walID=%d", m1.BaseWALID, m1.WALID)
+	} else if len(m1.Pgnos) >= len(m0.Pgnos) {
+		t.Fatalf("incremental backup not smaller than full: %d >= %d", len(m1.Pgnos), len(m0.Pgnos))
+	}
+
+	t.Run("RestoreChain", func(t *testing.T) {
+		path := t.TempDir()
+		if err := rbf.RestoreChain(path, bytes.NewReader(full), bytes.NewReader(inc1), bytes.NewReader(inc2)); err != nil {
+			t.Fatal(err)
+		}
+
+		db2 := MustOpenDBAt(t, path)
+		defer MustCloseDB(t, db2)
+		tx := MustBegin(t, db2, false)
+		defer tx.Rollback()
+
+		if r, err := tx.RoaringBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Slice(), []uint64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("x=%v, want %v", got, want)
+		}
+		if n, err := tx.Count("y"); err != nil {
+			t.Fatal(err)
+		} else if n != 1000 {
+			t.Fatalf("y count=%d, want 1000", n)
+		}
+	})
+
+	t.Run("ErrBackupMismatch", func(t *testing.T) {
+		err := rbf.RestoreChain(t.TempDir(), bytes.NewReader(full), bytes.NewReader(inc2))
+		if !errors.Is(err, rbf.ErrBackupMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WithoutVersions", func(t *testing.T) {
+		// Every page is included when versions are not stored.
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", 1, 2, 3); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		id, err := db.BackupSince(&buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := db.BackupSince(&buf, id); err != nil {
+			t.Fatal(err)
+		}
+		m0, err := rbf.ReadBackupManifest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Next(len(m0.Pgnos) * rbf.PageSize)
+		if m1, err := rbf.ReadBackupManifest(&buf); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(m1.Pgnos, m0.Pgnos) {
+			t.Fatalf("unexpected pages: %v, want %v", m1.Pgnos, m0.Pgnos)
+		}
+	})
+}
+
+func TestDB_Compact(t *testing.T) {
+	// populate writes 100 bitmaps and then deletes all but every tenth one.
+	populate := func(t *testing.T, db *rbf.DB) {
+		t.Helper()
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		for i := 0; i < 100; i++ {
+			for j := uint64(0); j < 100; j++ {
+				if _, err := tx.Add(fmt.Sprintf("x%03d", i), j<<16); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		tx = MustBegin(t, db, true)
+		defer tx.Rollback()
+		for i := 0; i < 99; i++ {
+			if i%10 == 0 {
+				continue
+			} else if err := tx.DeleteBitmap(fmt.Sprintf("x%03d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// verify checks the remaining bitmaps are intact.
+	verify := func(t *testing.T, db *rbf.DB) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		names, err := tx.BitmapNames()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := names, []string{"x000", "x010", "x020", "x030", "x040", "x050", "x060", "x070", "x080", "x090", "x099"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("names=%v, want %v", got, want)
+		}
+		for _, name := range names {
+			if n, err := tx.Count(name); err != nil {
+				t.Fatal(err)
+			} else if n != 100 {
+				t.Fatalf("%s count=%d, want 100", name, n)
+			}
+		}
+	}
+
+	t.Run("Compact", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		populate(t, db)
+
+		dstPath := t.TempDir()
+		stats, err := db.Compact(dstPath)
+		if err != nil {
+			t.Fatal(err)
+		} else if stats.BytesReclaimed <= 0 || stats.DstPageN >= stats.SrcPageN {
+			t.Fatalf("unexpected stats: %+v", stats)
+		} else if stats.LivePageN == 0 || stats.LivePageN >= int(stats.SrcPageN) {
+			t.Fatalf("unexpected live pages: %+v", stats)
+		} else if stats.PagesMoved == 0 || stats.PagesMoved > stats.LivePageN {
+			t.Fatalf("unexpected moved pages: %+v", stats)
+		}
+
+		if _, err := db.Compact(dstPath); err == nil {
+			t.Fatal("expected error for existing destination")
+		}
+
+		dst := MustOpenDBAt(t, dstPath)
+		defer MustCloseDB(t, dst)
+		verify(t, dst)
+
+		// A compacted database is already laid out in order.
+		if stats, err := dst.Compact(t.TempDir()); err != nil {
+			t.Fatal(err)
+		} else if stats.PagesMoved != 0 {
+			t.Fatalf("unexpected moved pages: %+v", stats)
+		}
+	})
+
+	t.Run("UnlimitedWAL", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MaxWALSize = 0
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+		populate(t, db)
+
+		dstPath := t.TempDir()
+		if _, err := db.Compact(dstPath); err != nil {
+			t.Fatal(err)
+		}
+		dst := MustOpenDBAt(t, dstPath)
+		defer MustCloseDB(t, dst)
+		verify(t, dst)
+	})
+
+	t.Run("Vacuum", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		populate(t, db)
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		before, err := os.Stat(db.DataPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := db.Vacuum()
+		if err != nil {
+			t.Fatal(err)
+		} else if after, err := os.Stat(db.DataPath()); err != nil {
+			t.Fatal(err)
+		} else if n := before.Size() - after.Size(); n != stats.BytesReclaimed {
+			t.Fatalf("size shrank by %d bytes, reported %d", n, stats.BytesReclaimed)
+		}
+		verify(t, db)
+
+		// Writes continue after the file is swapped.
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if _, err := tx.Add("y", 1); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ErrTxOpen", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		populate(t, db)
+
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if _, err := db.Vacuum(); !errors.Is(err, rbf.ErrTxOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tx.Rollback()
+		verify(t, db)
+	})
+
+	t.Run("SwapError", func(t *testing.T) {
+		path := t.TempDir()
+		db := rbf.NewDB(path, nil)
+		db.VFS = failRenameVFS{rbf.OSVFS{}}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+		populate(t, db)
+		if db.WALSize() == 0 {
+			t.Fatal("expected wal pages")
+		}
+
+		// The original data file is reopened with the WAL copied into it.
+		if _, err := db.Vacuum(); !errors.Is(err, errRenameFailed) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if db.WALSize() != 0 {
+			t.Fatal("expected wal to be checkpointed")
+		}
+		verify(t, db)
+
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if _, err := tx.Add("y", 1); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+var errRenameFailed = errors.New("rename failed")
+
+// failRenameVFS is a VFS which cannot rename files.
+type failRenameVFS struct {
+	rbf.VFS
+}
+
+func (failRenameVFS) Rename(oldpath, newpath string) error {
+	return errRenameFailed
+}
+
+func TestDB_Lock(t *testing.T) {
+	t.Run("Writer", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+
+		other := rbf.NewDB(db.Path, nil)
+		if err := other.Open(); !errors.Is(err, rbf.ErrDatabaseLocked) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ReadOnlyWithWriter", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+
+		add := func(t *testing.T, values ...uint64) {
+			t.Helper()
+			tx := MustBegin(t, db, true)
+			defer tx.Rollback()
+			if _, err := tx.Add("x", values...); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		verify := func(t *testing.T, db *rbf.DB, want []uint64) {
+			t.Helper()
+			tx := MustBegin(t, db, false)
+			defer tx.Rollback()
+			if bm, err := tx.RoaringBitmap("x"); err != nil {
+				t.Fatal(err)
+			} else if got := bm.Slice(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+
+		add(t, 1, 2, 3)
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		} else if db.WALSize() != 0 {
+			t.Fatal("expected checkpoint")
+		}
+
+		roConfig := rbfcfg.NewDefaultConfig()
+		roConfig.ReadOnly = true
+		r0 := MustOpenDBAt(t, db.Path, roConfig)
+		defer r0.Close()
+		verify(t, r0, []uint64{1, 2, 3})
+
+		// The writer cannot checkpoint while a read transaction is open and
+		// the transaction keeps its snapshot.
+		rtx := MustBegin(t, r0, false)
+		defer rtx.Rollback()
+		add(t, 4)
+		add(t, 5)
+		if err := db.Checkpoint(); !errors.Is(err, rbf.ErrDatabaseLocked) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if db.WALSize() == 0 {
+			t.Fatal("expected wal pages")
+		} else if stats, err := db.Stats(); err != nil {
+			t.Fatal(err)
+		} else if stats.CheckpointBlockedN == 0 {
+			t.Fatal("expected blocked checkpoint")
+		}
+		if n, err := rtx.Count("x"); err != nil {
+			t.Fatal(err)
+		} else if n != 3 {
+			t.Fatalf("Count()=%d, want 3", n)
+		}
+
+		// New transactions see the commits in the WAL.
+		verify(t, db, []uint64{1, 2, 3, 4, 5})
+		verify(t, r0, []uint64{1, 2, 3, 4, 5})
+		r1 := MustOpenDBAt(t, db.Path, roConfig)
+		defer r1.Close()
+		verify(t, r1, []uint64{1, 2, 3, 4, 5})
+
+		if _, err := db.Vacuum(); !errors.Is(err, rbf.ErrDatabaseLocked) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Checkpoints resume once the read transaction closes while the
+		// readers stay attached.
+		rtx.Rollback()
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		} else if db.WALSize() != 0 {
+			t.Fatal("expected checkpoint")
+		}
+		add(t, 6)
+		for _, r := range []*rbf.DB{db, r0, r1} {
+			verify(t, r, []uint64{1, 2, 3, 4, 5, 6})
+		}
+		if _, err := db.Vacuum(); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, r0, []uint64{1, 2, 3, 4, 5, 6})
+	})
+
+	t.Run("ReadOnlyWriterHalt", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MinWALCheckpointSize = 1 << 30
+		config.MaxWALCheckpointSize = 4 * rbf.PageSize
+		db := MustOpenDBAt(t, t.TempDir(), config)
+		defer MustCloseDB(t, db)
+
+		roConfig := rbfcfg.NewDefaultConfig()
+		roConfig.ReadOnly = true
+		r := MustOpenDBAt(t, db.Path, roConfig)
+		defer r.Close()
+		rtx := MustBegin(t, r, false)
+		defer rtx.Rollback()
+
+		// Writers halt rather than growing the WAL while the reader holds
+		// back the checkpoint.
+		for i := uint64(0); db.WALSize() <= config.MaxWALCheckpointSize; i++ {
+			tx := MustBegin(t, db, true)
+			if _, err := tx.Add("x", i<<16); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := db.BeginContext(ctx, true); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The writer resumes once the read transaction closes.
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			rtx.Rollback()
+		}()
+		tx, err := db.BeginContext(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Rollback()
+		if db.WALSize() > config.MaxWALCheckpointSize {
+			t.Fatalf("unexpected wal size: %d", db.WALSize())
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		db := MustOpenDB(t)
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", 1, 2, 3); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Leave a second commit in the WAL so the readers must use it.
+		config := rbfcfg.NewDefaultConfig()
+		config.MinWALCheckpointSize = 1 << 30
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = MustOpenDBAt(t, db.Path, config)
+		tx = MustBegin(t, db, true)
+		if _, err := tx.Add("x", 4); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		} else if db.WALSize() == 0 {
+			t.Fatal("expected wal pages")
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		config = rbfcfg.NewDefaultConfig()
+		config.ReadOnly = true
+		r0, r1 := MustOpenDBAt(t, db.Path, config), MustOpenDBAt(t, db.Path, config)
+		defer r0.Close()
+		defer r1.Close()
+
+		if _, err := r0.Begin(true); err != rbf.ErrReadOnly {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r0.Checkpoint(); err != rbf.ErrReadOnly {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, r := range []*rbf.DB{r0, r1} {
+			tx := MustBegin(t, r, false)
+			bm, err := tx.RoaringBitmap("x")
+			tx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			} else if got, want := bm.Slice(), []uint64{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+
+		// A writer may open while readers are attached and checkpoints as
+		// they have no transactions open.
+		w := MustOpenDBAt(t, db.Path)
+		defer MustCloseDB(t, w)
+		if w.WALSize() != 0 {
+			t.Fatal("expected checkpoint")
+		}
+		tx = MustBegin(t, w, true)
+		if _, err := tx.Add("x", 5); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The readers see the writer's commits.
+		for r, want := range map[*rbf.DB]uint64{w: 5, r0: 5, r1: 5} {
+			tx := MustBegin(t, r, false)
+			n, err := tx.Count("x")
+			tx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			} else if n != want {
+				t.Fatalf("Count()=%d, want %d", n, want)
+			}
+		}
+	})
+}
+
+func TestDB_MemVFS(t *testing.T) {
+	vfs := rbf.NewMemVFS()
+	path := filepath.Join(t.TempDir(), "mem")
+
+	open := func(t *testing.T, config *rbfcfg.Config) *rbf.DB {
+		t.Helper()
+		db := rbf.NewDB(path, config)
+		db.VFS = vfs
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	verify := func(t *testing.T, db *rbf.DB, want []uint64) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if bm, err := tx.RoaringBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if got := bm.Slice(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	db := open(t, nil)
+	tx := MustBegin(t, db, true)
+	if err := tx.CreateBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("x", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave the second commit in the WAL.
+	tx = MustBegin(t, db, true)
+	if _, err := tx.Add("x", 1<<20); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second writer on the same VFS must be rejected.
+	other := rbf.NewDB(path, nil)
+	other.VFS = vfs
+	if err := other.Open(); !errors.Is(err, rbf.ErrDatabaseLocked) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing should have been written to the file system.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("unexpected stat error: %v", err)
+	}
+
+	// Reopening from the same VFS recovers both commits.
+	config := rbfcfg.NewDefaultConfig()
+	config.ReadOnly = true
+	r := open(t, config)
+	verify(t, r, []uint64{1, 2, 3, 1 << 20})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open(t, nil)
+	defer MustCloseDB(t, db)
+	verify(t, db, []uint64{1, 2, 3, 1 << 20})
+
+	if _, err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	verify(t, db, []uint64{1, 2, 3, 1 << 20})
+}
+
+func TestDB_Replication(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.MinWALCheckpointSize = 1 << 30
+	primary := MustOpenDB(t, config)
+	defer MustCloseDB(t, primary)
+
+	followerConfig := rbfcfg.NewDefaultConfig()
+	followerConfig.Follower = true
+	follower := MustOpenDB(t, followerConfig)
+	defer func() { MustCloseDB(t, follower) }()
+
+	commit := func(t *testing.T, name string, values ...uint64) {
+		t.Helper()
+		tx := MustBegin(t, primary, true)
+		if _, err := tx.Add(name, values...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ship := func(t *testing.T, walID int64) int64 {
+		t.Helper()
+		var buf bytes.Buffer
+		want, err := primary.WriteWALTo(&buf, walID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := follower.ApplyWAL(&buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Fatalf("applied wal id=%d, want %d", got, want)
+		}
+		return got
+	}
+
+	verify := func(t *testing.T, db *rbf.DB, name string, want []uint64) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if bm, err := tx.RoaringBitmap(name); err != nil {
+			t.Fatal(err)
+		} else if got := bm.Slice(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	commit(t, "x", 1, 2, 3)
+	commit(t, "y", 1<<20)
+	walID := ship(t, 0)
+	verify(t, follower, "x", []uint64{1, 2, 3})
+	verify(t, follower, "y", []uint64{1 << 20})
+
+	// A reader opened before the next segment keeps its snapshot.
+	tx := MustBegin(t, follower, false)
+	commit(t, "x", 4)
+	walID = ship(t, walID)
+	if bm, err := tx.RoaringBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if got, want := bm.Slice(), []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	tx.Rollback()
+	verify(t, follower, "x", []uint64{1, 2, 3, 4})
+
+	if _, err := follower.Begin(true); err != rbf.ErrReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := primary.ApplyWAL(&bytes.Buffer{}); err != rbf.ErrNotFollower {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Replaying a segment that has already been applied must fail.
+	var buf bytes.Buffer
+	if _, err := primary.WriteWALTo(&buf, 0); err != nil {
+		t.Fatal(err)
+	} else if _, err := follower.ApplyWAL(&buf); !errors.Is(err, rbf.ErrWALMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Applied commits survive a checkpoint & reopen of the follower.
+	if err := follower.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	follower = MustOpenDBAt(t, follower.Path, followerConfig)
+	if id, err := follower.WALID(); err != nil {
+		t.Fatal(err)
+	} else if id != walID {
+		t.Fatalf("WALID()=%d, want %d", id, walID)
+	}
+	commit(t, "y", 5)
+	ship(t, walID)
+	verify(t, follower, "x", []uint64{1, 2, 3, 4})
+	verify(t, follower, "y", []uint64{5, 1 << 20})
+
+	// Commits are no longer available once the primary checkpoints.
+	if err := primary.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, "x", 6)
+	if _, err := primary.WriteWALTo(io.Discard, walID); !errors.Is(err, rbf.ErrWALUnavailable) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDB_WALRetention(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.WALSegmentSize = rbf.PageSize
+	primary := MustOpenDB(t, config)
+	defer MustCloseDB(t, primary)
+
+	followerConfig := rbfcfg.NewDefaultConfig()
+	followerConfig.Follower = true
+	follower := MustOpenDB(t, followerConfig)
+	defer MustCloseDB(t, follower)
+
+	commit := func(t *testing.T, values ...uint64) {
+		t.Helper()
+		tx := MustBegin(t, primary, true)
+		if _, err := tx.Add("x", values...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		} else if err := primary.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := primary.RetainWAL(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+
+	// Checkpointed commits are shipped to a follower which has fallen
+	// behind.
+	commit(t, 1)
+	commit(t, 2)
+	var buf bytes.Buffer
+	walID, err := primary.WriteWALTo(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := follower.ApplyWAL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r.Advance(walID)
+	if r.WALID() != walID {
+		t.Fatalf("WALID()=%d, want %d", r.WALID(), walID)
+	}
+
+	commit(t, 3)
+	buf.Reset()
+	if _, err := primary.WriteWALTo(&buf, walID); err != nil {
+		t.Fatal(err)
+	} else if _, err := follower.ApplyWAL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tx := MustBegin(t, follower, false)
+	defer tx.Rollback()
+	if bm, err := tx.RoaringBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if got, want := bm.Slice(), []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Commits before the retention are removed by the next checkpoint.
+	if _, err := primary.WriteWALTo(io.Discard, 0); !errors.Is(err, rbf.ErrWALUnavailable) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Releasing the retention removes the remaining segments.
+	r.Release()
+	commit(t, 4)
+	if _, err := primary.WriteWALTo(io.Discard, walID); !errors.Is(err, rbf.ErrWALUnavailable) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if paths, err := filepath.Glob(primary.WALPath() + "*"); err != nil {
+		t.Fatal(err)
+	} else if len(paths) > 1 {
+		t.Fatalf("unexpected wal segments: %v", paths)
+	}
+}
+
+func TestDB_BeginContext(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+
+	tx := MustBegin(t, db, true)
+
+	if _, err := db.TryBegin(true); err != rbf.ErrWriterBusy {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginContext(ctx, true); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Readers are not blocked by the writer.
+	rtx, err := db.TryBegin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtx.Rollback()
+
+	// A waiting writer starts once the current writer finishes.
+	errc := make(chan error)
+	go func() {
+		tx, err := db.BeginContext(context.Background(), true)
+		if err == nil {
+			tx.Rollback()
+		}
+		errc <- err
+	}()
+	tx.Rollback()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if tx, err := db.TryBegin(true); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Rollback()
+	}
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+
+	tx := MustBegin(t, db, true)
+	if _, err := tx.Add("x", 1); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("y", 1); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := db.Subscribe(2)
+
+	tx = MustBegin(t, db, true)
+	if _, err := tx.Add("x", 2, 1<<16|3, 5<<16); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("z", 7); err != nil {
+		t.Fatal(err)
+	} else if err := tx.DeleteBitmap("y"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes undone by a savepoint are not reported.
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("x", 9<<16); err != nil {
+		t.Fatal(err)
+	} else if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	walID, err := db.WALID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-sub.C, (&rbf.CommitEvent{
+		WALID:   walID,
+		Created: []string{"z"},
+		Deleted: []string{"y"},
+		Changed: map[string][]uint64{"x": {0, 1, 5}, "z": {0}},
+	}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	tx = MustBegin(t, db, true)
+	if err := tx.RenameBitmap("x", "w"); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-sub.C; !reflect.DeepEqual(ev.Renamed, []rbf.BitmapRename{{OldName: "x", NewName: "w"}}) {
+		t.Fatalf("unexpected event: %#v", ev)
+	} else if len(ev.Created) != 0 || len(ev.Deleted) != 0 {
+		t.Fatalf("unexpected event: %#v", ev)
+	}
+
+	// Commits do not wait for a slow subscriber. The subscription ends once
+	// its buffer overflows.
+	for i := uint64(0); i < 3; i++ {
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("w", 100+i); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var n int
+	for range sub.C {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("received %d events, want 2", n)
+	} else if err := sub.Err(); err != rbf.ErrSubscriptionOverflow {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Closing the database ends remaining subscriptions.
+	other := db.Subscribe(1)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := <-other.C; ok {
+		t.Fatal("expected closed channel")
+	} else if err := other.Err(); err != rbf.ErrClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDB_GrowMapping(t *testing.T) {
+	// addContainers writes dense containers so each becomes a bitmap page.
+	addContainers := func(tx *rbf.Tx, name string, start, n int) error {
+		for i := start; i < start+n; i++ {
+			a := make([]uint64, 0, 5000)
+			for j := 0; j < 5000; j++ {
+				a = append(a, uint64(i)<<16|uint64(j*3))
+			}
+			if _, err := tx.Add(name, a...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t.Run("Grow", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MinWALCheckpointSize = 1 << 30 // keep commits in the WAL
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", 1, 2, 3); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Hold a reader across remaps of the WAL.
+		rtx := MustBegin(t, db, false)
+		for i := 0; i < 4; i++ {
+			tx := MustBegin(t, db, true)
+			if err := addContainers(tx, "y", i*64, 64); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n, err := rtx.Count("x"); err != nil {
+			t.Fatal(err)
+		} else if n != 3 {
+			t.Fatalf("Count=%d, want 3", n)
+		}
+		rtx.Rollback()
+
+		// Copy the WAL into the data file, which must be remapped too.
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		tx = MustBegin(t, db, false)
+		defer tx.Rollback()
+		if n, err := tx.Count("y"); err != nil {
+			t.Fatal(err)
+		} else if n != 256*5000 {
+			t.Fatalf("Count=%d, want %d", n, 256*5000)
+		}
+	})
+
+	t.Run("MaxSize", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MaxSize = 64 * rbf.PageSize
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if err := addContainers(tx, "x", 0, 128); !errors.Is(err, rbf.ErrMaxSize) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDB_WALSegments(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.WALSegmentSize = 4 * rbf.PageSize
+	config.MinWALCheckpointSize = 1 << 30 // keep commits in the WAL
+
+	segments := func(t *testing.T, db *rbf.DB) []string {
+		t.Helper()
+		paths, err := filepath.Glob(db.WALPath() + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+
+	verify := func(t *testing.T, db *rbf.DB, n int) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		for i := 0; i < n; i++ {
+			if ok, err := tx.Contains(fmt.Sprintf("x%d", i), uint64(i)); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("missing bit in bitmap %d", i)
+			}
+		}
+	}
+
+	db := MustOpenDB(t, config)
+	for i := 0; i < 10; i++ {
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add(fmt.Sprintf("x%d", i), uint64(i)); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(segments(t, db)); n < 2 {
+		t.Fatalf("expected multiple segments, got %d", n)
+	}
+	verify(t, db, 10)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only databases read the segments in place.
+	roConfig := *config
+	roConfig.ReadOnly = true
+	ro := MustOpenDBAt(t, db.Path, &roConfig)
+	verify(t, ro, 10)
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening checkpoints & removes every segment.
+	db = MustOpenDBAt(t, db.Path, config)
+	verify(t, db, 10)
+	if paths := segments(t, db); len(paths) != 0 {
+		t.Fatalf("unexpected segments: %v", paths)
+	}
+
+	// A WAL file written before segments is read as the first segment.
+	tx := MustBegin(t, db, true)
+	if _, err := tx.Add("x10", 10); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	paths := segments(t, db)
+	if len(paths) != 1 {
+		t.Fatalf("expected one segment, got %v", paths)
+	} else if err := os.Rename(paths[0], db.WALPath()); err != nil {
+		t.Fatal(err)
+	}
+	db = MustOpenDBAt(t, db.Path, config)
+	defer MustCloseDB(t, db)
+	verify(t, db, 11)
+}
+
+func TestDB_Checkpoint(t *testing.T) {
+	t.Run("NonBlocking", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MinWALCheckpointSize = 1 << 30 // only checkpoint manually
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", 1); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The checkpoint waits for this reader before copying.
+		rtx := MustBegin(t, db, false)
+		errc := make(chan error, 1)
+		go func() { errc <- db.Checkpoint() }()
+		time.Sleep(10 * time.Millisecond)
+
+		// Writers are not blocked by the pending checkpoint.
+		tx, err := db.TryBegin(true)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Add("x", 2); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := rtx.Contains("x", 2); err != nil || ok {
+			t.Fatalf("Contains()=<%v,%v>", ok, err)
+		}
+		rtx.Rollback()
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+
+		if stats := db.LastCheckpoint(); stats.PageN == 0 || stats.WALID == 0 || stats.Duration <= 0 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+		tx = MustBegin(t, db, false)
+		if bm, err := tx.RoaringBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if got := bm.Slice(); !reflect.DeepEqual(got, []uint64{1, 2}) {
+			t.Fatalf("got %v", got)
+		}
+		tx.Rollback()
+
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		} else if sz := db.WALSize(); sz != 0 {
+			t.Fatalf("WALSize=%d, want 0", sz)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MinWALCheckpointSize = 8 * rbf.PageSize
+		config.MaxWALCheckpointSize = 64 * rbf.PageSize
+		config.WALSegmentSize = 16 * rbf.PageSize
+		config.FsyncEnabled, config.FsyncWALEnabled = false, false
+		db := MustOpenDB(t, config)
+
+		const n = 500
+		var g errgroup.Group
+		g.Go(func() error {
+			for i := 0; i < n; i++ {
+				tx, err := db.Begin(true)
+				if err != nil {
+					return err
+				} else if _, err := tx.Add("x", uint64(i)); err != nil {
+					tx.Rollback()
+					return err
+				} else if err := tx.Commit(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		for j := 0; j < 4; j++ {
+			g.Go(func() error {
+				for i := 0; i < n/5; i++ {
+					tx, err := db.Begin(false)
+					if err != nil {
+						return err
+					}
+					bm, err := tx.RoaringBitmap("x")
+					tx.Rollback()
+					if err != nil {
+						return err
+					}
+					// Bits are added in order so any snapshot holds a prefix.
+					if c := bm.Count(); c > 0 {
+						if min, _ := bm.Min(); min != 0 || bm.Max() != c-1 {
+							return fmt.Errorf("inconsistent snapshot: count=%d min=%d max=%d", c, min, bm.Max())
+						}
+					}
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		} else if stats := db.LastCheckpoint(); stats.PageN == 0 {
+			t.Fatal("expected background checkpoints")
+		}
+
+		db = MustReopenDB(t, db)
+		defer MustCloseDB(t, db)
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if c, err := tx.Count("x"); err != nil {
+			t.Fatal(err)
+		} else if c != n {
+			t.Fatalf("Count=%d, want %d", c, n)
+		}
+	})
+}
+
+// countingSink counts calls to a MetricsSink.
+type countingSink struct {
+	rbf.NopMetricsSink
+	mu                             sync.Mutex
+	started, closed, commits, ckpt int
+}
+
+func (s *countingSink) TxStarted(writable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started++
+}
+
+func (s *countingSink) TxClosed(writable bool, d time.Duration, pageReadN int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+}
+
+func (s *countingSink) Committed(d time.Duration, dirtyPageN int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits++
+}
+
+func (s *countingSink) Checkpointed(stats rbf.CheckpointStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ckpt++
+}
+
+func TestDB_Stats(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.MinWALCheckpointSize = 1 << 30 // only checkpoint manually
+	db := NewDB(t, config)
+	sink := &countingSink{}
+	db.Metrics = sink
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer MustCloseDB(t, db)
+
+	for i := 0; i < 3; i++ {
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", uint64(i)<<16); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx := MustBegin(t, db, false)
+	if _, err := tx.Contains("x", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.WriteTxN != 3 || stats.CommitN != 3 || stats.ReadTxN != 1 || stats.OpenReadTxN != 1 {
+		t.Fatalf("unexpected tx stats: %+v", stats)
+	} else if stats.DirtyPageN == 0 || stats.WALPageWriteN == 0 || stats.CommitTime <= 0 {
+		t.Fatalf("unexpected commit stats: %+v", stats)
+	} else if stats.WALPageN == 0 || stats.WALSize != int64(stats.WALPageN)*rbf.PageSize || stats.WALSegmentN != 1 {
+		t.Fatalf("unexpected wal stats: %+v", stats)
+	} else if stats.PageN == 0 {
+		t.Fatalf("unexpected storage stats: %+v", stats)
+	}
+	tx.Rollback()
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if stats, err = db.Stats(); err != nil {
+		t.Fatal(err)
+	} else if stats.CheckpointN != 1 || stats.CheckpointBytes == 0 || stats.DataPageWriteN == 0 || stats.WALPageN != 0 {
+		t.Fatalf("unexpected checkpoint stats: %+v", stats)
+	} else if stats.WALPageReadN == 0 {
+		t.Fatalf("expected wal page reads: %+v", stats)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.commits != 3 || sink.ckpt != 1 || sink.started != sink.closed {
+		t.Fatalf("unexpected sink calls: %+v", sink)
+	}
+}
+
+func TestDB_PageCompression(t *testing.T) {
+	// Write arrays, runs & bitmap containers across many pages.
+	var want []uint64
+	for i := uint64(0); i < 256; i++ {
+		switch i % 3 {
+		case 0:
+			want = append(want, i<<16|1, i<<16|100, i<<16|1000)
+		case 1:
+			for j := uint64(0); j < 5000; j++ {
+				want = append(want, i<<16|(j*13))
+			}
+		case 2:
+			for j := uint64(0); j < 100; j++ {
+				want = append(want, i<<16|(1<<15)|j)
+			}
+		}
+	}
+
+	verify := func(t *testing.T, db *rbf.DB) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if bm, err := tx.RoaringBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if got := bm.Slice(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected bitmap: n=%d, want n=%d", len(got), len(want))
+		} else if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// blockN returns the number of blocks allocated to the data file.
+	blockN := func(t *testing.T, db *rbf.DB) int64 {
+		t.Helper()
+		fi, err := os.Stat(db.DataPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Blocks
+	}
+
+	write := func(t *testing.T, compression bool) *rbf.DB {
+		t.Helper()
+		config := rbfcfg.NewDefaultConfig()
+		config.PageCompression = compression
+		config.MinWALCheckpointSize = 1 << 30 // only checkpoint manually
+		db := MustOpenDB(t, config)
+
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("x", want...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, db)
+
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, db)
+		return db
+	}
+
+	db := write(t, true)
+	defer MustCloseDB(t, db)
+	plain := write(t, false)
+	defer MustCloseDB(t, plain)
+
+	t.Run("DiskUsage", func(t *testing.T) {
+		if n, plainN := blockN(t, db), blockN(t, plain); n >= plainN {
+			t.Fatalf("expected fewer blocks than uncompressed: %d >= %d", n, plainN)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		// Rewrite compressed pages & add a bitmap container which does not
+		// compress.
+		tx := MustBegin(t, db, true)
+		rnd := rand.New(rand.NewSource(0))
+		for i := 0; i < 30000; i++ {
+			want = append(want, 300<<16|uint64(rnd.Intn(1<<16)))
+		}
+		if _, err := tx.Add("x", want...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		want = roaring.NewBitmap(want...).Slice()
+		verify(t, db)
+	})
+
+	// frameN returns the number of frame pages & pages stored in them.
+	frameN := func(t *testing.T, db *rbf.DB) (n, usedN int) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		infos, err := tx.PageInfos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if info, ok := info.(*rbf.FramePageInfo); ok {
+				n, usedN = n+1, usedN+info.UsedN
+			}
+		}
+		return n, usedN
+	}
+
+	t.Run("FramePages", func(t *testing.T) {
+		if n, usedN := frameN(t, db); n == 0 || usedN <= n {
+			t.Fatalf("expected several pages per frame page: frames=%d pages=%d", n, usedN)
+		}
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		// Pages compressed since the last checkpoint have no data of their
+		// own in either file.
+		var buf bytes.Buffer
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := t.TempDir()
+		if err := rbf.Restore(&buf, path); err != nil {
+			t.Fatal(err)
+		}
+		other := MustOpenDBAt(t, path)
+		defer MustCloseDB(t, other)
+		verify(t, other)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		db = MustReopenDB(t, db)
+		verify(t, db)
+	})
+
+	t.Run("DeleteBitmap", func(t *testing.T) {
+		// Frame pages are freed with the pages stored in them and reused.
+		// Only the root record & freelist pages are still compressed.
+		pageN := MustBegin(t, db, false)
+		defer pageN.Rollback()
+
+		tx := MustBegin(t, db, true)
+		if err := tx.DeleteBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		} else if n, usedN := frameN(t, db); n > 1 || usedN > 2 {
+			t.Fatalf("unexpected frame pages: frames=%d pages=%d", n, usedN)
+		} else if err := db.Check(); err != nil {
+			t.Fatal(err)
+		}
+
+		tx = MustBegin(t, db, true)
+		if _, err := tx.Add("x", want...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, db)
+
+		// Frames released during a commit are only reused by later commits
+		// so compare the pages in use rather than the file size.
+		inuseN := func(t *testing.T, tx *rbf.Tx) int {
+			t.Helper()
+			infos, err := tx.PageInfos()
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := len(infos)
+			for _, info := range infos {
+				if _, ok := info.(*rbf.FreePageInfo); ok {
+					n--
+				}
+			}
+			return n
+		}
+		tx = MustBegin(t, db, false)
+		defer tx.Rollback()
+		if n, prev := inuseN(t, tx), inuseN(t, pageN); n > prev {
+			t.Fatalf("unexpected growth: %d > %d pages in use", n, prev)
+		}
+	})
+
+	t.Run("Savepoint", func(t *testing.T) {
+		// Releasing frames modifies dirty frame & table pages which must not
+		// change the pages held by the savepoint.
+		tx := MustBegin(t, db, true)
+		if _, err := tx.Add("y", want...); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		tx = MustBegin(t, db, true)
+		if err := tx.DeleteBitmap("y"); err != nil {
+			t.Fatal(err)
+		}
+		sp, err := tx.Savepoint()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := tx.DeleteBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.RollbackTo(sp); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, db)
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "compact")
+		if _, err := db.Compact(path); err != nil {
+			t.Fatal(err)
+		}
+		other := MustOpenDBAt(t, path)
+		defer MustCloseDB(t, other)
+		verify(t, other)
+
+		tx := MustBegin(t, other, false)
+		defer tx.Rollback()
+		info, err := tx.PageInfos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, info := range info {
+			_, ok := info.(*rbf.CompressionPageInfo)
+			found = found || ok
+		}
+		if !found {
+			t.Fatal("expected compression pages")
+		}
+	})
+}
+
+// staticKey is a KeyProvider which returns the same key for every database.
+type staticKey []byte
+
+func (k staticKey) Key(path string) ([]byte, error) { return k, nil }
+
+func TestDB_Encryption(t *testing.T) {
+	key := staticKey(bytes.Repeat([]byte{1}, 32))
+	newConfig := func(key rbfcfg.KeyProvider) *rbfcfg.Config {
+		config := rbfcfg.NewDefaultConfig()
+		config.KeyProvider = key
+		config.MinWALCheckpointSize = 1 << 30 // only checkpoint manually
+		return config
+	}
+
+	var want []uint64
+	for i := uint64(0); i < 300; i++ {
+		want = append(want, i<<16|1, i<<16|2)
+	}
+	verify := func(t *testing.T, db *rbf.DB) {
+		t.Helper()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if bm, err := tx.RoaringBitmap("secret-name"); err != nil {
+			t.Fatal(err)
+		} else if got := bm.Slice(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected bitmap: n=%d, want n=%d", len(got), len(want))
+		} else if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write to both the data file & the WAL.
+	path := t.TempDir()
+	db := MustOpenDBAt(t, path, newConfig(key))
+	tx := MustBegin(t, db, true)
+	if _, err := tx.Add("secret-name", want[:300]...); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	tx = MustBegin(t, db, true)
+	if _, err := tx.Add("secret-name", want[300:]...); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	verify(t, db)
+
+	t.Run("Ciphertext", func(t *testing.T) {
+		paths, err := filepath.Glob(db.WALPath() + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range append(paths, db.DataPath()) {
+			if buf, err := os.ReadFile(path); err != nil {
+				t.Fatal(err)
+			} else if !bytes.HasPrefix(buf, []byte(rbf.EncryptedMagic)) {
+				t.Fatalf("missing encryption header: %s", path)
+			} else if bytes.Contains(buf, []byte("secret-name")) {
+				t.Fatalf("plaintext found in %s", path)
+			}
+		}
+	})
+
+	var full bytes.Buffer
+	if err := db.Backup(&full); err != nil {
+		t.Fatal(err)
+	}
+	var base bytes.Buffer
+	walID, err := db.BackupSince(&base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = MustBegin(t, db, true)
+	if _, err := tx.Add("secret-name", 1<<40); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var inc bytes.Buffer
+	if _, err := db.BackupSince(&inc, walID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Check(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		db := MustOpenDBAt(t, path, newConfig(key))
+		defer db.Close()
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if n, err := tx.Count("secret-name"); err != nil {
+			t.Fatal(err)
+		} else if n != uint64(len(want))+1 {
+			t.Fatalf("count=%d, want %d", n, len(want)+1)
+		}
+	})
+
+	t.Run("ErrInvalidKey", func(t *testing.T) {
+		db := NewDBAt(t, path, newConfig(staticKey(bytes.Repeat([]byte{2}, 32))))
+		if err := db.Open(); !errors.Is(err, rbf.ErrInvalidKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrEncrypted", func(t *testing.T) {
+		db := NewDBAt(t, path, newConfig(nil))
+		if err := db.Open(); !errors.Is(err, rbf.ErrEncrypted) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrCompressionEncrypted", func(t *testing.T) {
+		config := newConfig(key)
+		config.PageCompression = true
+		db := NewDBAt(t, t.TempDir(), config)
+		if err := db.Open(); !errors.Is(err, rbf.ErrCompressionEncrypted) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrNotEncrypted", func(t *testing.T) {
+		plain := MustOpenDB(t)
+		if err := plain.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db := NewDBAt(t, plain.Path, newConfig(key))
+		if err := db.Open(); !errors.Is(err, rbf.ErrNotEncrypted) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		path := t.TempDir()
+		if err := rbf.Restore(bytes.NewReader(full.Bytes()), path); err != nil {
+			t.Fatal(err)
+		} else if buf, err := os.ReadFile(filepath.Join(path, "data")); err != nil {
+			t.Fatal(err)
+		} else if bytes.Contains(buf, []byte("secret-name")) {
+			t.Fatal("plaintext found in backup")
+		}
+
+		db := MustOpenDBAt(t, path, newConfig(key))
+		defer MustCloseDB(t, db)
+		verify(t, db)
+	})
+
+	t.Run("RestoreChain", func(t *testing.T) {
+		path := t.TempDir()
+		if err := rbf.RestoreChain(path, bytes.NewReader(base.Bytes()), bytes.NewReader(inc.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		db := MustOpenDBAt(t, path, newConfig(key))
+		defer MustCloseDB(t, db)
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		if ok, err := tx.Contains("secret-name", 1<<40); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected incremental change")
+		}
+	})
+
+	t.Run("RestoreChainMismatch", func(t *testing.T) {
+		if err := rbf.RestoreChain(t.TempDir(), bytes.NewReader(full.Bytes())); !errors.Is(err, rbf.ErrInvalidBackup) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("TornMetaPage", func(t *testing.T) {
+		// Stop writing the data file after the checkpoint writes the
+		// ciphertext of the meta page but before its record.
+		path := t.TempDir()
+		vfs := &tornWriteVFS{VFS: rbf.OSVFS{}}
+		db := NewDBAt(t, path, newConfig(key))
+		db.VFS = vfs
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for _, values := range [][]uint64{want[:300], want[300:]} {
+			tx := MustBegin(t, db, true)
+			if _, err := tx.Add("secret-name", values...); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		vfs.armed = true
+		if err := db.Checkpoint(); err == nil {
+			t.Fatal("expected error")
+		} else if !vfs.torn {
+			t.Fatal("expected torn write")
+		}
+		db.Close()
+
+		// The meta page is rebuilt from the WAL.
+		db = MustOpenDBAt(t, path, newConfig(key))
+		defer MustCloseDB(t, db)
+		verify(t, db)
+	})
+}
+
+var errTornWrite = errors.New("torn write")
+
+// tornWriteVFS is a VFS whose encrypted data file fails every write from the
+// write of the meta page's record onwards, once armed, as if the process had
+// crashed.
+type tornWriteVFS struct {
+	rbf.VFS
+	armed, torn bool
+}
+
+func (vfs *tornWriteVFS) OpenFile(name string, readOnly bool, maxSize int64) (rbf.File, error) {
+	f, err := vfs.VFS.OpenFile(name, readOnly, maxSize)
+	if err != nil || filepath.Base(name) != "data" {
+		return f, err
+	}
+	return &tornWriteFile{File: f, vfs: vfs}, nil
+}
+
+type tornWriteFile struct {
+	rbf.File
+	vfs *tornWriteVFS
+}
+
+func (f *tornWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.vfs.armed && off == rbf.PageSize {
+		f.vfs.torn = true
+	}
+	if f.vfs.torn {
+		return 0, errTornWrite
+	}
+	return f.File.WriteAt(p, off)
+}
@@ -0,0 +1,382 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"bytes"
+
+	"github.com/gernest/roaring"
+)
+
+// Diffs compare the leaf cells of a bitmap in two transactions in key order.
+// Both trees are walked in step and a child of a branch page is only read once
+// the walk reaches it. A page is unchanged if it has the same page number in
+// both trees, was last written by the same commit, has the same non-zero
+// checksum and is neither dirty nor above a dirty page in either transaction.
+// Pages are written in place, rather than copied, so a branch page is not
+// rewritten when a page below it is, but its version is updated. An unchanged
+// branch child is skipped without reading any page below it. The cells of an
+// unchanged leaf page are skipped without decoding their containers, except
+// for bitmap pages, which are compared on their own. This holds for
+// transactions of the same database and of databases which share its history,
+// such as a restored backup or a replica. Without page versions & checksums
+// every page is compared.
+
+// ContainerDiff holds the bits of a container which were added & removed
+// between two transactions. Added or Removed is nil if no bits were.
+type ContainerDiff struct {
+	Key     uint64
+	Added   *roaring.Container
+	Removed *roaring.Container
+}
+
+// Diff calls fn with the change to each container of a bitmap between oldTx
+// & newTx, in key order. Containers which did not change are not passed to fn.
+// A bitmap which does not exist is treated as empty. The transactions may
+// belong to different databases. The containers passed to fn are only valid
+// until the transactions are closed and fn must not write to either
+// transaction.
+func Diff(oldTx, newTx *Tx, name string, fn func(diff ContainerDiff) error) error {
+	unlock, err := lockDiffTxs(oldTx, newTx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if name == "" {
+		return ErrBitmapNameRequired
+	}
+	return diffBitmap(oldTx, newTx, name, fn)
+}
+
+// DiffAll calls fn with the change to each container of every bitmap which
+// exists in either oldTx or newTx, in name & then key order. It has the same
+// requirements as Diff.
+func DiffAll(oldTx, newTx *Tx, fn func(name string, diff ContainerDiff) error) error {
+	unlock, err := lockDiffTxs(oldTx, newTx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oldNames, err := oldTx.BitmapNamesWithPrefix("")
+	if err != nil {
+		return err
+	}
+	newNames, err := newTx.BitmapNamesWithPrefix("")
+	if err != nil {
+		return err
+	}
+
+	// Merge the sorted names of both transactions.
+	for len(oldNames) > 0 || len(newNames) > 0 {
+		var name string
+		switch {
+		case len(newNames) == 0 || (len(oldNames) > 0 && oldNames[0] < newNames[0]):
+			name, oldNames = oldNames[0], oldNames[1:]
+		case len(oldNames) == 0 || newNames[0] < oldNames[0]:
+			name, newNames = newNames[0], newNames[1:]
+		default:
+			name, oldNames, newNames = oldNames[0], oldNames[1:], newNames[1:]
+		}
+
+		if err := diffBitmap(oldTx, newTx, name, func(diff ContainerDiff) error {
+			return fn(name, diff)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockDiffTxs read locks both transactions and returns a function to unlock
+// them.
+func lockDiffTxs(oldTx, newTx *Tx) (unlock func(), err error) {
+	oldTx.mu.RLock()
+	if newTx != oldTx {
+		newTx.mu.RLock()
+	}
+	unlock = func() {
+		if newTx != oldTx {
+			newTx.mu.RUnlock()
+		}
+		oldTx.mu.RUnlock()
+	}
+
+	if oldTx.db == nil || newTx.db == nil {
+		unlock()
+		return nil, ErrTxClosed
+	}
+	return unlock, nil
+}
+
+func diffBitmap(oldTx, newTx *Tx, name string, fn func(diff ContainerDiff) error) error {
+	a, err := oldTx.newDiffSource(name)
+	if err != nil {
+		return err
+	}
+	b, err := newTx.newDiffSource(name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := a.load(); err != nil {
+			return err
+		} else if err := b.load(); err != nil {
+			return err
+		} else if a.done() && b.done() {
+			return nil
+		}
+
+		// Skip a branch child which is unchanged in both trees.
+		if a.pending() && b.pending() && a.child() == b.child() {
+			if same, err := sameBranch(oldTx, newTx, a.child()); err != nil {
+				return err
+			} else if same {
+				a.skip()
+				b.skip()
+				continue
+			}
+		}
+
+		// Move into a branch child once the other tree reaches its first key.
+		ka, err := a.key()
+		if err != nil {
+			return err
+		}
+		kb, err := b.key()
+		if err != nil {
+			return err
+		}
+		if a.pending() && (b.done() || ka <= kb) {
+			if err := a.descend(); err != nil {
+				return err
+			}
+			continue
+		} else if b.pending() && (a.done() || kb <= ka) {
+			if err := b.descend(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case b.done() || (!a.done() && ka < kb):
+			x := a.top()
+			if err := fn(ContainerDiff{Key: ka, Removed: toContainer(x.cell(), oldTx)}); err != nil {
+				return err
+			}
+			x.index++
+
+		case a.done() || kb < ka:
+			y := b.top()
+			if err := fn(ContainerDiff{Key: kb, Added: toContainer(y.cell(), newTx)}); err != nil {
+				return err
+			}
+			y.index++
+
+		case a.top().index == 0 && b.top().index == 0 && a.top().pgno == b.top().pgno:
+			// Skip the cells of an unchanged leaf page except for bitmap
+			// pages which changed without it.
+			x, y := a.top(), b.top()
+			same, err := samePage(oldTx, newTx, x.pgno)
+			if err != nil {
+				return err
+			} else if !same {
+				if err := diffCells(oldTx, newTx, x.cell(), y.cell(), fn); err != nil {
+					return err
+				}
+				x.index, y.index = x.index+1, y.index+1
+				continue
+			}
+
+			for n := readCellN(x.page); x.index < n; x.index, y.index = x.index+1, y.index+1 {
+				if cell := x.cell(); cell.Type == ContainerTypeBitmapPtr {
+					if err := diffCells(oldTx, newTx, cell, y.cell(), fn); err != nil {
+						return err
+					}
+				}
+			}
+
+		default:
+			x, y := a.top(), b.top()
+			if err := diffCells(oldTx, newTx, x.cell(), y.cell(), fn); err != nil {
+				return err
+			}
+			x.index, y.index = x.index+1, y.index+1
+		}
+	}
+}
+
+// diffCells calls fn with the difference between two cells with the same key.
+func diffCells(oldTx, newTx *Tx, a, b leafCell, fn func(diff ContainerDiff) error) error {
+	if a.Type == b.Type && a.BitN == b.BitN {
+		if a.Type != ContainerTypeBitmapPtr && bytes.Equal(a.Data, b.Data) {
+			return nil
+		} else if a.Type == ContainerTypeBitmapPtr && toPgno(a.Data) == toPgno(b.Data) {
+			if same, err := samePage(oldTx, newTx, toPgno(a.Data)); err != nil || same {
+				return err
+			}
+		}
+	}
+
+	x, y := toContainer(a, oldTx), toContainer(b, newTx)
+	diff := ContainerDiff{Key: a.Key}
+	if ct := roaring.Difference(y, x); ct.N() > 0 {
+		diff.Added = ct
+	}
+	if ct := roaring.Difference(x, y); ct.N() > 0 {
+		diff.Removed = ct
+	}
+	if diff.Added == nil && diff.Removed == nil {
+		return nil
+	}
+	return fn(diff)
+}
+
+// samePage returns true if pgno is known to hold the same data in both
+// transactions. Pages are only known to match if both have a checksum.
+func samePage(oldTx, newTx *Tx, pgno uint32) (bool, error) {
+	for _, tx := range []*Tx{oldTx, newTx} {
+		if tx.dirtyPages[pgno] != nil || tx.dirtyBitmapPages[pgno] != nil {
+			return false, nil
+		} else if _, ok := tx.changedBranches[pgno]; ok {
+			return false, nil
+		}
+	}
+
+	if v, err := oldTx.pageVersion(pgno); err != nil || v == 0 {
+		return false, err
+	} else if other, err := newTx.pageVersion(pgno); err != nil || other != v {
+		return false, err
+	}
+
+	// Restored backups reuse WAL IDs so the version alone does not identify
+	// the contents. Pages without checksums must be compared.
+	if sum, err := oldTx.storedChecksum(pgno); err != nil || sum == 0 {
+		return false, err
+	} else if other, err := newTx.storedChecksum(pgno); err != nil || other != sum {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameBranch returns true if pgno is an unchanged branch page in both
+// transactions, so every page below it is also unchanged.
+func sameBranch(oldTx, newTx *Tx, pgno uint32) (bool, error) {
+	if page, _, err := oldTx.readPage(pgno); err != nil || readFlags(page) != PageTypeBranch {
+		return false, err
+	}
+	return samePage(oldTx, newTx, pgno)
+}
+
+// diffSource walks the pages of a bitmap in key order. The child of a branch
+// page is pending until the walk moves into it, so it can be skipped unread.
+type diffSource struct {
+	tx      *Tx
+	stack   []diffFrame // pages from the root to the current page
+	first   uint64      // first key below the pending child, if firstOK
+	firstOK bool
+}
+
+// diffFrame is a page on the path to the current position of a diffSource.
+type diffFrame struct {
+	pgno  uint32
+	page  []byte
+	index int // current cell of a leaf or pending child of a branch
+}
+
+func (f *diffFrame) cell() leafCell { return readLeafCell(f.page, f.index) }
+
+func (tx *Tx) newDiffSource(name string) (*diffSource, error) {
+	s := &diffSource{tx: tx}
+	root, err := tx.root(name)
+	if err == ErrBitmapNotFound {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return s, s.push(root)
+}
+
+// push moves into the page at pgno.
+func (s *diffSource) push(pgno uint32) error {
+	page, _, err := s.tx.readPage(pgno)
+	if err != nil {
+		return err
+	}
+	s.stack = append(s.stack, diffFrame{pgno: pgno, page: page})
+	return nil
+}
+
+// load moves out of each page which has been read so the source is at a leaf
+// cell, a pending branch child or the end of the tree.
+func (s *diffSource) load() error {
+	for len(s.stack) > 0 {
+		if f := s.top(); f.index < readCellN(f.page) {
+			return nil
+		}
+		s.stack = s.stack[:len(s.stack)-1]
+		if len(s.stack) > 0 {
+			s.top().index++
+		}
+		s.firstOK = false
+	}
+	return nil
+}
+
+func (s *diffSource) top() *diffFrame { return &s.stack[len(s.stack)-1] }
+func (s *diffSource) done() bool      { return len(s.stack) == 0 }
+
+// pending returns true if the source is at a child of a branch page.
+func (s *diffSource) pending() bool {
+	return !s.done() && readFlags(s.top().page) == PageTypeBranch
+}
+
+func (s *diffSource) child() uint32 {
+	f := s.top()
+	return readBranchCell(f.page, f.index).ChildPgno
+}
+
+// skip moves past the pending child.
+func (s *diffSource) skip() {
+	s.top().index++
+	s.firstOK = false
+}
+
+// descend moves into the pending child. The first key is unchanged if the
+// child is also a branch page.
+func (s *diffSource) descend() error {
+	if err := s.push(s.child()); err != nil {
+		return err
+	}
+	s.firstOK = s.firstOK && s.pending()
+	return nil
+}
+
+// key returns the key of the current leaf cell or the first key below the
+// pending child. The keys of branch cells are not used as they are not kept
+// exact when a smaller key is inserted.
+func (s *diffSource) key() (uint64, error) {
+	if s.done() {
+		return 0, nil
+	} else if !s.pending() {
+		f := s.top()
+		return pageKeyAt(f.page, f.index), nil
+	} else if s.firstOK {
+		return s.first, nil
+	}
+
+	for pgno := s.child(); ; {
+		page, _, err := s.tx.readPage(pgno)
+		if err != nil {
+			return 0, err
+		} else if readFlags(page) == PageTypeBranch {
+			pgno = readBranchCell(page, 0).ChildPgno
+			continue
+		}
+		s.first, s.firstOK = pageKeyAt(page, 0), true
+		return s.first, nil
+	}
+}
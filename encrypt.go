@@ -0,0 +1,437 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Databases opened with a KeyProvider encrypt every page of the data & WAL
+// files with AES-GCM. Encrypted files have a different physical layout from
+// the logical pages seen by the rest of the package:
+//
+//	header page -> record page, 256 data pages -> record page, 256 data pages...
+//
+// The header page identifies the file as encrypted and holds a random file ID
+// and a value sealed with the key so that opening with the wrong key fails
+// immediately. Each record page holds the nonce & authentication tag of the
+// data pages which follow it. Nonces are random and the file ID & logical
+// page number are authenticated with each page so pages cannot be moved
+// within or between files. WAL segments are separate files so WAL pages are
+// bound to their WAL ID.
+
+var (
+	// ErrEncrypted is returned when opening an encrypted database without a
+	// KeyProvider.
+	ErrEncrypted = errors.New("rbf: database is encrypted")
+
+	// ErrNotEncrypted is returned when opening an unencrypted database with a
+	// KeyProvider.
+	ErrNotEncrypted = errors.New("rbf: database is not encrypted")
+
+	// ErrInvalidKey is returned when opening an encrypted database with a key
+	// other than the one it was created with.
+	ErrInvalidKey = errors.New("rbf: invalid encryption key")
+
+	// ErrDecrypt is returned when a page fails authentication.
+	ErrDecrypt = errors.New("rbf: page decryption failed")
+
+	// ErrCompressionEncrypted is returned when opening a database with both
+	// a KeyProvider & PageCompression.
+	ErrCompressionEncrypted = errors.New("rbf: page compression cannot be used with encryption")
+)
+
+// EncryptedMagic is the magic at the start of an encrypted file.
+const EncryptedMagic = "\xFFRBE"
+
+const (
+	encryptedVersion    = 1
+	encryptedRecordSize = 32 // nonce, tag, reserved
+	encryptedGroupN     = PageSize / encryptedRecordSize
+
+	encryptedNonceSize = 12
+	encryptedTagSize   = 16
+)
+
+// newAEAD returns the cipher for a key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("rbf: encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedPageOffset returns the physical offset of a logical page.
+func encryptedPageOffset(pgno uint32) int64 {
+	group := int64(pgno / encryptedGroupN)
+	return (1 + (group * (encryptedGroupN + 1)) + 1 + int64(pgno%encryptedGroupN)) * PageSize
+}
+
+// encryptedRecordOffset returns the physical offset of the record for a
+// logical page.
+func encryptedRecordOffset(pgno uint32) int64 {
+	group := int64(pgno / encryptedGroupN)
+	return (1+(group*(encryptedGroupN+1)))*PageSize + int64(pgno%encryptedGroupN)*encryptedRecordSize
+}
+
+// encryptedFileSize returns the physical size of a file with pageN logical
+// pages.
+func encryptedFileSize(pageN int64) int64 {
+	groupN := (pageN + encryptedGroupN - 1) / encryptedGroupN
+	return (1 + groupN + pageN) * PageSize
+}
+
+// encryptedPageN returns the number of whole logical pages in a file of the
+// given physical size.
+func encryptedPageN(size int64) int64 {
+	n := size/PageSize - 1 // header
+	if n <= 0 {
+		return 0
+	}
+	pageN := (n / (encryptedGroupN + 1)) * encryptedGroupN
+	if rem := n % (encryptedGroupN + 1); rem > 1 {
+		pageN += rem - 1
+	}
+	return pageN
+}
+
+// newEncryptedHeader returns a new header page for a key.
+func newEncryptedHeader(aead cipher.AEAD) ([]byte, error) {
+	page := make([]byte, PageSize)
+	copy(page, EncryptedMagic)
+	binary.BigEndian.PutUint32(page[4:], encryptedVersion)
+
+	nonce := page[8 : 8+encryptedNonceSize] // also the file ID
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead.Seal(page[8+encryptedNonceSize:8+encryptedNonceSize], nonce, make([]byte, 16), page[:8])
+	return page, nil
+}
+
+// verifyEncryptedHeader returns an error if page is not an encrypted header
+// created with the same key.
+func verifyEncryptedHeader(aead cipher.AEAD, page []byte) error {
+	if string(page[:4]) != EncryptedMagic {
+		return ErrNotEncrypted
+	} else if v := binary.BigEndian.Uint32(page[4:]); v != encryptedVersion {
+		return fmt.Errorf("rbf: unsupported encryption version: %d", v)
+	}
+
+	nonce := page[8 : 8+encryptedNonceSize]
+	sealed := page[8+encryptedNonceSize : 8+encryptedNonceSize+16+encryptedTagSize]
+	if _, err := aead.Open(nil, nonce, sealed, page[:8]); err != nil {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// isEncryptedFile returns true if page is the header page of an encrypted file.
+func isEncryptedFile(page []byte) bool {
+	return string(page[:4]) == EncryptedMagic
+}
+
+// encryptedPageAD returns the additional data authenticated with a page.
+func encryptedPageAD(header []byte, pgno uint32) []byte {
+	ad := make([]byte, encryptedNonceSize+4)
+	copy(ad, header[8:8+encryptedNonceSize])
+	binary.BigEndian.PutUint32(ad[encryptedNonceSize:], pgno)
+	return ad
+}
+
+// sealPage encrypts page into dst, which must have room for the page & its
+// tag, and writes the nonce & tag to record. The page is bound to the file
+// with the given header.
+func sealPage(aead cipher.AEAD, header, dst, record, page []byte, pgno uint32) error {
+	nonce := record[:encryptedNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	buf := aead.Seal(dst[:0], nonce, page, encryptedPageAD(header, pgno))
+	copy(record[encryptedNonceSize:], buf[PageSize:])
+	return nil
+}
+
+// openPage returns the decrypted contents of an encrypted page.
+func openPage(aead cipher.AEAD, header, page, record []byte, pgno uint32) ([]byte, error) {
+	ad := encryptedPageAD(header, pgno)
+	buf := make([]byte, PageSize+encryptedTagSize)
+	copy(buf, page)
+	copy(buf[PageSize:], record[encryptedNonceSize:encryptedNonceSize+encryptedTagSize])
+	if _, err := aead.Open(buf[:0], record[:encryptedNonceSize], buf, ad); err != nil {
+		return nil, fmt.Errorf("%w: pgno=%d", ErrDecrypt, pgno)
+	}
+	return buf[:PageSize:PageSize], nil
+}
+
+// encryptedVFS encrypts the files opened from another VFS.
+type encryptedVFS struct {
+	VFS
+	aead cipher.AEAD
+}
+
+// OpenFile opens a file from the underlying VFS. A header page is written to
+// new files and the header of existing files is verified against the key.
+func (vfs encryptedVFS) OpenFile(name string, readOnly bool, maxSize int64) (_ File, err error) {
+	if maxSize > 0 {
+		maxSize = encryptedFileSize(maxSize / PageSize)
+	}
+	f, err := vfs.VFS.OpenFile(name, readOnly, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	sz, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files which were created without a complete header have no pages.
+	if sz < PageSize {
+		if readOnly {
+			return &encryptedFile{File: f, aead: vfs.aead}, nil
+		}
+		header, err := newEncryptedHeader(vfs.aead)
+		if err != nil {
+			return nil, err
+		} else if _, err := f.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		return &encryptedFile{File: f, aead: vfs.aead, header: header}, nil
+	}
+
+	page, err := f.ReadPage(0)
+	if err != nil {
+		return nil, err
+	} else if err := verifyEncryptedHeader(vfs.aead, page); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, name)
+	}
+	return &encryptedFile{File: f, aead: vfs.aead, header: bytes.Clone(page)}, nil
+}
+
+// encryptedFile is a File whose pages are encrypted in an underlying File.
+// Pages returned by ReadPage are decrypted copies so they do not reflect later
+// writes. Writes must be whole pages.
+type encryptedFile struct {
+	File
+	aead   cipher.AEAD
+	header []byte // header page, nil if the file is empty & read-only
+}
+
+// ReadPage returns the decrypted contents of a page.
+func (f *encryptedFile) ReadPage(pgno uint32) ([]byte, error) {
+	if f.header == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	page, err := f.File.ReadPage(uint32(encryptedPageOffset(pgno) / PageSize))
+	if err != nil {
+		return nil, err
+	}
+	records, err := f.File.ReadPage(uint32(encryptedRecordOffset(pgno) / PageSize))
+	if err != nil {
+		return nil, err
+	}
+	i := int(pgno%encryptedGroupN) * encryptedRecordSize
+	return openPage(f.aead, f.header, page, records[i:i+encryptedRecordSize], pgno)
+}
+
+// WriteAt encrypts & writes whole pages starting at off. Pages in the same
+// group are written with a single write and their records with another.
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off%PageSize != 0 || len(p)%PageSize != 0 {
+		return 0, fmt.Errorf("rbf: unaligned write to encrypted file: off=%d len=%d", off, len(p))
+	}
+
+	for n := 0; n < len(p); {
+		// Encrypt the pages up to the end of the group.
+		pgno := uint32((off + int64(n)) / PageSize)
+		pageN := min((len(p)-n)/PageSize, encryptedGroupN-int(pgno%encryptedGroupN))
+		buf := make([]byte, (pageN*PageSize)+encryptedTagSize)
+		records := make([]byte, pageN*encryptedRecordSize)
+		for i := 0; i < pageN; i++ {
+			page := p[n+(i*PageSize) : n+((i+1)*PageSize)]
+			if err := sealPage(f.aead, f.header, buf[i*PageSize:], records[i*encryptedRecordSize:], page, pgno+uint32(i)); err != nil {
+				return n, err
+			}
+		}
+
+		if _, err := f.File.WriteAt(buf[:pageN*PageSize], encryptedPageOffset(pgno)); err != nil {
+			return n, err
+		} else if _, err := f.File.WriteAt(records, encryptedRecordOffset(pgno)); err != nil {
+			return n, err
+		}
+		n += pageN * PageSize
+	}
+	return len(p), nil
+}
+
+// Truncate changes the number of pages in the file. The header is kept.
+func (f *encryptedFile) Truncate(size int64) error {
+	if size%PageSize != 0 {
+		return fmt.Errorf("rbf: unaligned truncate of encrypted file: size=%d", size)
+	}
+	return f.File.Truncate(encryptedFileSize(size / PageSize))
+}
+
+// Size returns the size of the whole pages in the file.
+func (f *encryptedFile) Size() (int64, error) {
+	sz, err := f.File.Size()
+	if err != nil {
+		return 0, err
+	}
+	return encryptedPageN(sz) * PageSize, nil
+}
+
+// grow ensures the first size bytes of logical pages can be read.
+func (f *encryptedFile) grow(size int64) (release func() error, err error) {
+	if m, ok := f.File.(mappedFile); ok {
+		return m.grow(encryptedFileSize((size + PageSize - 1) / PageSize))
+	}
+	return nil, nil
+}
+
+// fs returns the VFS used for the data & WAL files.
+func (db *DB) fs() VFS {
+	if db.aead != nil {
+		return encryptedVFS{VFS: db.VFS, aead: db.aead}
+	}
+	return db.VFS
+}
+
+// openKey initializes the cipher from the key provider, if one is set.
+func (db *DB) openKey() error {
+	db.aead = nil
+	if db.cfg.KeyProvider == nil {
+		return nil
+	} else if db.cfg.PageCompression {
+		return ErrCompressionEncrypted
+	}
+
+	key, err := db.cfg.KeyProvider.Key(db.Path)
+	if err != nil {
+		return fmt.Errorf("rbf: get encryption key: %w", err)
+	}
+	db.aead, err = newAEAD(key)
+	return err
+}
+
+// encryptedBackup writes the snapshot as an encrypted file which can be
+// copied into place by Restore.
+func (tx *Tx) encryptedBackup(w io.Writer) error {
+	header := tx.db.data.(*encryptedFile).header
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	pageN := readMetaPageN(tx.meta[:])
+	for start := uint32(0); start < pageN; start += encryptedGroupN {
+		n := min(pageN-start, encryptedGroupN)
+		records := make([]byte, PageSize)
+		buf := make([]byte, (int(n)*PageSize)+encryptedTagSize)
+		for i := uint32(0); i < n; i++ {
+			page, _, err := tx.readRawPage(start + i)
+			if err != nil {
+				return err
+			} else if err := sealPage(tx.db.aead, header, buf[i*PageSize:], records[i*encryptedRecordSize:], page, start+i); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(records); err != nil {
+			return err
+		} else if _, err := w.Write(buf[:int(n)*PageSize]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEncryptedPages writes the header page of the data file followed by
+// each page encrypted for the data file & its encryption record.
+func (tx *Tx) writeEncryptedPages(w io.Writer, pgnos []uint32) error {
+	header := tx.db.data.(*encryptedFile).header
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, PageSize+encryptedTagSize+encryptedRecordSize)
+	for _, pgno := range pgnos {
+		page, _, err := tx.readRawPage(pgno)
+		if err != nil {
+			return err
+		}
+
+		record := buf[PageSize+encryptedTagSize:]
+		if err := sealPage(tx.db.aead, header, buf, record, page, pgno); err != nil {
+			return err
+		} else if _, err := w.Write(buf[:PageSize]); err != nil {
+			return err
+		} else if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRestoreHeader returns the first page of a file being restored or nil if
+// the file is empty.
+func readRestoreHeader(f *os.File) ([]byte, error) {
+	page := make([]byte, PageSize)
+	if _, err := f.ReadAt(page, 0); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// restoreEncryptedPages writes the pages of an encrypted incremental backup to
+// f. The pages cannot be decrypted so they are only checked to come from the
+// same data file as the rest of the chain.
+func restoreEncryptedPages(f *os.File, m *BackupManifest, r io.Reader) error {
+	header := make([]byte, PageSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("read encryption header: %w", err)
+	} else if !isEncryptedFile(header) {
+		return fmt.Errorf("%w: invalid encryption header", ErrInvalidBackup)
+	}
+
+	if prev, err := readRestoreHeader(f); err != nil {
+		return err
+	} else if prev == nil {
+		if _, err := f.WriteAt(header, 0); err != nil {
+			return err
+		}
+	} else if !bytes.Equal(prev, header) {
+		return fmt.Errorf("%w: backup of a different encrypted file", ErrBackupMismatch)
+	}
+
+	buf := make([]byte, PageSize+encryptedRecordSize)
+	for _, pgno := range m.Pgnos {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("read page %d: %w", pgno, err)
+		} else if _, err := f.WriteAt(buf[:PageSize], encryptedPageOffset(pgno)); err != nil {
+			return err
+		} else if _, err := f.WriteAt(buf[PageSize:], encryptedRecordOffset(pgno)); err != nil {
+			return err
+		}
+	}
+
+	// Remove any pages truncated from the end of the database.
+	return f.Truncate(encryptedFileSize(int64(m.PageN)))
+}
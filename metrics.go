@@ -0,0 +1,197 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"syscall"
+	"time"
+)
+
+// Stats holds database statistics. Counts & durations are totals since the
+// DB was created. WAL, storage & open transaction fields are current values.
+type Stats struct {
+	// Transactions.
+	ReadTxN      int64         // read transactions started
+	WriteTxN     int64         // write transactions started
+	OpenReadTxN  int           // read transactions currently open
+	OpenWriteTxN int           // write transactions currently open
+	CommitN      int64         // write transactions committed
+	CommitTime   time.Duration // total commit latency
+	DirtyPageN   int64         // dirty pages written by commits
+
+	// Writers which waited for the WAL to be checkpointed.
+	WriterHaltN    int64
+	WriterHaltTime time.Duration
+
+	// WAL pages which have not been checkpointed.
+	WALSize     int64
+	WALPageN    int
+	WALSegmentN int
+
+	// Checkpoints.
+	CheckpointN        int64
+	CheckpointTime     time.Duration
+	CheckpointBytes    int64
+	CheckpointBlockedN int64 // attempts held back by read-only databases
+
+	// Page I/O. Reads are counted when transactions close.
+	WALPageReadN   int64 // pages read from the WAL
+	DataPageReadN  int64 // pages read from the data file
+	WALPageWriteN  int64 // pages appended to the WAL
+	DataPageWriteN int64 // pages copied to the data file by checkpoints
+
+	// Storage.
+	PageN     uint32 // pages in the database
+	FreePageN int    // pages on the freelist
+
+	// Page faults, which include faults on memory mapped files. These are
+	// reported for the whole process and are zero where not supported.
+	MinorFaultN int64
+	MajorFaultN int64
+}
+
+// MetricsSink receives metrics as they are recorded by a DB. Methods are
+// called synchronously, sometimes while the DB holds internal locks, so they
+// must not block or call back into the DB. Implementations should embed
+// NopMetricsSink so that methods can be added in the future.
+type MetricsSink interface {
+	// TxStarted is called when a transaction begins.
+	TxStarted(writable bool)
+
+	// TxClosed is called when a transaction commits or rolls back with the
+	// time it was open & the number of pages it read.
+	TxClosed(writable bool, d time.Duration, pageReadN int)
+
+	// Committed is called when a write transaction commits with the commit
+	// latency & the number of dirty pages written.
+	Committed(d time.Duration, dirtyPageN int)
+
+	// WriterHalted is called when a writer had to wait for the WAL to be
+	// checkpointed before it could begin.
+	WriterHalted(d time.Duration)
+
+	// Checkpointed is called when a checkpoint completes.
+	Checkpointed(stats CheckpointStats)
+
+	// CheckpointBlocked is called when a checkpoint cannot start because
+	// read-only databases are reading.
+	CheckpointBlocked()
+}
+
+// NopMetricsSink is a MetricsSink which discards all metrics.
+type NopMetricsSink struct{}
+
+func (NopMetricsSink) TxStarted(writable bool)                                {}
+func (NopMetricsSink) TxClosed(writable bool, d time.Duration, pageReadN int) {}
+func (NopMetricsSink) Committed(d time.Duration, dirtyPageN int)              {}
+func (NopMetricsSink) WriterHalted(d time.Duration)                           {}
+func (NopMetricsSink) Checkpointed(stats CheckpointStats)                     {}
+func (NopMetricsSink) CheckpointBlocked()                                     {}
+
+// Stats returns a snapshot of the database statistics.
+func (db *DB) Stats() (Stats, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer tx.Rollback()
+
+	free, err := tx.freePageSet()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	db.mu.RLock()
+	stats := db.stats
+	for other := range db.txs {
+		if other == tx {
+			continue
+		} else if other.writable {
+			stats.OpenWriteTxN++
+		} else {
+			stats.OpenReadTxN++
+		}
+	}
+	stats.WALSize = db.walSize()
+	stats.WALPageN = db.walPageN - db.walStart
+	if db.wal != nil {
+		stats.WALSegmentN = len(*db.wal.segments.Load())
+	}
+	db.mu.RUnlock()
+
+	stats.ReadTxN-- // exclude this transaction
+	stats.PageN = readMetaPageN(tx.meta[:])
+	stats.FreePageN = len(free)
+
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
+		stats.MinorFaultN, stats.MajorFaultN = int64(ru.Minflt), int64(ru.Majflt)
+	}
+	return stats, nil
+}
+
+// recordTxStart records a new transaction. Must be called while holding db.mu.
+func (db *DB) recordTxStart(tx *Tx) {
+	if tx.writable {
+		db.stats.WriteTxN++
+	} else {
+		db.stats.ReadTxN++
+	}
+	if db.Metrics != nil {
+		db.Metrics.TxStarted(tx.writable)
+	}
+}
+
+// recordTxClose records a closed transaction. Must be called while holding
+// db.mu.
+func (db *DB) recordTxClose(tx *Tx) {
+	walReadN, dataReadN := tx.walPageReadN.Load(), tx.dataPageReadN.Load()
+	db.stats.WALPageReadN += walReadN
+	db.stats.DataPageReadN += dataReadN
+	if db.Metrics != nil {
+		db.Metrics.TxClosed(tx.writable, time.Since(tx.start), int(walReadN+dataReadN))
+	}
+}
+
+// recordCommit records a committed write transaction. Must be called while
+// holding db.mu.
+func (db *DB) recordCommit(d time.Duration, dirtyPageN, walPageN int) {
+	db.stats.CommitN++
+	db.stats.CommitTime += d
+	db.stats.DirtyPageN += int64(dirtyPageN)
+	db.stats.WALPageWriteN += int64(walPageN)
+	if db.Metrics != nil {
+		db.Metrics.Committed(d, dirtyPageN)
+	}
+}
+
+// recordWriterHalt records a writer waiting for a checkpoint. Must be called
+// while holding db.mu.
+func (db *DB) recordWriterHalt(d time.Duration) {
+	db.stats.WriterHaltN++
+	db.stats.WriterHaltTime += d
+	if db.Metrics != nil {
+		db.Metrics.WriterHalted(d)
+	}
+}
+
+// recordCheckpoint records a completed checkpoint. Must be called while
+// holding db.mu.
+func (db *DB) recordCheckpoint(stats CheckpointStats) {
+	db.stats.CheckpointN++
+	db.stats.CheckpointTime += stats.Duration
+	db.stats.CheckpointBytes += int64(stats.PageN) * PageSize
+	db.stats.DataPageWriteN += int64(stats.PageN)
+	if db.Metrics != nil {
+		db.Metrics.Checkpointed(stats)
+	}
+}
+
+// recordCheckpointBlocked records a checkpoint held back by read-only
+// databases. Must be called while holding db.mu.
+func (db *DB) recordCheckpointBlocked() {
+	db.stats.CheckpointBlockedN++
+	if db.Metrics != nil {
+		db.Metrics.CheckpointBlocked()
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A pageTable stores a fixed-size entry for every page in the database. Bitmap
+// pages use the entire page for data so per-page metadata is stored
+// out-of-band in a two-level table:
+//
+//	meta page -> directory pages -> table pages -> entries
+//
+// Each table page holds the entries for a contiguous range of page numbers.
+// Table & directory pages are not listed in any table themselves. Instead,
+// they carry a checksum of their own contents in their header. An entry of
+// all zeros means that nothing has been recorded for the page.
+type pageTable struct {
+	dirOffset int    // offset of directory pgnos within the meta page
+	dirN      int    // number of directory pgnos in the meta page
+	entrySize int    // size of a single entry, in bytes
+	dirType   uint32 // page type of directory pages
+	typ       uint32 // page type of table pages
+}
+
+const (
+	tablePageHeaderSize = 4 + 4 + 4 // pgno, flags, checksum
+	dirEntriesPerPage   = (PageSize - tablePageHeaderSize) / 4
+)
+
+// checksumTable holds a CRC-32C checksum for every page. It has enough
+// directories for every 32-bit page number and the rest of the meta page is
+// used by countTable.
+var checksumTable = pageTable{
+	dirOffset: 256,
+	dirN:      1028,
+	entrySize: 4,
+	dirType:   PageTypeChecksumDir,
+	typ:       PageTypeChecksum,
+}
+
+// versionTable holds the WAL ID of the last commit that wrote each page. It
+// covers the first 48 * 2045 * 1022 pages, about 765GB. Pages past the end of
+// the table have no version and are always included in incremental backups.
+var versionTable = pageTable{
+	dirOffset: 64,
+	dirN:      (256 - 64) / 4,
+	entrySize: 8,
+	dirType:   PageTypeVersionDir,
+	typ:       PageTypeVersion,
+}
+
+// compressionTable holds the frame page, slot & frame length of every
+// compressed page. Pages which are stored uncompressed have no entry. It
+// covers the first 8 * 2045 * 1022 pages, about 127GB. Pages past the end of
+// the table are always stored uncompressed.
+var compressionTable = pageTable{
+	dirOffset: 32,
+	dirN:      (64 - 32) / 4,
+	entrySize: 8,
+	dirType:   PageTypeCompressionDir,
+	typ:       PageTypeCompression,
+}
+
+// countTable holds the bit count of every bitmap, by root page number.
+// Bitmaps whose count has not been recorded have no entry.
+var countTable = pageTable{
+	dirOffset: 256 + (1028 * 4),
+	dirN:      (PageSize - (256 + (1028 * 4))) / 4,
+	entrySize: 8,
+	dirType:   PageTypeCountDir,
+	typ:       PageTypeCount,
+}
+
+// pageTables is the list of all tables stored in the file.
+var pageTables = []*pageTable{&checksumTable, &versionTable, &compressionTable, &countTable}
+
+func (t *pageTable) entriesPerPage() int {
+	return (PageSize - tablePageHeaderSize) / t.entrySize
+}
+
+// index returns the directory index, the directory slot, and the table page
+// slot for a page number.
+func (t *pageTable) index(pgno uint32) (dirIndex, dirSlot, slot int) {
+	n := uint32(t.entriesPerPage())
+	group := pgno / n
+	return int(group / dirEntriesPerPage), int(group % dirEntriesPerPage), int(pgno % n)
+}
+
+func (t *pageTable) readDirPgno(meta []byte, i int) uint32 {
+	return binary.BigEndian.Uint32(meta[t.dirOffset+(i*4):])
+}
+
+func (t *pageTable) writeDirPgno(meta []byte, i int, pgno uint32) {
+	binary.BigEndian.PutUint32(meta[t.dirOffset+(i*4):], pgno)
+}
+
+// entry returns the bytes of the entry at slot i of a table page.
+func (t *pageTable) entry(page []byte, i int) []byte {
+	offset := tablePageHeaderSize + (i * t.entrySize)
+	return page[offset : offset+t.entrySize]
+}
+
+// tablePageSum returns the checksum of a table or directory page, excluding
+// the checksum stored in its own header.
+func tablePageSum(page []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, page[:8])
+	return crc32.Update(sum, castagnoli, page[tablePageHeaderSize:])
+}
+
+func readTablePageSum(page []byte) uint32     { return binary.BigEndian.Uint32(page[8:]) }
+func writeTablePageSum(page []byte, v uint32) { binary.BigEndian.PutUint32(page[8:], v) }
+
+func readDirEntry(page []byte, i int) uint32 {
+	return binary.BigEndian.Uint32(page[tablePageHeaderSize+(i*4):])
+}
+
+func writeDirEntry(page []byte, i int, pgno uint32) {
+	binary.BigEndian.PutUint32(page[tablePageHeaderSize+(i*4):], pgno)
+}
+
+// isTablePage returns true if page belongs to a page table.
+func isTablePage(page []byte) bool {
+	switch readFlags(page) {
+	case PageTypeChecksum, PageTypeChecksumDir, PageTypeVersion, PageTypeVersionDir,
+		PageTypeCompression, PageTypeCompressionDir, PageTypeCount, PageTypeCountDir:
+		return true
+	default:
+		return false
+	}
+}
+
+// tableEntry returns the entry for pgno or nil if none has been recorded.
+// The returned slice must not be modified.
+func (tx *Tx) tableEntry(t *pageTable, pgno uint32) ([]byte, error) {
+	dirIndex, dirSlot, slot := t.index(pgno)
+	if dirIndex >= t.dirN {
+		return nil, nil
+	}
+
+	dirPgno := t.readDirPgno(tx.meta[:], dirIndex)
+	if dirPgno == 0 {
+		return nil, nil
+	}
+	dir, err := tx.readTablePage(dirPgno, t.dirType)
+	if err != nil {
+		return nil, err
+	}
+
+	tpgno := readDirEntry(dir, dirSlot)
+	if tpgno == 0 {
+		return nil, nil
+	}
+	page, err := tx.readTablePage(tpgno, t.typ)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry(page, slot), nil
+}
+
+// writableTableEntry returns a writable entry for pgno, allocating table and
+// directory pages as needed. Directory pages are only dirtied when a new
+// table page is added to them.
+func (tx *Tx) writableTableEntry(t *pageTable, pgno uint32) ([]byte, error) {
+	dirIndex, dirSlot, slot := t.index(pgno)
+	if dirIndex >= t.dirN {
+		return nil, fmt.Errorf("rbf: page number exceeds page table: pgno=%d type=%d", pgno, t.typ)
+	}
+
+	dirPgno := t.readDirPgno(tx.meta[:], dirIndex)
+	if dirPgno == 0 {
+		dirPgno = tx.newTablePage(t.dirType)
+		t.writeDirPgno(tx.meta[:], dirIndex, dirPgno)
+	}
+	dir, err := tx.readTablePage(dirPgno, t.dirType)
+	if err != nil {
+		return nil, err
+	}
+
+	tpgno := readDirEntry(dir, dirSlot)
+	if tpgno == 0 {
+		if dir, err = tx.writableTablePage(dirPgno); err != nil {
+			return nil, err
+		}
+		tpgno = tx.newTablePage(t.typ)
+		writeDirEntry(dir, dirSlot, tpgno)
+	}
+
+	page, err := tx.writableTablePage(tpgno)
+	if err != nil {
+		return nil, err
+	}
+	return t.entry(page, slot), nil
+}
+
+// readTablePage reads a table or directory page and verifies it against the
+// checksum in its header. Dirty pages are not verified as their header is
+// only updated when the transaction is flushed.
+func (tx *Tx) readTablePage(pgno, typ uint32) ([]byte, error) {
+	page, isHeap, err := tx.readRawPage(pgno)
+	if err != nil || isHeap {
+		return page, err
+	} else if _, ok := tx.verified.Load(pgno); ok {
+		return page, nil
+	}
+
+	if readFlags(page) != typ || readTablePageSum(page) != tablePageSum(page) {
+		return nil, &ChecksumError{Pgno: pgno}
+	}
+	tx.verified.Store(pgno, struct{}{})
+	return page, nil
+}
+
+// newTablePage allocates an empty table or directory page. Pages are always
+// allocated from the end of the file so that the freelist, and therefore the
+// set of dirty pages, does not change while tables are being written.
+func (tx *Tx) newTablePage(typ uint32) uint32 {
+	pgno := tx.allocateNewPgno()
+	page := allocPage()
+	writePageNo(page, pgno)
+	writeFlags(page, typ)
+	tx.dirtyPages[pgno] = page
+	return pgno
+}
+
+// writableTablePage returns a dirty copy of a table or directory page.
+func (tx *Tx) writableTablePage(pgno uint32) ([]byte, error) {
+	if page := tx.dirtyPages[pgno]; page != nil && !tx.isSavepointPage(pgno) {
+		return page, nil
+	}
+	src, _, err := tx.readRawPage(pgno)
+	if err != nil {
+		return nil, err
+	}
+	page := allocPage()
+	copy(page, src)
+	tx.dirtyPages[pgno] = page
+	return page, nil
+}
+
+// sealTablePages updates the header checksum of all dirty table pages.
+func (tx *Tx) sealTablePages() {
+	for _, page := range tx.dirtyPages {
+		if isTablePage(page) {
+			writeTablePageSum(page, tablePageSum(page))
+		}
+	}
+}
+
+// tablePgnos returns the page numbers of all pages used by a table.
+func (tx *Tx) tablePgnos(t *pageTable) ([]uint32, error) {
+	var a []uint32
+	for i := 0; i < t.dirN; i++ {
+		dirPgno := t.readDirPgno(tx.meta[:], i)
+		if dirPgno == 0 {
+			continue
+		}
+		a = append(a, dirPgno)
+
+		dir, err := tx.readTablePage(dirPgno, t.dirType)
+		if err != nil {
+			return a, err
+		}
+		for j := 0; j < dirEntriesPerPage; j++ {
+			if pgno := readDirEntry(dir, j); pgno != 0 {
+				a = append(a, pgno)
+			}
+		}
+	}
+	return a, nil
+}
+
+// allTablePgnos returns the page numbers of all pages used by all tables.
+func (tx *Tx) allTablePgnos() ([]uint32, error) {
+	var a []uint32
+	for _, t := range pageTables {
+		pgnos, err := tx.tablePgnos(t)
+		a = append(a, pgnos...)
+		if err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// truncateLastTablePage moves the last page in the file to a free page if it
+// is a page table page. Table pages are allocated at the end of the file so
+// this allows free pages before them to be truncated. Returns true if a page
+// was moved.
+func (tx *Tx) truncateLastTablePage() (bool, error) {
+	pgno := readMetaPageN(tx.meta[:]) - 1
+	if !isTablePage(tx.mustReadRawPage(pgno)) {
+		return false, nil
+	}
+
+	for _, t := range pageTables {
+		t := t
+		for i := 0; i < t.dirN; i++ {
+			dirPgno := t.readDirPgno(tx.meta[:], i)
+			if dirPgno == 0 {
+				continue
+			}
+
+			dir, err := tx.readTablePage(dirPgno, t.dirType)
+			if err != nil {
+				return false, err
+			}
+
+			if dirPgno == pgno {
+				i := i
+				return tx.moveTablePage(pgno, isEmptyDir(dir), func(newPgno uint32) error {
+					t.writeDirPgno(tx.meta[:], i, newPgno)
+					return nil
+				})
+			}
+
+			for j := 0; j < dirEntriesPerPage; j++ {
+				if readDirEntry(dir, j) != pgno {
+					continue
+				}
+
+				// A table page which only covers pages past the end of the
+				// file can be removed entirely.
+				start := uint64((i*dirEntriesPerPage)+j) * uint64(t.entriesPerPage())
+				return tx.moveTablePage(pgno, start >= uint64(pgno), func(newPgno uint32) error {
+					dir, err := tx.writableTablePage(dirPgno)
+					if err != nil {
+						return err
+					}
+					writeDirEntry(dir, j, newPgno)
+					return nil
+				})
+			}
+		}
+	}
+	return false, nil
+}
+
+// moveTablePage removes the table page at pgno, which must be the last page
+// in the file. If remove is false then the page is copied to a free page
+// first. The setParent function updates the reference to the page.
+func (tx *Tx) moveTablePage(pgno uint32, remove bool, setParent func(uint32) error) (bool, error) {
+	var newPgno uint32
+	if !remove {
+		// Only relocate if there is a free page to move to.
+		if ok, err := tx.hasFreePages(); err != nil || !ok {
+			return false, err
+		}
+
+		src, err := tx.readTablePage(pgno, readFlags(tx.mustReadRawPage(pgno)))
+		if err != nil {
+			return false, err
+		}
+		if newPgno, err = tx.allocatePgno(); err != nil {
+			return false, err
+		}
+		page := allocPage()
+		copy(page, src)
+		writePageNo(page, newPgno)
+		tx.dirtyPages[newPgno] = page
+	}
+
+	if err := setParent(newPgno); err != nil {
+		return false, err
+	}
+	delete(tx.dirtyPages, pgno)
+
+	// Allocation can grow the freelist past the end of the file. In that
+	// case the old page must be freed instead.
+	if pageN := readMetaPageN(tx.meta[:]); pgno != pageN-1 {
+		return true, tx.freePgno(pgno)
+	}
+	writeMetaPageN(tx.meta[:], pgno)
+	return true, nil
+}
+
+// hasFreePages returns true if the freelist is not empty.
+func (tx *Tx) hasFreePages() (bool, error) {
+	c := tx.db.getFreelistCursor(tx)
+	defer c.unpooledClose()
+	if err := c.First(); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isEmptyDir returns true if a directory page does not reference any pages.
+func isEmptyDir(dir []byte) bool {
+	for j := 0; j < dirEntriesPerPage; j++ {
+		if readDirEntry(dir, j) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mustReadRawPage returns the page or an empty page if it cannot be read.
+// It is only used to determine page types.
+func (tx *Tx) mustReadRawPage(pgno uint32) []byte {
+	page, _, err := tx.readRawPage(pgno)
+	if err != nil {
+		return make([]byte, PageSize)
+	}
+	return page
+}
@@ -0,0 +1,563 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/gernest/roaring"
+)
+
+// Bitmaps are exchanged with other Roaring implementations using the portable
+// 64-bit format. It begins with the number of buckets, each holding the bits
+// which share their high 32 bits. A bucket is the high 32 bits followed by a
+// 32-bit portable Roaring bitmap of the low 32 bits. All integers are little
+// endian.
+//
+// A 32-bit bitmap begins with a cookie. If any container is a run, the cookie
+// holds the container count and is followed by a bitset marking the run
+// containers. Otherwise the count follows the cookie. The key & cardinality
+// minus one of each container follow, then the offset of each container from
+// the start of the bitmap, which is left out if there are runs and fewer than
+// four containers, and finally the containers. A container which is not a run
+// is an array of values if it holds up to 4096 bits and a bitset otherwise.
+// Runs are stored as a start and a length.
+
+const (
+	portableCookie      = 12347 // has run containers
+	portableCookieNoRun = 12346 // only array & bitmap containers
+
+	portableNoOffsetThreshold = 4
+	portableArrayMaxSize      = 4096
+)
+
+// ErrInvalidPortableBitmap is returned by ReadBitmapFrom if the data is not a
+// portable Roaring bitmap.
+var ErrInvalidPortableBitmap = errors.New("rbf: invalid portable roaring bitmap")
+
+// portableContainer describes a container in the portable format.
+type portableContainer struct {
+	key  uint64 // 64-bit container key
+	typ  byte   // roaring.ContainerArray, ContainerBitmap or ContainerRun
+	n    int    // bit count
+	runN int    // number of runs
+}
+
+// size returns the number of bytes of the container's data.
+func (pc *portableContainer) size() int {
+	switch pc.typ {
+	case roaring.ContainerArray:
+		return 2 * pc.n
+	case roaring.ContainerRun:
+		return 2 + 4*pc.runN
+	default:
+		return PageSize
+	}
+}
+
+// WriteBitmapTo writes a bitmap to w in the portable 64-bit Roaring format
+// used by other Roaring implementations. Containers are read from the b-tree
+// as they are written so the bitmap is never held in memory. A bitmap which
+// does not exist is written as an empty bitmap. Returns the number of bytes
+// written.
+func (tx *Tx) WriteBitmapTo(name string, w io.Writer) (n int64, err error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if name == "" {
+		return 0, ErrBitmapNameRequired
+	}
+
+	c, err := tx.cursor(name)
+	if err == ErrBitmapNotFound {
+		return writePortableBuf(w, binary.LittleEndian.AppendUint64(nil, 0), 0)
+	} else if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	// The bucket count is written first so the buckets are counted before
+	// any are written.
+	var bucketN, bucketKey uint64
+	if err := c.eachLeafCell(0, func(cell leafCell) (bool, error) {
+		if bucketN == 0 || cell.Key>>16 != bucketKey {
+			bucketN++
+			bucketKey = cell.Key >> 16
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if n, err = writePortableBuf(w, binary.LittleEndian.AppendUint64(nil, bucketN), n); err != nil {
+		return n, err
+	}
+
+	// The type & size of every container in a bucket are written in its
+	// header before their data, so each bucket is read twice: once for the
+	// cell headers and once for the data. Only the headers of the current
+	// bucket are held.
+	var pcs []portableContainer
+	var buf []byte
+	for key, i := uint64(0), uint64(0); i < bucketN; i++ {
+		pcs = pcs[:0]
+		if err := c.eachLeafCell(key, func(cell leafCell) (bool, error) {
+			if len(pcs) > 0 && cell.Key>>16 != pcs[0].key>>16 {
+				key = cell.Key
+				return false, nil
+			}
+			pcs = append(pcs, newPortableContainer(cell))
+			return true, nil
+		}); err != nil {
+			return n, err
+		}
+
+		if n, err = writePortableBuf(w, appendPortableHeader(buf[:0], pcs), n); err != nil {
+			return n, err
+		}
+
+		var j int
+		if err := c.eachLeafCell(pcs[0].key, func(cell leafCell) (bool, error) {
+			if j == len(pcs) {
+				return false, nil
+			}
+			if buf, err = tx.appendPortableContainer(buf[:0], &pcs[j], cell); err != nil {
+				return false, err
+			} else if n, err = writePortableBuf(w, buf, n); err != nil {
+				return false, err
+			}
+			j++
+			return true, nil
+		}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// newPortableContainer returns the portable container type & size of cell.
+func newPortableContainer(cell leafCell) portableContainer {
+	pc := portableContainer{key: cell.Key, n: cell.BitN}
+	switch {
+	case cell.Type == ContainerTypeRLE:
+		pc.typ, pc.runN = roaring.ContainerRun, cell.ElemN
+	case cell.BitN <= portableArrayMaxSize:
+		pc.typ = roaring.ContainerArray
+	default:
+		pc.typ = roaring.ContainerBitmap
+	}
+	return pc
+}
+
+// eachLeafCell calls fn for each leaf cell of the cursor's bitmap in order,
+// starting at the first container with a key of at least key, until fn
+// returns false.
+func (c *Cursor) eachLeafCell(key uint64, fn func(cell leafCell) (bool, error)) error {
+	if _, err := c.Seek(key); err != nil {
+		return err
+	}
+
+	for {
+		if err := c.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		elem := &c.stack.elems[c.stack.top]
+		leafPage, _, err := c.readPage(elem.pgno)
+		if err != nil {
+			return err
+		}
+		if more, err := fn(readLeafCell(leafPage, elem.index)); err != nil || !more {
+			return err
+		}
+	}
+}
+
+func writePortableBuf(w io.Writer, buf []byte, n int64) (int64, error) {
+	nn, err := w.Write(buf)
+	return n + int64(nn), err
+}
+
+// appendPortableHeader appends the high bits of the bucket holding pcs and the
+// header of its 32-bit bitmap to buf.
+func appendPortableHeader(buf []byte, pcs []portableContainer) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(pcs[0].key>>16))
+	start := len(buf)
+
+	hasRun := false
+	for i := range pcs {
+		hasRun = hasRun || pcs[i].typ == roaring.ContainerRun
+	}
+	if hasRun {
+		buf = binary.LittleEndian.AppendUint32(buf, portableCookie|uint32(len(pcs)-1)<<16)
+		runs := make([]byte, (len(pcs)+7)/8)
+		for i := range pcs {
+			if pcs[i].typ == roaring.ContainerRun {
+				runs[i/8] |= 1 << (i % 8)
+			}
+		}
+		buf = append(buf, runs...)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, portableCookieNoRun)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(pcs)))
+	}
+
+	for i := range pcs {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(pcs[i].key))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(pcs[i].n-1))
+	}
+
+	if !hasRun || len(pcs) >= portableNoOffsetThreshold {
+		offset := len(buf) - start + 4*len(pcs)
+		for i := range pcs {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(offset))
+			offset += pcs[i].size()
+		}
+	}
+	return buf
+}
+
+// appendPortableContainer appends the data of cell to buf as the container
+// type described by pc.
+func (tx *Tx) appendPortableContainer(buf []byte, pc *portableContainer, cell leafCell) ([]byte, error) {
+	var words []uint64
+	if cell.Type == ContainerTypeBitmapPtr {
+		var err error
+		if _, words, err = tx.leafCellBitmap(toPgno(cell.Data)); err != nil {
+			return buf, err
+		}
+	}
+
+	switch pc.typ {
+	case roaring.ContainerRun:
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(pc.runN))
+		for _, iv := range toInterval16(cell.Data) {
+			buf = binary.LittleEndian.AppendUint16(buf, iv.Start)
+			buf = binary.LittleEndian.AppendUint16(buf, iv.Last-iv.Start)
+		}
+
+	case roaring.ContainerArray:
+		var values []uint16
+		if words != nil {
+			values = bitmapValues(words)
+		} else {
+			values = cell.Values(tx)
+		}
+		for _, v := range values {
+			buf = binary.LittleEndian.AppendUint16(buf, v)
+		}
+
+	default:
+		if words == nil {
+			words = cell.Bitmap(tx)
+		}
+		for _, v := range words {
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		}
+	}
+	return buf, nil
+}
+
+// ReadBitmapFrom adds the bits of a bitmap in the portable 64-bit Roaring
+// format, as written by WriteBitmapTo, to a bitmap. The bitmap is created if
+// it does not exist. Containers are written as they are read so the bitmap is
+// never held in memory, and an empty bitmap is built with BulkLoad. Returns the
+// number of bytes read.
+//
+// Only the bitmap is read from r so it may be followed by other data. If an
+// error is returned, containers read before it may have been written.
+func (tx *Tx) ReadBitmapFrom(name string, r io.Reader) (n int64, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !tx.writable {
+		return 0, ErrTxNotWritable
+	} else if name == "" {
+		return 0, ErrBitmapNameRequired
+	}
+
+	itr := &portableIterator{r: r}
+	if itr.bucketN, itr.err = itr.readUint64(); itr.err != nil {
+		return itr.n, itr.err
+	}
+
+	if err := tx.bulkLoad(name, itr); err == ErrBitmapNotEmpty {
+		err = tx.mergePortableBitmap(name, itr)
+	}
+	if itr.err != nil {
+		return itr.n, itr.err
+	}
+	return itr.n, err
+}
+
+// mergePortableBitmap adds the containers of itr to an existing bitmap.
+func (tx *Tx) mergePortableBitmap(name string, itr *portableIterator) error {
+	c, err := tx.cursor(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for itr.Next() {
+		key, ct := itr.Value()
+		if exact, err := c.Seek(key); err != nil {
+			return err
+		} else if exact {
+			elem := &c.stack.elems[c.stack.top]
+			leafPage, _, err := c.readPage(elem.pgno)
+			if err != nil {
+				return err
+			}
+			prev := toContainer(readLeafCell(leafPage, elem.index), tx)
+			if ct = roaring.Union(prev, ct); ct.N() == prev.N() {
+				continue
+			}
+		}
+		if err := c.putLeafCell(ConvertToLeafArgs(key, roaring.Optimize(ct))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portableIterator reads the containers of a portable 64-bit Roaring bitmap
+// from a reader. Reading stops at the first error.
+type portableIterator struct {
+	r   io.Reader
+	n   int64 // bytes read
+	err error
+
+	bucketN uint64              // buckets remaining after the current one
+	high    uint64              // high 32 bits of the current bucket
+	pcs     []portableContainer // containers remaining in the current bucket
+	prev    uint64              // key of the previous container
+	started bool
+
+	key     uint64
+	ct      *roaring.Container
+	scratch []byte
+}
+
+// Close is a no-op as the reader is owned by the caller.
+func (itr *portableIterator) Close() {}
+
+// Value returns the current key & container.
+func (itr *portableIterator) Value() (uint64, *roaring.Container) {
+	return itr.key, itr.ct
+}
+
+// Next reads the next container.
+func (itr *portableIterator) Next() bool {
+	if itr.err != nil {
+		return false
+	}
+	for len(itr.pcs) == 0 {
+		if itr.bucketN == 0 {
+			return false
+		}
+		itr.bucketN--
+		if itr.err = itr.readHeader(); itr.err != nil {
+			return false
+		}
+	}
+
+	pc := &itr.pcs[0]
+	itr.pcs = itr.pcs[1:]
+	if itr.started && pc.key <= itr.prev {
+		itr.err = fmt.Errorf("%w: key %d does not follow key %d", ErrInvalidPortableBitmap, pc.key, itr.prev)
+		return false
+	}
+	itr.prev, itr.started = pc.key, true
+
+	itr.key = pc.key
+	itr.ct, itr.err = itr.readContainer(pc)
+	return itr.err == nil
+}
+
+// readHeader reads the high bits & header of the next bucket.
+func (itr *portableIterator) readHeader() error {
+	high, err := itr.readUint32()
+	if err != nil {
+		return err
+	}
+	itr.high = uint64(high)
+
+	cookie, err := itr.readUint32()
+	if err != nil {
+		return err
+	}
+	offset := 4 // bytes since the start of the 32-bit bitmap
+
+	var size int
+	var runs []byte
+	switch {
+	case cookie&0xFFFF == portableCookie:
+		size = int(cookie>>16) + 1
+		if runs, err = itr.read((size + 7) / 8); err != nil {
+			return err
+		}
+		runs = append([]byte(nil), runs...)
+	case cookie == portableCookieNoRun:
+		v, err := itr.readUint32()
+		if err != nil {
+			return err
+		} else if v > 1<<16 {
+			return fmt.Errorf("%w: container count %d", ErrInvalidPortableBitmap, v)
+		}
+		size = int(v)
+	default:
+		return fmt.Errorf("%w: cookie %d", ErrInvalidPortableBitmap, cookie)
+	}
+	offset += len(runs)
+	if runs == nil {
+		offset += 4
+	}
+
+	hdr, err := itr.read(4 * size)
+	if err != nil {
+		return err
+	}
+	offset += len(hdr)
+
+	itr.pcs = itr.pcs[:0]
+	for i := 0; i < size; i++ {
+		pc := portableContainer{
+			key: itr.high<<16 | uint64(binary.LittleEndian.Uint16(hdr[4*i:])),
+			n:   int(binary.LittleEndian.Uint16(hdr[4*i+2:])) + 1,
+			typ: roaring.ContainerBitmap,
+		}
+		if runs != nil && runs[i/8]&(1<<(i%8)) != 0 {
+			pc.typ = roaring.ContainerRun
+		} else if pc.n <= portableArrayMaxSize {
+			pc.typ = roaring.ContainerArray
+		}
+		itr.pcs = append(itr.pcs, pc)
+	}
+
+	// Containers are read in order so offsets are only checked.
+	if runs == nil || size >= portableNoOffsetThreshold {
+		offsets, err := itr.read(4 * size)
+		if err != nil {
+			return err
+		}
+		offset += len(offsets)
+		for i := range itr.pcs {
+			if itr.pcs[i].typ == roaring.ContainerRun {
+				break // run sizes are not known until read
+			} else if v := binary.LittleEndian.Uint32(offsets[4*i:]); v != uint32(offset) {
+				return fmt.Errorf("%w: container offset %d, expected %d", ErrInvalidPortableBitmap, v, offset)
+			}
+			offset += itr.pcs[i].size()
+		}
+	}
+	return nil
+}
+
+// readContainer reads the data of the container described by pc.
+func (itr *portableIterator) readContainer(pc *portableContainer) (*roaring.Container, error) {
+	switch pc.typ {
+	case roaring.ContainerRun:
+		v, err := itr.readUint16()
+		if err != nil {
+			return nil, err
+		}
+		data, err := itr.read(4 * int(v))
+		if err != nil {
+			return nil, err
+		}
+
+		runs := make([]roaring.Interval16, v)
+		n := 0
+		for i := range runs {
+			start, length := binary.LittleEndian.Uint16(data[4*i:]), binary.LittleEndian.Uint16(data[4*i+2:])
+			if int(start)+int(length) > 0xFFFF || (i > 0 && int(start) <= int(runs[i-1].Last)+1) {
+				return nil, fmt.Errorf("%w: invalid run in container %d", ErrInvalidPortableBitmap, pc.key)
+			}
+			runs[i] = roaring.Interval16{Start: start, Last: start + length}
+			n += int(length) + 1
+		}
+		if n != pc.n {
+			return nil, fmt.Errorf("%w: container %d has %d bits, expected %d", ErrInvalidPortableBitmap, pc.key, n, pc.n)
+		}
+		return roaring.NewContainerRun(runs), nil
+
+	case roaring.ContainerArray:
+		data, err := itr.read(2 * pc.n)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]uint16, pc.n)
+		for i := range values {
+			values[i] = binary.LittleEndian.Uint16(data[2*i:])
+			if i > 0 && values[i] <= values[i-1] {
+				return nil, fmt.Errorf("%w: unsorted array in container %d", ErrInvalidPortableBitmap, pc.key)
+			}
+		}
+		return roaring.NewContainerArray(values), nil
+
+	default:
+		data, err := itr.read(PageSize)
+		if err != nil {
+			return nil, err
+		}
+		words := make([]uint64, PageSize/8)
+		n := 0
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint64(data[8*i:])
+			n += bits.OnesCount64(words[i])
+		}
+		if n != pc.n {
+			return nil, fmt.Errorf("%w: container %d has %d bits, expected %d", ErrInvalidPortableBitmap, pc.key, n, pc.n)
+		}
+		return roaring.NewContainerBitmap(n, words), nil
+	}
+}
+
+// read reads exactly n bytes. The returned slice is only valid until the next
+// read.
+func (itr *portableIterator) read(n int) ([]byte, error) {
+	if cap(itr.scratch) < n {
+		itr.scratch = make([]byte, n)
+	}
+	buf := itr.scratch[:n]
+	nn, err := io.ReadFull(itr.r, buf)
+	itr.n += int64(nn)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPortableBitmap, io.ErrUnexpectedEOF)
+	}
+	return buf, err
+}
+
+func (itr *portableIterator) readUint16() (uint16, error) {
+	buf, err := itr.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf), nil
+}
+
+func (itr *portableIterator) readUint32() (uint32, error) {
+	buf, err := itr.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+func (itr *portableIterator) readUint64() (uint64, error) {
+	buf, err := itr.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
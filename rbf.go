@@ -15,7 +15,6 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/benbjohnson/immutable"
 	"github.com/gernest/rbf/vprint"
 	"github.com/gernest/roaring"
 	"github.com/gernest/roaring/shardwidth"
@@ -48,11 +47,22 @@ const maxBranchCellsPerPage = int((PageSize - branchPageHeaderSize) / (branchCel
 
 // Page types.
 const (
-	PageTypeRootRecord   = 1
-	PageTypeLeaf         = 2
-	PageTypeBranch       = 4
-	PageTypeBitmapHeader = 8  // Only used by the WAL for marking next page
-	PageTypeBitmap       = 16 // Only used internally when walking the b-tree
+	PageTypeRootRecord       = 1
+	PageTypeLeaf             = 2
+	PageTypeBranch           = 4
+	PageTypeBitmapHeader     = 8  // Only used by the WAL for marking next page
+	PageTypeBitmap           = 16 // Only used internally when walking the b-tree
+	PageTypeChecksum         = 32
+	PageTypeChecksumDir      = 64
+	PageTypeVersion          = 128
+	PageTypeVersionDir       = 256
+	PageTypeCompression      = 512
+	PageTypeCompressionDir   = 1024
+	PageTypeCount            = 2048
+	PageTypeCountDir         = 4096
+	PageTypeRootRecordLeaf   = 8192
+	PageTypeRootRecordBranch = 16384
+	PageTypeFrame            = 32768
 )
 
 // Meta commit/rollback flags.
@@ -61,6 +71,13 @@ const (
 	MetaPageFlagRollback = 2
 )
 
+// Meta feature flags.
+const (
+	MetaFeaturePageChecksums   = 1
+	MetaFeaturePageCompression = 2
+	MetaFeaturePageVersions    = 4
+)
+
 type ContainerType int
 
 // Container types.
@@ -140,6 +157,9 @@ func writeMetaRootRecordPageNo(page []byte, pgno uint32) { binary.BigEndian.PutU
 func readMetaFreelistPageNo(page []byte) uint32        { return binary.BigEndian.Uint32(page[24:]) }
 func writeMetaFreelistPageNo(page []byte, pgno uint32) { binary.BigEndian.PutUint32(page[24:], pgno) }
 
+func readMetaFeatures(page []byte) uint32     { return binary.BigEndian.Uint32(page[28:]) }
+func writeMetaFeatures(page []byte, v uint32) { binary.BigEndian.PutUint32(page[28:], v) }
+
 /* lint
 func readMetaChecksum(page []byte) uint32 {
 	return binary.BigEndian.Uint32(page[PageSize-4 : PageSize])
@@ -169,25 +189,6 @@ func readRootRecords(page []byte) (records []*RootRecord, err error) {
 	}
 }
 
-// writeRootRecords is only called by tx.go Tx.writeRootRecordPages().
-// We can return io.ErrShortBuffer in err. If we still have records
-// to write that don't fit on page, remain will point to the next
-// record that hasn't yet been written.
-func writeRootRecords(page []byte, itr *immutable.SortedMapIterator[string, uint32]) (err error) {
-	data := page[rootRecordPageHeaderSize:]
-
-	for !itr.Done() {
-		name, pgno, _ := itr.Next()
-
-		data, err = WriteRootRecord(data, &RootRecord{Name: name, Pgno: pgno})
-		if err != nil {
-			itr.Seek(name)
-			return err
-		}
-	}
-	return nil
-}
-
 // Branch & leaf page helpers
 
 func readPageNo(page []byte) uint32     { return binary.BigEndian.Uint32(page[0:4]) }
@@ -710,22 +711,22 @@ func Pagedump(b []byte, indent string, writer io.Writer) {
 	}
 }
 
+// Walk calls v with the records on each page holding root records. Branch
+// pages of the root record b-tree are skipped.
 func Walk(tx *Tx, pgno uint32, v func(uint32, []*RootRecord)) {
-	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
-		page, _, err := tx.readPage(pgno)
-		if err != nil {
-			vprint.PanicOn(err)
+	vprint.PanicOn(tx.walkRootRecordPages(func(pgno uint32, page []byte) error {
+		if readFlags(page) == PageTypeRootRecordBranch {
+			return nil
 		}
 
 		// Read all records on the page.
 		a, err := readRootRecords(page)
 		if err != nil {
-			vprint.PanicOn(err)
+			return err
 		}
 		v(pgno, a)
-		// Read next overflow page number.
-		pgno = WalkRootRecordPages(page)
-	}
+		return nil
+	}))
 }
 
 func assert(condition bool) {
@@ -752,14 +753,14 @@ func RowValues(b []uint64) []uint64 {
 // 	return fmt.Sprintf("%s:%d", file, line)
 // }
 
-func (db *DB) fsync(f *os.File) error {
+func (db *DB) fsync(f File) error {
 	if !db.cfg.FsyncEnabled {
 		return nil
 	}
 	return f.Sync()
 }
 
-func (db *DB) fsyncWAL(f *os.File) error {
+func (db *DB) fsyncWAL(f File) error {
 	if !db.cfg.FsyncEnabled || !db.cfg.FsyncWALEnabled {
 		return nil // no sync if either fsync flag is disabled
 	}
@@ -785,6 +786,8 @@ func hashUint64(value uint64) uint32 {
 }
 
 // Metric is a simple, internal metric for check duration of operations.
+//
+// Deprecated: Use DB.Stats or a MetricsSink instead.
 type Metric struct {
 	name     string
 	interval int // reporting interval
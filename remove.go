@@ -0,0 +1,146 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"io"
+
+	"github.com/gernest/roaring"
+)
+
+// RemoveRange removes all bits from start up to, but not including, end from
+// a bitmap. Containers which fall entirely within the range are dropped,
+// freeing any bitmap page, and only the containers at the edges of the range
+// are rewritten. Returns the number of bits removed.
+func (tx *Tx) RemoveRange(name string, start, end uint64) (n uint64, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	n, _, err = tx.removeRange(name, start, end, 0)
+	return n, err
+}
+
+// removeRange removes bits from start up to end, stopping once limit bits have
+// been removed. A zero limit removes the whole range. Returns the number of
+// bits removed and the position up to which the range has been cleared.
+func (tx *Tx) removeRange(name string, start, end, limit uint64) (n, next uint64, err error) {
+	if tx.db == nil {
+		return 0, start, ErrTxClosed
+	} else if !tx.writable {
+		return 0, start, ErrTxNotWritable
+	} else if name == "" {
+		return 0, start, ErrBitmapNameRequired
+	} else if start >= end {
+		return 0, end, nil
+	}
+
+	c, err := tx.cursor(name)
+	if err == ErrBitmapNotFound {
+		return 0, end, nil
+	} else if err != nil {
+		return 0, start, err
+	}
+	defer c.Close()
+
+	for key := highbits(start); ; key++ {
+		if _, err := c.Seek(key); err != nil {
+			return n, start, err
+		} else if err := c.Next(); err == io.EOF {
+			return n, end, nil
+		} else if err != nil {
+			return n, start, err
+		}
+
+		// Find the bits of the container within the range. Bounds are
+		// inclusive as the last container ends at the largest value.
+		key = c.Key()
+		lo, hi := max(start, key<<16), min(end-1, key<<16|0xFFFF)
+		if lo > hi {
+			return n, end, nil
+		}
+
+		elem := &c.stack.elems[c.stack.top]
+		leafPage, _, err := c.readPage(elem.pgno)
+		if err != nil {
+			return n, start, err
+		}
+		cell := readLeafCell(leafPage, elem.index)
+
+		// Drop containers which are entirely within the range.
+		if lo == key<<16 && hi == key<<16|0xFFFF && (limit == 0 || n+uint64(cell.BitN) <= limit) {
+			if err := c.deleteLeafCell(key); err != nil {
+				return n, start, err
+			}
+			n, start = n+uint64(cell.BitN), hi+1
+			continue
+		}
+
+		// Otherwise remove bits up to the limit from the container.
+		ct := toContainer(cell, tx)
+		if limit > 0 {
+			if n == limit {
+				return n, lo, nil
+			}
+			if remaining := limit - n; uint64(ct.CountRange(int32(lowbits(lo)), int32(lowbits(hi))+1)) > remaining {
+				for _, v := range ct.Slice() {
+					if v < lowbits(lo) {
+						continue
+					} else if remaining == 0 {
+						hi = key<<16 | uint64(v-1)
+						break
+					}
+					remaining--
+				}
+			}
+		}
+
+		other := roaring.Difference(ct, roaring.NewContainerRun([]roaring.Interval16{{Start: lowbits(lo), Last: lowbits(hi)}}))
+		if other.N() == 0 {
+			err = c.deleteLeafCell(key)
+		} else if other.N() != ct.N() {
+			err = c.putLeafCell(ConvertToLeafArgs(key, roaring.Optimize(other)))
+		}
+		if err != nil {
+			return n, start, err
+		}
+		n, start = n+uint64(ct.N()-other.N()), hi+1
+
+		if limit > 0 && n >= limit {
+			return n, start, nil
+		}
+	}
+}
+
+// RemoveRange removes all bits from start up to, but not including, end from
+// a bitmap using as many transactions as needed so that none removes more
+// than Config.MaxDelete bits. If progress is not nil, it is called after each
+// commit with the number of bits removed so far and the position up to which
+// the range has been cleared. Returns the number of bits removed.
+//
+// The range is not removed atomically. If an error is returned, the bits
+// removed by earlier transactions remain removed.
+func (db *DB) RemoveRange(name string, start, end uint64, progress func(removed, next uint64)) (n uint64, err error) {
+	limit := uint64(max(db.cfg.MaxDelete, 0))
+	for start < end {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return n, err
+		}
+
+		tx.mu.Lock()
+		removed, next, err := tx.removeRange(name, start, end, limit)
+		tx.mu.Unlock()
+		if err != nil {
+			tx.Rollback()
+			return n, err
+		} else if err := tx.Commit(); err != nil {
+			return n, err
+		}
+
+		n, start = n+removed, next
+		if progress != nil {
+			progress(n, next)
+		}
+	}
+	return n, nil
+}
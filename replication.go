@@ -0,0 +1,364 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// WALSegmentMagic is the magic at the start of each segment in a WAL stream.
+const WALSegmentMagic = "\xFFRBW"
+
+const (
+	walSegmentVersion    = 1
+	walSegmentHeaderSize = 4 + 4 + 8 + 4 + 4 // magic, version, base WAL ID, page count, checksum
+)
+
+var (
+	// ErrWALUnavailable is returned by WriteWALTo when the requested WAL ID is
+	// no longer in the WAL or is not at a commit boundary. The follower must
+	// be reseeded from a backup.
+	ErrWALUnavailable = errors.New("rbf: wal id not available")
+
+	// ErrWALMismatch is returned by ApplyWAL when a segment does not start at
+	// the follower's current WAL ID.
+	ErrWALMismatch = errors.New("rbf: wal segment does not follow current wal id")
+
+	// ErrNotFollower is returned by ApplyWAL when the database was not opened
+	// with Config.Follower.
+	ErrNotFollower = errors.New("rbf: database is not a follower")
+)
+
+// A WAL stream is a sequence of segments. Each segment holds the WAL pages of
+// a single commit, exactly as written by the primary, ending with the meta
+// page of the commit. The segment header stores the WAL ID before the first
+// page, the number of pages and a CRC-32C of the page data.
+
+// WALID returns the WAL ID of the last committed transaction.
+func (db *DB) WALID() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if !db.opened {
+		return 0, ErrClosed
+	}
+	page, err := db.readMetaPage()
+	if err != nil {
+		return 0, err
+	}
+	return readMetaWALID(page), nil
+}
+
+// WriteWALTo writes every commit after walID to w as a stream of WAL segments
+// and returns the WAL ID of the last commit written. The commits must still be
+// in the WAL, either because they have not been checkpointed or because a
+// WALRetention keeps them. ErrWALUnavailable is returned otherwise.
+func (db *DB) WriteWALTo(w io.Writer, walID int64) (int64, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return tx.writeWALTo(w, walID)
+}
+
+func (tx *Tx) writeWALTo(w io.Writer, walID int64) (int64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if walID == tx.walID {
+		return walID, nil // nothing to ship
+	} else if walID > tx.walID {
+		return 0, fmt.Errorf("%w: %d is after current wal id %d", ErrWALUnavailable, walID, tx.walID)
+	}
+
+	// The WAL ends with the meta page of the transaction's snapshot so the
+	// WAL ID of the first page can be derived from it. Pages from the first
+	// position kept for followers are not removed from the WAL until this
+	// transaction closes, even once they have been checkpointed.
+	base := tx.walID - int64(tx.walPageN)
+	if first := base + int64(tx.walRetainStart); walID < first {
+		return 0, fmt.Errorf("%w: %d has been checkpointed, wal starts at %d", ErrWALUnavailable, walID, first)
+	}
+
+	// Split the WAL into commits. Each commit ends with a meta page. Bitmap
+	// pages always follow a bitmap header and are skipped as they may look
+	// like a meta page.
+	start, found := tx.walRetainStart, walID == base+int64(tx.walRetainStart)
+	for i := tx.walRetainStart; i < tx.walPageN; i++ {
+		page, err := tx.db.readWALPageAt(i)
+		if err != nil {
+			return 0, err
+		} else if IsBitmapHeader(page) {
+			i++
+			continue
+		} else if !IsMetaPage(page) {
+			continue
+		}
+
+		end := i + 1
+		if found {
+			if err := tx.writeWALSegment(w, base+int64(start), start, end); err != nil {
+				return 0, err
+			}
+		} else if base+int64(end) == walID {
+			found = true
+		}
+		start = end
+	}
+
+	if !found {
+		return 0, fmt.Errorf("%w: %d is not a commit boundary", ErrWALUnavailable, walID)
+	}
+	return tx.walID, nil
+}
+
+// WALRetention keeps the WAL segments holding commits which a follower has
+// not received after they are checkpointed, so WriteWALTo can still ship them
+// when the follower falls behind. Segments are removed by the first
+// checkpoint after every retention has advanced past them. Retentions are not
+// persisted: segments are removed on open and by Vacuum.
+type WALRetention struct {
+	db    *DB
+	walID int64
+}
+
+// RetainWAL registers a follower which has applied every commit up to walID,
+// which must be the WAL ID of a commit. Call Release once the follower is
+// removed so the segments are no longer kept.
+func (db *DB) RetainWAL(walID int64) (*WALRetention, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.opened {
+		return nil, ErrClosed
+	} else if db.cfg.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	r := &WALRetention{db: db, walID: walID}
+	if db.walRetentions == nil {
+		db.walRetentions = make(map[*WALRetention]struct{})
+	}
+	db.walRetentions[r] = struct{}{}
+	return r, nil
+}
+
+// WALID returns the WAL ID of the last commit the follower has applied.
+func (r *WALRetention) WALID() int64 {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	return r.walID
+}
+
+// Advance records that the follower has applied every commit up to walID.
+func (r *WALRetention) Advance(walID int64) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	r.walID = max(r.walID, walID)
+}
+
+// Release stops keeping segments for the follower.
+func (r *WALRetention) Release() {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	delete(r.db.walRetentions, r)
+}
+
+// retainedWALPosition returns the first WAL position to keep after a
+// checkpoint: the end of the checkpoint or the first commit which a follower
+// has not received, if earlier. Positions which are no longer kept are never
+// kept again. Must be called while holding db.mu.
+func (db *DB) retainedWALPosition() int {
+	end := db.walStart
+	for r := range db.walRetentions {
+		end = min(end, int(max(r.walID-db.baseWALID, 0)))
+	}
+	return max(end, db.walRetainStart)
+}
+
+// writeWALSegment writes WAL pages in [start, end) to w as a single segment.
+func (tx *Tx) writeWALSegment(w io.Writer, base int64, start, end int) error {
+	pages := make([][]byte, 0, end-start)
+	var sum uint32
+	for i := start; i < end; i++ {
+		page, err := tx.db.readWALPageAt(i)
+		if err != nil {
+			return err
+		}
+		pages = append(pages, page)
+		sum = crc32.Update(sum, castagnoli, page)
+	}
+
+	hdr := make([]byte, walSegmentHeaderSize)
+	copy(hdr, WALSegmentMagic)
+	binary.BigEndian.PutUint32(hdr[4:], walSegmentVersion)
+	binary.BigEndian.PutUint64(hdr[8:], uint64(base))
+	binary.BigEndian.PutUint32(hdr[16:], uint32(len(pages)))
+	binary.BigEndian.PutUint32(hdr[20:], sum)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyWAL reads WAL segments from r until EOF and appends each commit to the
+// follower's WAL. Each commit becomes visible to new read transactions once
+// it has been applied. Returns the WAL ID of the last applied commit, which
+// should be passed to the primary's WriteWALTo to continue the stream.
+//
+// The follower must start from the same state as the primary, either as a new
+// database or restored from one of its backups.
+func (db *DB) ApplyWAL(r io.Reader) (int64, error) {
+	if !db.cfg.Follower {
+		return 0, ErrNotFollower
+	}
+
+	walID, err := db.WALID()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		pages, base, err := db.readWALSegment(r)
+		if err == io.EOF {
+			return walID, nil
+		} else if err != nil {
+			return walID, err
+		}
+
+		id, err := db.applyWALSegment(pages, base)
+		if err != nil {
+			return walID, err
+		}
+		walID = id
+	}
+}
+
+// readWALSegment reads the next segment from r. Returns io.EOF if there are
+// no more segments.
+func (db *DB) readWALSegment(r io.Reader) (pages [][]byte, base int64, err error) {
+	hdr := make([]byte, walSegmentHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err == io.EOF {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("read wal segment header: %w", err)
+	} else if string(hdr[0:4]) != WALSegmentMagic {
+		return nil, 0, fmt.Errorf("rbf: invalid wal segment magic")
+	} else if v := binary.BigEndian.Uint32(hdr[4:]); v != walSegmentVersion {
+		return nil, 0, fmt.Errorf("rbf: unsupported wal segment version: %d", v)
+	}
+
+	base = int64(binary.BigEndian.Uint64(hdr[8:]))
+	pageN := int64(binary.BigEndian.Uint32(hdr[16:]))
+	if pageN == 0 || (db.cfg.MaxWALSize > 0 && pageN*PageSize > db.cfg.MaxWALSize) {
+		return nil, 0, fmt.Errorf("rbf: invalid wal segment page count: %d", pageN)
+	}
+
+	var sum uint32
+	pages = make([][]byte, pageN)
+	for i := range pages {
+		pages[i] = make([]byte, PageSize)
+		if _, err := io.ReadFull(r, pages[i]); err != nil {
+			return nil, 0, fmt.Errorf("read wal segment page: %w", err)
+		}
+		sum = crc32.Update(sum, castagnoli, pages[i])
+	}
+	if sum != binary.BigEndian.Uint32(hdr[20:]) {
+		return nil, 0, fmt.Errorf("rbf: wal segment checksum mismatch: base=%d", base)
+	}
+	return pages, base, nil
+}
+
+// applyWALSegment appends the pages of a single commit to the WAL & publishes
+// the new meta page. Returns the WAL ID of the segment's meta page.
+func (db *DB) applyWALSegment(pages [][]byte, base int64) (_ int64, err error) {
+	tx, err := db.begin(context.Background(), true, false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	meta := pages[len(pages)-1]
+	if base != tx.walID {
+		return 0, fmt.Errorf("%w: segment base=%d current=%d", ErrWALMismatch, base, tx.walID)
+	} else if !IsMetaPage(meta) || readMetaWALID(meta) != base+int64(len(pages)) {
+		return 0, fmt.Errorf("rbf: wal segment does not end with its meta page: base=%d", base)
+	}
+
+	if err := tx.db.wal.rotate(tx.walPageN, base); err != nil {
+		return 0, err
+	}
+
+	// Discard any partially written segment if we fail.
+	start := tx.walPageN
+	defer func() {
+		if err != nil {
+			if e := tx.db.wal.Truncate(int64(start) * PageSize); e != nil {
+				tx.db.logger.Error("truncate wal after failed apply", "err", e)
+			}
+		}
+	}()
+
+	// Map the pages before writing them so the segment cannot become durable
+	// without being readable by later transactions.
+	tx.db.mu.Lock()
+	err = tx.db.growMapping(tx.db.wal, int64(start+len(pages))*PageSize)
+	tx.db.mu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("grow wal mapping: %w", err)
+	}
+
+	// Pages keep the WAL IDs assigned by the primary. This is the same
+	// mapping used by loadWALPageMap.
+	w := &fileWriter{f: tx.db.wal, off: int64(start) * PageSize}
+	for i := 0; i < len(pages); i++ {
+		page, walID := pages[i], base+int64(i)+1
+		if _, err := w.Write(page); err != nil {
+			return 0, fmt.Errorf("write wal page: %w", err)
+		}
+		tx.walPageN++
+
+		switch {
+		case i == len(pages)-1:
+			tx.pageMap = tx.pageMap.Set(0, walID)
+		case IsBitmapHeader(page):
+			if i+1 >= len(pages)-1 {
+				return 0, fmt.Errorf("rbf: wal segment bitmap header without bitmap page: base=%d", base)
+			}
+			i++
+			if _, err := w.Write(pages[i]); err != nil {
+				return 0, fmt.Errorf("write wal page: %w", err)
+			}
+			tx.walPageN++
+			tx.pageMap = tx.pageMap.Set(readPageNo(page), walID+1)
+		default:
+			tx.pageMap = tx.pageMap.Set(readPageNo(page), walID)
+		}
+	}
+	if err := tx.db.fsyncWAL(tx.db.wal); err != nil {
+		return 0, fmt.Errorf("sync wal: %w", err)
+	}
+
+	copy(tx.meta[:], meta)
+	walID := readMetaWALID(meta)
+	tx.walID = walID
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.pageMap = tx.pageMap
+	tx.db.walPageN = tx.walPageN
+	tx.db.frameHints = nil
+	if e := tx.db.removeTx(tx); e != nil {
+		tx.db.logger.Error("remove tx after apply", "err", e)
+	}
+	return walID, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gernest/roaring"
+)
+
+// Reverse scans walk containers from the highest key down using Cursor.Prev so
+// queries for the most recent columns can stop once they have enough.
+
+// ContainerIteratorReverse returns an iterator over the containers of a bitmap
+// in descending key order, starting from the container with the given key or,
+// if it does not exist, the last container before it. Returns true if a
+// container with the key exists.
+func (tx *Tx) ContainerIteratorReverse(name string, key uint64) (citer roaring.ContainerIterator, found bool, err error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	c, err := tx.cursor(name)
+	if err == ErrBitmapNotFound {
+		return &emptyContainerIterator{}, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	exact, err := c.seekReverse(key)
+	if err == io.EOF {
+		c.Close()
+		return &emptyContainerIterator{}, false, nil
+	} else if err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	return &reverseContainerIterator{containerIterator: containerIterator{cursor: c}}, exact, nil
+}
+
+// ApplyFilterReverse is like ApplyFilter but considers containers from the
+// given key down to the first container.
+func (tx *Tx) ApplyFilterReverse(name string, key uint64, filter roaring.BitmapFilter) (err error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	c, err := tx.cursor(name)
+	if err == ErrBitmapNotFound {
+		return nil // nothing available.
+	} else if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.ApplyFilterReverse(key, filter)
+}
+
+// IteratorReverse returns an iterator over the containers of the cursor's
+// bitmap in descending key order, starting from the last container.
+func (c *Cursor) IteratorReverse() roaring.ContainerIterator {
+	itr := &reverseContainerIterator{containerIterator: containerIterator{cursor: c}}
+	itr.done = c.Last() != nil
+	return itr
+}
+
+// ApplyFilterReverse passes the containers from the given key down to the
+// first container to filter in descending key order. Filter results only
+// describe keys after the one being considered so they cannot be used to skip
+// containers. A result which rejects every key up to the maximum key ends the
+// scan.
+func (c *Cursor) ApplyFilterReverse(key uint64, filter roaring.BitmapFilter) (err error) {
+	if _, err := c.seekReverse(key); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f := c.getContainerFilter(filter, nil)
+	defer f.Close()
+	return f.ApplyFilterReverse()
+}
+
+// RowsReverse returns the row IDs which have containers in descending order.
+// If limit is greater than zero, no more than limit rows are returned.
+func (c *Cursor) RowsReverse(limit int) ([]uint64, error) {
+	shardVsContainerExponent := uint(4) // needs constant exported from roaring package
+	rows := make([]uint64, 0)
+	if err := c.Last(); err == io.EOF {
+		return rows, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("rows reverse: %w", err)
+	}
+
+	for limit <= 0 || len(rows) < limit {
+		if err := c.Prev(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if row := c.Key() >> shardVsContainerExponent; len(rows) == 0 || rows[len(rows)-1] != row {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// seekReverse moves to the container with the given key or, if it does not
+// exist, the last container before it. The next call to Prev does not move
+// the cursor. Returns io.EOF if there are no containers at or before key.
+func (c *Cursor) seekReverse(key uint64) (exact bool, err error) {
+	if exact, err = c.Seek(key); err != nil || exact {
+		return exact, err
+	}
+
+	// Seek stops at the first container after key so step back once.
+	c.buffered = false
+	if err := c.Prev(); err != nil {
+		return false, err
+	}
+	c.buffered = true
+	return false, nil
+}
+
+// ApplyFilterReverse is like ApplyFilter but moves backwards from the current
+// position of the cursor.
+func (s *containerFilter) ApplyFilterReverse() (err error) {
+	var cell leafCell
+	if s.filter == nil {
+		return errors.New("can't apply filter without a filter")
+	}
+	for {
+		if err := s.cursor.Prev(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		elem := &s.cursor.stack.elems[s.cursor.stack.top]
+		leafPage, _, err := s.cursor.readPage(elem.pgno)
+		if err != nil {
+			return fmt.Errorf("reading from pgno %d applying filter: %s", elem.pgno, err)
+		}
+		readLeafCellInto(&cell, leafPage, elem.index)
+		key := roaring.FilterKey(cell.Key)
+		res := s.filter.ConsiderKey(key, int32(cell.BitN))
+		if res.Err != nil {
+			return res.Err
+		}
+		if res.YesKey <= key && res.NoKey <= key {
+			data := intoContainer(cell, s.cursor.tx, &s.header, s.body[:])
+			res = s.filter.ConsiderData(key, data)
+			if res.Err != nil {
+				return res.Err
+			}
+		}
+		if res.NoKey == ^roaring.FilterKey(0) {
+			return nil
+		}
+	}
+}
+
+// reverseContainerIterator wraps Cursor to implement roaring.ContainerIterator
+// in descending key order.
+type reverseContainerIterator struct {
+	containerIterator
+	done bool
+}
+
+// Next moves the iterator to the previous container.
+func (itr *reverseContainerIterator) Next() bool {
+	if itr.done {
+		return false
+	} else if err := itr.cursor.Prev(); err != nil {
+		itr.done = true
+		return false
+	}
+	return true
+}
@@ -0,0 +1,564 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Root records are stored in a b-tree keyed by bitmap name so that creating,
+// renaming or deleting a bitmap only rewrites the pages on the path to its
+// record, and names can be listed by prefix without reading every record.
+// Leaf pages hold root records. Branch pages hold a record for each child
+// with the child's page number and a key, in key order. A child other than
+// the first holds the names which are no less than its key and less than the
+// next child's key. The first child holds every name below the second child's
+// key, including names below its own key, which is only kept as a
+// placeholder. Lookups follow the last child whose key is not greater than
+// the name, or the first child. Both use the root record page format with no
+// overflow page.
+//
+// Files written before the b-tree was introduced store root records in a
+// chain of PageTypeRootRecord pages. The chain is read as is and converted to
+// a b-tree the first time a writable transaction changes a root record.
+
+// MaxBitmapNameSize is the longest bitmap name, in bytes, that can be stored.
+// Two records of this size fit on a page so that the records of a page which
+// has overflowed can always be split in two.
+const MaxBitmapNameSize = (PageSize-rootRecordPageHeaderSize)/2 - rootRecordHeaderSize
+
+// ErrBitmapNameTooLong is returned when creating or renaming a bitmap with a
+// name longer than MaxBitmapNameSize.
+var ErrBitmapNameTooLong = errors.New("rbf: bitmap name too long")
+
+// errStopRootRecords is returned by a walk callback to end the walk early.
+var errStopRootRecords = errors.New("stop root records")
+
+// forEachRootRecordCell calls fn with the pgno & name of each record on a root
+// record page until fn returns false. The name is only valid during the call.
+func forEachRootRecordCell(page []byte, fn func(pgno uint32, name []byte) bool) error {
+	for data := page[rootRecordPageHeaderSize:]; len(data) >= rootRecordHeaderSize; {
+		pgno := binary.BigEndian.Uint32(data)
+		if pgno == 0 {
+			return nil
+		}
+		sz := int(binary.BigEndian.Uint16(data[4:]))
+		data = data[rootRecordHeaderSize:]
+		if len(data) < sz {
+			return fmt.Errorf("short root record buffer")
+		} else if !fn(pgno, data[:sz]) {
+			return nil
+		}
+		data = data[sz:]
+	}
+	return nil
+}
+
+// rootRecordsSize returns the space used by records on a root record page.
+func rootRecordsSize(records []*RootRecord) int {
+	n := rootRecordPageHeaderSize
+	for _, rec := range records {
+		n += rootRecordHeaderSize + len(rec.Name)
+	}
+	return n
+}
+
+// isLegacyRootRecords returns true if the root records are stored in a chain
+// of overflow pages rather than a b-tree.
+func (tx *Tx) isLegacyRootRecords() (bool, error) {
+	pgno := readMetaRootRecordPageNo(tx.meta[:])
+	if pgno == 0 {
+		return false, nil
+	}
+	page, _, err := tx.readPage(pgno)
+	if err != nil {
+		return false, err
+	}
+	return readFlags(page) == PageTypeRootRecord, nil
+}
+
+// lookupRootRecord returns the root page of the named bitmap.
+func (tx *Tx) lookupRootRecord(name string) (uint32, error) {
+	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
+		page, _, err := tx.readPage(pgno)
+		if err != nil {
+			return 0, err
+		}
+
+		var next uint32
+		switch typ := readFlags(page); typ {
+		case PageTypeRootRecord:
+			var root uint32
+			if err := forEachRootRecordCell(page, func(pgno uint32, key []byte) bool {
+				if string(key) == name {
+					root = pgno
+				}
+				return root == 0
+			}); err != nil {
+				return 0, err
+			} else if root != 0 {
+				return root, nil
+			}
+			next = WalkRootRecordPages(page)
+
+		case PageTypeRootRecordLeaf:
+			var root uint32
+			if err := forEachRootRecordCell(page, func(pgno uint32, key []byte) bool {
+				if string(key) >= name {
+					if string(key) == name {
+						root = pgno
+					}
+					return false
+				}
+				return true
+			}); err != nil {
+				return 0, err
+			}
+			if root == 0 {
+				return 0, ErrBitmapNotFound
+			}
+			return root, nil
+
+		case PageTypeRootRecordBranch:
+			// Follow the last child whose key is not greater than the name.
+			if err := forEachRootRecordCell(page, func(pgno uint32, key []byte) bool {
+				if next != 0 && string(key) > name {
+					return false
+				}
+				next = pgno
+				return true
+			}); err != nil {
+				return 0, err
+			}
+
+		default:
+			return 0, fmt.Errorf("rbf: invalid root record page type: pgno=%d type=%d", pgno, typ)
+		}
+		pgno = next
+	}
+	return 0, ErrBitmapNotFound
+}
+
+// walkRootRecords calls fn for each bitmap with a name beginning with prefix,
+// in name order.
+func (tx *Tx) walkRootRecords(prefix string, fn func(name string, pgno uint32) error) error {
+	pgno := readMetaRootRecordPageNo(tx.meta[:])
+	if pgno == 0 {
+		return nil
+	}
+
+	if legacy, err := tx.isLegacyRootRecords(); err != nil {
+		return err
+	} else if legacy {
+		return tx.walkLegacyRootRecords(prefix, fn)
+	}
+
+	if err := tx.walkRootRecordTree(pgno, prefix, fn); err != nil && err != errStopRootRecords {
+		return err
+	}
+	return nil
+}
+
+func (tx *Tx) walkLegacyRootRecords(prefix string, fn func(name string, pgno uint32) error) error {
+	records, err := tx.legacyRootRecords()
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if !strings.HasPrefix(rec.Name, prefix) {
+			continue
+		}
+		if err := fn(rec.Name, rec.Pgno); err == errStopRootRecords {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkRootRecordTree walks the records under pgno. Children which cannot hold
+// a name with the prefix are skipped and errStopRootRecords is returned once
+// a name after the prefix range is found.
+func (tx *Tx) walkRootRecordTree(pgno uint32, prefix string, fn func(name string, pgno uint32) error) error {
+	page, _, err := tx.readPage(pgno)
+	if err != nil {
+		return err
+	}
+
+	switch typ := readFlags(page); typ {
+	case PageTypeRootRecordLeaf:
+		records, err := readRootRecords(page)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec.Name < prefix {
+				continue
+			} else if !strings.HasPrefix(rec.Name, prefix) {
+				return errStopRootRecords
+			} else if err := fn(rec.Name, rec.Pgno); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case PageTypeRootRecordBranch:
+		cells, err := readRootRecords(page)
+		if err != nil {
+			return err
+		}
+		for i, cell := range cells {
+			// Every name in the child is less than the key of the next child.
+			if i+1 < len(cells) && cells[i+1].Name <= prefix {
+				continue
+			}
+			if err := tx.walkRootRecordTree(cell.Pgno, prefix, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("rbf: invalid root record page type: pgno=%d type=%d", pgno, typ)
+	}
+}
+
+// walkRootRecordPages calls fn for each page holding root records.
+func (tx *Tx) walkRootRecordPages(fn func(pgno uint32, page []byte) error) error {
+	pgno := readMetaRootRecordPageNo(tx.meta[:])
+	if pgno == 0 {
+		return nil
+	}
+
+	if legacy, err := tx.isLegacyRootRecords(); err != nil {
+		return err
+	} else if legacy {
+		for pgno != 0 {
+			page, _, err := tx.readPage(pgno)
+			if err != nil {
+				return err
+			} else if err := fn(pgno, page); err != nil {
+				return err
+			}
+			pgno = WalkRootRecordPages(page)
+		}
+		return nil
+	}
+	return tx.walkRootRecordTreePages(pgno, fn)
+}
+
+func (tx *Tx) walkRootRecordTreePages(pgno uint32, fn func(pgno uint32, page []byte) error) error {
+	page, _, err := tx.readPage(pgno)
+	if err != nil {
+		return err
+	} else if err := fn(pgno, page); err != nil {
+		return err
+	}
+
+	switch typ := readFlags(page); typ {
+	case PageTypeRootRecordLeaf:
+		return nil
+	case PageTypeRootRecordBranch:
+		cells, err := readRootRecords(page)
+		if err != nil {
+			return err
+		}
+		for _, cell := range cells {
+			if err := tx.walkRootRecordTreePages(cell.Pgno, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("rbf: invalid root record page type: pgno=%d type=%d", pgno, typ)
+	}
+}
+
+// legacyRootRecords reads all records from a chain of root record pages.
+func (tx *Tx) legacyRootRecords() ([]*RootRecord, error) {
+	var records []*RootRecord
+	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
+		page, _, err := tx.readPage(pgno)
+		if err != nil {
+			return nil, err
+		}
+		a, err := readRootRecords(page)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, a...)
+		pgno = WalkRootRecordPages(page)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// migrateRootRecords converts a chain of root record pages to a b-tree.
+func (tx *Tx) migrateRootRecords() error {
+	if legacy, err := tx.isLegacyRootRecords(); err != nil || !legacy {
+		return err
+	}
+
+	records, err := tx.legacyRootRecords()
+	if err != nil {
+		return err
+	}
+	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
+		page, _, err := tx.readPage(pgno)
+		if err != nil {
+			return err
+		} else if err := tx.freePgno(pgno); err != nil {
+			return err
+		}
+		pgno = WalkRootRecordPages(page)
+	}
+	writeMetaRootRecordPageNo(tx.meta[:], 0)
+
+	// Pack records into full leaves and build each level of branches above
+	// them until a single page remains.
+	if len(records) == 0 {
+		return nil
+	}
+	for typ := uint32(PageTypeRootRecordLeaf); ; typ = PageTypeRootRecordBranch {
+		var parents []*RootRecord
+		for len(records) > 0 {
+			n, size := 0, rootRecordPageHeaderSize
+			for ; n < len(records); n++ {
+				if size += rootRecordHeaderSize + len(records[n].Name); size > PageSize {
+					break
+				}
+			}
+			pgno, err := tx.allocatePgno()
+			if err != nil {
+				return err
+			} else if err := tx.writeRootRecordNode(pgno, typ, records[:n]); err != nil {
+				return err
+			}
+			parents = append(parents, &RootRecord{Name: records[0].Name, Pgno: pgno})
+			records = records[n:]
+		}
+
+		if len(parents) == 1 {
+			writeMetaRootRecordPageNo(tx.meta[:], parents[0].Pgno)
+			return nil
+		}
+		records = parents
+	}
+}
+
+// rootRecordNode is a root record page read for modification.
+type rootRecordNode struct {
+	pgno    uint32
+	typ     uint32
+	records []*RootRecord
+	index   int // index of the child on the path, if a branch
+}
+
+func (tx *Tx) readRootRecordNode(pgno uint32) (*rootRecordNode, error) {
+	page, _, err := tx.readPage(pgno)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := readFlags(page)
+	if typ != PageTypeRootRecordLeaf && typ != PageTypeRootRecordBranch {
+		return nil, fmt.Errorf("rbf: invalid root record page type: pgno=%d type=%d", pgno, typ)
+	}
+	records, err := readRootRecords(page)
+	if err != nil {
+		return nil, err
+	}
+	return &rootRecordNode{pgno: pgno, typ: typ, records: records}, nil
+}
+
+// rootRecordPath returns the pages from the root to the leaf which holds, or
+// would hold, the record for name. Returns nil if there are no records.
+func (tx *Tx) rootRecordPath(name string) ([]*rootRecordNode, error) {
+	var path []*rootRecordNode
+	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
+		node, err := tx.readRootRecordNode(pgno)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, node)
+
+		if node.typ == PageTypeRootRecordLeaf {
+			break
+		} else if len(node.records) == 0 {
+			return nil, fmt.Errorf("rbf: empty root record branch: pgno=%d", pgno)
+		}
+		node.index = max(sort.Search(len(node.records), func(i int) bool { return node.records[i].Name > name })-1, 0)
+		pgno = node.records[node.index].Pgno
+	}
+	return path, nil
+}
+
+// writeRootRecordNode writes records to a root record page.
+func (tx *Tx) writeRootRecordNode(pgno, typ uint32, records []*RootRecord) (err error) {
+	page := allocPage()
+	writePageNo(page, pgno)
+	writeFlags(page, typ)
+
+	data := page[rootRecordPageHeaderSize:]
+	for _, rec := range records {
+		if data, err = WriteRootRecord(data, rec); err != nil {
+			return err
+		}
+	}
+	return tx.writePage(page)
+}
+
+// putRootRecord inserts or updates the record for a bitmap.
+func (tx *Tx) putRootRecord(name string, pgno uint32) error {
+	if err := tx.migrateRootRecords(); err != nil {
+		return err
+	} else if err := tx.trackRoot(name); err != nil {
+		return err
+	}
+
+	path, err := tx.rootRecordPath(name)
+	if err != nil {
+		return err
+	}
+	rec := &RootRecord{Name: name, Pgno: pgno}
+
+	// Start a new tree if there are no records.
+	if len(path) == 0 {
+		root, err := tx.allocatePgno()
+		if err != nil {
+			return err
+		}
+		writeMetaRootRecordPageNo(tx.meta[:], root)
+		return tx.writeRootRecordNode(root, PageTypeRootRecordLeaf, []*RootRecord{rec})
+	}
+
+	leaf := path[len(path)-1]
+	i := sort.Search(len(leaf.records), func(i int) bool { return leaf.records[i].Name >= name })
+	if i < len(leaf.records) && leaf.records[i].Name == name {
+		leaf.records[i] = rec
+	} else {
+		leaf.records = append(leaf.records, nil)
+		copy(leaf.records[i+1:], leaf.records[i:])
+		leaf.records[i] = rec
+	}
+
+	// Write pages from the leaf up, splitting any which have overflowed and
+	// adding the new page to the parent.
+	for depth := len(path) - 1; depth >= 0; depth-- {
+		node := path[depth]
+		if rootRecordsSize(node.records) <= PageSize {
+			return tx.writeRootRecordNode(node.pgno, node.typ, node.records)
+		}
+
+		left, right, err := splitRootRecords(node.records)
+		if err != nil {
+			return err
+		}
+		pgno, err := tx.allocatePgno()
+		if err != nil {
+			return err
+		} else if err := tx.writeRootRecordNode(node.pgno, node.typ, left); err != nil {
+			return err
+		} else if err := tx.writeRootRecordNode(pgno, node.typ, right); err != nil {
+			return err
+		}
+		cell := &RootRecord{Name: right[0].Name, Pgno: pgno}
+
+		// Grow the tree by a level if the root was split.
+		if depth == 0 {
+			root, err := tx.allocatePgno()
+			if err != nil {
+				return err
+			}
+			writeMetaRootRecordPageNo(tx.meta[:], root)
+			return tx.writeRootRecordNode(root, PageTypeRootRecordBranch, []*RootRecord{{Name: left[0].Name, Pgno: node.pgno}, cell})
+		}
+
+		parent := path[depth-1]
+		parent.records = append(parent.records, nil)
+		copy(parent.records[parent.index+2:], parent.records[parent.index+1:])
+		parent.records[parent.index+1] = cell
+	}
+	return nil
+}
+
+// splitRootRecords divides the records of an overflowed page in two, by size
+// if possible. Otherwise the left page is filled so the rest fit on the right.
+func splitRootRecords(records []*RootRecord) (left, right []*RootRecord, err error) {
+	half := rootRecordsSize(records) / 2
+	i, size := 0, rootRecordPageHeaderSize
+	for ; i < len(records)-1 && size < half; i++ {
+		size += rootRecordHeaderSize + len(records[i].Name)
+	}
+	for ; i > 0 && size > PageSize; i-- {
+		size -= rootRecordHeaderSize + len(records[i-1].Name)
+	}
+
+	left, right = records[:i:i], records[i:]
+	if i == 0 || rootRecordsSize(right) > PageSize {
+		return nil, nil, fmt.Errorf("rbf: cannot split root record page")
+	}
+	return left, right, nil
+}
+
+// deleteRootRecord removes the record for a bitmap. Pages left empty are
+// freed and a root with a single child is replaced by the child.
+func (tx *Tx) deleteRootRecord(name string) error {
+	if err := tx.migrateRootRecords(); err != nil {
+		return err
+	} else if err := tx.trackRoot(name); err != nil {
+		return err
+	}
+
+	path, err := tx.rootRecordPath(name)
+	if err != nil {
+		return err
+	} else if len(path) == 0 {
+		return ErrBitmapNotFound
+	}
+
+	leaf := path[len(path)-1]
+	i := sort.Search(len(leaf.records), func(i int) bool { return leaf.records[i].Name >= name })
+	if i == len(leaf.records) || leaf.records[i].Name != name {
+		return ErrBitmapNotFound
+	}
+	leaf.records = append(leaf.records[:i], leaf.records[i+1:]...)
+
+	for depth := len(path) - 1; depth >= 0; depth-- {
+		node := path[depth]
+		if len(node.records) > 0 {
+			if err := tx.writeRootRecordNode(node.pgno, node.typ, node.records); err != nil {
+				return err
+			}
+			break
+		}
+
+		if err := tx.freePgno(node.pgno); err != nil {
+			return err
+		} else if depth == 0 {
+			writeMetaRootRecordPageNo(tx.meta[:], 0)
+			return nil
+		}
+		parent := path[depth-1]
+		parent.records = append(parent.records[:parent.index], parent.records[parent.index+1:]...)
+	}
+
+	// Shrink the tree while the root has a single child.
+	for {
+		root, err := tx.readRootRecordNode(readMetaRootRecordPageNo(tx.meta[:]))
+		if err != nil {
+			return err
+		} else if root.typ != PageTypeRootRecordBranch || len(root.records) != 1 {
+			return nil
+		}
+		if err := tx.freePgno(root.pgno); err != nil {
+			return err
+		}
+		writeMetaRootRecordPageNo(tx.meta[:], root.records[0].Pgno)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Ensure root records stored in a chain of overflow pages can be read and are
+// converted to a b-tree when a record is changed.
+func TestTx_MigrateRootRecords(t *testing.T) {
+	db := testHelperMustOpenNewDB(t)
+	defer MustCloseDB(t, db)
+
+	const n = 1000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%04d/%s", i, strings.Repeat("x", 200))
+	}
+
+	// Replace the initial root record page with a chain of legacy pages.
+	tx := MustBegin(t, db, true)
+	roots := make(map[string]uint32)
+	page := newLegacyRootRecordPage(1)
+	data := page[rootRecordPageHeaderSize:]
+	for _, name := range names {
+		root, err := tx.allocatePgno()
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := allocPage()
+		writePageNo(leaf, root)
+		writeFlags(leaf, PageTypeLeaf)
+		if err := tx.writePage(leaf); err != nil {
+			t.Fatal(err)
+		}
+		roots[name] = root
+
+		rec := &RootRecord{Name: name, Pgno: root}
+		if data, err = WriteRootRecord(data, rec); err == io.ErrShortBuffer {
+			next, err := tx.allocatePgno()
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeRootRecordOverflowPgno(page, next)
+			if err := tx.writePage(page); err != nil {
+				t.Fatal(err)
+			}
+			page = newLegacyRootRecordPage(next)
+			if data, err = WriteRootRecord(page[rootRecordPageHeaderSize:], rec); err != nil {
+				t.Fatal(err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.writePage(page); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read records from the chain.
+	tx = MustBegin(t, db, false)
+	if legacy, err := tx.isLegacyRootRecords(); err != nil {
+		t.Fatal(err)
+	} else if !legacy {
+		t.Fatal("expected legacy root records")
+	} else if a, err := tx.BitmapNamesWithPrefix("05"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 100 {
+		t.Fatalf("unexpected names: n=%d", len(a))
+	}
+	for name, root := range roots {
+		if pgno, err := tx.Root(name); err != nil {
+			t.Fatal(err)
+		} else if pgno != root {
+			t.Fatalf("Root(%q)=%d, want %d", name, pgno, root)
+		}
+	}
+	if err := tx.Check(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	// Creating a bitmap converts the chain to a b-tree.
+	tx = MustBegin(t, db, true)
+	if err := tx.CreateBitmap("z"); err != nil {
+		t.Fatal(err)
+	} else if legacy, err := tx.isLegacyRootRecords(); err != nil {
+		t.Fatal(err)
+	} else if legacy {
+		t.Fatal("expected root record b-tree")
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = MustBegin(t, db, false)
+	defer tx.Rollback()
+	if page, _, err := tx.readPage(readMetaRootRecordPageNo(tx.meta[:])); err != nil {
+		t.Fatal(err)
+	} else if typ := readFlags(page); typ != PageTypeRootRecordBranch {
+		t.Fatalf("unexpected root page type: %d", typ)
+	}
+	for name, root := range roots {
+		if pgno, err := tx.Root(name); err != nil {
+			t.Fatal(err)
+		} else if pgno != root {
+			t.Fatalf("Root(%q)=%d, want %d", name, pgno, root)
+		}
+	}
+	if a, err := tx.BitmapNames(); err != nil {
+		t.Fatal(err)
+	} else if len(a) != n+1 || a[n] != "z" {
+		t.Fatalf("unexpected names: n=%d", len(a))
+	} else if err := tx.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newLegacyRootRecordPage(pgno uint32) []byte {
+	page := allocPage()
+	writePageNo(page, pgno)
+	writeFlags(page, PageTypeRootRecord)
+	return page
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"errors"
+)
+
+// ErrInvalidSavepoint is returned when a savepoint does not belong to the
+// transaction or has already been released.
+var ErrInvalidSavepoint = errors.New("rbf: invalid savepoint")
+
+// Savepoint is a handle to the state of a writable transaction at a point in
+// time. It is created with Tx.Savepoint and used with Tx.RollbackTo and
+// Tx.Release.
+type Savepoint struct {
+	tx               *Tx
+	meta             [PageSize]byte
+	pageMap          *PageMap
+	dirtyPages       map[uint32][]byte
+	dirtyBitmapPages map[uint32][]byte
+	changes          map[string]map[uint64]struct{}
+	counts           map[uint32]countChange
+}
+
+// Savepoint records the current state of the transaction so later changes can
+// be undone with RollbackTo. Savepoints may be nested.
+//
+// Dirty pages are shared with the savepoint rather than copied since pages are
+// replaced, not modified, when they are written. Replaced pages are not
+// reused while a savepoint is held so that they remain valid.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+
+	sp := &Savepoint{
+		tx:               tx,
+		meta:             tx.meta,
+		pageMap:          tx.pageMap,
+		dirtyPages:       cloneDirtyPageMap(tx.dirtyPages),
+		dirtyBitmapPages: cloneDirtyPageMap(tx.dirtyBitmapPages),
+		changes:          cloneChanges(tx.changes),
+		counts:           cloneCounts(tx.counts),
+	}
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// RollbackTo undoes all changes made since sp was created. The savepoint stays
+// valid so it can be rolled back to again but savepoints created after it are
+// released. Cursors opened before the rollback must not be used afterward.
+func (tx *Tx) RollbackTo(sp *Savepoint) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	i, err := tx.savepointIndex(sp)
+	if err != nil {
+		return err
+	}
+
+	tx.meta = sp.meta
+	tx.pageMap = sp.pageMap
+	tx.dirtyPages = cloneDirtyPageMap(sp.dirtyPages)
+	tx.dirtyBitmapPages = cloneDirtyPageMap(sp.dirtyBitmapPages)
+	tx.changes = cloneChanges(sp.changes)
+	tx.counts = cloneCounts(sp.counts)
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release discards sp and any savepoints created after it. Changes made since
+// the savepoint are kept.
+func (tx *Tx) Release(sp *Savepoint) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	i, err := tx.savepointIndex(sp)
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// savepointIndex returns the position of sp on the transaction's stack.
+func (tx *Tx) savepointIndex(sp *Savepoint) (int, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if sp == nil || sp.tx != tx {
+		return 0, ErrInvalidSavepoint
+	}
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i] == sp {
+			return i, nil
+		}
+	}
+	return 0, ErrInvalidSavepoint
+}
+
+// isSavepointPage returns true if the dirty page at pgno is shared with a
+// savepoint. Pages which are modified in place, rather than replaced, must be
+// copied first.
+func (tx *Tx) isSavepointPage(pgno uint32) bool {
+	page := tx.dirtyPages[pgno]
+	for _, sp := range tx.savepoints {
+		if other := sp.dirtyPages[pgno]; other != nil && &other[0] == &page[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// freeHeapPage returns a replaced dirty page to the page pool unless it may
+// still be referenced by a savepoint.
+func (tx *Tx) freeHeapPage(page []byte) {
+	if len(tx.savepoints) == 0 {
+		freePage(page)
+	}
+}
+
+func cloneDirtyPageMap(m map[uint32][]byte) map[uint32][]byte {
+	other := make(map[uint32][]byte, len(m))
+	for k, v := range m {
+		other[k] = v
+	}
+	return other
+}
@@ -0,0 +1,454 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"io"
+	"math"
+
+	"github.com/gernest/roaring"
+)
+
+// Set operations combine stored bitmaps container by container so neither the
+// sources nor the result are held in memory. Source cursors step forward
+// together by container key and a cursor which falls behind the others is
+// moved with Seek, so an intersection costs time proportional to its most
+// selective source. When a destination is written, which may also be a
+// source, each source cursor is instead seeked for every container it
+// contributes. Only destination containers whose bits change are written.
+
+type setOp int
+
+const (
+	setOpUnion setOp = iota
+	setOpIntersect
+	setOpDifference
+	setOpXor
+)
+
+// Union sets dst to the union of the source bitmaps. Returns true if dst
+// changed.
+//
+// For all set operations, dst is created if it does not exist and may be one
+// of the sources. Sources which do not exist are treated as empty.
+func (tx *Tx) Union(dst string, srcs ...string) (changed bool, err error) {
+	return tx.applySetOp(setOpUnion, dst, srcs)
+}
+
+// Intersect sets dst to the intersection of the source bitmaps. Returns true
+// if dst changed.
+func (tx *Tx) Intersect(dst string, srcs ...string) (changed bool, err error) {
+	return tx.applySetOp(setOpIntersect, dst, srcs)
+}
+
+// Difference sets dst to the bits of the first source bitmap which are not set
+// in any other source. Returns true if dst changed.
+func (tx *Tx) Difference(dst string, srcs ...string) (changed bool, err error) {
+	return tx.applySetOp(setOpDifference, dst, srcs)
+}
+
+// Xor sets dst to the bits which are set in an odd number of the source
+// bitmaps. Returns true if dst changed.
+func (tx *Tx) Xor(dst string, srcs ...string) (changed bool, err error) {
+	return tx.applySetOp(setOpXor, dst, srcs)
+}
+
+// UnionIterator returns an iterator over the containers of the union of the
+// source bitmaps.
+//
+// For all set operation iterators, only non-empty containers are returned.
+// The iterator must be closed and must not be used after the sources are
+// written. An error reading a source ends the iteration.
+func (tx *Tx) UnionIterator(srcs ...string) (roaring.ContainerIterator, error) {
+	return tx.setOpIterator(setOpUnion, srcs)
+}
+
+// IntersectIterator returns an iterator over the containers of the
+// intersection of the source bitmaps.
+func (tx *Tx) IntersectIterator(srcs ...string) (roaring.ContainerIterator, error) {
+	return tx.setOpIterator(setOpIntersect, srcs)
+}
+
+// DifferenceIterator returns an iterator over the containers of the first
+// source bitmap with the bits of every other source removed.
+func (tx *Tx) DifferenceIterator(srcs ...string) (roaring.ContainerIterator, error) {
+	return tx.setOpIterator(setOpDifference, srcs)
+}
+
+// XorIterator returns an iterator over the containers holding the bits which
+// are set in an odd number of the source bitmaps.
+func (tx *Tx) XorIterator(srcs ...string) (roaring.ContainerIterator, error) {
+	return tx.setOpIterator(setOpXor, srcs)
+}
+
+// IntersectCursors returns an iterator over the containers of the intersection
+// of the cursors' bitmaps. A nil cursor is treated as an empty bitmap.
+//
+// For cursor iterators, the cursors must be distinct. They are moved by the
+// iterator, must not be used until it is closed and are not closed by it. An
+// error reading a cursor ends the iteration.
+func IntersectCursors(cursors ...*Cursor) (roaring.ContainerIterator, error) {
+	return cursorSetOpIterator(setOpIntersect, cursors)
+}
+
+// UnionCursors returns an iterator over the containers of the union of the
+// cursors' bitmaps. A nil cursor is treated as an empty bitmap.
+func UnionCursors(cursors ...*Cursor) (roaring.ContainerIterator, error) {
+	return cursorSetOpIterator(setOpUnion, cursors)
+}
+
+func cursorSetOpIterator(op setOp, cursors []*Cursor) (roaring.ContainerIterator, error) {
+	itr := &setOpIterator{op: op}
+	for _, c := range cursors {
+		src := &setOpSource{cursor: c}
+		itr.srcs = append(itr.srcs, src)
+		if err := src.seek(0); err != nil {
+			return nil, err
+		}
+	}
+	return itr, nil
+}
+
+func (tx *Tx) setOpIterator(op setOp, srcs []string) (roaring.ContainerIterator, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	itr, err := tx.newSetOpIterator(op, srcs)
+	if err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+func (tx *Tx) applySetOp(op setOp, dst string, srcs []string) (changed bool, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.db == nil {
+		return false, ErrTxClosed
+	} else if !tx.writable {
+		return false, ErrTxNotWritable
+	} else if dst == "" {
+		return false, ErrBitmapNameRequired
+	}
+
+	if err := tx.createBitmapIfNotExists(dst); err != nil {
+		return false, err
+	}
+	c, err := tx.cursor(dst)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	itr, err := tx.newSetOpIterator(op, srcs)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	itr.reseek = true
+
+	// Write each result container and remove destination containers which
+	// fall between them.
+	var next uint64
+	for itr.Next() {
+		key, ct := itr.Value()
+		if removed, err := c.removeContainers(next, key); err != nil {
+			return changed, err
+		} else if removed {
+			changed = true
+		}
+		next = key + 1
+
+		exact, err := c.Seek(key)
+		if err != nil {
+			return changed, err
+		} else if exact {
+			elem := &c.stack.elems[c.stack.top]
+			leafPage, _, err := c.readPage(elem.pgno)
+			if err != nil {
+				return changed, err
+			} else if toContainer(readLeafCell(leafPage, elem.index), tx).BitwiseCompare(ct) == nil {
+				continue
+			}
+		}
+		if err := c.putLeafCell(ConvertToLeafArgs(key, ct)); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	if itr.err != nil {
+		return changed, itr.err
+	}
+
+	if removed, err := c.removeContainers(next, math.MaxUint64); err != nil {
+		return changed, err
+	} else if removed {
+		changed = true
+	}
+	return changed, nil
+}
+
+// removeContainers deletes the containers with keys from start up to, but
+// not including, end. Returns true if any container was deleted.
+func (c *Cursor) removeContainers(start, end uint64) (changed bool, err error) {
+	for start < end {
+		if _, err := c.Seek(start); err != nil {
+			return changed, err
+		} else if err := c.Next(); err == io.EOF {
+			return changed, nil
+		} else if err != nil {
+			return changed, err
+		}
+
+		key := c.Key()
+		if key >= end {
+			return changed, nil
+		} else if err := c.deleteLeafCell(key); err != nil {
+			return changed, err
+		}
+		changed, start = true, key+1
+	}
+	return changed, nil
+}
+
+// setOpSource is the position of a source bitmap in a set operation.
+type setOpSource struct {
+	cursor *Cursor // nil if the bitmap does not exist
+	key    uint64  // key of the next container
+	ok     bool    // false once there are no more containers
+	owned  bool    // cursor is closed with the iterator
+}
+
+// seek moves the source to the first container at or after key.
+func (s *setOpSource) seek(key uint64) error {
+	s.ok = false
+	if s.cursor == nil {
+		return nil
+	} else if _, err := s.cursor.Seek(key); err != nil {
+		return err
+	} else if err := s.cursor.Next(); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.key, s.ok = s.cursor.Key(), true
+	return nil
+}
+
+// next moves the source past its current container. The cursor is stepped
+// unless writes may have moved cells since the source was positioned.
+func (s *setOpSource) next(reseek bool) error {
+	if reseek {
+		return s.seek(s.key + 1)
+	}
+
+	s.ok = false
+	if err := s.cursor.Next(); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.key, s.ok = s.cursor.Key(), true
+	return nil
+}
+
+// container reads the container at the source's position. It is read when
+// needed, rather than when the source is positioned, since writes to the
+// destination can move cells between pages.
+func (s *setOpSource) container(reseek bool) (*roaring.Container, error) {
+	if reseek {
+		if _, err := s.cursor.Seek(s.key); err != nil {
+			return nil, err
+		}
+	}
+	elem := &s.cursor.stack.elems[s.cursor.stack.top]
+	leafPage, _, err := s.cursor.readPage(elem.pgno)
+	if err != nil {
+		return nil, err
+	}
+	return toContainer(readLeafCell(leafPage, elem.index), s.cursor.tx), nil
+}
+
+// setOpIterator merges source bitmaps into the containers of a set operation.
+type setOpIterator struct {
+	op     setOp
+	srcs   []*setOpSource
+	reseek bool // sources may be written during iteration
+	key    uint64
+	ct     *roaring.Container
+	err    error
+}
+
+func (tx *Tx) newSetOpIterator(op setOp, srcs []string) (*setOpIterator, error) {
+	itr := &setOpIterator{op: op}
+	for _, name := range srcs {
+		src := &setOpSource{owned: true}
+		itr.srcs = append(itr.srcs, src)
+
+		c, err := tx.cursor(name)
+		if err == nil {
+			src.cursor = c
+		} else if err != ErrBitmapNotFound {
+			itr.Close()
+			return nil, err
+		}
+		if err := src.seek(0); err != nil {
+			itr.Close()
+			return nil, err
+		}
+	}
+	return itr, nil
+}
+
+// Close releases the source cursors opened by the iterator.
+func (itr *setOpIterator) Close() {
+	for _, src := range itr.srcs {
+		if src.cursor != nil && src.owned {
+			src.cursor.Close()
+		}
+		src.cursor = nil
+	}
+}
+
+// Next moves to the next non-empty container of the result.
+func (itr *setOpIterator) Next() bool {
+	for itr.err == nil {
+		key, ok, err := itr.nextKey()
+		if err != nil {
+			itr.err = err
+			return false
+		} else if !ok {
+			return false
+		}
+
+		ct, err := itr.combine(key)
+		if err != nil {
+			itr.err = err
+			return false
+		}
+
+		// Move past the key in every source which has it.
+		for _, src := range itr.srcs {
+			if src.ok && src.key == key {
+				if err := src.next(itr.reseek); err != nil {
+					itr.err = err
+					return false
+				}
+			}
+		}
+
+		if ct.N() > 0 {
+			itr.key, itr.ct = key, roaring.Optimize(ct)
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns the current key & container.
+func (itr *setOpIterator) Value() (uint64, *roaring.Container) {
+	return itr.key, itr.ct
+}
+
+// nextKey returns the key of the next container which may be in the result.
+// Sources which cannot contribute to it are moved forward to it.
+func (itr *setOpIterator) nextKey() (key uint64, ok bool, err error) {
+	if len(itr.srcs) == 0 {
+		return 0, false, nil
+	}
+
+	switch itr.op {
+	case setOpIntersect:
+		// Move every source to the largest key until they all agree.
+		for {
+			for _, src := range itr.srcs {
+				if !src.ok {
+					return 0, false, nil
+				} else if src.key > key {
+					key = src.key
+				}
+			}
+
+			agree := true
+			for _, src := range itr.srcs {
+				if src.key < key {
+					agree = false
+					if err := src.seek(key); err != nil {
+						return 0, false, err
+					}
+				}
+			}
+			if agree {
+				return key, true, nil
+			}
+		}
+
+	case setOpDifference:
+		if !itr.srcs[0].ok {
+			return 0, false, nil
+		}
+		key = itr.srcs[0].key
+		for _, src := range itr.srcs[1:] {
+			if src.ok && src.key < key {
+				if err := src.seek(key); err != nil {
+					return 0, false, err
+				}
+			}
+		}
+		return key, true, nil
+
+	default:
+		for _, src := range itr.srcs {
+			if src.ok && (!ok || src.key < key) {
+				key, ok = src.key, true
+			}
+		}
+		return key, ok, nil
+	}
+}
+
+// combine returns the result container for key from the sources positioned
+// at it.
+func (itr *setOpIterator) combine(key uint64) (ct *roaring.Container, err error) {
+	for _, src := range itr.srcs {
+		if !src.ok || src.key != key {
+			continue
+		}
+		other, err := src.container(itr.reseek)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case ct == nil:
+			ct = other
+		case itr.op == setOpUnion:
+			ct = roaring.Union(ct, other)
+		case itr.op == setOpIntersect:
+			ct = roaring.Intersect(ct, other)
+		case itr.op == setOpDifference:
+			ct = roaring.Difference(ct, other)
+		case itr.op == setOpXor:
+			ct = xorContainers(ct, other)
+		}
+		if ct.N() == 0 && (itr.op == setOpIntersect || itr.op == setOpDifference) {
+			return nil, nil
+		}
+	}
+	return ct, nil
+}
+
+// xorContainers returns the bits which are set in exactly one of a & b.
+func xorContainers(a, b *roaring.Container) *roaring.Container {
+	x, y := roaring.Difference(a, b), roaring.Difference(b, a)
+	if x.N() == 0 {
+		return y
+	} else if y.N() == 0 {
+		return x
+	}
+	return roaring.Union(x, y)
+}
@@ -4,11 +4,13 @@ package rbf
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/benbjohnson/immutable"
 	txkey "github.com/gernest/rbf/short_txkey"
@@ -24,12 +26,14 @@ var _ = txkey.ToString
 // Transactions can be obtained by calling DB.Begin() and provide a snapshot
 // view at the point-in-time they are started.
 type Tx struct {
-	mu          sync.RWMutex
-	db          *DB                                  // parent db
-	meta        [PageSize]byte                       // copy of current meta page
-	walID       int64                                // max WAL ID at start of tx
-	walPageN    int                                  // wal page count
-	rootRecords *immutable.SortedMap[string, uint32] // read-only cache of root records
+	mu       sync.RWMutex
+	db       *DB            // parent db
+	meta     [PageSize]byte // copy of current meta page
+	walID    int64          // max WAL ID at start of tx
+	walPageN int            // wal page count
+	walStart int            // position of first wal page not checkpointed
+
+	walRetainStart int // position of first wal page kept for followers
 
 	// pageMap holds WAL pages that have not yet been transferred
 	// into the database pages. So it can be empty, if the whole previous
@@ -37,9 +41,33 @@ type Tx struct {
 	pageMap  *PageMap // mapping of database pages to WAL IDs
 	writable bool     // if true, tx can write
 
+	// Pages up to this WAL ID have been copied to the data file by a
+	// checkpoint so they are read from there instead of the WAL.
+	checkpointWALID int64
+
 	dirtyPages       map[uint32][]byte // updated pages in this tx
 	dirtyBitmapPages map[uint32][]byte // updated bitmap pages in this tx
 
+	changedBranches map[uint32]struct{} // branch pages above changed pages, if versions are enabled
+
+	verified sync.Map // page numbers whose checksums have been verified
+
+	pageCache  pageCache           // recently decompressed pages
+	compressed map[uint32]struct{} // dirty pages stored in frame pages, set when flushed
+	frameHints map[int][]uint32    // frame pages with free slots, by slot count
+
+	start         time.Time    // time the transaction began
+	walPageReadN  atomic.Int64 // pages read from the WAL
+	dataPageReadN atomic.Int64 // pages read from the data file
+
+	savepoints []*Savepoint // active savepoints, oldest first
+
+	changes map[string]map[uint64]struct{} // changed container keys by bitmap, if subscribed
+
+	prevRoots map[string]uint32 // starting roots of bitmaps with changed records, if subscribed
+
+	counts map[uint32]countChange // pending bit count changes, by root pgno
+
 	// If Rollback() has already completed, don't do it again.
 	// Note db == nil means that commit has already been done.
 	rollbackDone bool
@@ -113,6 +141,7 @@ func (tx *Tx) Commit() error {
 	if tx.db == nil {
 		return ErrTxClosed
 	}
+	start := time.Now()
 
 	// Remove any free pages off the end of the file and update the size.
 	if err := tx.truncateFreelist(); err != nil {
@@ -122,25 +151,32 @@ func (tx *Tx) Commit() error {
 	// If any pages have been written, ensure we write a new meta page with
 	// the commit flag to mark the end of the transaction.
 	if tx.dirty() {
+		// Read the changed root records before the commit for subscribers.
+		var prev, records *immutable.SortedMap[string, uint32]
+		if tx.changes != nil {
+			var err error
+			if prev, records, err = tx.changedRootRecords(); err != nil {
+				return err
+			}
+		}
+
+		walPageN := tx.walPageN
 		if err := tx.flush(); err != nil {
 			return err
 		}
-		// future plan: after checkpoint is moved to background
-		// or not every removeTx, then we can move the
-		// tx.db.rootRecords = tx.rootRecords into removeTx().
-		//
-		// ... or maybe not: let's do that part here, and then removeTx
-		// may or may not start a checkpoint, possibly asynchronously.
-		//
-		// avoid race detector firing on a write race here
-		// vs the read of rootRecords at db.Begin(), then release
-		// the lock, because we need removeTx to grab the lock to
-		// work, but if it wants to checkpoint, it wants to be able to return
-		// to us here and still be holding the lock.
+		// Avoid the race detector firing on a write race here vs the read
+		// of the page map at db.Begin(), then release the lock, because we
+		// need removeTx to grab the lock to work, but if it wants to
+		// checkpoint, it wants to be able to return to us here and still be
+		// holding the lock.
 		tx.db.mu.Lock()
-		tx.db.rootRecords = tx.rootRecords
+		if records != nil {
+			tx.db.publish(tx.commitEvent(prev, records))
+		}
+		tx.db.recordCommit(time.Since(start), len(tx.dirtyPages)+len(tx.dirtyBitmapPages), tx.walPageN-walPageN)
 		tx.db.pageMap = tx.pageMap
 		tx.db.walPageN = tx.walPageN
+		tx.db.frameHints = tx.frameHints
 		tx.db.mu.Unlock()
 	}
 
@@ -156,7 +192,14 @@ func (tx *Tx) truncateFreelist() error {
 	for {
 		if truncated, err := tx.truncateLastFreePage(); err != nil {
 			return err
-		} else if !truncated {
+		} else if truncated {
+			continue
+		}
+
+		// Page table pages may be blocking free pages from being truncated.
+		if moved, err := tx.truncateLastTablePage(); err != nil {
+			return err
+		} else if !moved {
 			return nil // no more free pages at end of file, exit
 		}
 	}
@@ -178,7 +221,7 @@ func (tx *Tx) truncateLastFreePage() (truncated bool, outErr error) {
 	}
 
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return false, err
 	}
@@ -239,22 +282,17 @@ func (tx *Tx) Root(name string) (uint32, error) {
 }
 
 func (tx *Tx) root(name string) (uint32, error) {
-	// Fetch list of roots (or retrieve from cache).
-	records, err := tx.RootRecords()
-	if err != nil {
-		return 0, err
-	}
-
-	// Lookup record by bitmap name and return its root page.
-	pgno, ok := records.Get(name)
-	if !ok {
-		return 0, ErrBitmapNotFound
-	}
-	return pgno, nil
+	return tx.lookupRootRecord(name)
 }
 
 // BitmapNames returns a list of all bitmap names.
 func (tx *Tx) BitmapNames() ([]string, error) {
+	return tx.BitmapNamesWithPrefix("")
+}
+
+// BitmapNamesWithPrefix returns a list of bitmap names with a given prefix.
+// Only the root record pages which may hold a matching name are read.
+func (tx *Tx) BitmapNamesWithPrefix(prefix string) ([]string, error) {
 	tx.mu.RLock()
 	defer tx.mu.RUnlock()
 
@@ -262,17 +300,13 @@ func (tx *Tx) BitmapNames() ([]string, error) {
 		return nil, ErrTxClosed
 	}
 
-	// Read list of root records.
-	records, err := tx.RootRecords()
-	if err != nil {
+	var a []string
+	if err := tx.walkRootRecords(prefix, func(name string, _ uint32) error {
+		a = append(a, name)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
-
-	a := make([]string, 0, records.Len())
-	for itr := records.Iterator(); !itr.Done(); {
-		k, _, _ := itr.Next()
-		a = append(a, k)
-	}
 	return a, nil
 }
 
@@ -290,13 +324,13 @@ func (tx *Tx) bitmapExists(name string) (bool, error) {
 		return false, ErrBitmapNameRequired
 	}
 
-	// Read root records and find entry for bitmap.
-	records, err := tx.RootRecords()
-	if err != nil {
+	// Find the root record for the bitmap.
+	if _, err := tx.root(name); err == ErrBitmapNotFound {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
-	_, ok := records.Get(name)
-	return ok, nil
+	return true, nil
 }
 
 // CreateBitmap creates a new empty bitmap with the given name.
@@ -314,16 +348,14 @@ func (tx *Tx) createBitmap(name string) error {
 		return ErrTxNotWritable
 	} else if name == "" {
 		return ErrBitmapNameRequired
-	}
-
-	// Read list of root records.
-	records, err := tx.RootRecords()
-	if err != nil {
-		return err
+	} else if len(name) > MaxBitmapNameSize {
+		return ErrBitmapNameTooLong
 	}
 
 	// Find btree by name. Exit if already exists.
-	if _, ok := records.Get(name); ok {
+	if ok, err := tx.bitmapExists(name); err != nil {
+		return err
+	} else if ok {
 		return ErrBitmapExists
 	}
 
@@ -341,10 +373,10 @@ func (tx *Tx) createBitmap(name string) error {
 	if err := tx.writePage(page); err != nil {
 		return err
 	}
+	tx.createCount(pgno)
 
 	// Insert into correct index.
-	records = records.Set(name, pgno)
-	if err := tx.writeRootRecordPages(records); err != nil {
+	if err := tx.putRootRecord(name, pgno); err != nil {
 		return fmt.Errorf("write bitmaps: %w", err)
 	}
 
@@ -381,29 +413,29 @@ func (tx *Tx) DeleteBitmap(name string) error {
 		return ErrBitmapNameRequired
 	}
 
-	// Read list of root records.
-	records, err := tx.RootRecords()
-	if err != nil {
-		return err
-	}
-
 	// Find btree by name. Exit if it doesn't exist.
-	pgno, ok := records.Get(name)
-	if !ok {
+	pgno, err := tx.root(name)
+	if err == ErrBitmapNotFound {
 		return fmt.Errorf("bitmap does not exist: %q", name)
+	} else if err != nil {
+		return err
 	}
 
+	return tx.deleteBitmap(name, pgno)
+}
+
+// deleteBitmap deallocates the b-tree of a bitmap and removes its record.
+func (tx *Tx) deleteBitmap(name string, pgno uint32) error {
 	// Deallocate all pages in the tree.
 	if err := tx.deallocateTree(pgno); err != nil {
 		return err
 	}
+	tx.deleteCount(pgno)
 
-	// Delete from record list & rewrite record pages.
-	records = records.Delete(name)
-	if err := tx.writeRootRecordPages(records); err != nil {
+	// Delete from record list.
+	if err := tx.deleteRootRecord(name); err != nil {
 		return fmt.Errorf("write bitmaps: %w", err)
 	}
-	tx.rootRecords = records
 	return nil
 }
 
@@ -418,32 +450,20 @@ func (tx *Tx) DeleteBitmapsWithPrefix(prefix string) error {
 		return ErrTxNotWritable
 	}
 
-	// Read list of root records.
-	records, err := tx.RootRecords()
-	if err != nil {
+	// Read matching records before the tree is modified.
+	var records []*RootRecord
+	if err := tx.walkRootRecords(prefix, func(name string, pgno uint32) error {
+		records = append(records, &RootRecord{Name: name, Pgno: pgno})
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	for itr := records.Iterator(); !itr.Done(); {
-		name, pgno, _ := itr.Next()
-
-		// Skip bitmaps without matching prefix.
-		if !strings.HasPrefix(name, prefix) {
-			continue
-		}
-		// Deallocate all pages in the tree.
-		if err := tx.deallocateTree(pgno); err != nil {
+	for _, rec := range records {
+		if err := tx.deleteBitmap(rec.Name, rec.Pgno); err != nil {
 			return err
 		}
-
-		records = records.Delete(name)
 	}
-
-	// Rewrite record pages.
-	if err := tx.writeRootRecordPages(records); err != nil {
-		return fmt.Errorf("write bitmaps: %w", err)
-	}
-	tx.rootRecords = records
 	return nil
 }
 
@@ -459,117 +479,40 @@ func (tx *Tx) RenameBitmap(oldname, newname string) error {
 		return ErrTxNotWritable
 	} else if oldname == "" || newname == "" {
 		return ErrBitmapNameRequired
-	}
-
-	// Read list of root records.
-	records, err := tx.RootRecords()
-	if err != nil {
-		return err
+	} else if len(newname) > MaxBitmapNameSize {
+		return ErrBitmapNameTooLong
 	}
 
 	// Find btree by name. Exit if it doesn't exist.
-	pgno, ok := records.Get(oldname)
-	if !ok {
+	pgno, err := tx.root(oldname)
+	if err == ErrBitmapNotFound {
 		return fmt.Errorf("bitmap does not exist: %q", oldname)
+	} else if err != nil {
+		return err
 	}
 
-	// Update record name & rewrite record pages.
-	records = records.Delete(oldname)
-	records = records.Set(newname, pgno)
-	if err := tx.writeRootRecordPages(records); err != nil {
+	// Move the record to the new name.
+	if err := tx.deleteRootRecord(oldname); err != nil {
+		return fmt.Errorf("write bitmaps: %w", err)
+	} else if err := tx.putRootRecord(newname, pgno); err != nil {
 		return fmt.Errorf("write bitmaps: %w", err)
 	}
 
 	return nil
 }
 
-// RootRecords returns a list of root records.
+// RootRecords returns a list of root records. All records are read so
+// walking a prefix with BitmapNamesWithPrefix should be preferred for large
+// databases.
 func (tx *Tx) RootRecords() (records *immutable.SortedMap[string, uint32], err error) {
-	if tx.rootRecords != nil {
-		return tx.rootRecords, nil
-	}
-
-	records = immutable.NewSortedMap[string, uint32](nil)
-	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
-		page, _, err := tx.readPage(pgno)
-		if err != nil {
-			return nil, err
-		}
-
-		// Read all records on the page.
-		a, err := readRootRecords(page)
-		if err != nil {
-			return nil, err
-		}
-		for _, rec := range a {
-			records = records.Set(rec.Name, rec.Pgno)
-		}
-
-		// Read next overflow page number.
-		pgno = WalkRootRecordPages(page)
-	}
-
-	// Cache result
-	tx.rootRecords = records
-	return records, nil
-}
-
-// writeRootRecordPages writes a list of root record pages.
-func (tx *Tx) writeRootRecordPages(records *immutable.SortedMap[string, uint32]) (err error) {
-	// Release all existing root record pages.
-	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
-		page, _, err := tx.readPage(pgno)
-		if err != nil {
-			return err
-		}
-
-		err = tx.freePgno(pgno)
-		if err != nil {
-			return err
-		}
-		pgno = WalkRootRecordPages(page)
-	}
-
-	// Exit early if no records exist.
-	if records.Len() == 0 {
-		writeMetaRootRecordPageNo(tx.meta[:], 0)
+	b := immutable.NewSortedMapBuilder[string, uint32](nil)
+	if err := tx.walkRootRecords("", func(name string, pgno uint32) error {
+		b.Set(name, pgno)
 		return nil
+	}); err != nil {
+		return nil, err
 	}
-
-	// Allocate initial root record page.
-	pgno, err := tx.allocatePgno()
-	if err != nil {
-		return err
-	}
-	writeMetaRootRecordPageNo(tx.meta[:], pgno)
-
-	// Write new root record pages.
-	for itr := records.Iterator(); !itr.Done(); {
-		// Initialize page & write as many records as will fit.
-		page := allocPage()
-		writePageNo(page, pgno)
-		writeFlags(page, PageTypeRootRecord)
-
-		if err := writeRootRecords(page, itr); err == io.ErrShortBuffer {
-			// Allocate next pgno and write overflow if we have remaining records.
-			if pgno, err = tx.allocatePgno(); err != nil {
-				return err
-			}
-			writeRootRecordOverflowPgno(page, pgno)
-		} else if err != nil {
-			return err
-		}
-
-		// Write page to disk.
-		if err := tx.writePage(page); err != nil {
-			return err
-		}
-	}
-
-	// Update cache records.
-	tx.rootRecords = records
-
-	return nil
+	return b.Map(), nil
 }
 
 // Add sets a given bit on the bitmap.
@@ -703,6 +646,7 @@ func (tx *Tx) cursor(name string) (*Cursor, error) {
 	}
 
 	c := tx.db.getCursor(tx)
+	c.name = name
 	c.stack.top = 0
 	c.stack.elems[0] = stackElem{pgno: root}
 	return c, nil
@@ -742,7 +686,7 @@ func (tx *Tx) RoaringBitmap(name string) (*roaring.Bitmap, error) {
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			return nil, err
 		}
@@ -778,7 +722,7 @@ func (tx *Tx) container(name string, key uint64) (*roaring.Container, error) {
 	}
 
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return nil, err
 	}
@@ -860,10 +804,19 @@ func (tx *Tx) Check() error {
 		return ErrTxClosed
 	}
 
+	// Corrupt pages cannot be traversed reliably so report them all before
+	// checking the structure of the file.
+	if err := tx.checkChecksums(); err != nil {
+		return err
+	}
+
 	var errorList ErrorList
 	if err := tx.checkPageAllocations(); err != nil {
 		errorList.Append(err)
 	}
+	if err := tx.checkCounts(); err != nil {
+		errorList.Append(err)
+	}
 	return errorList.Err()
 }
 
@@ -944,7 +897,7 @@ func (tx *Tx) freePageSet() (map[uint32]struct{}, error) {
 		}
 
 		elem := &c.stack.elems[c.stack.top]
-		leafPage, _, err := c.tx.readPage(elem.pgno)
+		leafPage, _, err := c.readPage(elem.pgno)
 		if err != nil {
 			errorList.Append(fmt.Errorf("cannot read free page: pgno=%d err=%w", elem.pgno, err))
 			continue
@@ -964,16 +917,30 @@ func (tx *Tx) inusePageSet() (map[uint32]struct{}, error) {
 	m := make(map[uint32]struct{})
 	m[0] = struct{}{} // meta page
 
-	// Traverse root record linked list and mark each page as in-use.
-	for pgno := readMetaRootRecordPageNo(tx.meta[:]); pgno != 0; {
+	// Mark page table & directory pages as in-use.
+	pgnos, err := tx.allTablePgnos()
+	if err != nil {
+		errorList.Append(err)
+	}
+	for _, pgno := range pgnos {
 		m[pgno] = struct{}{}
+	}
 
-		page, _, err := tx.readPage(pgno)
-		if err != nil {
-			errorList.Append(err)
-			break
-		}
-		pgno = WalkRootRecordPages(page)
+	// Mark frame pages of compressed pages as in-use.
+	framePgnos, err := tx.framePgnos()
+	if err != nil {
+		errorList.Append(err)
+	}
+	for _, pgno := range framePgnos {
+		m[pgno] = struct{}{}
+	}
+
+	// Traverse root record pages and mark each page as in-use.
+	if err := tx.walkRootRecordPages(func(pgno uint32, _ []byte) error {
+		m[pgno] = struct{}{}
+		return nil
+	}); err != nil {
+		errorList.Append(err)
 	}
 
 	// Traverse freelist and mark pages as in-use.
@@ -1021,27 +988,15 @@ func (tx *Tx) inusePageSet() (map[uint32]struct{}, error) {
 
 // GetSizeBytesWithPrefix returns the size of bitmaps with a given key prefix.
 func (tx *Tx) GetSizeBytesWithPrefix(prefix string) (n uint64, err error) {
-	records, err := tx.RootRecords()
-	if err != nil {
-		return 0, err
-	}
-
-	// Loop over each bitmap in the database.
-	for itr := records.Iterator(); !itr.Done(); {
-		name, pgno, _ := itr.Next()
-
-		// Skip over any bitmaps that don't have a matching prefix.
-		if !strings.HasPrefix(name, prefix) {
-			continue
-		}
-
+	// Loop over each bitmap in the database with a matching prefix.
+	if err := tx.walkRootRecords(prefix, func(name string, pgno uint32) error {
 		// Traverse the bitmap's b-tree and count the bytes for each page.
-		if err := tx.walkTree(pgno, 0, func(pgno, parent, typ uint32, err error) error {
+		return tx.walkTree(pgno, 0, func(pgno, parent, typ uint32, err error) error {
 			n += PageSize
 			return err
-		}); err != nil {
-			return 0, err
-		}
+		})
+	}); err != nil {
+		return 0, err
 	}
 	return n, nil
 }
@@ -1166,7 +1121,7 @@ func (tx *Tx) allocatePgno() (_ uint32, outErr error) {
 	}
 
 	elem := &c.stack.elems[c.stack.top]
-	leafPage, _, err := c.tx.readPage(elem.pgno)
+	leafPage, _, err := c.readPage(elem.pgno)
 	if err != nil {
 		return 0, err
 	}
@@ -1196,6 +1151,9 @@ func (tx *Tx) allocateNewPgno() uint32 {
 func (tx *Tx) freePgno(pgno uint32) (outErr error) {
 	delete(tx.dirtyPages, pgno)
 	delete(tx.dirtyBitmapPages, pgno)
+	if _, err := tx.releaseFrame(pgno); err != nil {
+		return err
+	}
 
 	if tx.modifyingFreelist {
 		tx.pendingFreelistAdds = append(tx.pendingFreelistAdds, pgno)
@@ -1245,7 +1203,26 @@ func (tx *Tx) deallocateTree(pgno uint32) error {
 	}
 }
 
+// readPage returns the decompressed page and verifies it against its stored
+// checksum.
 func (tx *Tx) readPage(pgno uint32) (_ []byte, isHeap bool, err error) {
+	page, err := tx.readCompressedPage(pgno)
+	if err != nil {
+		return nil, false, err
+	} else if page == nil {
+		if page, isHeap, err = tx.readRawPage(pgno); err != nil || isHeap || pgno == 0 {
+			return page, isHeap, err
+		}
+	}
+	if err := tx.verifyPage(pgno, page); err != nil {
+		return nil, false, err
+	}
+	return page, false, nil
+}
+
+// readRawPage returns the page as stored in the file, without decompressing it
+// or verifying its checksum.
+func (tx *Tx) readRawPage(pgno uint32) (_ []byte, isHeap bool, err error) {
 	// Meta page is always cached on the transaction.
 	if pgno == 0 {
 		return tx.meta[:], false, nil
@@ -1267,12 +1244,14 @@ func (tx *Tx) readPage(pgno uint32) (_ []byte, isHeap bool, err error) {
 	}
 
 	// Check if page is remapped in WAL.
-	if walID, ok := tx.pageMap.Get(pgno); ok {
+	if walID, ok := tx.pageMap.Get(pgno); ok && walID > tx.checkpointWALID {
+		tx.walPageReadN.Add(1)
 		buf, err := tx.db.readWALPageByID(walID)
 		return buf, false, err
 	}
 
 	// Otherwise read directly from DB.
+	tx.dataPageReadN.Add(1)
 	buf, err := tx.db.readDBPage(pgno)
 	return buf, false, err
 }
@@ -1288,9 +1267,11 @@ func (tx *Tx) writeBitmapPage(pgno uint32, page []byte) error {
 }
 
 func (tx *Tx) checkTxSize() error {
-	pageN := tx.walPageN + len(tx.dirtyPages) + (len(tx.dirtyBitmapPages) * 2)
-	if pageN*PageSize >= len(tx.db.wal) {
+	pageN := tx.walPageN - tx.walStart + len(tx.dirtyPages) + (len(tx.dirtyBitmapPages) * 2)
+	if max := tx.db.cfg.MaxWALSize; max > 0 && int64(pageN)*PageSize >= max {
 		return ErrTxTooLarge
+	} else if max := tx.db.cfg.MaxSize; max > 0 && int64(readMetaPageN(tx.meta[:]))*PageSize > max {
+		return ErrMaxSize
 	}
 	return nil
 }
@@ -1499,7 +1480,7 @@ func (s *containerFilter) ApplyFilter() (err error) {
 	}
 	for err := s.cursor.Next(); err == nil; err = s.cursor.Next() {
 		elem := &s.cursor.stack.elems[s.cursor.stack.top]
-		leafPage, _, err := s.cursor.tx.readPage(elem.pgno)
+		leafPage, _, err := s.cursor.readPage(elem.pgno)
 		if err != nil {
 			return fmt.Errorf("reading from pgno %d applying filter: %s", elem.pgno, err)
 		}
@@ -1564,7 +1545,7 @@ func (s *containerFilter) ApplyRewriter() (err error) {
 	}
 	for err := s.cursor.Next(); err == nil; err = s.cursor.Next() {
 		elem := &s.cursor.stack.elems[s.cursor.stack.top]
-		leafPage, _, err := s.cursor.tx.readPage(elem.pgno)
+		leafPage, _, err := s.cursor.readPage(elem.pgno)
 		if err != nil {
 			return fmt.Errorf("reading from pgno %d applying rewriter: %s", elem.pgno, err)
 		}
@@ -1628,7 +1609,7 @@ func (itr *containerIterator) Next() bool {
 // Value returns the current key & container.
 func (itr *containerIterator) Value() (uint64, *roaring.Container) {
 	elem := &itr.cursor.stack.elems[itr.cursor.stack.top]
-	leafPage, _, _ := itr.cursor.tx.readPage(elem.pgno)
+	leafPage, _, _ := itr.cursor.readPage(elem.pgno)
 	cell := readLeafCell(leafPage, elem.index)
 	return cell.Key, toContainer(cell, itr.cursor.tx)
 }
@@ -1699,7 +1680,7 @@ func (tx *Tx) ImportRoaringBits(name string, itr roaring.RoaringIterator, clear
 			return changed, rowSet, err
 		} else if exact {
 			elem := &cur.stack.elems[cur.stack.top]
-			leafPage, _, err := cur.tx.readPage(elem.pgno)
+			leafPage, _, err := cur.readPage(elem.pgno)
 			if err != nil {
 				return changed, rowSet, err
 			}
@@ -1786,10 +1767,52 @@ func (tx *Tx) ImportRoaringBits(name string, itr roaring.RoaringIterator, clear
 
 // flush writes the dirty pages & meta page to the WAL.
 func (tx *Tx) flush() error {
-	w := bufio.NewWriterSize(tx.db.walFile, 65536)
+	// Record bit counts, page versions & checksums. Pages are compressed
+	// once their contents are final so that the frame pages they are stored
+	// in are versioned. Checksums must be written after every other dirty
+	// page.
+	if err := tx.writeCounts(); err != nil {
+		return fmt.Errorf("write counts: %w", err)
+	} else if err := tx.compressPages(); err != nil {
+		return fmt.Errorf("compress pages: %w", err)
+	} else if err := tx.writeVersions(); err != nil {
+		return fmt.Errorf("write page versions: %w", err)
+	} else if err := tx.writeChecksums(); err != nil {
+		return fmt.Errorf("write checksums: %w", err)
+	}
+	tx.sealTablePages()
+	if err := tx.checkTxSize(); err != nil {
+		return err
+	}
+
+	if err := tx.db.wal.rotate(tx.walPageN, readMetaWALID(tx.meta[:])); err != nil {
+		return err
+	}
+	// Map the pages before writing them so the commit cannot become durable
+	// without being readable by later transactions.
+	walPageN := tx.walPageN + len(tx.dirtyPages) + (len(tx.dirtyBitmapPages) * 2) + 1
+	for pgno := range tx.compressed {
+		if tx.dirtyBitmapPages[pgno] != nil {
+			walPageN -= 2
+		} else {
+			walPageN--
+		}
+	}
+	tx.db.mu.Lock()
+	err := tx.db.growMapping(tx.db.wal, int64(walPageN)*PageSize)
+	tx.db.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("grow wal mapping: %w", err)
+	}
+
+	w := bufio.NewWriterSize(&fileWriter{f: tx.db.wal, off: int64(tx.walPageN) * PageSize}, 65536)
 
-	// Write non-bitmap pages to WAL.
+	// Write non-bitmap pages to WAL. Compressed pages are stored in frame
+	// pages instead.
 	for _, pgno := range dirtyPageMapKeys(tx.dirtyPages) {
+		if _, ok := tx.compressed[pgno]; ok {
+			continue
+		}
 		walID, err := tx.writeToWAL(w, tx.dirtyPages[pgno])
 		if err != nil {
 			return fmt.Errorf("write page to wal: %w", err)
@@ -1807,6 +1830,10 @@ func (tx *Tx) flush() error {
 		hdr = allocPage()
 	}
 	for _, pgno := range dirtyPageMapKeys(tx.dirtyBitmapPages) {
+		if _, ok := tx.compressed[pgno]; ok {
+			continue
+		}
+
 		// Write header page.
 		writePageNo(hdr[:], pgno)
 		writeFlags(hdr[:], PageTypeBitmapHeader)
@@ -1841,7 +1868,7 @@ func (tx *Tx) flush() error {
 	// Flush & sync WAL.
 	if err := w.Flush(); err != nil {
 		return fmt.Errorf("flush wal: %w", err)
-	} else if err := tx.db.fsyncWAL(tx.db.walFile); err != nil {
+	} else if err := tx.db.fsyncWAL(tx.db.wal); err != nil {
 		return fmt.Errorf("sync wal: %w", err)
 	}
 
@@ -1875,9 +1902,13 @@ func (tx *Tx) Pages(pgnos []uint32) ([]Page, error) {
 	// Loop over each requested page number and extract additional data.
 	var pages []Page
 	for _, pgno := range pgnos {
-		buf, _, err := tx.readPage(pgno)
+		buf, err := tx.readCompressedPage(pgno)
 		if err != nil {
 			return nil, err
+		} else if buf == nil {
+			if buf, _, err = tx.readRawPage(pgno); err != nil {
+				return nil, err
+			}
 		}
 
 		switch info := infos[pgno].(type) {
@@ -1931,6 +1962,59 @@ func (tx *Tx) Pages(pgnos []uint32) ([]Page, error) {
 		case *FreePageInfo:
 			pages = append(pages, &FreePage{FreePageInfo: info})
 
+		case *ChecksumPageInfo:
+			page := &ChecksumPage{ChecksumPageInfo: info}
+			for i := 0; i < dirEntriesPerPage; i++ {
+				page.Entries = append(page.Entries, readDirEntry(buf, i))
+			}
+			pages = append(pages, page)
+
+		case *VersionPageInfo:
+			page := &VersionPage{VersionPageInfo: info}
+			if info.Flags == PageTypeVersionDir {
+				for i := 0; i < dirEntriesPerPage; i++ {
+					page.Entries = append(page.Entries, int64(readDirEntry(buf, i)))
+				}
+			} else {
+				for i := 0; i < versionTable.entriesPerPage(); i++ {
+					page.Entries = append(page.Entries, readVersionEntry(versionTable.entry(buf, i)))
+				}
+			}
+			pages = append(pages, page)
+
+		case *CompressionPageInfo:
+			page := &CompressionPage{CompressionPageInfo: info}
+			if info.Flags == PageTypeCompressionDir {
+				for i := 0; i < dirEntriesPerPage; i++ {
+					page.Entries = append(page.Entries, uint64(readDirEntry(buf, i)))
+				}
+			} else {
+				for i := 0; i < compressionTable.entriesPerPage(); i++ {
+					page.Entries = append(page.Entries, binary.BigEndian.Uint64(compressionTable.entry(buf, i)))
+				}
+			}
+			pages = append(pages, page)
+
+		case *FramePageInfo:
+			page := &FramePage{FramePageInfo: info}
+			for i := 0; i < info.SlotN; i++ {
+				page.Owners = append(page.Owners, readFrameOwner(buf, i))
+			}
+			pages = append(pages, page)
+
+		case *CountPageInfo:
+			page := &CountPage{CountPageInfo: info}
+			if info.Flags == PageTypeCountDir {
+				for i := 0; i < dirEntriesPerPage; i++ {
+					page.Entries = append(page.Entries, uint64(readDirEntry(buf, i)))
+				}
+			} else {
+				for i := 0; i < countTable.entriesPerPage(); i++ {
+					page.Entries = append(page.Entries, binary.BigEndian.Uint64(countTable.entry(buf, i)))
+				}
+			}
+			pages = append(pages, page)
+
 		default:
 			vprint.PanicOn(fmt.Sprintf("invalid page info type %T", info))
 		}
@@ -1952,15 +2036,12 @@ func (tx *Tx) PageInfos() ([]PageInfo, error) {
 	}
 	infos[0] = metaInfo
 
-	// Traverse root record linked list.
-	for pgno := metaInfo.RootRecordPageNo; pgno != 0; {
-		info, err := tx.rootRecordPageInfo(pgno)
-		if err != nil {
-			errorList.Append(err)
-			break
-		}
-		infos[pgno] = info
-		pgno = info.Next
+	// Traverse root record pages.
+	if err := tx.walkRootRecordPages(func(pgno uint32, page []byte) error {
+		infos[pgno] = rootRecordPageInfo(pgno, page)
+		return nil
+	}); err != nil {
+		errorList.Append(err)
 	}
 
 	// Traverse freelist and mark pages as in-use.
@@ -1982,6 +2063,46 @@ func (tx *Tx) PageInfos() ([]PageInfo, error) {
 		}
 	}
 
+	// Build page info objects for page table & directory pages.
+	for _, t := range pageTables {
+		pgnos, err := tx.tablePgnos(t)
+		if err != nil {
+			errorList.Append(err)
+		}
+		for _, pgno := range pgnos {
+			buf, _, err := tx.readRawPage(pgno)
+			if err != nil {
+				errorList.Append(err)
+				continue
+			}
+
+			switch t {
+			case &checksumTable:
+				infos[pgno] = &ChecksumPageInfo{Pgno: pgno, Flags: readFlags(buf)}
+			case &versionTable:
+				infos[pgno] = &VersionPageInfo{Pgno: pgno, Flags: readFlags(buf)}
+			case &compressionTable:
+				infos[pgno] = &CompressionPageInfo{Pgno: pgno, Flags: readFlags(buf)}
+			default:
+				infos[pgno] = &CountPageInfo{Pgno: pgno, Flags: readFlags(buf)}
+			}
+		}
+	}
+
+	// Build page info objects for frame pages.
+	framePgnos, err := tx.framePgnos()
+	if err != nil {
+		errorList.Append(err)
+	}
+	for _, pgno := range framePgnos {
+		buf, _, err := tx.readRawPage(pgno)
+		if err != nil {
+			errorList.Append(err)
+			continue
+		}
+		infos[pgno] = &FramePageInfo{Pgno: pgno, SlotN: readFrameSlotN(buf), UsedN: frameUsedN(buf)}
+	}
+
 	// Build page info objects for each free page.
 	freePageSet, err := tx.freePageSet()
 	if err != nil {
@@ -2009,20 +2130,17 @@ func (tx *Tx) metaPageInfo() (*MetaPageInfo, error) {
 		WALID:            readMetaWALID(buf),
 		RootRecordPageNo: readMetaRootRecordPageNo(buf),
 		FreelistPageNo:   readMetaFreelistPageNo(buf),
+		Features:         readMetaFeatures(buf),
 	}, nil
 }
 
 // rootRecordPageInfo returns page metadata for a root record page.
-func (tx *Tx) rootRecordPageInfo(pgno uint32) (*RootRecordPageInfo, error) {
-	buf, _, err := tx.readPage(pgno)
-	if err != nil {
-		return nil, err
-	}
-
+func rootRecordPageInfo(pgno uint32, buf []byte) *RootRecordPageInfo {
 	return &RootRecordPageInfo{
-		Pgno: pgno,
-		Next: WalkRootRecordPages(buf),
-	}, nil
+		Pgno:  pgno,
+		Flags: readFlags(buf),
+		Next:  WalkRootRecordPages(buf),
+	}
 }
 
 func (tx *Tx) walkPageInfo(infos []PageInfo, root uint32, name string) error {
@@ -2109,6 +2227,7 @@ type TxDebugInfo struct {
 }
 
 // SnapshotReader returns a reader that provides a snapshot for the current database state.
+// Pages of an encrypted database are returned decrypted.
 func (tx *Tx) SnapshotReader() (io.Reader, error) {
 	if tx.db == nil {
 		return nil, ErrTxClosed
@@ -2120,10 +2239,13 @@ func (tx *Tx) backup(w io.Writer) error {
 	if tx.db == nil {
 		return ErrTxClosed
 	}
+	if tx.db.aead != nil {
+		return tx.encryptedBackup(w)
+	}
 	var pgno uint32
 	last := readMetaPageN(tx.meta[:])
 	for pgno < last {
-		buf, _, err := tx.readPage(pgno)
+		buf, err := tx.readStoredPage(pgno)
 		if err != nil {
 			return err
 		}
@@ -2148,7 +2270,9 @@ func (r *snapshotReader) Read(p []byte) (n int, err error) {
 	}
 
 	// Otherwise look up the page data from mmap or page cache and copy it out.
-	buf, _, err := r.tx.readPage(r.pgno)
+	// Free & page table pages may not match a stored checksum so pages are
+	// copied without verification.
+	buf, err := r.tx.readStoredPage(r.pgno)
 	if err != nil {
 		return 0, err
 	} else if len(p) < len(buf) {
@@ -2166,12 +2290,17 @@ type PageInfo interface {
 	pageInfo()
 }
 
-func (*MetaPageInfo) pageInfo()       {}
-func (*RootRecordPageInfo) pageInfo() {}
-func (*LeafPageInfo) pageInfo()       {}
-func (*BranchPageInfo) pageInfo()     {}
-func (*BitmapPageInfo) pageInfo()     {}
-func (*FreePageInfo) pageInfo()       {}
+func (*MetaPageInfo) pageInfo()        {}
+func (*RootRecordPageInfo) pageInfo()  {}
+func (*LeafPageInfo) pageInfo()        {}
+func (*BranchPageInfo) pageInfo()      {}
+func (*BitmapPageInfo) pageInfo()      {}
+func (*FreePageInfo) pageInfo()        {}
+func (*ChecksumPageInfo) pageInfo()    {}
+func (*VersionPageInfo) pageInfo()     {}
+func (*CompressionPageInfo) pageInfo() {}
+func (*CountPageInfo) pageInfo()       {}
+func (*FramePageInfo) pageInfo()       {}
 
 type MetaPageInfo struct {
 	Pgno             uint32
@@ -2180,11 +2309,13 @@ type MetaPageInfo struct {
 	WALID            int64
 	RootRecordPageNo uint32
 	FreelistPageNo   uint32
+	Features         uint32
 }
 
 type RootRecordPageInfo struct {
-	Pgno uint32
-	Next uint32
+	Pgno  uint32
+	Flags uint32
+	Next  uint32 // overflow page, if stored as a chain
 }
 
 type LeafPageInfo struct {
@@ -2213,16 +2344,52 @@ type FreePageInfo struct {
 	Pgno uint32
 }
 
+// ChecksumPageInfo describes a checksum or checksum directory page.
+type ChecksumPageInfo struct {
+	Pgno  uint32
+	Flags uint32
+}
+
+// VersionPageInfo describes a page version or page version directory page.
+type VersionPageInfo struct {
+	Pgno  uint32
+	Flags uint32
+}
+
+// CompressionPageInfo describes a compression or compression directory page.
+type CompressionPageInfo struct {
+	Pgno  uint32
+	Flags uint32
+}
+
+// CountPageInfo describes a count or count directory page.
+type CountPageInfo struct {
+	Pgno  uint32
+	Flags uint32
+}
+
+// FramePageInfo describes a frame page holding compressed pages.
+type FramePageInfo struct {
+	Pgno  uint32
+	SlotN int // number of slots
+	UsedN int // number of slots storing a page
+}
+
 type Page interface {
 	page()
 }
 
-func (*MetaPage) page()       {}
-func (*RootRecordPage) page() {}
-func (*LeafPage) page()       {}
-func (*BranchPage) page()     {}
-func (*BitmapPage) page()     {}
-func (*FreePage) page()       {}
+func (*MetaPage) page()        {}
+func (*RootRecordPage) page()  {}
+func (*LeafPage) page()        {}
+func (*BranchPage) page()      {}
+func (*BitmapPage) page()      {}
+func (*FreePage) page()        {}
+func (*ChecksumPage) page()    {}
+func (*VersionPage) page()     {}
+func (*CompressionPage) page() {}
+func (*CountPage) page()       {}
+func (*FramePage) page()       {}
 
 type MetaPage struct {
 	*MetaPageInfo
@@ -2267,6 +2434,47 @@ type FreePage struct {
 	*FreePageInfo
 }
 
+// ChecksumPage holds the entries of a checksum or checksum directory page.
+// Directory entries are page numbers of checksum pages.
+type ChecksumPage struct {
+	*ChecksumPageInfo
+	Entries []uint32
+}
+
+// VersionPage holds the entries of a page version or page version directory
+// page. Version entries are the WAL ID of the last write to each page.
+// Directory entries are page numbers of version pages.
+type VersionPage struct {
+	*VersionPageInfo
+	Entries []int64
+}
+
+// CompressionPage holds the entries of a compression or compression directory
+// page. Compression entries hold the frame page of each compressed page in the
+// high 32 bits followed by its slot & frame length in 16 bits each, or zero if
+// the page is stored uncompressed. Directory entries are page numbers of
+// compression pages.
+type CompressionPage struct {
+	*CompressionPageInfo
+	Entries []uint64
+}
+
+// CountPage holds the entries of a count or count directory page. Count
+// entries are the bit count of the bitmap rooted at each page plus one, or
+// zero if no count is recorded. Directory entries are page numbers of count
+// pages.
+type CountPage struct {
+	*CountPageInfo
+	Entries []uint64
+}
+
+// FramePage holds the page number stored in each slot of a frame page, or zero
+// if the slot is free.
+type FramePage struct {
+	*FramePageInfo
+	Owners []uint32
+}
+
 // dirtyPageMapKeys returns a sorted slice slice of keys for a dirty page map.
 func dirtyPageMapKeys(m map[uint32][]byte) []uint32 {
 	a := make([]uint32, 0, len(m))
@@ -5,16 +5,21 @@ package rbf_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gernest/rbf"
+	rbfcfg "github.com/gernest/rbf/cfg"
 	"github.com/gernest/roaring"
 	"github.com/stretchr/testify/assert"
 )
@@ -1118,6 +1123,123 @@ func TestTx_CreateBitmap(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+
+	t.Run("ErrBitmapNameTooLong", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+
+		name := strings.Repeat("x", rbf.MaxBitmapNameSize+1)
+		if err := tx.CreateBitmap(name); err != rbf.ErrBitmapNameTooLong {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := tx.CreateBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.RenameBitmap("x", name); err != rbf.ErrBitmapNameTooLong {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// Ensure root records remain ordered & reachable as the b-tree which holds
+// them is split and shrunk.
+func TestTx_RootRecords(t *testing.T) {
+	db := MustOpenDB(t)
+	defer func() { MustCloseDB(t, db) }()
+
+	// Long names make the tree several levels deep.
+	const n = 3000
+	pad := strings.Repeat("x", 200)
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%d/%05d/%s", i%3, i, pad)
+	}
+
+	// Insert in random order so pages split in the middle of the tree.
+	tx := MustBegin(t, db, true)
+	for _, i := range rand.New(rand.NewSource(0)).Perm(n) {
+		if err := tx.CreateBitmap(names[i]); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Add(names[i], uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = MustReopenDB(t, db)
+
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	tx = MustBegin(t, db, true)
+	defer tx.Rollback()
+	if a, err := tx.BitmapNames(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, sorted) {
+		t.Fatalf("unexpected names: n=%d", len(a))
+	} else if a, err := tx.BitmapNamesWithPrefix("f1/"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != n/3 || !sort.StringsAreSorted(a) {
+		t.Fatalf("unexpected prefix names: n=%d", len(a))
+	} else if a, err := tx.BitmapNamesWithPrefix("f1/00004/"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []string{names[4]}) {
+		t.Fatalf("unexpected prefix names: %v", a)
+	} else if a, err := tx.BitmapNamesWithPrefix("g"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected prefix names: %v", a)
+	}
+	for i, name := range names {
+		if ok, err := tx.Contains(name, uint64(i)); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("expected bit in %q", name)
+		}
+	}
+
+	// Rename one prefix, delete another & delete the rest one at a time.
+	for _, name := range names {
+		if strings.HasPrefix(name, "f0/") {
+			if err := tx.RenameBitmap(name, "r"+name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx.DeleteBitmapsWithPrefix("f1/"); err != nil {
+		t.Fatal(err)
+	} else if a, err := tx.BitmapNamesWithPrefix("f"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != n/3 {
+		t.Fatalf("unexpected names: n=%d", len(a))
+	} else if err := tx.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range names {
+		if strings.HasPrefix(name, "f0/") {
+			if ok, err := tx.Contains("r"+name, uint64(i)); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("expected bit in renamed %q", name)
+			} else if err := tx.DeleteBitmap("r" + name); err != nil {
+				t.Fatal(err)
+			}
+		} else if strings.HasPrefix(name, "f2/") {
+			if err := tx.DeleteBitmap(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if a, err := tx.BitmapNames(); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected names: n=%d", len(a))
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = MustReopenDB(t, db)
 }
 
 func TestTx_DeleteBitmapsWithPrefix(t *testing.T) {
@@ -1180,6 +1302,21 @@ func TestTx_DeleteBitmapsWithPrefix(t *testing.T) {
 				_, _ = pf("%-10s ", "free")
 				_, _ = pf("-\n")
 
+			case *rbf.ChecksumPageInfo:
+				_, _ = pf("%-8d ", pgno)
+				_, _ = pf("%-10s ", "checksum")
+				_, _ = pf("-\n")
+
+			case *rbf.VersionPageInfo:
+				_, _ = pf("%-8d ", pgno)
+				_, _ = pf("%-10s ", "version")
+				_, _ = pf("-\n")
+
+			case *rbf.CountPageInfo:
+				_, _ = pf("%-8d ", pgno)
+				_, _ = pf("%-10s ", "count")
+				_, _ = pf("-\n")
+
 			default:
 				t.Fatalf("unexpected page info type %T", info)
 			}
@@ -1227,7 +1364,10 @@ func TestTx_Check(t *testing.T) {
 	t.Run("EmptyBranchPage", func(t *testing.T) {
 		t.Parallel()
 
-		db := MustOpenDB(t)
+		// Disable checksums so the structural check sees the corrupt page.
+		config := rbfcfg.NewDefaultConfig()
+		config.PageChecksums = false
+		db := MustOpenDB(t, config)
 		defer MustCloseDBNoCheck(t, db)
 		tx := MustBegin(t, db, true)
 		defer tx.Rollback()
@@ -1305,6 +1445,85 @@ func TestTx_Check(t *testing.T) {
 	})
 }
 
+func TestTx_Checksum(t *testing.T) {
+	config := rbfcfg.NewDefaultConfig()
+	config.PageChecksums = true
+	db := MustOpenDB(t, config)
+	defer MustCloseDBNoCheck(t, db)
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	// Create one bitmap with an array container & one with a bitmap container.
+	if _, err := tx.Add("x", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 10000; i += 2 {
+		if _, err := tx.Add("y", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := tx.PageInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the leaf page of "x" & the bitmap page of "y".
+	var leafPgno, bitmapPgno uint32
+	for _, info := range infos {
+		switch info := info.(type) {
+		case *rbf.LeafPageInfo:
+			if info.Tree == "x" {
+				leafPgno = info.Pgno
+			}
+		case *rbf.BitmapPageInfo:
+			if info.Tree == "y" {
+				bitmapPgno = info.Pgno
+			}
+		}
+	}
+	for _, pgno := range []uint32{leafPgno, bitmapPgno} {
+		if pgno == 0 {
+			t.Fatal("page not found")
+		}
+		page := mustReadPage(t, db.DataPath(), pgno)
+		page[rbf.PageSize-1] ^= 1
+		mustWritePage(t, db.DataPath(), pgno, page)
+	}
+
+	tx = MustBegin(t, db, false)
+	defer tx.Rollback()
+
+	var cerr *rbf.ChecksumError
+	if _, err := tx.Contains("x", 1); !errors.Is(err, rbf.ErrChecksumMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &cerr) || cerr.Pgno != leafPgno || cerr.Name != "x" {
+		t.Fatalf("unexpected checksum error: %#v", cerr)
+	}
+
+	if _, err := tx.Contains("y", 2); !errors.Is(err, rbf.ErrChecksumMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &cerr) || cerr.Pgno != bitmapPgno || cerr.Name != "y" {
+		t.Fatalf("unexpected checksum error: %#v", cerr)
+	}
+
+	// Check should report every corrupt page.
+	if err, ok := tx.Check().(rbf.ErrorList); !ok {
+		t.Fatal("expected error list")
+	} else if len(err) != 2 {
+		t.Fatalf("unexpected error count: %s", err.FullError())
+	} else if s := err.FullError(); !strings.Contains(s, fmt.Sprintf(`pgno=%d bitmap="x"`, leafPgno)) ||
+		!strings.Contains(s, fmt.Sprintf(`pgno=%d bitmap="y"`, bitmapPgno)) {
+		t.Fatalf("unexpected error:\n%s", s)
+	}
+}
+
 func mustReadPage(tb testing.TB, path string, pgno uint32) []byte {
 	tb.Helper()
 	f, err := os.Open(path)
@@ -1333,3 +1552,1076 @@ func mustWritePage(tb testing.TB, path string, pgno uint32, buf []byte) {
 		tb.Fatal(err)
 	}
 }
+
+func TestTx_Savepoint(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	if _, err := tx.Add("x", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make enough changes to split pages & allocate bitmap containers.
+	for i := uint64(0); i < 100000; i += 3 {
+		if _, err := tx.Add("x", 1000+i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Add("y", 10); err != nil {
+		t.Fatal(err)
+	} else if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+
+	if bm, err := tx.RoaringBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if got, want := bm.Slice(), []uint64{1, 2, 3}; !assert.Equal(t, want, got) {
+		return
+	}
+	if ok, err := tx.BitmapExists("y"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected bitmap to be rolled back")
+	}
+
+	// The savepoint remains valid after rolling back to it, but savepoints
+	// created after it do not.
+	inner, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Add("x", 4); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Release(inner); err != nil {
+		t.Fatal(err)
+	} else if err := tx.RollbackTo(inner); err != rbf.ErrInvalidSavepoint {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := tx.Release(sp); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Release(sp); err != rbf.ErrInvalidSavepoint {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = MustBegin(t, db, false)
+	defer tx.Rollback()
+	if bm, err := tx.RoaringBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if got, want := bm.Slice(), []uint64{1, 2, 3, 4}; !assert.Equal(t, want, got) {
+		return
+	} else if err := tx.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTx_Count(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+
+	want := roaring.NewBitmap()
+	rand := rand.New(rand.NewSource(0))
+	randomBitmap := func(n int) *roaring.Bitmap {
+		bm := roaring.NewBitmap()
+		for i := 0; i < n; i++ {
+			bm.DirectAdd(uint64(rand.Intn(20)<<16 | rand.Intn(1<<16)))
+		}
+		return bm
+	}
+
+	// verify checks the count against a model and a full scan.
+	verify := func(t *testing.T, tx *rbf.Tx) {
+		t.Helper()
+		if n, err := tx.Count("x"); err != nil {
+			t.Fatal(err)
+		} else if n != want.Count() {
+			t.Fatalf("count=%d, want %d", n, want.Count())
+		} else if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mutations := []func(tx *rbf.Tx) error{
+		func(tx *rbf.Tx) error { // Add
+			a := randomBitmap(100).Slice()
+			want.DirectAddN(a...)
+			_, err := tx.Add("x", a...)
+			return err
+		},
+		func(tx *rbf.Tx) error { // Remove
+			a := want.Slice()
+			a = a[:len(a)/10]
+			want.DirectRemoveN(a...)
+			_, err := tx.Remove("x", a...)
+			return err
+		},
+		func(tx *rbf.Tx) error { // AddRoaring
+			bm := randomBitmap(10000)
+			want = want.Union(bm)
+			_, err := tx.AddRoaring("x", bm)
+			return err
+		},
+		func(tx *rbf.Tx) error { // RemoveRoaring
+			bm := randomBitmap(10000)
+			want = want.Difference(bm)
+			c, err := tx.Cursor("x")
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			_, err = c.RemoveRoaring(bm)
+			return err
+		},
+		func(tx *rbf.Tx) error { // PutContainer
+			key := uint64(rand.Intn(20))
+			ct := randomBitmap(5000).Containers.Get(0)
+			if ct == nil {
+				ct = roaring.NewContainerArray([]uint16{1})
+			}
+			want.Containers.Put(key, ct.Clone())
+			return tx.PutContainer("x", key, ct)
+		},
+		func(tx *rbf.Tx) error { // RemoveContainer
+			key := uint64(rand.Intn(20))
+			want.Containers.Remove(key)
+			return tx.RemoveContainer("x", key)
+		},
+		func(tx *rbf.Tx) error { // ImportRoaringBits
+			bm := randomBitmap(1000)
+			var buf bytes.Buffer
+			if _, err := bm.WriteTo(&buf); err != nil {
+				return err
+			}
+			itr, err := roaring.NewRoaringIterator(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			want = want.Union(bm)
+			_, _, err = tx.ImportRoaringBits("x", itr, false, false, 1<<20)
+			return err
+		},
+	}
+
+	for i := 0; i < 50; i++ {
+		tx := MustBegin(t, db, true)
+		if err := mutations[i%len(mutations)](tx); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, tx)
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Stored", func(t *testing.T) {
+		tx := MustBegin(t, db, false)
+		defer tx.Rollback()
+		verify(t, tx)
+
+		infos, err := tx.PageInfos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, info := range infos {
+			if _, ok := info.(*rbf.CountPageInfo); ok {
+				n++
+			}
+		}
+		if n == 0 {
+			t.Fatal("expected count pages")
+		}
+	})
+
+	t.Run("Savepoint", func(t *testing.T) {
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		sp, err := tx.Savepoint()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Add("x", 1<<40); err != nil {
+			t.Fatal(err)
+		} else if err := tx.RollbackTo(sp); err != nil {
+			t.Fatal(err)
+		}
+		verify(t, tx)
+	})
+
+	t.Run("Recreate", func(t *testing.T) {
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if err := tx.DeleteBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Add("x", 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		want = roaring.NewBitmap(1, 2)
+		verify(t, tx)
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		tx = MustBegin(t, db, false)
+		defer tx.Rollback()
+		verify(t, tx)
+	})
+}
+
+func TestTx_SetOps(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+
+	// randomBitmap returns array, bitmap & run containers over a few keys.
+	randomBitmap := func() *roaring.Bitmap {
+		bm := roaring.NewBitmap()
+		for key := uint64(0); key < 8; key++ {
+			switch rand.Intn(4) {
+			case 0: // empty
+			case 1:
+				for i := 0; i < 100; i++ {
+					bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			case 2:
+				for i := 0; i < 10000; i++ {
+					bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			case 3:
+				start := rand.Intn(1 << 15)
+				for v := start; v < start+5000; v++ {
+					bm.DirectAdd(key<<16 | uint64(v))
+				}
+			}
+		}
+		return bm
+	}
+
+	ops := []struct {
+		name  string
+		apply func(tx *rbf.Tx, dst string, srcs ...string) (bool, error)
+		iter  func(tx *rbf.Tx, srcs ...string) (roaring.ContainerIterator, error)
+		want  func(a ...*roaring.Bitmap) *roaring.Bitmap
+	}{
+		{"Union", (*rbf.Tx).Union, (*rbf.Tx).UnionIterator, func(a ...*roaring.Bitmap) *roaring.Bitmap {
+			return a[0].Union(a[1:]...)
+		}},
+		{"Intersect", (*rbf.Tx).Intersect, (*rbf.Tx).IntersectIterator, func(a ...*roaring.Bitmap) *roaring.Bitmap {
+			bm := a[0]
+			for _, other := range a[1:] {
+				bm = bm.Intersect(other)
+			}
+			return bm
+		}},
+		{"Difference", (*rbf.Tx).Difference, (*rbf.Tx).DifferenceIterator, func(a ...*roaring.Bitmap) *roaring.Bitmap {
+			return a[0].Difference(a[1:]...)
+		}},
+		{"Xor", (*rbf.Tx).Xor, (*rbf.Tx).XorIterator, func(a ...*roaring.Bitmap) *roaring.Bitmap {
+			bm := a[0]
+			for _, other := range a[1:] {
+				bm = bm.Xor(other)
+			}
+			return bm
+		}},
+	}
+
+	for _, op := range ops {
+		t.Run(op.name, func(t *testing.T) {
+			db := MustOpenDB(t)
+			defer MustCloseDB(t, db)
+			tx := MustBegin(t, db, true)
+			defer tx.Rollback()
+
+			srcs := map[string]*roaring.Bitmap{"a": randomBitmap(), "b": randomBitmap(), "c": randomBitmap(), "dst": randomBitmap()}
+			for name, bm := range srcs {
+				if _, err := tx.AddRoaring(name, bm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			verify := func(t *testing.T, name string, want *roaring.Bitmap) {
+				t.Helper()
+				if bm, err := tx.RoaringBitmap(name); err != nil {
+					t.Fatal(err)
+				} else if !reflect.DeepEqual(bm.Slice(), want.Slice()) {
+					t.Fatalf("count=%d, want %d", bm.Count(), want.Count())
+				} else if n, err := tx.Count(name); err != nil {
+					t.Fatal(err)
+				} else if n != want.Count() {
+					t.Fatalf("Count()=%d, want %d", n, want.Count())
+				}
+			}
+
+			// Overwrite the existing destination.
+			want := op.want(srcs["a"], srcs["b"], srcs["c"])
+			if changed, err := op.apply(tx, "dst", "a", "b", "c"); err != nil {
+				t.Fatal(err)
+			} else if !changed {
+				t.Fatal("expected change")
+			}
+			verify(t, "dst", want)
+
+			// Repeating the operation changes nothing.
+			if changed, err := op.apply(tx, "dst", "a", "b", "c"); err != nil {
+				t.Fatal(err)
+			} else if changed {
+				t.Fatal("unexpected change")
+			}
+
+			// Stream the same result.
+			itr, err := op.iter(tx, "a", "b", "c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := roaring.NewBitmap()
+			for itr.Next() {
+				key, ct := itr.Value()
+				if ct.N() == 0 {
+					t.Fatalf("unexpected empty container: key=%d", key)
+				}
+				got.Containers.Put(key, ct.Clone())
+			}
+			itr.Close()
+			if !reflect.DeepEqual(got.Slice(), want.Slice()) {
+				t.Fatalf("iterator count=%d, want %d", got.Count(), want.Count())
+			}
+
+			// An invalid source returns an error and no iterator.
+			if itr, err := op.iter(tx, "a", ""); err != rbf.ErrBitmapNameRequired {
+				t.Fatalf("unexpected error: %v", err)
+			} else if itr != nil {
+				t.Fatalf("unexpected iterator: %#v", itr)
+			}
+
+			// Write to a new destination which is also a source & read a
+			// missing source as empty.
+			want = op.want(srcs["b"], srcs["a"], roaring.NewBitmap())
+			if _, err := op.apply(tx, "b", "b", "a", "missing"); err != nil {
+				t.Fatal(err)
+			}
+			verify(t, "b", want)
+
+			if _, err := op.apply(tx, "new", "c"); err != nil {
+				t.Fatal(err)
+			}
+			verify(t, "new", srcs["c"])
+
+			if err := tx.Check(); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTx_RemoveRange(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+
+	// newBitmap returns array, bitmap & run containers over ten keys.
+	newBitmap := func() *roaring.Bitmap {
+		bm := roaring.NewBitmap()
+		for key := uint64(0); key < 10; key++ {
+			switch key % 3 {
+			case 0:
+				for i := 0; i < 100; i++ {
+					bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			case 1:
+				for i := 0; i < 10000; i++ {
+					bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			case 2:
+				for v := uint64(1000); v < 30000; v++ {
+					bm.DirectAdd(key<<16 | v)
+				}
+			}
+		}
+		return bm
+	}
+
+	// removeRange returns the bits of bm outside of [start, end).
+	removeRange := func(bm *roaring.Bitmap, start, end uint64) *roaring.Bitmap {
+		other := roaring.NewBitmap()
+		for _, v := range bm.Slice() {
+			if v < start || v >= end {
+				other.DirectAdd(v)
+			}
+		}
+		return other
+	}
+
+	t.Run("Tx", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+
+		want := newBitmap()
+		if _, err := tx.AddRoaring("x", want); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range []struct{ start, end uint64 }{
+			{5, 5},                       // empty range
+			{1<<16 + 100, 1<<16 + 200},   // inside a bitmap container
+			{2<<16 + 500, 2<<16 + 2000},  // edge of a run container
+			{3<<16 + 1000, 6<<16 + 1000}, // whole containers & both edges
+			{9 << 16, 10 << 16},          // exactly one container
+			{20 << 16, 30 << 16},         // past the end
+			{7<<16 + 1, math.MaxUint64},  // to the end
+		} {
+			before := want.Count()
+			want = removeRange(want, r.start, r.end)
+			if n, err := tx.RemoveRange("x", r.start, r.end); err != nil {
+				t.Fatal(err)
+			} else if n != before-want.Count() {
+				t.Fatalf("RemoveRange(%d, %d)=%d, want %d", r.start, r.end, n, before-want.Count())
+			}
+
+			if bm, err := tx.RoaringBitmap("x"); err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(bm.Slice(), want.Slice()) {
+				t.Fatalf("RemoveRange(%d, %d): count=%d, want %d", r.start, r.end, bm.Count(), want.Count())
+			} else if n, err := tx.Count("x"); err != nil {
+				t.Fatal(err)
+			} else if n != want.Count() {
+				t.Fatalf("Count()=%d, want %d", n, want.Count())
+			}
+		}
+
+		if n, err := tx.RemoveRange("missing", 0, 100); err != nil || n != 0 {
+			t.Fatalf("RemoveRange(missing)=%d, %v", n, err)
+		} else if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("DB", func(t *testing.T) {
+		config := rbfcfg.NewDefaultConfig()
+		config.MaxDelete = 5000
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+
+		bm := newBitmap()
+		tx := MustBegin(t, db, true)
+		if _, err := tx.AddRoaring("x", bm); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		start, end := uint64(1<<16+100), uint64(8<<16+100)
+		want := removeRange(bm, start, end)
+		var calls int
+		var last, pos uint64
+		n, err := db.RemoveRange("x", start, end, func(removed, next uint64) {
+			calls++
+			if removed-last > uint64(config.MaxDelete) {
+				t.Fatalf("removed %d bits in one tx", removed-last)
+			} else if next <= pos {
+				t.Fatalf("position did not advance: %d", next)
+			}
+			last, pos = removed, next
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if n != bm.Count()-want.Count() || last != n || pos != end {
+			t.Fatalf("n=%d last=%d pos=%d, want %d", n, last, pos, bm.Count()-want.Count())
+		} else if calls < int(n)/config.MaxDelete {
+			t.Fatalf("unexpected progress calls: %d", calls)
+		}
+
+		tx = MustBegin(t, db, false)
+		defer tx.Rollback()
+		if other, err := tx.RoaringBitmap("x"); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other.Slice(), want.Slice()) {
+			t.Fatalf("count=%d, want %d", other.Count(), want.Count())
+		}
+	})
+}
+
+func TestTx_BulkLoad(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+
+	// Mix array, bitmap & run containers followed by enough small containers
+	// to need more than one level of branch pages.
+	bm := roaring.NewBitmap()
+	for key := uint64(0); key < 300; key++ {
+		switch key % 3 {
+		case 0:
+			for i := 0; i < 100; i++ {
+				bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+			}
+		case 1:
+			for i := 0; i < 10000; i++ {
+				bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+			}
+		case 2:
+			for v := uint64(1000); v < 30000; v++ {
+				bm.DirectAdd(key<<16 | v)
+			}
+		}
+	}
+	for key := uint64(300); key < 200000; key++ {
+		bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+	}
+
+	db := MustOpenDB(t)
+	defer func() { MustCloseDB(t, db) }()
+
+	tx := MustBegin(t, db, true)
+	itr, _ := bm.Containers.Iterator(0)
+	if err := tx.BulkLoad("x", itr); err != nil {
+		t.Fatal(err)
+	}
+	itr.Close()
+	if _, err := tx.AddRoaring("y", bm); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := tx.Count("x"); err != nil {
+		t.Fatal(err)
+	} else if n != bm.Count() {
+		t.Fatalf("Count()=%d, want %d", n, bm.Count())
+	} else if depth, err := tx.Depth("x"); err != nil {
+		t.Fatal(err)
+	} else if depth != 3 {
+		t.Fatalf("Depth()=%d, want 3", depth)
+	}
+
+	// Packed leaves should need fewer pages than inserting containers.
+	infos, err := tx.PageInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafN := make(map[string]int)
+	for _, info := range infos {
+		if info, ok := info.(*rbf.LeafPageInfo); ok {
+			leafN[info.Tree]++
+		}
+	}
+	if leafN["x"] >= leafN["y"] {
+		t.Fatalf("bulk load used %d leaf pages, insertion used %d", leafN["x"], leafN["y"])
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = MustReopenDB(t, db)
+	tx = MustBegin(t, db, true)
+	defer tx.Rollback()
+	if other, err := tx.RoaringBitmap("x"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other.Slice(), bm.Slice()) {
+		t.Fatalf("count=%d, want %d", other.Count(), bm.Count())
+	}
+
+	// Loaded bitmaps can be changed like any other.
+	if _, err := tx.Add("x", 1, 150<<16|7, 250000<<16); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Remove("x", bm.Slice()[0]); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ErrBitmapNotEmpty", func(t *testing.T) {
+		itr, _ := bm.Containers.Iterator(0)
+		defer itr.Close()
+		if err := tx.BulkLoad("x", itr); err != rbf.ErrBitmapNotEmpty {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		itr, _ := roaring.NewBitmap().Containers.Iterator(0)
+		defer itr.Close()
+		if err := tx.BulkLoad("empty", itr); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Root("empty"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Unsorted", func(t *testing.T) {
+		itr := &containerSliceIterator{
+			keys: []uint64{1, 3, 2},
+			cts:  []*roaring.Container{roaring.NewContainerArray([]uint16{1}), roaring.NewContainerArray([]uint16{2}), roaring.NewContainerArray([]uint16{3})},
+		}
+		if err := tx.BulkLoad("unsorted", itr); err == nil || err.Error() != "bulk load: key 2 does not follow key 3" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// containerSliceIterator returns containers in the order given.
+type containerSliceIterator struct {
+	keys []uint64
+	cts  []*roaring.Container
+	i    int
+}
+
+func (itr *containerSliceIterator) Next() bool {
+	itr.i++
+	return itr.i <= len(itr.keys)
+}
+
+func (itr *containerSliceIterator) Value() (uint64, *roaring.Container) {
+	return itr.keys[itr.i-1], itr.cts[itr.i-1]
+}
+
+func (itr *containerSliceIterator) Close() {}
+
+func TestTx_PortableBitmap(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+
+	// Array, bitmap & run containers in buckets on both sides of 2^32, as
+	// well as a stored bitmap container holding few enough bits to be
+	// written as an array.
+	bm := roaring.NewBitmap()
+	for _, key := range []uint64{0, 1, 2, 0xFFFF, 1 << 16, 1<<16 + 1, 5 << 16, 5<<16 + 3, 5<<16 + 9} {
+		switch key % 3 {
+		case 0:
+			for i := 0; i < 100; i++ {
+				bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+			}
+		case 1:
+			for i := 0; i < 10000; i++ {
+				bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+			}
+		case 2:
+			for v := uint64(1000); v < 30000; v += 3000 {
+				for i := uint64(0); i < 100; i++ {
+					bm.DirectAdd(key<<16 | (v + i))
+				}
+			}
+		}
+	}
+
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+	tx := MustBegin(t, db, true)
+	defer tx.Rollback()
+
+	words := make([]uint64, 1024)
+	for i := 0; i < 50; i++ {
+		words[rand.Intn(1024)] |= 1 << rand.Intn(64)
+	}
+	bm.Containers.Put(3, roaring.NewContainerBitmap(-1, words))
+	want := bm.Clone()
+
+	if _, err := tx.AddRoaring("x", bm); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := tx.WriteBitmapTo("x", &buf); err != nil {
+		t.Fatal(err)
+	} else if n != int64(buf.Len()) {
+		t.Fatalf("WriteBitmapTo()=%d, wrote %d bytes", n, buf.Len())
+	}
+	data := buf.Bytes()
+
+	// The first bucket holds the bits below 2^32 as a 32-bit portable bitmap.
+	itr, err := roaring.NewRoaringIterator(data[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := itr.ContainerKeys(); !reflect.DeepEqual(keys, []uint64{0, 1, 2, 3, 0xFFFF}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	for {
+		key, ct := itr.NextContainer()
+		if ct == nil {
+			break
+		}
+		if other := want.Containers.Get(key); other.BitwiseCompare(ct) != nil {
+			t.Fatalf("container %d: %v", key, other.BitwiseCompare(ct))
+		}
+	}
+
+	t.Run("New", func(t *testing.T) {
+		r := bytes.NewReader(append(append([]byte{}, data...), "trailing"...))
+		if n, err := tx.ReadBitmapFrom("y", r); err != nil {
+			t.Fatal(err)
+		} else if n != int64(len(data)) || r.Len() != len("trailing") {
+			t.Fatalf("ReadBitmapFrom()=%d, remaining %d", n, r.Len())
+		} else if other, err := tx.RoaringBitmap("y"); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other.Slice(), want.Slice()) {
+			t.Fatalf("count=%d, want %d", other.Count(), want.Count())
+		} else if n, err := tx.Count("y"); err != nil || n != want.Count() {
+			t.Fatalf("Count()=%d, %v", n, err)
+		}
+	})
+
+	t.Run("Existing", func(t *testing.T) {
+		if _, err := tx.Add("z", 1, 5<<32, 1<<48); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.ReadBitmapFrom("z", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		want := want.Clone()
+		want.DirectAdd(1)
+		want.DirectAdd(5 << 32)
+		want.DirectAdd(1 << 48)
+		if other, err := tx.RoaringBitmap("z"); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other.Slice(), want.Slice()) {
+			t.Fatalf("count=%d, want %d", other.Count(), want.Count())
+		} else if err := tx.Check(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Compare against the bytes of {1, 2^32+5} written by other implementations.
+	t.Run("Interop", func(t *testing.T) {
+		other := []byte{
+			2, 0, 0, 0, 0, 0, 0, 0, // bucket count
+			0, 0, 0, 0, 0x3A, 0x30, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 16, 0, 0, 0, 1, 0,
+			1, 0, 0, 0, 0x3A, 0x30, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 16, 0, 0, 0, 5, 0,
+		}
+		if _, err := tx.Add("interop", 1, 1<<32+5); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := tx.WriteBitmapTo("interop", &buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), other) {
+			t.Fatalf("unexpected bytes: %v", buf.Bytes())
+		}
+
+		buf.Reset()
+		if _, err := tx.WriteBitmapTo("no such bitmap", &buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), make([]byte, 8)) {
+			t.Fatalf("unexpected bytes: %v", buf.Bytes())
+		}
+	})
+
+	t.Run("ErrInvalidPortableBitmap", func(t *testing.T) {
+		for _, data := range [][]byte{
+			data[:7],
+			data[:len(data)-1],
+			{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+		} {
+			if _, err := tx.ReadBitmapFrom("invalid", bytes.NewReader(data)); !errors.Is(err, rbf.ErrInvalidPortableBitmap) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	rand := rand.New(rand.NewSource(0))
+
+	// Enough array, bitmap & run containers to span several leaf pages.
+	bm := roaring.NewBitmap()
+	for key := uint64(0); key < 2000; key++ {
+		switch key % 3 {
+		case 0:
+			for i := 0; i < 20; i++ {
+				bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+			}
+		case 1:
+			if key%30 == 1 {
+				for i := 0; i < 5000; i++ {
+					bm.DirectAdd(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			}
+		case 2:
+			for v := uint64(1000); v < 2000; v++ {
+				bm.DirectAdd(key<<16 | v)
+			}
+		}
+	}
+
+	// diff collects the bits added & removed for each bitmap.
+	type change struct{ added, removed *roaring.Bitmap }
+	diff := func(t *testing.T, oldTx, newTx *rbf.Tx) map[string]change {
+		t.Helper()
+		m := make(map[string]change)
+		prev := make(map[string]uint64)
+		if err := rbf.DiffAll(oldTx, newTx, func(name string, diff rbf.ContainerDiff) error {
+			ch, ok := m[name]
+			if !ok {
+				ch = change{roaring.NewBitmap(), roaring.NewBitmap()}
+				m[name] = ch
+			} else if diff.Key <= prev[name] {
+				t.Fatalf("%s: key %d after %d", name, diff.Key, prev[name])
+			}
+			prev[name] = diff.Key
+			if diff.Added == nil && diff.Removed == nil {
+				t.Fatalf("%s: empty diff for key %d", name, diff.Key)
+			}
+			if diff.Added != nil {
+				ch.added.Containers.Put(diff.Key, diff.Added.Clone())
+			}
+			if diff.Removed != nil {
+				ch.removed.Containers.Put(diff.Key, diff.Removed.Clone())
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// update changes a few containers & returns the expected changes.
+	update := func(t *testing.T, db *rbf.DB) map[string]change {
+		t.Helper()
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+
+		x := change{roaring.NewBitmap(), roaring.NewBitmap()}
+		add := []uint64{5<<16 | 7, 31<<16 | 1, 1500<<16 | 3, 5000 << 16}
+		for _, v := range add {
+			if ok, err := tx.Contains("x", v); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				x.added.DirectAdd(v)
+			}
+		}
+		if _, err := tx.Add("x", add...); err != nil {
+			t.Fatal(err)
+		}
+
+		// Swap a bit of a bitmap container so its count is unchanged.
+		ct, err := tx.Container("x", 61)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := uint64(61<<16) | uint64(ct.Slice()[0])
+		if _, err := tx.Remove("x", v); err != nil {
+			t.Fatal(err)
+		}
+		x.removed.DirectAdd(v)
+		for v := uint64(61 << 16); ; v++ {
+			if ok, err := tx.Contains("x", v); err != nil {
+				t.Fatal(err)
+			} else if !ok && !x.removed.Contains(v) {
+				if _, err := tx.Add("x", v); err != nil {
+					t.Fatal(err)
+				}
+				x.added.DirectAdd(v)
+				break
+			}
+		}
+
+		// Remove whole containers.
+		if _, err := tx.RemoveRange("x", 700<<16, 703<<16); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range bm.Slice() {
+			if v >= 700<<16 && v < 703<<16 {
+				x.removed.DirectAdd(v)
+			}
+		}
+
+		if _, err := tx.Add("y", 1, 2, 3); err != nil {
+			t.Fatal(err)
+		} else if err := tx.DeleteBitmap("z"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return map[string]change{
+			"x": x,
+			"y": {roaring.NewBitmap(1, 2, 3), roaring.NewBitmap()},
+			"z": {roaring.NewBitmap(), roaring.NewBitmap(10, 20)},
+		}
+	}
+
+	check := func(t *testing.T, got, want map[string]change) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("changed bitmaps: %d, want %d", len(got), len(want))
+		}
+		for name, ch := range want {
+			if !reflect.DeepEqual(got[name].added.Slice(), ch.added.Slice()) {
+				t.Fatalf("%s: added %v, want %v", name, got[name].added.Slice(), ch.added.Slice())
+			} else if !reflect.DeepEqual(got[name].removed.Slice(), ch.removed.Slice()) {
+				t.Fatalf("%s: removed %d bits, want %d", name, got[name].removed.Count(), ch.removed.Count())
+			}
+		}
+	}
+
+	// Unchanged pages are only skipped with page versions & checksums.
+	config := rbfcfg.NewDefaultConfig()
+	config.PageVersions = true
+	config.PageChecksums = true
+
+	load := func(t *testing.T, db *rbf.DB) {
+		t.Helper()
+		tx := MustBegin(t, db, true)
+		defer tx.Rollback()
+		if _, err := tx.AddRoaring("x", bm); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Add("z", 10, 20); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Snapshot", func(t *testing.T) {
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+		load(t, db)
+
+		oldTx := MustBegin(t, db, false)
+		defer oldTx.Rollback()
+		want := update(t, db)
+		newTx := MustBegin(t, db, false)
+		defer newTx.Rollback()
+
+		check(t, diff(t, oldTx, newTx), want)
+		if m := diff(t, newTx, newTx); len(m) != 0 {
+			t.Fatalf("unexpected changes: %d", len(m))
+		}
+
+		var n int
+		if err := rbf.Diff(oldTx, newTx, "y", func(diff rbf.ContainerDiff) error {
+			if n++; diff.Key != 0 || diff.Removed != nil || diff.Added.N() != 3 {
+				t.Fatalf("unexpected diff: %#v", diff)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("diffs=%d, want 1", n)
+		}
+	})
+
+	t.Run("RestoredBackup", func(t *testing.T) {
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+		load(t, db)
+
+		var buf bytes.Buffer
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := t.TempDir()
+		if err := rbf.Restore(&buf, path); err != nil {
+			t.Fatal(err)
+		}
+		other := MustOpenDBAt(t, path, config)
+		defer MustCloseDB(t, other)
+
+		want := update(t, db)
+		oldTx, newTx := MustBegin(t, other, false), MustBegin(t, db, false)
+		defer oldTx.Rollback()
+		defer newTx.Rollback()
+		check(t, diff(t, oldTx, newTx), want)
+	})
+
+	t.Run("WithoutChecksums", func(t *testing.T) {
+		// Both databases write the same leaf page at the same WAL ID after
+		// the restore so only the page contents tell them apart.
+		config := rbfcfg.NewDefaultConfig()
+		config.PageVersions = true
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+		load(t, db)
+
+		var buf bytes.Buffer
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := t.TempDir()
+		if err := rbf.Restore(&buf, path); err != nil {
+			t.Fatal(err)
+		}
+		other := MustOpenDBAt(t, path, config)
+		defer MustCloseDB(t, other)
+
+		tx := MustBegin(t, other, true)
+		if _, err := tx.Add("x", 5<<16|9); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := update(t, db)
+		if !bm.Contains(5<<16 | 9) {
+			want["x"].removed.DirectAdd(5<<16 | 9)
+		}
+		oldTx, newTx := MustBegin(t, other, false), MustBegin(t, db, false)
+		defer oldTx.Rollback()
+		defer newTx.Rollback()
+		check(t, diff(t, oldTx, newTx), want)
+	})
+
+	t.Run("UnchangedBranches", func(t *testing.T) {
+		db := MustOpenDB(t, config)
+		defer MustCloseDB(t, db)
+
+		// Enough containers for several branch pages below the root.
+		bm := roaring.NewBitmap()
+		for key := uint64(0); key < 200000; key++ {
+			bm.DirectAdd(key << 16)
+		}
+		tx := MustBegin(t, db, true)
+		if _, err := tx.AddRoaring("x", bm); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// readN returns the pages read to diff the bitmap before & after
+		// adding values.
+		readN := func(t *testing.T, values ...uint64) int64 {
+			t.Helper()
+			oldTx := MustBegin(t, db, false)
+			defer oldTx.Rollback()
+			tx := MustBegin(t, db, true)
+			if _, err := tx.Add("x", values...); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			newTx := MustBegin(t, db, false)
+			defer newTx.Rollback()
+
+			st, err := db.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := diff(t, oldTx, newTx); !reflect.DeepEqual(got["x"].added.Slice(), values) {
+				t.Fatalf("added %v, want %v", got["x"].added.Slice(), values)
+			}
+			oldTx.Rollback()
+			newTx.Rollback()
+
+			other, err := db.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return other.WALPageReadN + other.DataPageReadN - st.WALPageReadN - st.DataPageReadN
+		}
+
+		// A change below one branch page reads less than changes below
+		// every branch page.
+		if n, all := readN(t, 100000<<16|1), readN(t, 1, 50000<<16|1, 100000<<16|2, 150000<<16|1, 199999<<16|1); n*2 >= all {
+			t.Fatalf("pages read=%d, want less than half of %d", n, all)
+		}
+
+		// Branch pages above uncommitted changes are not skipped.
+		oldTx := MustBegin(t, db, false)
+		defer oldTx.Rollback()
+		tx = MustBegin(t, db, true)
+		defer tx.Rollback()
+		if _, err := tx.Add("x", 100000<<16|3); err != nil {
+			t.Fatal(err)
+		} else if got := diff(t, oldTx, tx); !reflect.DeepEqual(got["x"].added.Slice(), []uint64{100000<<16 | 3}) {
+			t.Fatalf("added %v", got["x"].added.Slice())
+		}
+	})
+}
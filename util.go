@@ -40,13 +40,13 @@ func (tx *Tx) dumpAllPages(showLeaves bool) error {
 			fmt.Printf("Pgno:%-8d ", pgno)
 			fmt.Printf("%-10s ", "meta")
 			fmt.Printf("%-54s ", "")
-			fmt.Printf("pageN=%d,walid=%d,rootrec=%d,freelist=%d\n", info.PageN, info.WALID, info.RootRecordPageNo, info.FreelistPageNo)
+			fmt.Printf("pageN=%d,walid=%d,rootrec=%d,freelist=%d,features=%d\n", info.PageN, info.WALID, info.RootRecordPageNo, info.FreelistPageNo, info.Features)
 
 		case *RootRecordPageInfo:
 			fmt.Printf("Pgno:%-8d ", pgno)
 			fmt.Printf("%-10s ", "rootrec")
 			fmt.Printf("%-54s ", "")
-			fmt.Printf("next=%d\n", info.Next)
+			fmt.Printf("flags=%d,next=%d\n", info.Flags, info.Next)
 
 			page, _, err := tx.readPage(uint32(pgno))
 			vprint.PanicOn(err)
@@ -100,6 +100,52 @@ func (tx *Tx) dumpAllPages(showLeaves bool) error {
 			fmt.Printf("%-54s ", "")
 			fmt.Printf("-\n")
 
+		case *ChecksumPageInfo:
+			typ := "checksum"
+			if info.Flags == PageTypeChecksumDir {
+				typ = "checksumdir"
+			}
+			fmt.Printf("Pgno:%-8d ", pgno)
+			fmt.Printf("%-10s ", typ)
+			fmt.Printf("%-54s ", "")
+			fmt.Printf("-\n")
+
+		case *VersionPageInfo:
+			typ := "version"
+			if info.Flags == PageTypeVersionDir {
+				typ = "versiondir"
+			}
+			fmt.Printf("Pgno:%-8d ", pgno)
+			fmt.Printf("%-10s ", typ)
+			fmt.Printf("%-54s ", "")
+			fmt.Printf("-\n")
+
+		case *CompressionPageInfo:
+			typ := "compression"
+			if info.Flags == PageTypeCompressionDir {
+				typ = "compressiondir"
+			}
+			fmt.Printf("Pgno:%-8d ", pgno)
+			fmt.Printf("%-10s ", typ)
+			fmt.Printf("%-54s ", "")
+			fmt.Printf("-\n")
+
+		case *CountPageInfo:
+			typ := "count"
+			if info.Flags == PageTypeCountDir {
+				typ = "countdir"
+			}
+			fmt.Printf("Pgno:%-8d ", pgno)
+			fmt.Printf("%-10s ", typ)
+			fmt.Printf("%-54s ", "")
+			fmt.Printf("-\n")
+
+		case *FramePageInfo:
+			fmt.Printf("Pgno:%-8d ", pgno)
+			fmt.Printf("%-10s ", "frame")
+			fmt.Printf("%-54s ", fmt.Sprintf("slots=%d used=%d", info.SlotN, info.UsedN))
+			fmt.Printf("-\n")
+
 		case nil:
 			fmt.Printf("Pgno:%-8d ", pgno)
 			fmt.Printf("%-10s ", "<nil> problem, corrupt page set")
@@ -134,6 +180,16 @@ func (tx *Tx) dumpPages(pgnos []uint32) error {
 			printBitmapPage(page)
 		case *FreePage:
 			printFreePage(page)
+		case *ChecksumPage:
+			printChecksumPage(page)
+		case *VersionPage:
+			printVersionPage(page)
+		case *CompressionPage:
+			printCompressionPage(page)
+		case *CountPage:
+			printCountPage(page)
+		case *FramePage:
+			printFramePage(page)
 		default:
 			return fmt.Errorf("unexpected page type %T", page)
 		}
@@ -151,11 +207,13 @@ func printMetaPage(page *MetaPage) {
 	fmt.Printf("WALID: %d\n", page.WALID)
 	fmt.Printf("Root Record Pgno: %d\n", page.RootRecordPageNo)
 	fmt.Printf("Freelist Pgno: %d\n", page.FreelistPageNo)
+	fmt.Printf("Features: %d\n", page.Features)
 }
 
 func printRootRecordPage(page *RootRecordPage) {
 	fmt.Printf("Pgno: %d\n", page.Pgno)
 	fmt.Printf("Type: root record\n")
+	fmt.Printf("Flags: %d\n", page.Flags)
 	fmt.Printf("Next: %d\n", page.Next)
 	fmt.Printf("Records: n=%d\n", len(page.Records))
 	for i, rec := range page.Records {
@@ -196,6 +254,83 @@ func printFreePage(page *FreePage) {
 	fmt.Printf("Type: free\n")
 }
 
+func printChecksumPage(page *ChecksumPage) {
+	fmt.Printf("Pgno: %d\n", page.Pgno)
+	if page.Flags == PageTypeChecksumDir {
+		fmt.Printf("Type: checksumdir\n")
+	} else {
+		fmt.Printf("Type: checksum\n")
+	}
+	for i, v := range page.Entries {
+		if v != 0 {
+			fmt.Printf("[%d]: %08x\n", i, v)
+		}
+	}
+}
+
+func printVersionPage(page *VersionPage) {
+	fmt.Printf("Pgno: %d\n", page.Pgno)
+	if page.Flags == PageTypeVersionDir {
+		fmt.Printf("Type: versiondir\n")
+	} else {
+		fmt.Printf("Type: version\n")
+	}
+	for i, v := range page.Entries {
+		if v != 0 {
+			fmt.Printf("[%d]: %d\n", i, v)
+		}
+	}
+}
+
+func printCompressionPage(page *CompressionPage) {
+	fmt.Printf("Pgno: %d\n", page.Pgno)
+	if page.Flags == PageTypeCompressionDir {
+		fmt.Printf("Type: compressiondir\n")
+		for i, v := range page.Entries {
+			if v != 0 {
+				fmt.Printf("[%d]: pgno=%d\n", i, v)
+			}
+		}
+		return
+	}
+	fmt.Printf("Type: compression\n")
+	for i, v := range page.Entries {
+		if v != 0 {
+			fmt.Printf("[%d]: frame=%d slot=%d len=%d\n", i, v>>32, uint16(v>>16), uint16(v))
+		}
+	}
+}
+
+func printCountPage(page *CountPage) {
+	fmt.Printf("Pgno: %d\n", page.Pgno)
+	if page.Flags == PageTypeCountDir {
+		fmt.Printf("Type: countdir\n")
+		for i, v := range page.Entries {
+			if v != 0 {
+				fmt.Printf("[%d]: pgno=%d\n", i, v)
+			}
+		}
+		return
+	}
+	fmt.Printf("Type: count\n")
+	for i, v := range page.Entries {
+		if v != 0 {
+			fmt.Printf("[%d]: count=%d\n", i, v-1)
+		}
+	}
+}
+
+func printFramePage(page *FramePage) {
+	fmt.Printf("Pgno: %d\n", page.Pgno)
+	fmt.Printf("Type: frame\n")
+	fmt.Printf("Slots: n=%d used=%d\n", page.SlotN, page.UsedN)
+	for i, pgno := range page.Owners {
+		if pgno != 0 {
+			fmt.Printf("[%d]: pgno=%d\n", i, pgno)
+		}
+	}
+}
+
 func prefixToString(s string) (ret string) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -213,4 +348,9 @@ var _ = printLeafPage
 var _ = printBranchPage
 var _ = printBitmapPage
 var _ = printFreePage
+var _ = printChecksumPage
+var _ = printVersionPage
+var _ = printCompressionPage
+var _ = printCountPage
+var _ = printFramePage
 var _ = prefixToString
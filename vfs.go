@@ -0,0 +1,519 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gernest/rbf/syswrap"
+)
+
+// VFS is the storage backend used by a DB for its data & WAL files.
+type VFS interface {
+	// OpenFile opens the named file. The file is created if it does not
+	// exist unless readOnly is set, in which case an error satisfying
+	// os.IsNotExist is returned. If maxSize is greater than zero then the
+	// file never grows larger than maxSize bytes.
+	OpenFile(name string, readOnly bool, maxSize int64) (File, error)
+
+	// Lock obtains an advisory lock on the named lock file, creating it if
+	// it does not exist. Any number of shared locks may be held at once but
+	// an exclusive lock excludes every other lock. If wait is false then
+	// ErrDatabaseLocked is returned rather than waiting for a conflicting
+	// lock to be released. The returned function releases the lock.
+	Lock(name string, exclusive, wait bool) (unlock func() error, err error)
+
+	// MkdirAll creates a directory and any missing parents.
+	MkdirAll(path string) error
+
+	// Remove removes the named file. It returns an error satisfying
+	// os.IsNotExist if the file does not exist.
+	Remove(name string) error
+
+	// RemoveAll removes a path and any children it contains.
+	RemoveAll(path string) error
+
+	// ReadDir returns the names of the files in a directory, sorted by name.
+	ReadDir(path string) ([]string, error)
+
+	// Rename moves a file, replacing any existing file at newpath.
+	Rename(oldpath, newpath string) error
+}
+
+// File is a page-oriented file opened from a VFS.
+type File interface {
+	// ReadPage returns the contents of the page at pgno. The returned slice
+	// is only valid until the file is closed and must not be modified. It
+	// reflects later writes to the same page.
+	ReadPage(pgno uint32) ([]byte, error)
+
+	// WriteAt writes p at offset off, growing the file if necessary.
+	WriteAt(p []byte, off int64) (int, error)
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+
+	// Size returns the size of the file, in bytes.
+	Size() (int64, error)
+
+	// Sync flushes writes to stable storage.
+	Sync() error
+
+	// Close closes the file and releases its lock.
+	Close() error
+}
+
+// fileWriter appends sequential writes to a File starting at an offset.
+type fileWriter struct {
+	f   File
+	off int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// mappedFile is implemented by files which serve pages from a memory map.
+type mappedFile interface {
+	// grow ensures the first size bytes of the file can be read. If the file
+	// is remapped then the previous mapping stays valid until release is
+	// called. Release is nil if the mapping did not change.
+	grow(size int64) (release func() error, err error)
+}
+
+const (
+	minMmapSize  = 1 << 20 // initial mapping size
+	maxMmapGrowN = 1 << 30 // largest single increase in mapping size
+)
+
+// mmapSize returns the mapping size needed to read the first size bytes. The
+// mapping doubles in size until it grows in steps of maxMmapGrowN.
+func mmapSize(size, current, maxSize int64) int64 {
+	n := current
+	if n < minMmapSize {
+		n = minMmapSize
+	}
+	for n < size {
+		if n < maxMmapGrowN {
+			n *= 2
+		} else {
+			n += maxMmapGrowN
+		}
+	}
+	if maxSize > 0 && n > maxSize {
+		n = maxSize
+	}
+	return n
+}
+
+// OSVFS is the default VFS. It stores files on the local file system and
+// serves page reads from a read-only memory map. The mapping grows with the
+// file so address space is only reserved for data which exists.
+type OSVFS struct{}
+
+func (OSVFS) OpenFile(name string, readOnly bool, maxSize int64) (_ File, err error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(name, flag, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &osFile{File: f, maxSize: maxSize}
+	if err := file.mmap(mmapSize(fi.Size(), 0, maxSize)); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSVFS) MkdirAll(path string) error           { return os.MkdirAll(path, 0o755) }
+func (OSVFS) Remove(name string) error             { return os.Remove(name) }
+func (OSVFS) RemoveAll(path string) error          { return os.RemoveAll(path) }
+func (OSVFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (OSVFS) ReadDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Lock locks a file with flock(2). The lock belongs to the open file so
+// handles within the same process conflict as they would across processes.
+// The lock file is opened read-only if it cannot be created.
+func (OSVFS) Lock(name string, exclusive, wait bool) (unlock func() error, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	return f.Close, nil
+}
+
+// osFile is a File backed by an os.File & a memory map.
+type osFile struct {
+	*os.File
+	data    atomic.Pointer[[]byte] // read-only mmap
+	maxSize int64
+
+	mu      sync.Mutex
+	retired map[*[]byte]struct{} // previous mappings not yet released
+}
+
+func (f *osFile) ReadPage(pgno uint32) ([]byte, error) {
+	offset := int64(pgno) * PageSize
+	p := f.data.Load()
+	if p == nil {
+		return nil, os.ErrClosed
+	}
+	data := *p
+
+	// FB-1381
+	// Verify page number requested is within the current size of database.
+	bound := offset + PageSize
+	if sz := int64(len(data)); bound > sz {
+		return nil, fmt.Errorf("rbf: page read out of bounds, pgno=%d upper-bound=%d file-size=%d", pgno, bound, sz)
+	}
+	return data[offset:bound], nil
+}
+
+func (f *osFile) grow(size int64) (release func() error, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev := f.data.Load()
+	if prev == nil {
+		return nil, os.ErrClosed
+	}
+	current := int64(len(*prev))
+	if size <= current {
+		return nil, nil
+	} else if f.maxSize > 0 && size > f.maxSize {
+		return nil, fmt.Errorf("%w: size=%d max=%d", ErrMaxSize, size, f.maxSize)
+	}
+
+	if err := f.mmap(mmapSize(size, current, f.maxSize)); err != nil {
+		return nil, err
+	}
+	if f.retired == nil {
+		f.retired = make(map[*[]byte]struct{})
+	}
+	f.retired[prev] = struct{}{}
+	return func() error { return f.unmap(prev) }, nil
+}
+
+// mmap replaces the current mapping with one of size bytes.
+func (f *osFile) mmap(size int64) error {
+	data, err := syswrap.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	f.data.Store(&data)
+	return nil
+}
+
+// unmap releases a retired mapping. It is a no-op if the mapping has already
+// been released.
+func (f *osFile) unmap(data *[]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.retired[data]; !ok {
+		return nil
+	}
+	delete(f.retired, data)
+	return syswrap.Munmap(*data)
+}
+
+func (f *osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (f *osFile) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for data := range f.retired {
+		if e := syswrap.Munmap(*data); e != nil && err == nil {
+			err = e
+		}
+	}
+	f.retired = nil
+
+	if data := f.data.Swap(nil); data != nil {
+		if e := syswrap.Munmap(*data); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := f.File.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// MemVFS is a VFS which keeps all files in memory. Files persist across
+// opens for the lifetime of the MemVFS so databases can be closed & reopened.
+type MemVFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	locks map[string]*memLock
+	cond  *sync.Cond // signaled when a lock is released
+}
+
+// memLock is the state of a lock obtained from a MemVFS.
+type memLock struct {
+	exclusive bool
+	sharedN   int
+}
+
+// NewMemVFS returns a new, empty in-memory VFS.
+func NewMemVFS() *MemVFS {
+	vfs := &MemVFS{files: make(map[string]*memFile), locks: make(map[string]*memLock)}
+	vfs.cond = sync.NewCond(&vfs.mu)
+	return vfs
+}
+
+func (vfs *MemVFS) OpenFile(name string, readOnly bool, maxSize int64) (File, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	f := vfs.files[name]
+	if f == nil {
+		if readOnly {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{}
+		vfs.files[name] = f
+	}
+	return &memHandle{f: f, readOnly: readOnly, maxSize: maxSize}, nil
+}
+
+// Lock emulates advisory locking between the handles of the VFS. Lock files
+// are not visible to the other methods.
+func (vfs *MemVFS) Lock(name string, exclusive, wait bool) (unlock func() error, err error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	l := vfs.locks[name]
+	if l == nil {
+		l = &memLock{}
+		vfs.locks[name] = l
+	}
+
+	for l.exclusive || (exclusive && l.sharedN > 0) {
+		if !wait {
+			return nil, ErrDatabaseLocked
+		}
+		vfs.cond.Wait()
+	}
+	if exclusive {
+		l.exclusive = true
+	} else {
+		l.sharedN++
+	}
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			vfs.mu.Lock()
+			defer vfs.mu.Unlock()
+			if exclusive {
+				l.exclusive = false
+			} else {
+				l.sharedN--
+			}
+			vfs.cond.Broadcast()
+		})
+		return nil
+	}, nil
+}
+
+// MkdirAll is a no-op as directories are implicit.
+func (vfs *MemVFS) MkdirAll(path string) error { return nil }
+
+func (vfs *MemVFS) Remove(name string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := vfs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(vfs.files, name)
+	return nil
+}
+
+func (vfs *MemVFS) RemoveAll(path string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	path = filepath.Clean(path)
+	for name := range vfs.files {
+		if name == path || filepath.Dir(name) == path {
+			delete(vfs.files, name)
+		}
+	}
+	return nil
+}
+
+func (vfs *MemVFS) ReadDir(path string) ([]string, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	path = filepath.Clean(path)
+	var names []string
+	for name := range vfs.files {
+		if filepath.Dir(name) == path {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (vfs *MemVFS) Rename(oldpath, newpath string) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f, ok := vfs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(vfs.files, oldpath)
+	vfs.files[newpath] = f
+	return nil
+}
+
+// memFile holds the contents of an in-memory file. Each page is allocated
+// separately so slices returned by ReadPage remain valid as the file grows.
+type memFile struct {
+	mu    sync.RWMutex
+	pages [][]byte
+	size  int64
+}
+
+// memHandle is an open handle to a memFile.
+type memHandle struct {
+	f        *memFile
+	readOnly bool
+	maxSize  int64
+}
+
+func (h *memHandle) ReadPage(pgno uint32) ([]byte, error) {
+	h.f.mu.RLock()
+	defer h.f.mu.RUnlock()
+
+	if int(pgno) >= len(h.f.pages) {
+		return nil, fmt.Errorf("rbf: page read out of bounds, pgno=%d file-size=%d", pgno, h.f.size)
+	}
+	return h.f.pages[pgno], nil
+}
+
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.readOnly {
+		return 0, os.ErrPermission
+	} else if end := off + int64(len(p)); h.maxSize > 0 && end > h.maxSize {
+		return 0, fmt.Errorf("%w: size=%d max=%d", ErrMaxSize, end, h.maxSize)
+	}
+
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	for n := 0; n < len(p); {
+		pgno, i := int((off+int64(n))/PageSize), int((off+int64(n))%PageSize)
+		for len(h.f.pages) <= pgno {
+			h.f.pages = append(h.f.pages, make([]byte, PageSize))
+		}
+		n += copy(h.f.pages[pgno][i:], p[n:])
+	}
+	if end := off + int64(len(p)); end > h.f.size {
+		h.f.size = end
+	}
+	return len(p), nil
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	if h.readOnly {
+		return os.ErrPermission
+	}
+
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	// Drop whole pages past the new size & zero the remainder of the last page.
+	pageN := int((size + PageSize - 1) / PageSize)
+	if pageN < len(h.f.pages) {
+		h.f.pages = h.f.pages[:pageN]
+	}
+	if i := int(size % PageSize); i > 0 && pageN <= len(h.f.pages) {
+		page := h.f.pages[pageN-1]
+		for j := i; j < PageSize; j++ {
+			page[j] = 0
+		}
+	}
+	h.f.size = size
+	return nil
+}
+
+func (h *memHandle) Size() (int64, error) {
+	h.f.mu.RLock()
+	defer h.f.mu.RUnlock()
+	return h.f.size, nil
+}
+
+// Sync is a no-op as there is no stable storage.
+func (h *memHandle) Sync() error { return nil }
+
+// Close is a no-op as the file's contents persist in the VFS.
+func (h *memHandle) Close() error { return nil }
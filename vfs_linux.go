@@ -0,0 +1,17 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+//go:build linux
+
+package rbf
+
+import "syscall"
+
+const (
+	fallocKeepSize  = 0x1 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole deallocates a range of the file without changing its size.
+func (f *osFile) punchHole(off, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, off, size)
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+//go:build !linux
+
+package rbf
+
+import "errors"
+
+// punchHole is not supported so callers leave the range allocated.
+func (f *osFile) punchHole(off, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,454 @@
+// Copyright 2022 Molecula Corp. (DBA FeatureBase).
+// SPDX-License-Identifier: Apache-2.0
+package rbf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// segmentedWAL is the write-ahead log. It is stored as a sequence of segment files
+// which are addressed as a single File by page position, starting from the
+// first page of the first segment.
+//
+// Segments are named by appending the WAL ID before their first page, in hex,
+// to the WAL path. A new segment is only started between commits, once the
+// last segment has reached the segment size, so a commit never spans two
+// segments. A WAL file written before segments were introduced has no suffix
+// and is read as the first segment.
+type segmentedWAL struct {
+	vfs         VFS
+	path        string // path prefix of segment files
+	readOnly    bool
+	segmentSize int64 // rotation threshold, zero disables rotation
+
+	mu       sync.Mutex                    // serializes writers
+	segments atomic.Pointer[[]*walSegment] // copy-on-write for readers
+	sealed   bool                          // start a new segment on the next commit
+}
+
+// walSegment is a single WAL segment file.
+type walSegment struct {
+	file  File
+	name  string
+	base  int64 // WAL ID before the first page, -1 for an unnamed WAL file
+	start int   // position of the first page in the WAL
+	pageN int   // number of whole pages, only updated by the writer
+}
+
+// openSegmentedWAL opens all existing segments with the given path prefix.
+// A read-only WAL only reads the whole pages which existed when it was
+// opened so a writer may continue to append to it.
+func openSegmentedWAL(vfs VFS, path string, readOnly bool, segmentSize int64) (_ *segmentedWAL, err error) {
+	w := &segmentedWAL{vfs: vfs, path: path, readOnly: readOnly, segmentSize: segmentSize}
+	w.setSegments(nil)
+	defer func() {
+		if err != nil {
+			w.Close()
+		}
+	}()
+
+	names, err := walSegmentNames(vfs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*walSegment
+	var start int
+	for _, name := range names {
+		seg, err := w.openSegment(name, start)
+		if err != nil {
+			return nil, err
+		}
+
+		// The segment may have grown since it was mapped.
+		if release, err := seg.grow(readOnly); err != nil {
+			seg.file.Close()
+			return nil, err
+		} else if release != nil {
+			if err := release(); err != nil {
+				seg.file.Close()
+				return nil, fmt.Errorf("wal segment munmap: %w", err)
+			}
+		}
+		segments = append(segments, seg)
+		w.setSegments(segments)
+		start += seg.pageN
+	}
+	return w, nil
+}
+
+// openSegment opens the segment file name which starts at WAL position start.
+func (w *segmentedWAL) openSegment(name string, start int) (*walSegment, error) {
+	base := int64(-1)
+	if name != w.path {
+		var err error
+		if base, err = parseWALSegmentName(w.path, name); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := w.vfs.OpenFile(name, w.readOnly, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open wal segment: %w", err)
+	}
+	sz, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("wal segment stat: %w", err)
+	}
+	return &walSegment{file: f, name: name, base: base, start: start, pageN: int(sz / PageSize)}, nil
+}
+
+// grow maps the whole pages of a read-only segment. Release is nil if the
+// mapping did not change.
+func (seg *walSegment) grow(readOnly bool) (release func() error, err error) {
+	m, ok := seg.file.(mappedFile)
+	if !ok || !readOnly {
+		return nil, nil
+	}
+	if release, err = m.grow(int64(seg.pageN) * PageSize); err != nil {
+		return nil, fmt.Errorf("wal segment mmap: %w", err)
+	}
+	return release, nil
+}
+
+// refresh adds the segments and whole pages written since a read-only WAL was
+// opened or last refreshed. The writer does not remove segments while
+// read-only databases hold the readers lock so the position of every page
+// read so far is unchanged. Returns the functions which release replaced
+// memory mappings once transactions no longer read them, even on error.
+func (w *segmentedWAL) refresh() (releases []func() error, err error) {
+	names, err := walSegmentNames(w.vfs, w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := *w.segments.Load()
+	segments := make([]*walSegment, 0, len(names))
+	defer func() {
+		if err != nil {
+			for _, seg := range segments[min(len(prev), len(segments)):] {
+				seg.file.Close()
+			}
+		}
+	}()
+
+	var start int
+	for i, name := range names {
+		// Existing segments are replaced rather than updated in place as
+		// transactions may be reading them.
+		var seg *walSegment
+		if i < len(prev) {
+			if prev[i].name != name {
+				return releases, fmt.Errorf("rbf: wal segment removed while attached: %s", prev[i].name)
+			}
+			sz, err := prev[i].file.Size()
+			if err != nil {
+				return releases, fmt.Errorf("wal segment stat: %w", err)
+			}
+			seg = &walSegment{file: prev[i].file, name: name, base: prev[i].base, start: start, pageN: int(sz / PageSize)}
+		} else if seg, err = w.openSegment(name, start); err != nil {
+			return releases, err
+		}
+		segments = append(segments, seg)
+
+		if release, err := seg.grow(w.readOnly); err != nil {
+			return releases, err
+		} else if release != nil {
+			releases = append(releases, release)
+		}
+		start += seg.pageN
+	}
+	if len(segments) < len(prev) {
+		return releases, fmt.Errorf("rbf: wal segment removed while attached: %s", prev[len(segments)].name)
+	}
+
+	w.setSegments(segments)
+	return releases, nil
+}
+
+// walSegmentNames returns the paths of the segments with the given prefix in
+// WAL order.
+func walSegmentNames(vfs VFS, path string) ([]string, error) {
+	entries, err := vfs.ReadDir(filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(path)
+	var names []string
+	for _, entry := range entries {
+		if entry == prefix || strings.HasPrefix(entry, prefix+".") {
+			names = append(names, filepath.Join(filepath.Dir(path), entry))
+		}
+	}
+
+	// An unnamed WAL file sorts first as it is a prefix of every segment.
+	sort.Strings(names)
+	return names, nil
+}
+
+// walSegmentName returns the path of the segment which starts after the WAL
+// ID base.
+func walSegmentName(path string, base int64) string {
+	return fmt.Sprintf("%s.%016x", path, uint64(base))
+}
+
+func parseWALSegmentName(path, name string) (int64, error) {
+	base, err := strconv.ParseUint(strings.TrimPrefix(name, path+"."), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("rbf: invalid wal segment name: %s", name)
+	}
+	return int64(base), nil
+}
+
+// removeWALSegments removes every segment with the given path prefix.
+func removeWALSegments(vfs VFS, path string) error {
+	names, err := walSegmentNames(vfs, path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := vfs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// base returns the WAL ID before the first page. Returns false if the WAL is
+// empty or the first segment has no WAL ID in its name.
+func (w *segmentedWAL) base() (int64, bool) {
+	segments := *w.segments.Load()
+	if len(segments) == 0 || segments[0].base < 0 {
+		return 0, false
+	}
+	return segments[0].base, true
+}
+
+// ReadPage returns the page at position i in the WAL.
+func (w *segmentedWAL) ReadPage(i uint32) ([]byte, error) {
+	segments := *w.segments.Load()
+	n := sort.Search(len(segments), func(j int) bool { return segments[j].start > int(i) }) - 1
+	if n < 0 {
+		return nil, fmt.Errorf("rbf: wal page read out of bounds, position=%d", i)
+	}
+	seg := segments[n]
+	return seg.file.ReadPage(i - uint32(seg.start))
+}
+
+// WriteAt writes p at offset off from the start of the WAL. Writes must fall
+// within the last segment.
+func (w *segmentedWAL) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments := *w.segments.Load()
+	if len(segments) == 0 {
+		return 0, fmt.Errorf("rbf: wal segment not started")
+	}
+	seg := segments[len(segments)-1]
+	segOff := off - int64(seg.start)*PageSize
+	if segOff < 0 {
+		return 0, fmt.Errorf("rbf: wal write before last segment: offset=%d", off)
+	}
+
+	n, err := seg.file.WriteAt(p, segOff)
+	if pageN := int((segOff + int64(n)) / PageSize); pageN > seg.pageN {
+		seg.pageN = pageN
+	}
+	return n, err
+}
+
+// rotate starts a new segment at position start, after the WAL ID base, if
+// the WAL is empty or the last segment is full or sealed. It must be called
+// before writing a commit.
+func (w *segmentedWAL) rotate(start int, base int64) error {
+	if w.readOnly {
+		return os.ErrPermission
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments := *w.segments.Load()
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		if end := last.start + last.pageN; end != start {
+			return fmt.Errorf("rbf: wal position mismatch: segment end=%d position=%d", end, start)
+		} else if last.pageN == 0 {
+			return nil // reuse an empty segment
+		} else if !w.sealed && (w.segmentSize <= 0 || int64(last.pageN)*PageSize < w.segmentSize) {
+			return nil
+		}
+	}
+	w.sealed = false
+
+	name := walSegmentName(w.path, base)
+	f, err := w.vfs.OpenFile(name, false, 0)
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	} else if err := f.Truncate(0); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate wal segment: %w", err)
+	}
+
+	w.setSegments(append(append(make([]*walSegment, 0, len(segments)+1), segments...), &walSegment{file: f, name: name, base: base, start: start}))
+	return nil
+}
+
+// seal causes the next commit to start a new segment so that the segments
+// before it can be removed once they have been checkpointed.
+func (w *segmentedWAL) seal() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sealed = true
+}
+
+// removeBefore removes the segments which end at or before position end,
+// oldest first. The positions of later segments are unchanged.
+func (w *segmentedWAL) removeBefore(end int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments := *w.segments.Load()
+	for len(segments) > 0 && segments[0].start+segments[0].pageN <= end {
+		// Keep the last segment if it is still being written.
+		if len(segments) == 1 && !w.sealed {
+			break
+		}
+		if err := w.removeSegment(segments[0]); err != nil {
+			return err
+		}
+		w.setSegments(segments[1:])
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// empty returns true if there are no segments.
+func (w *segmentedWAL) empty() bool {
+	return len(*w.segments.Load()) == 0
+}
+
+// Truncate changes the size of the WAL. Segments past the new size are
+// removed. Truncating to zero removes every segment, oldest first, so a
+// partially removed WAL still ends with its most recent commit.
+func (w *segmentedWAL) Truncate(size int64) error {
+	if w.readOnly {
+		return os.ErrPermission
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments := *w.segments.Load()
+	if size == 0 {
+		for len(segments) > 0 {
+			if err := w.removeSegment(segments[0]); err != nil {
+				return err
+			}
+			w.setSegments(segments[1:])
+			segments = segments[1:]
+		}
+		return nil
+	}
+
+	for len(segments) > 0 {
+		seg := segments[len(segments)-1]
+		if segStart := int64(seg.start) * PageSize; segStart < size {
+			if err := seg.file.Truncate(size - segStart); err != nil {
+				return err
+			}
+			seg.pageN = int((size - segStart) / PageSize)
+			return nil
+		}
+
+		if err := w.removeSegment(seg); err != nil {
+			return err
+		}
+		segments = segments[:len(segments)-1]
+		w.setSegments(segments)
+	}
+	return nil
+}
+
+// setSegments publishes a new segment list. Must be called while holding w.mu.
+func (w *segmentedWAL) setSegments(segments []*walSegment) {
+	w.segments.Store(&segments)
+}
+
+func (w *segmentedWAL) removeSegment(seg *walSegment) error {
+	if err := seg.file.Close(); err != nil {
+		return fmt.Errorf("close wal segment: %w", err)
+	} else if err := w.vfs.Remove(seg.name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove wal segment: %w", err)
+	}
+	return nil
+}
+
+// Size returns the size of the WAL, in bytes, including any partial page at
+// the end of the last segment. The size of a read-only WAL is the size of its
+// whole pages when it was opened.
+func (w *segmentedWAL) Size() (int64, error) {
+	segments := *w.segments.Load()
+	if len(segments) == 0 {
+		return 0, nil
+	}
+	seg := segments[len(segments)-1]
+	if w.readOnly {
+		return int64(seg.start+seg.pageN) * PageSize, nil
+	}
+	sz, err := seg.file.Size()
+	if err != nil {
+		return 0, err
+	}
+	return int64(seg.start)*PageSize + sz, nil
+}
+
+// Sync syncs the last segment. Earlier segments were synced by the commits
+// which filled them.
+func (w *segmentedWAL) Sync() error {
+	segments := *w.segments.Load()
+	if len(segments) == 0 {
+		return nil
+	}
+	return segments[len(segments)-1].file.Sync()
+}
+
+// Close closes all segment files.
+func (w *segmentedWAL) Close() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, seg := range *w.segments.Load() {
+		if e := seg.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	w.setSegments(nil)
+	return err
+}
+
+// grow ensures the first size bytes of the WAL can be read. Only the last
+// segment grows.
+func (w *segmentedWAL) grow(size int64) (release func() error, err error) {
+	segments := *w.segments.Load()
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	seg := segments[len(segments)-1]
+	if m, ok := seg.file.(mappedFile); ok {
+		return m.grow(size - int64(seg.start)*PageSize)
+	}
+	return nil, nil
+}